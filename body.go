@@ -0,0 +1,314 @@
+package spdy
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// BufferedBodyWriter accumulates small writes and sends them on a stream
+// as fewer, larger DATA frames. It mirrors the semantics of bufio.Writer at
+// the frame level: a frame is sent when the buffer is full, or when Flush or
+// Close is called.
+//
+// The stream must already have sent its SYN_STREAM or SYN_REPLY frame.
+type BufferedBodyWriter struct {
+	stream	*Stream
+	buf	[]byte
+	err	error
+}
+
+// BufferedBodyWriter returns a new BufferedBodyWriter which sends DATA frames
+// of up to `size` bytes on the stream.
+func (s *Stream) BufferedBodyWriter(size int) *BufferedBodyWriter {
+	if size <= 0 {
+		size = 4096
+	}
+	return &BufferedBodyWriter{stream: s, buf: make([]byte, 0, size)}
+}
+
+// Write copies data into the buffer, flushing it as many times as needed.
+// It returns the number of bytes accepted, and the error which caused
+// a flush to fail, if any.
+func (w *BufferedBodyWriter) Write(data []byte) (int, error) {
+	n := 0
+	for len(data) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		if w.Available() == 0 {
+			w.Flush()
+			continue
+		}
+		copied := copy(w.buf[len(w.buf):cap(w.buf)], data)
+		w.buf = w.buf[:len(w.buf)+copied]
+		data = data[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+// Flush sends any buffered data as a single DATA frame.
+func (w *BufferedBodyWriter) Flush() error {
+	return w.flush(false)
+}
+
+// Close flushes the buffer and half-closes the stream: the last DATA frame
+// (empty if there was nothing left to flush) carries FLAG_FIN.
+// Writing after Close returns an error.
+func (w *BufferedBodyWriter) Close() error {
+	if err := w.flush(true); err != nil {
+		return err
+	}
+	w.err = &Error{Err: StreamClosed, StreamId: w.stream.Id}
+	return nil
+}
+
+// Buffered returns the number of bytes waiting to be sent.
+func (w *BufferedBodyWriter) Buffered() int {
+	return len(w.buf)
+}
+
+// Available returns how many bytes can be written before the next flush.
+func (w *BufferedBodyWriter) Available() int {
+	return cap(w.buf) - len(w.buf)
+}
+
+func (w *BufferedBodyWriter) flush(fin bool) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) == 0 && !fin {
+		return nil
+	}
+	// The frame is handed over to another goroutine, so it can't share
+	// its payload with our buffer.
+	data := make([]byte, len(w.buf))
+	copy(data, w.buf)
+	if err := w.stream.WriteDataFrame(data, fin); err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// The largest DATA payload sent by a BodyWriter, unless set.
+const DefaultMaxPayload = 16384
+
+// BodyWriter sends the data of each Write on a stream right away, as DATA
+// frames of at most MaxPayload bytes. See BufferedBodyWriter to coalesce
+// small writes instead.
+//
+// The stream must already have sent its SYN_STREAM or SYN_REPLY frame.
+type BodyWriter struct {
+	// The largest payload of a DATA frame. If 0, DefaultMaxPayload is used.
+	MaxPayload	int
+	stream		*Stream
+	err		error
+}
+
+// BodyWriter returns a new BodyWriter on the stream.
+func (s *Stream) BodyWriter() *BodyWriter {
+	return &BodyWriter{stream: s}
+}
+
+// Write sends `data` as one or more DATA frames. It returns the number of
+// bytes sent, and an error once the stream can't be written to (eg. after
+// Close, or once the stream was reset).
+func (w *BodyWriter) Write(data []byte) (int, error) {
+	max := w.MaxPayload
+	if max <= 0 {
+		max = DefaultMaxPayload
+	}
+	n := 0
+	for len(data) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		size := len(data)
+		if size > max {
+			size = max
+		}
+		// The frame is handed over to another goroutine, so it can't
+		// share its payload with the caller's buffer.
+		chunk := make([]byte, size)
+		copy(chunk, data)
+		if err := w.stream.WriteDataFrame(chunk, false); err != nil {
+			w.err = err
+			return n, err
+		}
+		data = data[size:]
+		n += size
+	}
+	return n, w.err
+}
+
+// Close half-closes the stream with an empty DATA frame carrying FLAG_FIN.
+// Writing after Close returns an error.
+func (w *BodyWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.stream.WriteDataFrame(nil, true); err != nil {
+		w.err = err
+		return err
+	}
+	w.err = &Error{Err: StreamClosed, StreamId: w.stream.Id}
+	return nil
+}
+
+// bodyReader reads the data of the DATA frames of a stream. Frames are only
+// pulled from the stream as the data is read, so a slow reader doesn't cause
+// frames to pile up anywhere but in the stream itself, which the peer can
+// only fill up to the receive window.
+type bodyReader struct {
+	stream	*Stream
+	data	[]byte	// Data of the current frame, not read yet
+	err	error	// Returned once the data is exhausted
+	unacked	uint32	// Bytes read but not acknowledged with WINDOW_UPDATE yet
+}
+
+func (r *bodyReader) Read(data []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pull()
+	}
+	n := copy(data, r.data)
+	r.data = r.data[n:]
+	r.consumed(n)
+	return n, nil
+}
+
+/*
+** Read frames from the stream until a DATA frame or an error is found.
+*/
+
+func (r *bodyReader) pull() {
+	frame, err := r.stream.ReadFrame()
+	if err != nil {
+		r.err = err
+		return
+	}
+	switch f := frame.(type) {
+		case *DataFrame:	r.data = f.Data
+		case *RstStreamFrame:	r.err = &StreamResetError{StreamId: f.StreamId, Status: f.Status}
+	}
+	// The window is consumed by the DATA on the wire, padding included
+	if padding := r.stream.paddingRead; padding > 0 {
+		r.stream.paddingRead = 0
+		r.consumed(padding)
+	}
+	if r.err == nil && frame.GetFinFlag() {
+		r.err = io.EOF
+	}
+}
+
+/*
+** Acknowledge `n` consumed bytes of DATA on the wire, once they add up to
+** half the window.
+*/
+
+func (r *bodyReader) consumed(n int) {
+	window := r.stream.ReceiveWindow
+	if window == 0 {
+		return
+	}
+	r.unacked += uint32(n)
+	if r.unacked < window/2 {
+		return
+	}
+	if err := r.stream.sendWindowUpdate(r.unacked); err != nil {
+		r.stream.debug("Can't send WINDOW_UPDATE: %s", err)
+	}
+	r.unacked = 0
+}
+
+// The state of DATA padding on a session. See Session.EnableDataPadding.
+type padding struct {
+	lock		sync.Mutex
+	local		int	// Our block size, if we enabled padding
+	peer		bool	// Did the peer enable padding?
+}
+
+func (p *padding) setLocal(blockSize int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.local = blockSize
+}
+
+func (p *padding) setPeerEnabled() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.peer = true
+}
+
+/*
+** Return true if we accept padded frames. A nil padding never does.
+*/
+
+func (p *padding) enabled() bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.local > 0
+}
+
+/*
+** Return the size to pad the frames we send to, or 0 if padding wasn't
+** negotiated.
+*/
+
+func (p *padding) blockSize() int {
+	if p == nil {
+		return 0
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.peer {
+		return 0
+	}
+	return p.local
+}
+
+// Return a copy of `frame` with its data padded to a multiple of `blockSize`.
+// If the padded data wouldn't fit in a frame, `frame` is returned as is.
+func padDataFrame(frame *DataFrame, blockSize int) *DataFrame {
+	size := 4 + len(frame.Data)
+	if size%blockSize != 0 {
+		size += blockSize - size%blockSize
+	}
+	if size > MaxDataLength {
+		return frame
+	}
+	data := make([]byte, size)
+	binary.BigEndian.PutUint32(data, uint32(len(frame.Data)))
+	copy(data[4:], frame.Data)
+	return &DataFrame{StreamId: frame.StreamId, Flags: frame.Flags | DataFlagPadded, Data: data}
+}
+
+// The length of the data carried by a frame, without padding.
+func payloadLength(frame *DataFrame) int {
+	if frame.Flags&DataFlagPadded != 0 {
+		if unpadded, err := unpadDataFrame(frame); err == nil {
+			return len(unpadded.Data)
+		}
+	}
+	return len(frame.Data)
+}
+
+// The reverse of padDataFrame.
+func unpadDataFrame(frame *DataFrame) (*DataFrame, error) {
+	if len(frame.Data) < 4 {
+		return nil, &Error{Err: InvalidDataFrame, StreamId: frame.StreamId}
+	}
+	length := binary.BigEndian.Uint32(frame.Data)
+	if length > uint32(len(frame.Data) - 4) {
+		return nil, &Error{Err: InvalidDataFrame, StreamId: frame.StreamId}
+	}
+	return &DataFrame{StreamId: frame.StreamId, Flags: frame.Flags &^ DataFlagPadded, Data: frame.Data[4:4+length]}, nil
+}
@@ -0,0 +1,162 @@
+package spdy
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ChaosOptions configures the adversity injected by a ChaosFramer.
+type ChaosOptions struct {
+	// The seed of the random number generator: the same seed and the same
+	// input produce the same frames.
+	Seed		int64
+	// The fraction of frames dropped, between 0 and 1.
+	DropRate	float64
+	// The fraction of control frames swapped with the frame following them,
+	// between 0 and 1. Unless AllowIllegal is set, frames are only swapped
+	// when the protocol allows it (see reorderable).
+	ReorderRate	float64
+	// If true, swap frames regardless of the protocol, eg. to check that
+	// a DATA frame before its SYN_STREAM is rejected.
+	AllowIllegal	bool
+	// If non-zero, each frame is delayed by a random duration below
+	// MaxDelay.
+	MaxDelay	time.Duration
+	// The clock used for delays. If nil, RealClock is used.
+	Clock		Clock
+}
+
+// ChaosFramer wraps a ReadWriter and mistreats the frames read from it, as
+// configured by its ChaosOptions: frames are dropped, delayed or reordered
+// before the reader gets them. Frames written are passed through untouched.
+//
+// It is a testing tool: serving a session over a ChaosFramer shows how its
+// state machine and flow control cope with a misbehaving peer.
+type ChaosFramer struct {
+	ReadWriter
+	options		ChaosOptions
+	rand		*rand.Rand
+	queue		[]Frame	// Frames held back by a reordering
+	err		error	// Returned once the queue is empty
+	lock		sync.Mutex	// Protects the counters
+	dropped		int
+	reordered	int
+}
+
+// NewChaosFramer returns a ChaosFramer reading from `inner`.
+func NewChaosFramer(inner ReadWriter, options ChaosOptions) *ChaosFramer {
+	return &ChaosFramer{
+		ReadWriter:	inner,
+		options:	options,
+		rand:		rand.New(rand.NewSource(options.Seed)),
+	}
+}
+
+func (c *ChaosFramer) ReadFrame() (Frame, error) {
+	frame, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	if c.options.MaxDelay > 0 {
+		delay := time.Duration(c.rand.Int63n(int64(c.options.MaxDelay)))
+		<-clockOrDefault(c.options.Clock).After(delay)
+	}
+	return frame, nil
+}
+
+/*
+** Return the next frame to deliver, after drops and reordering
+*/
+
+func (c *ChaosFramer) next() (Frame, error) {
+	if len(c.queue) > 0 {
+		frame := c.queue[0]
+		c.queue = c.queue[1:]
+		return frame, nil
+	}
+	frame, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if _, isData := frame.(*DataFrame); isData || c.rand.Float64() >= c.options.ReorderRate {
+		return frame, nil
+	}
+	following, err := c.read()
+	if err != nil {
+		// Nothing to swap with: deliver the error after the frame
+		c.err = err
+		return frame, nil
+	}
+	if !c.options.AllowIllegal && !reorderable(frame, following) {
+		c.queue = append(c.queue, following)
+		return frame, nil
+	}
+	debug("ChaosFramer: swapping %v and %v", frame, following)
+	c.lock.Lock()
+	c.reordered++
+	c.lock.Unlock()
+	c.queue = append(c.queue, frame)
+	return following, nil
+}
+
+/*
+** Read a frame from the wrapped ReadWriter, skipping dropped frames
+*/
+
+func (c *ChaosFramer) read() (Frame, error) {
+	for {
+		if c.err != nil {
+			return nil, c.err
+		}
+		frame, err := c.ReadWriter.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if c.rand.Float64() >= c.options.DropRate {
+			return frame, nil
+		}
+		debug("ChaosFramer: dropping %v", frame)
+		c.lock.Lock()
+		c.dropped++
+		c.lock.Unlock()
+	}
+}
+
+// Dropped returns the number of frames dropped so far.
+func (c *ChaosFramer) Dropped() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.dropped
+}
+
+// Reordered returns the number of frames swapped so far.
+func (c *ChaosFramer) Reordered() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.reordered
+}
+
+/*
+** Return true if the protocol allows control frame `a` to arrive after
+** `b`: they must belong to different streams (or to the session), new stream
+** ids must keep increasing, and SETTINGS and GOAWAY change the meaning of
+** the frames around them.
+*/
+
+func reorderable(a, b Frame) bool {
+	for _, frame := range []Frame{a, b} {
+		switch frame.(type) {
+			case *SettingsFrame, *GoAwayFrame, *CredentialFrame:
+				return false
+		}
+	}
+	_, synA := a.(*SynStreamFrame)
+	_, synB := b.(*SynStreamFrame)
+	if synA && synB {
+		return false
+	}
+	idA, streamA := a.GetStreamId()
+	idB, streamB := b.GetStreamId()
+	return !streamA || !streamB || idA != idB
+}
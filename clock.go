@@ -0,0 +1,131 @@
+package spdy
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by sessions and streams for all their
+// timeouts. The default is the real clock; tests can use a MockClock to
+// trigger timeouts deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the Clock equivalent of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// RealClock is a Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time			{ return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time	{ return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer	{ return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// Return `c`, or the real clock if `c` is nil.
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return RealClock
+	}
+	return c
+}
+
+// MockClock is a Clock which only moves forward when Advance is called.
+type MockClock struct {
+	lock	sync.Mutex
+	cond	*sync.Cond
+	now	time.Time
+	timers	[]*mockTimer
+}
+
+type mockTimer struct {
+	clock		*MockClock
+	deadline	time.Time
+	ch		chan time.Time
+}
+
+// NewMockClock returns a MockClock set to `now`.
+func NewMockClock(now time.Time) *MockClock {
+	c := &MockClock{now: now}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *MockClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *MockClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *MockClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &mockTimer{clock: c, deadline: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by `d`, firing all the timers which expire
+// in the meantime.
+func (c *MockClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.ch <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// BlockUntil waits until at least `n` timers are pending. This lets a test
+// make sure the code under test is waiting before it advances the clock.
+func (c *MockClock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (t *mockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *mockTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package spdy
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+)
+
+// The words of the SPDY/3 header dictionary which are prefixed with their
+// length. See headerDictionaryV3.
+var headerDictionaryV3Words = []string{
+	"options", "head", "post", "put", "delete", "trace", "accept",
+	"accept-charset", "accept-encoding", "accept-language", "accept-ranges",
+	"age", "allow", "authorization", "cache-control", "connection",
+	"content-base", "content-encoding", "content-language", "content-length",
+	"content-location", "content-md5", "content-range", "content-type",
+	"date", "etag", "expect", "expires", "from", "host", "if-match",
+	"if-modified-since", "if-none-match", "if-range", "if-unmodified-since",
+	"last-modified", "location", "max-forwards", "pragma",
+	"proxy-authenticate", "proxy-authorization", "range", "referer",
+	"retry-after", "server", "te", "trailer", "transfer-encoding", "upgrade",
+	"user-agent", "vary", "via", "warning", "www-authenticate", "method",
+	"get", "status", "200 OK", "version", "HTTP/1.1", "url", "public",
+	"set-cookie", "keep-alive", "origin",
+}
+
+// The end of the SPDY/3 header dictionary, which is used as is.
+const headerDictionaryV3Tail = "100101201202205206300302303304305306307402405406407408409410411412413414415416417502504505" +
+	"203 Non-Authoritative Information204 No Content301 Moved Permanently400 Bad Request401 Unauthorized" +
+	"403 Forbidden404 Not Found500 Internal Server Error501 Not Implemented503 Service Unavailable" +
+	"Jan Feb Mar Apr May Jun Jul Aug Sept Oct Nov Dec 00:00:00 Mon, Tue, Wed, Thu, Fri, Sat, Sun, GMT" +
+	"chunked,text/html,image/png,image/jpg,image/gif,application/xml,application/xhtml+xml,text/plain," +
+	"text/javascript,publicprivatemax-age=gzip,deflate,sdchcharset=utf-8charset=iso-8859-1,utf-,*,enq=0."
+
+// headerDictionaryV3 is the zlib dictionary of SPDY/3 header blocks: the
+// words of headerDictionaryV3Words, each preceded by its length on 32 bits,
+// followed by headerDictionaryV3Tail.
+var headerDictionaryV3 = buildHeaderDictionaryV3()
+
+func buildHeaderDictionaryV3() []byte {
+	var dictionary []byte
+	for _, word := range headerDictionaryV3Words {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(word)))
+		dictionary = append(dictionary, length[:]...)
+		dictionary = append(dictionary, word...)
+	}
+	return append(dictionary, headerDictionaryV3Tail...)
+}
+
+/*
+** Return the zlib dictionary of the header blocks of `version`
+*/
+
+func headerDictionaryFor(version uint16) []byte {
+	if version >= 3 {
+		return headerDictionaryV3
+	}
+	return headerDictionary
+}
+
+// HeaderCompressor compresses the header blocks of the frames sent on a
+// connection, with the zlib dictionary of their version of SPDY. zlib is
+// streaming: each block is compressed in the context of the blocks before
+// it, so a connection uses a single HeaderCompressor for all the blocks it
+// sends, in order.
+type HeaderCompressor struct {
+	w	*zlib.Writer
+}
+
+// NewHeaderCompressor returns a HeaderCompressor writing the compressed
+// blocks to `w`, for frames of version `version`. The blocks must have the
+// layout of that version: the SPDY/3 dictionary only matches the 32 bit
+// lengths of SPDY/3 blocks.
+func NewHeaderCompressor(w io.Writer, version uint16) (*HeaderCompressor, error) {
+	zw, err := zlib.NewWriterLevelDict(w, zlib.BestCompression, headerDictionaryFor(version))
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderCompressor{zw}, nil
+}
+
+// Write compresses a part of a header block.
+func (c *HeaderCompressor) Write(data []byte) (int, error) {
+	return c.w.Write(data)
+}
+
+// Flush ends a header block: everything written so far is compressed and
+// written, so that the peer can decompress the block without the next ones.
+func (c *HeaderCompressor) Flush() error {
+	return c.w.Flush()
+}
+
+// HeaderDecompressor decompresses the header blocks of the frames received
+// on a connection. Like HeaderCompressor, it keeps the zlib context from one
+// block to the next: a connection uses a single HeaderDecompressor for all
+// the blocks it receives, in order.
+type HeaderDecompressor struct {
+	dictionary	[]byte
+	block		io.LimitedReader	// The compressed block being read
+	r		io.ReadCloser	// Created with the first block
+}
+
+// NewHeaderDecompressor returns a HeaderDecompressor for frames of version
+// `version`.
+func NewHeaderDecompressor(version uint16) *HeaderDecompressor {
+	return &HeaderDecompressor{dictionary: headerDictionaryFor(version)}
+}
+
+// Decompress starts reading a block of `size` compressed bytes from `r`, and
+// returns a reader of the uncompressed block. The reader must not be used
+// after the next call to Decompress.
+func (d *HeaderDecompressor) Decompress(r io.Reader, size int64) (io.Reader, error) {
+	d.block = io.LimitedReader{R: r, N: size}
+	if d.r == nil {
+		zr, err := zlib.NewReaderDict(&d.block, d.dictionary)
+		if err != nil {
+			return nil, err
+		}
+		d.r = zr
+	}
+	return d.r, nil
+}
+
+// Remaining returns how many bytes of the current compressed block haven't
+// been read yet.
+func (d *HeaderDecompressor) Remaining() int64 {
+	return d.block.N
+}
@@ -0,0 +1,118 @@
+package spdy
+
+import (
+	"errors"
+	"sync"
+)
+
+// Demux routes the frames read from a connection to the streams they
+// belong to, by stream id. A frame can arrive for a stream which isn't
+// registered yet (eg. a HEADERS frame racing the registration of the stream
+// its SYN_STREAM opened): such frames are held until the stream registers,
+// and then passed to it in order.
+//
+// At most Limit frames are held, for all streams together, and at most
+// StreamLimit for each stream, if it is non-zero. Past a limit, the held
+// frames of the stream are dropped, and the stream is reset with
+// INVALID_STREAM on the Writer given to NewDemux. A RST_STREAM frame past a
+// limit is dropped without resetting its stream in reply.
+//
+// The ids of each parity are expected to register in increasing order, as
+// the streams are opened: a frame for an unregistered id lower than one
+// already registered belongs to a stream which ended, and is dropped.
+type Demux struct {
+	Limit	int
+	StreamLimit	int
+	reset	Writer
+	lock	sync.Mutex	// Held while frames are passed to a stream, so that they stay in order
+	streams	map[uint32]Writer
+	pending	map[uint32][]Frame	// Frames held for streams which aren't registered
+	held	int	// The number of frames in pending
+	last	[2]uint32	// The highest id registered, for even and odd ids
+}
+
+// NewDemux returns a Demux with no streams, which holds up to `limit`
+// frames for unregistered streams, and sends the RST_STREAM frames resetting
+// them to `reset`.
+func NewDemux(limit int, reset Writer) *Demux {
+	return &Demux{
+		Limit:		limit,
+		reset:		reset,
+		streams:	make(map[uint32]Writer),
+		pending:	make(map[uint32][]Frame),
+	}
+}
+
+// ErrNoStreamId is returned by Demux.WriteFrame for the frames which don't
+// belong to a stream (eg. SETTINGS or PING).
+var ErrNoStreamId = errors.New("Can't route a frame without a stream id")
+
+// Register passes the frames of the stream `id` to `w`, starting with the
+// frames held for it, if any. It returns the error of the first frame which
+// `w` fails to write; the frames after it are dropped.
+func (d *Demux) Register(id uint32, w Writer) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	held := d.pending[id]
+	delete(d.pending, id)
+	d.held -= len(held)
+	d.streams[id] = w
+	if id > d.last[id % 2] {
+		d.last[id % 2] = id
+	}
+	for _, frame := range held {
+		if err := w.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unregister stops passing frames to the stream `id`: the frames received
+// for it afterwards are dropped.
+func (d *Demux) Unregister(id uint32) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.streams, id)
+}
+
+// WriteFrame passes `frame` to its stream, or holds it until the stream
+// registers. It returns the error of the stream's Writer, or of the reset
+// if holding the frame would exceed Limit or StreamLimit.
+func (d *Demux) WriteFrame(frame Frame) error {
+	id, exists := frame.GetStreamId()
+	if !exists {
+		return ErrNoStreamId
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if w, registered := d.streams[id]; registered {
+		return w.WriteFrame(frame)
+	}
+	if id <= d.last[id % 2] {
+		debug("Demux: dropping a frame for ended stream %d", id)
+		return nil
+	}
+	if d.held >= d.Limit || (d.StreamLimit > 0 && len(d.pending[id]) >= d.StreamLimit) {
+		d.held -= len(d.pending[id])
+		delete(d.pending, id)
+		if _, isRst := frame.(*RstStreamFrame); isRst {
+			// Never reset in reply to a reset
+			debug("Demux: too many frames held. Dropping stream %d", id)
+			return nil
+		}
+		debug("Demux: too many frames held. Resetting stream %d", id)
+		return d.reset.WriteFrame(&RstStreamFrame{StreamId: id, Status: InvalidStream})
+	}
+	d.pending[id] = append(d.pending[id], frame)
+	d.held++
+	return nil
+}
+
+// Held returns the number of frames held for streams which aren't
+// registered yet.
+func (d *Demux) Held() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.held
+}
@@ -0,0 +1,221 @@
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const maxStreamId = 1<<31 - 1
+
+// Header blocks at the limits of the SPDY/2 encoding, where every length is
+// 16 bits. SPDY/3 lengths are 32 bits: see TestRoundTripSynReplyHeaders.
+var roundTripHeaders = map[string]http.Header{
+	"no headers":	http.Header{},
+	"multi-valued":	http.Header{"Accept": {"text/html", "text/plain", ""}},
+	"longest value":	http.Header{"X-Long": {strings.Repeat("v", 0xffff)}},
+	"longest name":	http.Header{strings.Repeat("n", 0xffff): {"value"}},
+}
+
+// Serialize `frame`, parse it back, and check that the parsed frame
+// serializes to the same bytes.
+func checkRoundTrip(t *testing.T, name string, frame Frame, version uint16) {
+	data, err := SerializeFrame(frame, version)
+	if err != nil {
+		t.Errorf("%s (v%d): can't serialize: %s", name, version, err)
+		return
+	}
+	parsed, err := ParseFrame(data)
+	if err != nil {
+		t.Errorf("%s (v%d): can't parse: %s", name, version, err)
+		return
+	}
+	if fmt.Sprintf("%T", parsed) != fmt.Sprintf("%T", frame) {
+		t.Errorf("%s (v%d): parsed as %T", name, version, parsed)
+		return
+	}
+	again, err := SerializeFrame(parsed, version)
+	if err != nil {
+		t.Errorf("%s (v%d): can't serialize the parsed frame: %s", name, version, err)
+		return
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("%s (v%d): round trip changed the frame:\n%x\n%x", name, version, data, again)
+	}
+}
+
+func roundTripVersions(t *testing.T, frames map[string]Frame) {
+	for _, version := range []uint16{2, 3} {
+		for name, frame := range frames {
+			checkRoundTrip(t, name, frame, version)
+		}
+	}
+}
+
+func TestRoundTripData(t *testing.T) {
+	frames := map[string]Frame{
+		"empty":	&DataFrame{StreamId: 1},
+		"max stream id":	&DataFrame{StreamId: maxStreamId, Data: []byte("x")},
+		"max length":	&DataFrame{StreamId: 1, Data: make([]byte, MaxDataLength)},
+	}
+	for _, flags := range []DataFlags{DataFlagFin, DataFlagCompressed, DataFlagPadded, knownDataFlags} {
+		frames[fmt.Sprintf("flags %#x", flags)] = &DataFrame{StreamId: 1, Flags: flags, Data: []byte("x")}
+	}
+	roundTripVersions(t, frames)
+	if _, err := SerializeFrame(&DataFrame{StreamId: 1, Data: make([]byte, MaxDataLength + 1)}, 2); err == nil {
+		t.Errorf("DATA longer than MaxDataLength can't be encoded")
+	}
+}
+
+func TestRoundTripSynStream(t *testing.T) {
+	frames := map[string]Frame{
+		"max stream ids":	&SynStreamFrame{StreamId: maxStreamId, AssociatedToStreamId: maxStreamId},
+		"fin":	&SynStreamFrame{StreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+		"unidirectional":	&SynStreamFrame{StreamId: 2, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}},
+		"lowest priority":	&SynStreamFrame{StreamId: 1, Priority: 3},
+	}
+	for name, headers := range roundTripHeaders {
+		frames[name] = &SynStreamFrame{StreamId: 1, Headers: headers}
+	}
+	roundTripVersions(t, frames)
+	checkRoundTrip(t, "v3 priority and slot", &SynStreamFrame{StreamId: 1, Priority: 7, Slot: 255}, 3)
+}
+
+func TestRoundTripSynReplyHeaders(t *testing.T) {
+	frames := map[string]Frame{
+		"reply max stream id":	&SynReplyFrame{StreamId: maxStreamId},
+		"reply fin":	&SynReplyFrame{StreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+		"headers max stream id":	&HeadersFrame{StreamId: maxStreamId},
+		"headers fin":	&HeadersFrame{StreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+	}
+	for name, headers := range roundTripHeaders {
+		frames["reply " + name] = &SynReplyFrame{StreamId: 1, Headers: headers}
+		frames["headers " + name] = &HeadersFrame{StreamId: 1, Headers: headers}
+	}
+	roundTripVersions(t, frames)
+	tooLong := http.Header{"X-Long": {strings.Repeat("v", 0x10000)}}
+	if _, err := SerializeFrame(&SynReplyFrame{StreamId: 1, Headers: tooLong}, 2); err == nil {
+		t.Errorf("A header value longer than 0xffff bytes can't be encoded")
+	}
+	// SPDY/3 lengths are 32 bits
+	checkRoundTrip(t, "reply value longer than 16 bits", &SynReplyFrame{StreamId: 1, Headers: tooLong}, 3)
+	checkRoundTrip(t, "headers name longer than 16 bits", &HeadersFrame{StreamId: 1, Headers: http.Header{strings.Repeat("n", 0x10000): {"value"}}}, 3)
+}
+
+// Serialize `frame` as `version` without header compression, so that the
+// bytes can be compared with the layouts of the spec.
+func serializeUncompressed(t *testing.T, frame Frame, version uint16) []byte {
+	buffer := new(bytes.Buffer)
+	framer := &Framer{headerCompressionDisabled: true, w: buffer, headerBuf: new(bytes.Buffer), version: version}
+	if err := framer.WriteFrame(frame); err != nil {
+		t.Fatalf("Can't serialize %#v: %s", frame, err)
+	}
+	return buffer.Bytes()
+}
+
+// The frames with a header block, byte for byte as the specs lay them out.
+// Written by hand rather than by the encoder under test.
+func TestHeaderFrameLayouts(t *testing.T) {
+	headers := http.Header{":status": {"200"}}
+	v2Block := "\x00\x01" + "\x00\x07:status" + "\x00\x03200"
+	v3Block := "\x00\x00\x00\x01" + "\x00\x00\x00\x07:status" + "\x00\x00\x00\x03200"
+	layouts := []struct {
+		name	string
+		frame	Frame
+		version	uint16
+		bytes	string
+	}{
+		{"v2 syn_stream", &SynStreamFrame{StreamId: 1, Priority: 3, Headers: headers}, 2,
+			"\x80\x02\x00\x01\x00\x00\x00\x1a" + "\x00\x00\x00\x01\x00\x00\x00\x00\xc0\x00" + v2Block},
+		{"v3 syn_stream", &SynStreamFrame{StreamId: 1, Priority: 3, Slot: 2, Headers: headers}, 3,
+			"\x80\x03\x00\x01\x00\x00\x00\x20" + "\x00\x00\x00\x01\x00\x00\x00\x00\x60\x02" + v3Block},
+		// SPDY/2 has an unused 16 bit field after the stream id, SPDY/3 doesn't
+		{"v2 syn_reply", &SynReplyFrame{StreamId: 1, Headers: headers}, 2,
+			"\x80\x02\x00\x02\x00\x00\x00\x16" + "\x00\x00\x00\x01\x00\x00" + v2Block},
+		{"v3 syn_reply", &SynReplyFrame{StreamId: 1, Headers: headers}, 3,
+			"\x80\x03\x00\x02\x00\x00\x00\x1a" + "\x00\x00\x00\x01" + v3Block},
+		{"v2 headers", &HeadersFrame{StreamId: 1, Headers: headers}, 2,
+			"\x80\x02\x00\x08\x00\x00\x00\x16" + "\x00\x00\x00\x01\x00\x00" + v2Block},
+		{"v3 headers", &HeadersFrame{StreamId: 1, Headers: headers, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}}, 3,
+			"\x80\x03\x00\x08\x01\x00\x00\x1a" + "\x00\x00\x00\x01" + v3Block},
+	}
+	for _, layout := range layouts {
+		data := serializeUncompressed(t, layout.frame, layout.version)
+		if string(data) != layout.bytes {
+			t.Errorf("%s: serialized as\n%x\ninstead of\n%x", layout.name, data, layout.bytes)
+			continue
+		}
+		framer := &Framer{headerCompressionDisabled: true, r: bytes.NewReader(data)}
+		parsed, err := framer.ReadFrame()
+		if err != nil {
+			t.Errorf("%s: can't parse: %s", layout.name, err)
+			continue
+		}
+		if parsed.GetHeaders().Get(":status") != "200" {
+			t.Errorf("%s: parsed the headers %v", layout.name, parsed.GetHeaders())
+		}
+	}
+}
+
+func TestRoundTripRstStream(t *testing.T) {
+	frames := map[string]Frame{
+		"max stream id":	&RstStreamFrame{StreamId: maxStreamId, Status: Cancel},
+	}
+	for status := ProtocolError; status <= StreamAlreadyClosed; status++ {
+		frames[fmt.Sprintf("status %d", status)] = &RstStreamFrame{StreamId: 1, Status: status}
+	}
+	roundTripVersions(t, frames)
+}
+
+func TestRoundTripSessionFrames(t *testing.T) {
+	frames := map[string]Frame{
+		"noop":	&NoopFrame{},
+		"ping":	&PingFrame{Id: 1},
+		"ping max id":	&PingFrame{Id: 0xffffffff},
+		"goaway":	&GoAwayFrame{},
+		"goaway max stream id":	&GoAwayFrame{LastGoodStreamId: maxStreamId},
+		"window update":	&WindowUpdateFrame{StreamId: maxStreamId, DeltaWindowSize: 0x7fffffff},
+		"empty settings":	&SettingsFrame{},
+	}
+	for _, flag := range []SettingsFlag{0, FlagSettingsPersistValue, FlagSettingsPersisted} {
+		frames[fmt.Sprintf("settings flag %d", flag)] = &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+			{flag, SettingsMaxConcurrentStreams, 100},
+			{flag, SettingsInitialWindowSize, 0xffffffff},
+			{flag, SettingsDataPadding, 0},
+		}}
+	}
+	roundTripVersions(t, frames)
+	checkRoundTrip(t, "v3 goaway status", &GoAwayFrame{LastGoodStreamId: 1, Status: ProtocolError}, 3)
+}
+
+func TestRoundTripCredential(t *testing.T) {
+	frame := &CredentialFrame{
+		Slot:		1,
+		Proof:		[]byte("proof"),
+		Certificates:	[][]byte{[]byte("leaf certificate"), []byte("issuer certificate")},
+	}
+	checkRoundTrip(t, "credential", frame, 3)
+	checkRoundTrip(t, "credential without proof", &CredentialFrame{Slot: 0xffff, Certificates: [][]byte{{}}}, 3)
+	data, err := SerializeFrame(frame, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseFrame(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := parsed.(*CredentialFrame)
+	if credential.Slot != 1 || string(credential.Proof) != "proof" || len(credential.Certificates) != 2 {
+		t.Fatalf("Parsed %#v", credential)
+	}
+	for i, cert := range frame.Certificates {
+		if !bytes.Equal(credential.Certificates[i], cert) {
+			t.Errorf("Certificate %d: expected %q, not %q", i, cert, credential.Certificates[i])
+		}
+	}
+	if _, err := SerializeFrame(frame, 2); err == nil {
+		t.Errorf("CREDENTIAL doesn't exist in version 2")
+	}
+}
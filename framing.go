@@ -0,0 +1,43 @@
+package spdy
+
+import (
+	"bufio"
+	"io"
+)
+
+// Framing is the wire format of a connection: it turns a byte stream into
+// frames and back. Sessions and streams only deal with frames, so another
+// protocol with the same multiplexing model can reuse them by providing its
+// own Framing to ServeFraming.
+type Framing interface {
+	// NewFramer returns a ReadWriter which writes frames to `w` and reads
+	// frames from `r`, for the lifetime of one connection.
+	NewFramer(w io.Writer, r io.Reader) (ReadWriter, error)
+	// CheckPreface peeks at the first bytes sent by a client, without
+	// consuming them, and returns an error if they don't belong to this
+	// framing.
+	CheckPreface(r *bufio.Reader) error
+}
+
+// SPDYFraming is the Framing of a version of SPDY.
+type SPDYFraming struct {
+	Version	uint16
+}
+
+var (
+	SPDY2	Framing = &SPDYFraming{2}
+	SPDY3	Framing = &SPDYFraming{3}
+)
+
+func (f *SPDYFraming) NewFramer(w io.Writer, r io.Reader) (ReadWriter, error) {
+	framer, err := NewFramer(w, r)
+	if err != nil {
+		return nil, err
+	}
+	framer.version = f.Version
+	return framer, nil
+}
+
+func (f *SPDYFraming) CheckPreface(r *bufio.Reader) error {
+	return checkPreface(r, f.Version)
+}
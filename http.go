@@ -2,8 +2,12 @@ package spdy
 
 import (
 	"net/http"
+	"net/url"
 	"fmt"
+	"io"
 	"log"
+	"strconv"
+	"strings"
 )
 
 type ResponseWriter struct {
@@ -25,7 +29,8 @@ func (w *ResponseWriter) Write(data []byte) (int, error) {
 		w.WriteHeader(http.StatusOK)
 	}
 	debug("Sending %v\n", data)
-	err := w.WriteDataFrame(data, false)
+	// The frame is queued, and io.Writer implementations must not retain data
+	err := w.WriteDataFrame(append([]byte(nil), data...), false)
 	if err != nil {
 		debug("error: %s", err)
 		return 0, err
@@ -37,10 +42,10 @@ func (w *ResponseWriter) Write(data []byte) (int, error) {
 func (w *ResponseWriter) WriteHeader(status int) {
 	fin := status == 0 // Status=0 will half-close the stream 
 	debug("WriteHeader() header = %v\n", w.Header())
-	if w.output.Headers.Get("status") == "" {
+	if w.output.headers().Get("status") == "" {
 		w.Header().Set("status", fmt.Sprintf("%d", status))
 	}
-	if w.output.NFrames == 0 {
+	if w.output.frames() == 0 || w.interimSent {
 		if w.local {
 			w.Syn(w.headers, fin)
 		} else {
@@ -55,3 +60,285 @@ func (w *ResponseWriter) WriteHeader(status int) {
 	}
 	w.sentHeaders = true
 }
+
+// HTTPHandler adapts `h`, a plain net/http handler, to serve SPDY streams.
+// The request is rebuilt from the headers of the SYN_STREAM, with either
+// the SPDY/3 names (:method, :path, :host, :scheme, :version) or the SPDY/2
+// ones (method, url, host, scheme, version), and the DATA of the stream is
+// its body. The response status and headers are sent in the SYN_REPLY,
+// followed by the body in DATA frames: the last frame carries FLAG_FIN.
+// Trailers (see http.ResponseWriter) are sent in a final HEADERS frame with
+// FLAG_FIN.
+func HTTPHandler(h http.Handler) Handler {
+	return &httpHandler{h}
+}
+
+type httpHandler struct {
+	handler	http.Handler
+}
+
+func (a *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stream, isStream := w.(*ResponseWriter)
+	if !isStream {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+	request, err := newHTTPRequest(r.Header, r.Body)
+	if err != nil {
+		stream.debug("Can't rebuild HTTP request: %s", err)
+		stream.Rst(ProtocolError)
+		return
+	}
+	response := &httpResponseWriter{
+		stream:		stream.Stream,
+		header:		make(http.Header),
+		spdy3:		r.Header.Get(":method") != "",
+	}
+	a.handler.ServeHTTP(response, request)
+	if err := response.finish(); err != nil {
+		stream.debug("Can't send response: %s", err)
+	}
+}
+
+/*
+** Return the value of the header `name`, under its SPDY/3 or SPDY/2 name
+*/
+
+func spdyHeader(headers http.Header, name string) string {
+	if value := headers.Get(":" + name); value != "" {
+		return value
+	}
+	return headers.Get(name)
+}
+
+// Headers which describe the request rather than being passed to the handler
+var requestHeaders = []string{"method", "url", "path", "host", "scheme", "version"}
+
+/*
+** Build the request described by the headers of a SYN_STREAM
+*/
+
+func newHTTPRequest(headers http.Header, body io.ReadCloser) (*http.Request, error) {
+	method := spdyHeader(headers, "method")
+	if method == "" {
+		method = "GET"
+	}
+	path := headers.Get(":path")
+	if path == "" {
+		path = headers.Get("url")
+	}
+	if path == "" {
+		path = "/"
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		u.Scheme = spdyHeader(headers, "scheme")
+		if u.Scheme == "" {
+			u.Scheme = "https"
+		}
+	}
+	if u.Host == "" {
+		u.Host = spdyHeader(headers, "host")
+	}
+	proto := spdyHeader(headers, "version")
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, fmt.Errorf("Malformed HTTP version: %q", proto)
+	}
+	r := &http.Request{
+		Method:		method,
+		URL:		u,
+		Proto:		proto,
+		ProtoMajor:	major,
+		ProtoMinor:	minor,
+		Header:		make(http.Header),
+		Body:		body,
+		ContentLength:	-1,
+		Host:		u.Host,
+		RequestURI:	path,
+	}
+	for name, values := range headers {
+		r.Header[name] = append([]string(nil), values...)
+	}
+	for _, name := range requestHeaders {
+		r.Header.Del(name)
+		r.Header.Del(":" + name)
+	}
+	if length := r.Header.Get("Content-Length"); length != "" {
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil && n >= 0 {
+			r.ContentLength = n
+		}
+	}
+	return r, nil
+}
+
+/*
+** The http.ResponseWriter passed to the handlers adapted by HTTPHandler. The
+** last chunk of body written is held back, so that it can carry FLAG_FIN once
+** the handler returns.
+*/
+
+type httpResponseWriter struct {
+	stream	*Stream
+	header	http.Header
+	spdy3	bool	// Did the request use the SPDY/3 header names?
+	status	int	// The status sent, or 0 before the SYN_REPLY
+	trailers	[]string	// Announced in the Trailer header
+	pending	[]byte	// The last chunk of body, not sent yet
+	err	error
+}
+
+func (w *httpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *httpResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.err = w.reply(status, false)
+}
+
+func (w *httpResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	// The frame is queued, and io.Writer implementations must not retain data
+	w.pending = append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// Flush sends the body written so far.
+func (w *httpResponseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err == nil {
+		w.err = w.flush()
+	}
+}
+
+/*
+** Send the pending chunk of body, without FLAG_FIN
+*/
+
+func (w *httpResponseWriter) flush() error {
+	for len(w.pending) > 0 {
+		n := len(w.pending)
+		if n > DefaultMaxPayload {
+			n = DefaultMaxPayload
+		}
+		if err := w.stream.WriteDataFrame(w.pending[:n], false); err != nil {
+			w.pending = nil
+			return err
+		}
+		w.pending = w.pending[n:]
+	}
+	w.pending = nil
+	return nil
+}
+
+/*
+** Send the SYN_REPLY
+*/
+
+func (w *httpResponseWriter) reply(status int, fin bool) error {
+	w.status = status
+	declared := make(map[string]bool)
+	for _, value := range w.header["Trailer"] {
+		for _, trailer := range strings.Split(value, ",") {
+			if trailer = http.CanonicalHeaderKey(strings.TrimSpace(trailer)); trailer != "" {
+				w.trailers = append(w.trailers, trailer)
+				declared[trailer] = true
+			}
+		}
+	}
+	headers := make(http.Header)
+	for name, values := range w.header {
+		// Trailers are sent after the body, even if already set
+		if name == "Trailer" || declared[name] || strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		headers[name] = append([]string(nil), values...)
+	}
+	statusName, versionName := "status", "version"
+	if w.spdy3 {
+		statusName, versionName = ":status", ":version"
+	}
+	headers.Set(statusName, fmt.Sprintf("%d %s", status, http.StatusText(status)))
+	headers.Set(versionName, "HTTP/1.1")
+	return w.stream.Reply(&headers, fin)
+}
+
+/*
+** Collect the trailers set by the handler, if any
+*/
+
+func (w *httpResponseWriter) trailerHeaders() http.Header {
+	trailers := make(http.Header)
+	for _, name := range w.trailers {
+		if values := w.header[name]; len(values) > 0 {
+			trailers[name] = values
+		}
+	}
+	for name, values := range w.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))] = values
+		}
+	}
+	return trailers
+}
+
+/*
+** Send what the handler left, with FLAG_FIN on the last frame
+*/
+
+func (w *httpResponseWriter) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.status == 0 {
+		trailers := w.header.Get("Trailer") != ""
+		for name := range w.header {
+			trailers = trailers || strings.HasPrefix(name, http.TrailerPrefix)
+		}
+		if !trailers {
+			return w.reply(http.StatusOK, true)
+		}
+		if err := w.reply(http.StatusOK, false); err != nil {
+			return err
+		}
+	}
+	trailers := w.trailerHeaders()
+	if len(trailers) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		return w.stream.WriteHeadersFrame(&trailers, true)
+	}
+	// Send all but the last frame, which carries FLAG_FIN
+	for len(w.pending) > DefaultMaxPayload {
+		if err := w.stream.WriteDataFrame(w.pending[:DefaultMaxPayload], false); err != nil {
+			return err
+		}
+		w.pending = w.pending[DefaultMaxPayload:]
+	}
+	last := w.pending
+	w.pending = nil
+	return w.stream.WriteDataFrame(last, true)
+}
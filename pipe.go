@@ -1,18 +1,23 @@
 package spdy
 
 import (
+	"errors"
 	"io"
+	"sync"
+	"time"
 )
 
 func Pipe(buffer int) (*PipeReader, *PipeWriter) {
-	p := &pipe{ch: make(chan Frame, buffer)}
+	p := &pipe{ch: make(chan Frame, buffer), done: make(chan struct{})}
 	return &PipeReader{pipe: p}, &PipeWriter{pipe: p}
 }
 
 
 type pipe struct {
 	ch	chan Frame
+	done	chan struct{} // Closed when the pipe is closed. ch is never closed, so writers can't panic
 	err	error
+	lock	sync.Mutex // Both ends may close the pipe concurrently
 }
 
 type PipeReader struct {
@@ -23,29 +28,64 @@ type PipeReader struct {
 type PipeWriter struct {
 	*pipe
 	NFrames int
+	lock	sync.Mutex // A session's streams all write to the same pipe
 }
 
 
 func (p *pipe) CloseWithError(err error) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if p.err != nil {
 		return nil
 	}
 	p.err = err
-	close(p.ch)
+	close(p.done)
 	return nil
 }
 
+func (p *pipe) error() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
 
 
 func (writer *PipeWriter) WriteFrame(frame Frame) error {
-	if writer.err != nil {
-		return writer.err
+	return writer.writeFrameUntil(frame, nil)
+}
+
+/*
+** Like WriteFrame, but give up and return errPipeTimeout if `timeout` fires
+** while the pipe is full. A nil `timeout` never fires.
+*/
+
+func (writer *PipeWriter) writeFrameUntil(frame Frame, timeout <-chan time.Time) error {
+	if err := writer.error(); err != nil {
+		return err
 	}
-	writer.ch <- frame
+	select {
+		case writer.ch <- frame:
+		case <-writer.done: return writer.error()
+		case <-timeout: return errPipeTimeout
+	}
+	writer.lock.Lock()
 	writer.NFrames += 1
+	writer.lock.Unlock()
 	return nil
 }
 
+/*
+** The number of frames written so far. NFrames may be read directly by the
+** goroutine writing to the pipe, but not by the others.
+*/
+
+func (writer *PipeWriter) frames() int {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.NFrames
+}
+
 func (writer *PipeWriter) Close() error {
 	return writer.CloseWithError(io.EOF)
 }
@@ -53,10 +93,38 @@ func (writer *PipeWriter) Close() error {
 
 
 func (reader *PipeReader) ReadFrame() (Frame, error) {
-	/* This will not block if the channel is closed and empty */
-	frame, ok := <-reader.ch
-	if !ok {
-		return nil, reader.err
+	return reader.readFrame(nil)
+}
+
+var errPipeTimeout = errors.New("timeout while waiting for a frame")
+var errPipeCancelled = errors.New("cancelled while waiting for a frame")
+
+/*
+** Like ReadFrame, but give up and return errPipeTimeout if `timeout`
+** fires before a frame is available. A nil `timeout` never fires.
+*/
+
+func (reader *PipeReader) readFrame(timeout <-chan time.Time) (Frame, error) {
+	return reader.readFrameUntil(timeout, nil)
+}
+
+/*
+** Like readFrame, but also give up and return errPipeCancelled once `done`
+** is closed.
+*/
+
+func (reader *PipeReader) readFrameUntil(timeout <-chan time.Time, done <-chan struct{}) (Frame, error) {
+	var frame Frame
+	select {
+		case frame = <-reader.ch:
+		case <-reader.done:
+			/* Frames written before the pipe was closed can still be read */
+			select {
+				case frame = <-reader.ch:
+				default: return nil, reader.error()
+			}
+		case <-timeout: return nil, errPipeTimeout
+		case <-done: return nil, errPipeCancelled
 	}
 	reader.NFrames += 1
 	return frame, nil
@@ -66,3 +134,19 @@ func (reader *PipeReader) Close() error {
 	return reader.CloseWithError(io.ErrClosedPipe)
 }
 
+/*
+** Drop the frames waiting in the pipe, and return how many there were
+*/
+
+func (reader *PipeReader) discard() int {
+	n := 0
+	for {
+		select {
+			case <-reader.ch:
+				n += 1
+			default:
+				return n
+		}
+	}
+}
+
@@ -0,0 +1,196 @@
+package spdy
+
+import (
+	"io"
+	"sync"
+)
+
+// PriorityFramer multiplexes the frames of several sources (typically the
+// outputs of streams) onto a single Reader, in priority order: when frames
+// are waiting on several sources, the next frame comes from the source with
+// the highest priority (the lowest number), round-robin among equals.
+//
+// It is starvation-free: a source with a frame waiting is passed over at
+// most Patience times in a row, after which it is served first. So a busy
+// high-priority stream slows down the others, but doesn't stop them.
+//
+// Each source is read by its own goroutine, which buffers a limited number
+// of frames ahead: a source which isn't drained still blocks its writer.
+//
+// A Session applies the same order to the frames of its streams with
+// Session.PrioritizeStreams.
+type PriorityFramer struct {
+	// How many times a waiting frame may be passed over by frames of a
+	// higher priority. If 0, DefaultPatience is used.
+	Patience	int
+	size		int	// How many frames are buffered per source
+	lock		sync.Mutex
+	changed		*sync.Cond	// Signalled when a frame is queued or taken, or a source ends
+	sources		[]*prioritySource
+	next		int	// Where the round-robin among equal priorities starts
+	closed		bool
+}
+
+// The Patience of a PriorityFramer, unless set.
+const DefaultPatience = 16
+
+type prioritySource struct {
+	priority	uint8
+	queue		[]Frame
+	skipped		int	// How many times in a row a waiting frame was passed over
+	done		bool	// Did the source return an error (including io.EOF)?
+}
+
+// NewPriorityFramer returns a PriorityFramer with no sources, which buffers
+// up to `size` frames per source.
+func NewPriorityFramer(size int) *PriorityFramer {
+	if size < 1 {
+		size = 1
+	}
+	p := &PriorityFramer{size: size}
+	p.changed = sync.NewCond(&p.lock)
+	return p
+}
+
+// Add reads the frames of `source` until it returns an error (including
+// io.EOF), and passes them on with the priority `priority`.
+func (p *PriorityFramer) Add(source Reader, priority uint8) {
+	s := &prioritySource{priority: priority}
+	p.lock.Lock()
+	p.sources = append(p.sources, s)
+	p.lock.Unlock()
+	go p.pump(source, s)
+}
+
+/*
+** Queue the frames of `source` until it fails
+*/
+
+func (p *PriorityFramer) pump(source Reader, s *prioritySource) {
+	for {
+		frame, err := source.ReadFrame()
+		p.lock.Lock()
+		if err != nil {
+			if err != io.EOF {
+				debug("PriorityFramer: source failed: %s", err)
+			}
+			s.done = true
+			p.changed.Broadcast()
+			p.lock.Unlock()
+			return
+		}
+		for len(s.queue) >= p.size {
+			p.changed.Wait()
+		}
+		s.queue = append(s.queue, frame)
+		p.changed.Broadcast()
+		p.lock.Unlock()
+	}
+}
+
+// ReadFrame returns the next frame by priority, blocking until a source has
+// one. Once Close was called and every source has ended, it returns io.EOF.
+func (p *PriorityFramer) ReadFrame() (Frame, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		if s := p.pick(); s != nil {
+			frame := s.queue[0]
+			s.queue = s.queue[1:]
+			p.changed.Broadcast()
+			return frame, nil
+		}
+		p.dropEnded()
+		if p.closed && len(p.sources) == 0 {
+			return nil, io.EOF
+		}
+		p.changed.Wait()
+	}
+}
+
+// Close tells ReadFrame to return io.EOF once all the sources added so far
+// have ended, instead of waiting for new ones.
+func (p *PriorityFramer) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	p.changed.Broadcast()
+	p.lock.Unlock()
+	return nil
+}
+
+/*
+** Choose the source of the next frame, and update the starvation counters.
+** Return nil if no frame is waiting. Must be called with the lock held.
+*/
+
+func (p *PriorityFramer) pick() *prioritySource {
+	return pickSource(p.sources, &p.next, p.Patience)
+}
+
+/*
+** Choose the source of the next frame among `sources`, round-robin among
+** equal priorities from `*next`, and update the starvation counters and
+** `*next`. Return nil if no frame is waiting.
+*/
+
+func pickSource(sources []*prioritySource, next *int, patience int) *prioritySource {
+	if patience <= 0 {
+		patience = DefaultPatience
+	}
+	var best *prioritySource
+	bestStarving := false
+	for i := range sources {
+		s := sources[(*next + i) % len(sources)]
+		if len(s.queue) == 0 {
+			continue
+		}
+		starving := s.skipped >= patience
+		if best == nil || (starving && !bestStarving) || (starving == bestStarving && s.priority < best.priority) {
+			best, bestStarving = s, starving
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	for i, s := range sources {
+		if s == best {
+			s.skipped = 0
+			*next = (i + 1) % len(sources)
+		} else if len(s.queue) > 0 {
+			s.skipped++
+		}
+	}
+	return best
+}
+
+/*
+** Forget the sources which ended and have nothing left to read. Must be
+** called with the lock held.
+*/
+
+func (p *PriorityFramer) dropEnded() {
+	sources := p.sources[:0]
+	for _, s := range p.sources {
+		if !s.done || len(s.queue) > 0 {
+			sources = append(sources, s)
+		}
+	}
+	p.sources = sources
+	if p.next >= len(sources) {
+		p.next = 0
+	}
+}
+
+/*
+** The number of frames waiting, for tests
+*/
+
+func (p *PriorityFramer) buffered() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	n := 0
+	for _, s := range p.sources {
+		n += len(s.queue)
+	}
+	return n
+}
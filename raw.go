@@ -0,0 +1,61 @@
+package spdy
+
+import (
+	"bytes"
+	"io"
+)
+
+// RawFrame is a frame along with the exact bytes it was read from.
+type RawFrame struct {
+	Frame
+	Raw []byte
+}
+
+// RawFramer is a Framer which can also return the on-wire encoding of the
+// frames it reads, so that a proxy can forward them verbatim instead of
+// re-encoding them.
+//
+// Beware that header blocks are compressed with a zlib context shared by all
+// the frames of a connection. The raw bytes of a SYN_STREAM, SYN_REPLY or
+// HEADERS frame can only be decoded by a peer whose decompressor has seen
+// exactly the same header blocks: forwarding them raw only works if every
+// frame carrying headers is forwarded raw, in order, and nothing else is
+// compressed on the outgoing connection. Otherwise the frame must be
+// re-encoded (and recompressed) with WriteFrame.
+type RawFramer struct {
+	*Framer
+	raw bytes.Buffer // Bytes read since the beginning of the current frame
+}
+
+// NewRawFramer allocates a new RawFramer for a given SPDY connection,
+// represented by an io.Writer and an io.Reader.
+func NewRawFramer(w io.Writer, r io.Reader) (*RawFramer, error) {
+	rawFramer := &RawFramer{}
+	framer, err := NewFramer(w, io.TeeReader(r, &rawFramer.raw))
+	if err != nil {
+		return nil, err
+	}
+	rawFramer.Framer = framer
+	return rawFramer, nil
+}
+
+// ReadRawFrame reads the next frame, and returns it along with its raw bytes.
+func (f *RawFramer) ReadRawFrame() (*RawFrame, error) {
+	f.raw.Reset()
+	frame, err := f.Framer.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, f.raw.Len())
+	copy(raw, f.raw.Bytes())
+	return &RawFrame{Frame: frame, Raw: raw}, nil
+}
+
+// ReadFrame reads the next frame. Its raw bytes are discarded.
+func (f *RawFramer) ReadFrame() (Frame, error) {
+	frame, err := f.ReadRawFrame()
+	if err != nil {
+		return nil, err
+	}
+	return frame.Frame, nil
+}
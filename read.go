@@ -5,9 +5,11 @@
 package spdy
 
 import (
-	"compress/zlib"
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -29,7 +31,7 @@ func (frame *RstStreamFrame) read(h ControlFrameHeader, f *Framer) error {
 		return err
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return nil
 }
@@ -40,6 +42,10 @@ func (frame *SettingsFrame) read(h ControlFrameHeader, f *Framer) error {
 	if err := binary.Read(f.r, binary.BigEndian, &numSettings); err != nil {
 		return err
 	}
+	// Each setting takes 8 bytes, after the count
+	if uint64(numSettings) * 8 != uint64(h.length) - 4 {
+		return &Error{Err: InvalidControlFrame, StreamId: 0}
+	}
 	frame.FlagIdValues = make([]SettingsFlagIdValue, numSettings)
 	for i := uint32(0); i < numSettings; i++ {
 		if err := binary.Read(f.r, binary.BigEndian, &frame.FlagIdValues[i].Id); err != nil {
@@ -65,7 +71,7 @@ func (frame *PingFrame) read(h ControlFrameHeader, f *Framer) error {
 		return err
 	}
 	if frame.Id == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return nil
 }
@@ -75,6 +81,11 @@ func (frame *GoAwayFrame) read(h ControlFrameHeader, f *Framer) error {
 	if err := binary.Read(f.r, binary.BigEndian, &frame.LastGoodStreamId); err != nil {
 		return err
 	}
+	if h.version >= 3 {
+		if err := binary.Read(f.r, binary.BigEndian, &frame.Status); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -82,6 +93,62 @@ func (frame *HeadersFrame) read(h ControlFrameHeader, f *Framer) error {
 	return f.readHeadersFrame(h, frame)
 }
 
+func (frame *WindowUpdateFrame) read(h ControlFrameHeader, f *Framer) error {
+	frame.CFHeader = h
+	if err := binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
+		return err
+	}
+	if err := binary.Read(f.r, binary.BigEndian, &frame.DeltaWindowSize); err != nil {
+		return err
+	}
+	frame.StreamId &= 0x7fffffff
+	frame.DeltaWindowSize &= 0x7fffffff
+	if frame.StreamId == 0 {
+		return &Error{Err: ZeroStreamId, StreamId: 0}
+	}
+	return nil
+}
+
+func (frame *CredentialFrame) read(h ControlFrameHeader, f *Framer) error {
+	frame.CFHeader = h
+	if err := binary.Read(f.r, binary.BigEndian, &frame.Slot); err != nil {
+		return err
+	}
+	// Each length must leave room for what follows, within the frame
+	left := h.length - 2
+	readBlock := func() ([]byte, error) {
+		var length uint32
+		if err := binary.Read(f.r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if left -= 4; length > left {
+			return nil, &Error{Err: InvalidControlFrame, StreamId: 0}
+		}
+		left -= length
+		block := make([]byte, length)
+		if _, err := io.ReadFull(f.r, block); err != nil {
+			return nil, err
+		}
+		return block, nil
+	}
+	var err error
+	if frame.Proof, err = readBlock(); err != nil {
+		return err
+	}
+	frame.Certificates = nil
+	for left > 0 {
+		if left < 4 {
+			return &Error{Err: InvalidControlFrame, StreamId: 0}
+		}
+		certificate, err := readBlock()
+		if err != nil {
+			return err
+		}
+		frame.Certificates = append(frame.Certificates, certificate)
+	}
+	return nil
+}
+
 func newControlFrame(frameType ControlFrameType) (controlFrame, error) {
 	ctor, ok := cframeCtor[frameType]
 	if !ok {
@@ -99,21 +166,35 @@ var cframeCtor = map[ControlFrameType]func() controlFrame{
 	TypePing:      func() controlFrame { return new(PingFrame) },
 	TypeGoAway:    func() controlFrame { return new(GoAwayFrame) },
 	TypeHeaders:   func() controlFrame { return new(HeadersFrame) },
-	// TODO(willchan): Add TypeWindowUpdate
+	TypeWindowUpdate: func() controlFrame { return new(WindowUpdateFrame) },
+	TypeCredential: func() controlFrame { return new(CredentialFrame) },
 }
 
-func (f *Framer) uncorkHeaderDecompressor(payloadSize int64) error {
-	if f.headerDecompressor != nil {
-		f.headerReader.N = payloadSize
-		return nil
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r	io.Reader
+	n	int
+}
+
+func (c *countingReader) Read(data []byte) (int, error) {
+	n, err := c.r.Read(data)
+	c.n += n
+	return n, err
+}
+
+func (f *Framer) countHeadersIn(uncompressed int, payloadSize uint32) {
+	if f.headerCompressionDisabled {
+		f.headerStatsIn.add(uncompressed, uncompressed)
+	} else {
+		f.headerStatsIn.add(uncompressed, int(payloadSize))
 	}
-	f.headerReader = io.LimitedReader{R: f.r, N: payloadSize}
-	decompressor, err := zlib.NewReaderDict(&f.headerReader, []byte(HeaderDictionary))
-	if err != nil {
-		return err
+}
+
+func (f *Framer) uncorkHeaderDecompressor(version uint16, payloadSize int64) (io.Reader, error) {
+	if f.headerDecompressor == nil {
+		f.headerDecompressor = NewHeaderDecompressor(version)
 	}
-	f.headerDecompressor = decompressor
-	return nil
+	return f.headerDecompressor.Decompress(f.r, payloadSize)
 }
 
 // ReadFrame reads SPDY encoded data and returns a decompressed Frame.
@@ -122,12 +203,41 @@ func (f *Framer) ReadFrame() (Frame, error) {
 	if err := binary.Read(f.r, binary.BigEndian, &firstWord); err != nil {
 		return nil, err
 	}
-	if (firstWord & 0x80000000) != 0 {
+	var frame Frame
+	var err error
+	// The control bit comes first, and tells how to read the rest
+	if firstWord&controlBit != 0 {
 		frameType := ControlFrameType(firstWord & 0xffff)
-		version := uint16(0x7fff & (firstWord >> 16))
-		return f.parseControlFrame(version, frameType)
+		version := uint16(firstWord >> 16) &^ controlBit16
+		frame, err = f.parseControlFrame(version, frameType)
+	} else {
+		frame, err = f.parseDataFrame(firstWord)
+	}
+	// io.EOF means the connection was closed cleanly between two frames:
+	// in the middle of a frame, it is a truncated frame.
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return frame, err
+}
+
+// ParseFrame decodes a single frame encoded by SerializeFrame, with a new
+// header compression context. It fails if `data` holds anything after the
+// frame.
+func ParseFrame(data []byte) (Frame, error) {
+	reader := bytes.NewReader(data)
+	framer, err := NewFramer(nil, reader)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after the frame", reader.Len())
 	}
-	return f.parseDataFrame(firstWord & 0x7fffffff)
+	return frame, nil
 }
 
 func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType) (Frame, error) {
@@ -142,44 +252,101 @@ func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType) (
 	if err != nil {
 		return nil, err
 	}
+	if !validControlFrameLength(header) {
+		return nil, &Error{Err: InvalidControlFrame, StreamId: 0}
+	}
 	if err = cframe.read(header, f); err != nil {
 		return nil, err
 	}
 	return cframe, nil
 }
 
-func parseHeaderValueBlock(r io.Reader, streamId uint32) (http.Header, error) {
-	var numHeaders uint16
-	if err := binary.Read(r, binary.BigEndian, &numHeaders); err != nil {
+/*
+** Return false if the length of the control frame `h` doesn't match its
+** fixed fields, so that reading them would go past the frame
+*/
+
+func validControlFrameLength(h ControlFrameHeader) bool {
+	switch h.frameType {
+		case TypeSynStream:			return h.length >= 10
+		case TypeSynReply, TypeHeaders:		return h.length >= headersFieldsLength(h.version)
+		case TypeRstStream, TypeWindowUpdate:	return h.length == 8
+		case TypeSettings:			return h.length >= 4
+		case TypeCredential:			return h.length >= 6 && h.version >= 3
+		case TypeNoop:				return h.length == 0
+		case TypePing:				return h.length == 4
+		case TypeGoAway:
+			if h.version >= 3 {
+				return h.length == 8
+			}
+			return h.length == 4
+	}
+	return true
+}
+
+/*
+** Read a count or length of a header block of `version`: 16 bits in SPDY/2,
+** 32 bits since SPDY/3
+*/
+
+func readHeaderLength(r io.Reader, version uint16) (uint32, error) {
+	if version >= 3 {
+		var length uint32
+		err := binary.Read(r, binary.BigEndian, &length)
+		return length, err
+	}
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	return uint32(length), err
+}
+
+/*
+** Read a name or value of `length` bytes. The buffer grows with the bytes
+** actually read, so that a bogus 32 bit length can't allocate gigabytes
+*/
+
+func readHeaderString(r io.Reader, length uint32) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return "", err
+	}
+	if uint32(len(data)) != length {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(data), nil
+}
+
+func parseHeaderValueBlock(r io.Reader, streamId uint32, version uint16) (http.Header, error) {
+	numHeaders, err := readHeaderLength(r, version)
+	if err != nil {
 		return nil, err
 	}
 	var e error
-	h := make(http.Header, int(numHeaders))
-	for i := 0; i < int(numHeaders); i++ {
-		var length uint16
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+	h := make(http.Header)
+	for i := uint32(0); i < numHeaders; i++ {
+		length, err := readHeaderLength(r, version)
+		if err != nil {
 			return nil, err
 		}
-		nameBytes := make([]byte, length)
-		if _, err := io.ReadFull(r, nameBytes); err != nil {
+		name, err := readHeaderString(r, length)
+		if err != nil {
 			return nil, err
 		}
-		name := string(nameBytes)
 		if name != strings.ToLower(name) {
-			e = &Error{UnlowercasedHeaderName, streamId}
+			e = &Error{Err: UnlowercasedHeaderName, StreamId: streamId}
 			name = strings.ToLower(name)
 		}
 		if h[name] != nil {
-			e = &Error{DuplicateHeaders, streamId}
+			e = &Error{Err: DuplicateHeaders, StreamId: streamId}
 		}
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		if length, err = readHeaderLength(r, version); err != nil {
 			return nil, err
 		}
-		value := make([]byte, length)
-		if _, err := io.ReadFull(r, value); err != nil {
+		value, err := readHeaderString(r, length)
+		if err != nil {
 			return nil, err
 		}
-		valueList := strings.Split(string(value), "\x00")
+		valueList := strings.Split(value, "\x00")
 		for _, v := range valueList {
 			h.Add(name, v)
 		}
@@ -199,23 +366,25 @@ func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame)
 	if err = binary.Read(f.r, binary.BigEndian, &frame.AssociatedToStreamId); err != nil {
 		return err
 	}
-	if err = binary.Read(f.r, binary.BigEndian, &frame.Priority); err != nil {
+	var priority uint16
+	if err = binary.Read(f.r, binary.BigEndian, &priority); err != nil {
 		return err
 	}
-	frame.Priority >>= 14
+	frame.Priority, frame.Slot = unpackPriority(h.version, priority)
 
-	reader := f.r
+	reader := &countingReader{r: f.r}
 	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 10))
+		decompressed, err := f.uncorkHeaderDecompressor(h.version, int64(h.length - 10))
 		if err != nil {
 			return err
 		}
-		reader = f.headerDecompressor
+		reader.r = decompressed
 	}
 
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerReader.N == 0) || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
+	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId, h.version)
+	f.countHeadersIn(reader.n, h.length-10)
+	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerDecompressor.Remaining() == 0) || f.headerDecompressor.Remaining() != 0) {
+		err = &Error{Err: WrongCompressedPayloadSize, StreamId: 0}
 	}
 	if err != nil {
 		return err
@@ -224,12 +393,12 @@ func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame)
 	if Version >= 3 {
 		for h := range frame.Headers {
 			if invalidReqHeaders[h] {
-				return &Error{InvalidHeaderPresent, frame.StreamId}
+				return &Error{Err: InvalidHeaderPresent, StreamId: frame.StreamId}
 			}
 		}
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return nil
 }
@@ -240,21 +409,25 @@ func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) e
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	var unused uint16
-	if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
-		return err
+	if h.version < 3 {
+		var unused uint16
+		if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
+			return err
+		}
 	}
-	reader := f.r
+	blockLength := h.length - headersFieldsLength(h.version)
+	reader := &countingReader{r: f.r}
 	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 6))
+		decompressed, err := f.uncorkHeaderDecompressor(h.version, int64(blockLength))
 		if err != nil {
 			return err
 		}
-		reader = f.headerDecompressor
+		reader.r = decompressed
 	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerReader.N == 0) || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
+	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId, h.version)
+	f.countHeadersIn(reader.n, blockLength)
+	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerDecompressor.Remaining() == 0) || f.headerDecompressor.Remaining() != 0) {
+		err = &Error{Err: WrongCompressedPayloadSize, StreamId: 0}
 	}
 	if err != nil {
 		return err
@@ -263,12 +436,12 @@ func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) e
 	if Version >= 3 {
 		for h := range frame.Headers {
 			if invalidRespHeaders[h] {
-				return &Error{InvalidHeaderPresent, frame.StreamId}
+				return &Error{Err: InvalidHeaderPresent, StreamId: frame.StreamId}
 			}
 		}
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return nil
 }
@@ -279,21 +452,25 @@ func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) err
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	var unused uint16
-	if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
-		return err
+	if h.version < 3 {
+		var unused uint16
+		if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
+			return err
+		}
 	}
-	reader := f.r
+	blockLength := h.length - headersFieldsLength(h.version)
+	reader := &countingReader{r: f.r}
 	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 6))
+		decompressed, err := f.uncorkHeaderDecompressor(h.version, int64(blockLength))
 		if err != nil {
 			return err
 		}
-		reader = f.headerDecompressor
+		reader.r = decompressed
 	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerReader.N == 0) || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
+	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId, h.version)
+	f.countHeadersIn(reader.n, blockLength)
+	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerDecompressor.Remaining() == 0) || f.headerDecompressor.Remaining() != 0) {
+		err = &Error{Err: WrongCompressedPayloadSize, StreamId: 0}
 	}
 	if err != nil {
 		return err
@@ -302,19 +479,19 @@ func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) err
 	// Remove this condition when we bump Version to 3.
 	if Version >= 3 {
 		var invalidHeaders map[string]bool
-		if frame.StreamId%2 == 0 {
+		if isServerId(frame.StreamId) {
 			invalidHeaders = invalidReqHeaders
 		} else {
 			invalidHeaders = invalidRespHeaders
 		}
 		for h := range frame.Headers {
 			if invalidHeaders[h] {
-				return &Error{InvalidHeaderPresent, frame.StreamId}
+				return &Error{Err: InvalidHeaderPresent, StreamId: frame.StreamId}
 			}
 		}
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return nil
 }
@@ -333,7 +510,7 @@ func (f *Framer) parseDataFrame(streamId uint32) (*DataFrame, error) {
 		return nil, err
 	}
 	if frame.StreamId == 0 {
-		return nil, &Error{ZeroStreamId, 0}
+		return nil, &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return &frame, nil
 }
@@ -0,0 +1,49 @@
+package spdy
+
+import (
+	"io"
+	"sync"
+)
+
+// RecordingFramer is a test double for a Framer: it records every frame
+// written to it, and reads frames from a queue seeded in advance. Spliced
+// with a Stream, it lets a test run a handler and check the exact sequence
+// of frames it produced, without a session or a connection.
+type RecordingFramer struct {
+	lock	sync.Mutex
+	written	[]Frame
+	input	[]Frame
+}
+
+// NewRecordingFramer returns a RecordingFramer whose ReadFrame returns
+// `input`, in order, then io.EOF.
+func NewRecordingFramer(input ...Frame) *RecordingFramer {
+	return &RecordingFramer{input: input}
+}
+
+func (f *RecordingFramer) WriteFrame(frame Frame) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.written = append(f.written, frame)
+	return nil
+}
+
+func (f *RecordingFramer) ReadFrame() (Frame, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.input) == 0 {
+		return nil, io.EOF
+	}
+	frame := f.input[0]
+	f.input = f.input[1:]
+	return frame, nil
+}
+
+// Frames returns the frames written so far.
+func (f *RecordingFramer) Frames() []Frame {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	frames := make([]Frame, len(f.written))
+	copy(frames, f.written)
+	return frames
+}
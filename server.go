@@ -1,9 +1,14 @@
 package spdy
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"crypto/tls"
 	"net"
+	"net/http"
 )
 
 func ListenAndServe(listener net.Listener, handler Handler) error {
@@ -22,16 +27,75 @@ func ListenAndServe(listener net.Listener, handler Handler) error {
 }
 
 
+// Serve runs a new session over `conn`. If `server` is true, the client
+// must open the connection with a SPDY control frame of the supported
+// version (see CheckPreface): other traffic, such as an HTTP/1.1 request,
+// closes the connection before anything is parsed.
 func Serve(conn net.Conn, handler Handler, server bool) (*Session, error) {
-	framer, err := NewFramer(conn, conn)
+	return ServeFraming(conn, handler, server, SPDY2)
+}
+
+// ServeFraming is like Serve, but frames are read from and written to
+// `conn` by `framing`.
+func ServeFraming(conn net.Conn, handler Handler, server bool, framing Framing) (*Session, error) {
+	input := bufio.NewReader(conn)
+	framer, err := framing.NewFramer(conn, input)
 	if err != nil {
 		return nil, err
 	}
 	session := NewSession(handler, server)
-	go session.Serve(framer)
+	go func() {
+		if server {
+			if err := framing.CheckPreface(input); err != nil {
+				debug("Rejecting connection from %s: %s", conn.RemoteAddr(), err)
+				session.Close()
+				conn.Close()
+				return
+			}
+		}
+		if err := session.Serve(framer); err != nil {
+			debug("Session with %s failed: %s", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+	}()
 	return session, nil
 }
 
+// A PrefaceError is returned by CheckPreface when a connection doesn't start
+// with a SPDY control frame of the supported version.
+type PrefaceError struct {
+	Preface	[]byte // The first bytes received
+	version	uint16 // The version expected
+}
+
+func (e *PrefaceError) Error() string {
+	return fmt.Sprintf("Not a SPDY/%d connection: received %q", e.version, e.Preface)
+}
+
+// CheckPreface peeks at the first bytes of a connection without consuming
+// them, and returns a *PrefaceError unless they are the header of a control
+// frame of the supported version. A client's first frame is always a
+// control frame (SYN_STREAM or SETTINGS), so this rejects non-SPDY traffic
+// before it gets misparsed.
+func CheckPreface(r *bufio.Reader) error {
+	return checkPreface(r, Version)
+}
+
+func checkPreface(r *bufio.Reader, version uint16) error {
+	preface, err := r.Peek(4)
+	if err != nil {
+		if len(preface) == 0 {
+			return err
+		}
+		return &PrefaceError{preface, version}
+	}
+	word := binary.BigEndian.Uint16(preface)
+	if word&controlBit16 == 0 || word&^controlBit16 != version {
+		return &PrefaceError{preface, version}
+	}
+	return nil
+}
+
 /* Listen on a TCP port, and pass new connections to a handler */
 func ListenAndServeTCP(addr string, handler Handler) error {
 	listener, err := net.Listen("tcp", addr)
@@ -41,46 +105,158 @@ func ListenAndServeTCP(addr string, handler Handler) error {
 	return ListenAndServe(listener, handler)
 }
 
-/* Connect to a remote tcp server and return a new Session */
-func DialTCP(addr string, handler Handler) (*Session, error) {
+// DialFunc opens a connection, like net.Dial.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// Dial opens a connection with `dial` and returns a new client Session over
+// it. If `dial` is nil, net.Dial is used. A custom DialFunc can route SPDY
+// over other transports (eg. a unix socket or an in-process pipe), or
+// simulate network failures in tests.
+func Dial(dial DialFunc, network, addr string, handler Handler) (*Session, error) {
+	if dial == nil {
+		dial = net.Dial
+	}
 	debug("Connecting to %s\n", addr)
-	conn, err := net.Dial("tcp", addr)
+	conn, err := dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
 	return Serve(conn, handler, false)
 }
 
+/* Connect to a remote tcp server and return a new Session */
+func DialTCP(addr string, handler Handler) (*Session, error) {
+	return Dial(nil, "tcp", addr, handler)
+}
+
+// ListenAndServeTLS serves HTTPS on `addr` with the certificate in
+// `certFile` and `keyFile`: connections which negotiate SPDY are served by a
+// session, others by HTTP/1.1 (see ConfigureHTTPServer).
 func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler) error {
 	if addr == "" {
 		addr = ":https"
 	}
-	config := &tls.Config{}
-	config.NextProtos = []string{"spdy/2"}
+	server := &http.Server{Addr: addr, Handler: handler}
+	ConfigureHTTPServer(server)
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+// The framings negotiated during the TLS handshake (with ALPN), by protocol
+// name, preferred first.
+var tlsProtocols = []struct {
+	name	string
+	framing	Framing
+}{
+	{"spdy/3", SPDY3},
+	{"spdy/2", SPDY2},
+}
+
+// ErrNotSPDY is returned when the TLS handshake of a connection didn't
+// select a version of SPDY.
+var ErrNotSPDY = errors.New("SPDY was not negotiated")
+
+// ConfigureServer makes `config` offer SPDY to clients during the TLS
+// handshake, before the protocols already configured. If none were, HTTP/1.1
+// is offered after SPDY, for clients which don't support it.
+func ConfigureServer(config *tls.Config) {
+	protos := config.NextProtos
+	if len(protos) == 0 {
+		protos = []string{"http/1.1"}
 	}
+	config.NextProtos = addTLSProtocols(protos)
+}
 
-	conn, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+// ConfigureClient makes `config` request SPDY during the TLS handshake. See
+// NewClientTLS.
+func ConfigureClient(config *tls.Config) {
+	config.NextProtos = addTLSProtocols(config.NextProtos)
+}
+
+/*
+** Return `protos` preceded by the versions of SPDY it doesn't include yet
+*/
+
+func addTLSProtocols(protos []string) []string {
+	var spdy []string
+	for _, proto := range tlsProtocols {
+		found := false
+		for _, p := range protos {
+			found = found || p == proto.name
+		}
+		if !found {
+			spdy = append(spdy, proto.name)
+		}
+	}
+	return append(spdy, protos...)
+}
+
+/*
+** Return the framing of the protocol negotiated on `conn`, or nil
+*/
+
+func negotiatedFraming(conn *tls.Conn) Framing {
+	negotiated := conn.ConnectionState().NegotiatedProtocol
+	for _, proto := range tlsProtocols {
+		if proto.name == negotiated {
+			return proto.framing
+		}
+	}
+	return nil
+}
+
+// ConfigureHTTPServer makes `server` serve the TLS connections which
+// negotiate SPDY with a session, passing its streams to the handler of the
+// server. Connections which don't are served by `server` as usual, with
+// HTTP/1.1. server.TLSConfig is set up with ConfigureServer.
+func ConfigureHTTPServer(server *http.Server) {
+	if server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{}
+	}
+	ConfigureServer(server.TLSConfig)
+	if server.TLSNextProto == nil {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
+	for _, proto := range tlsProtocols {
+		framing := proto.framing
+		server.TLSNextProto[proto.name] = func(server *http.Server, conn *tls.Conn, handler http.Handler) {
+			session, err := ServeFraming(conn, handler, true, framing)
+			if err != nil {
+				debug("Can't serve SPDY to %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+			// The connection is closed when we return
+			<-session.done
+		}
+	}
+}
 
-	tlsListener := tls.NewListener(conn, config)
-	return ListenAndServe(tlsListener, handler)
+// NewClientTLS completes the TLS handshake of `conn` if needed, and returns
+// a new client Session over it, in the version of SPDY negotiated (see
+// ConfigureClient). If the server didn't select SPDY, it returns ErrNotSPDY
+// and the connection is left open, eg. to fall back to HTTP/1.1.
+func NewClientTLS(conn *tls.Conn, handler Handler) (*Session, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	framing := negotiatedFraming(conn)
+	if framing == nil {
+		return nil, ErrNotSPDY
+	}
+	return ServeFraming(conn, handler, false, framing)
 }
 
 func DialTLS(addr string, handler Handler) (*Session, error) {
 	config := &tls.Config{}
-	config.NextProtos = []string{"spdy/2"}
+	ConfigureClient(config)
 	config.InsecureSkipVerify = true //FIXME: load a root CA instead
 	conn, err := tls.Dial("tcp", addr, config)
 	if err != nil {
 		return nil, err
 	}
-	return Serve(conn, handler, false)
+	session, err := NewClientTLS(conn, handler)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
 }
@@ -9,9 +9,17 @@
 package spdy
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 /*
@@ -33,20 +41,177 @@ type Session struct {
 	streams      map[uint32]*Stream
 	handler      http.Handler
 	closed       bool
+	done         chan struct{} // Closed when the session is closed
 	outputR	     *PipeReader
 	outputW      *PipeWriter
+	framer       *Framer // Set by Serve if the peer is a Framer
+	lock         sync.Mutex
+	// Applied to every locally initiated stream. See Stream.ResponseHeaderTimeout.
+	ResponseHeaderTimeout	time.Duration
+	// StrictMode controls how streams react to a peer deviating from the
+	// spec. It is true by default, and applies to streams created after
+	// it is changed. The checks which differ are:
+	//
+	// - A repeated SYN_REPLY on a stream: strict mode resets the stream
+	// with STREAM_IN_USE, lenient mode passes it as a HEADERS frame.
+	//
+	// - A frame received on a stream after the peer half-closed it: strict
+	// mode resets the stream with STREAM_ALREADY_CLOSED, lenient mode
+	// drops the frame.
+	//
+	// All other checks (stream id validity, SYN_STREAM/SYN_REPLY as the first
+	// frame, etc.) are enforced in both modes.
+	StrictMode	bool
+	// The source of time for the session and its streams. If nil,
+	// RealClock is used.
+	Clock		Clock
+	// If non-zero, the maximum number of open streams the peer may push
+	// from a single stream. Excess pushes are refused with REFUSED_STREAM.
+	MaxPushesPerStream	int
+	// The destination of debug output for the session and its streams.
+	// If nil, they go to the package logger: see SetLogger.
+	Logger		Logger
+	pingEchoDelay	time.Duration
+	// Applied to every stream. See Stream.ReceiveWindow.
+	ReceiveWindow	uint32
+	// If true, frames received for unknown streams are dropped. Otherwise
+	// (the default) they are answered with RST_STREAM (INVALID_STREAM).
+	// A RST_STREAM for an unknown stream is always ignored.
+	IgnoreUnknownStreams	bool
+	padding		padding
+	// Pushing a stream fails if it would leave less than PushHeadroom
+	// streams available before the peer's SETTINGS_MAX_CONCURRENT_STREAMS
+	// is reached, so that there is always room to answer requests.
+	PushHeadroom	int
+	peerMaxStreams	uint32 // The peer's SETTINGS_MAX_CONCURRENT_STREAMS. 0 means no limit
+	streamSlot	chan struct{} // Closed when a local stream ends, or peerMaxStreams changes. See waitStreamSlot
+	peerInitialWindow	uint32 // The peer's SETTINGS_INITIAL_WINDOW_SIZE. 0 means the default
+	goAwayReceived	bool
+	lastGoAwayId	uint32 // The last-good-stream-id of the last GOAWAY received
+	queueSize	int // How many outgoing frames are buffered by the session and each stream
+	// If true, a SYN_REPLY waiting to be sent is sent before any other
+	// frame already queued (typically DATA for other streams), so that
+	// the headers of a response aren't held back by the bodies of others.
+	// Frames of a given stream are still sent in order.
+	PrioritizeReplyBeforeData	bool
+	// If true, the frames queued for the peer are sent by the priority of
+	// their stream (see Stream.Priority), like a PriorityFramer would:
+	// the highest priority first, but a stream passed over
+	// DefaultPatience times is served next. The frames of a stream stay
+	// in order, and so do the SYN_STREAM frames. Frames which don't
+	// belong to a stream have the highest priority.
+	PrioritizeStreams	bool
+	skipped		map[uint32]int // How many times the frames of a stream were passed over, with PrioritizeStreams
+	scheduled	[]Frame // Frames taken from the output queue, not yet sent
+	scheduledLock	sync.Mutex
+	// If non-zero, and the session is served over a Framer, frames are
+	// buffered for up to WriteCoalesceDelay and written to the connection
+	// together, trading a little latency for fewer writes. SYN_STREAM,
+	// SYN_REPLY and PING frames are written immediately, along with
+	// anything buffered before them.
+	WriteCoalesceDelay	time.Duration
+	// If non-zero, the maximum number of handlers running at the same time.
+	// Streams opened by the peer while the limit is reached are refused
+	// with REFUSED_STREAM, so a flood of streams can't spawn an unbounded
+	// number of goroutines.
+	MaxConcurrentHandlers	int
+	handlers	chan bool // Semaphore for MaxConcurrentHandlers
+	accept		chan *Stream // Streams waiting for AcceptStream. See EnableAccept
+	// If true, every stream pushed by the peer (a SYN_STREAM with an
+	// Associated-To-Stream-ID) is refused with REFUSED_STREAM as soon as
+	// it arrives: it is never passed to the handler or AcceptStream. For
+	// clients which don't handle push.
+	DisableServerPush	bool
+	openLock	sync.Mutex // Serializes OpenStream and push, so that SYN_STREAMs are sent in id order
+	// If non-zero, the receive window of the streams pushed by the peer,
+	// instead of ReceiveWindow, so a client can bound how much data is
+	// pushed before it acknowledges it. Announce it to the peer with the
+	// non-standard SettingsPushWindowSize setting (SendInitialSettings sets
+	// this field from it).
+	PushReceiveWindow	uint32
+	peerPushWindow	uint32 // The peer's SettingsPushWindowSize. 0 means the initial window
+	// If true, the payload sizes of the DATA frames received and sent are
+	// counted in a histogram. See SessionStats.DataSizesIn.
+	RecordFrameSizes	bool
+	dataSizesIn	FrameSizeHistogram
+	dataSizesOut	FrameSizeHistogram
+	// After Shutdown sends GOAWAY, the connection is kept open until the
+	// streams in flight end, but at most GoAwayGracePeriod if non-zero,
+	// so that the peer can read the responses it is waiting for.
+	GoAwayGracePeriod	time.Duration
+	// If set, notified of the life of every stream of the session. Set it
+	// before the session is used.
+	Observer	StreamObserver
+	goAwaySent	bool	// Streams opened by the peer are refused from then on
+	forwarding	int	// Streams whose output isn't fully passed to the session yet
+	forwarded	*sync.Cond	// Signalled when forwarding decreases, or the session closes
+	drainOutput	int32	// Set when the queued frames must be written before closing
+	lastPingId	uint32	// The id of the last PING sent by Ping
+	pings		map[uint32]chan struct{}	// Closed when the echo of the PING is received
+	// If set on a client, the settings the server asks to persist are
+	// saved in SettingsStore under SettingsKey (typically the address of
+	// the server), and cleared when the server sends a SETTINGS frame
+	// with ControlFlagClearSettings. See SendPersistedSettings. Set them
+	// before the session is used.
+	SettingsStore	SettingsStore
+	SettingsKey	string
+	peerSettings	map[SettingsId]uint32	// The last value of every setting received
+	// The maximum number of open streams initiated by the peer. Streams
+	// opened beyond it are refused with REFUSED_STREAM. It is
+	// DefaultMaxConcurrentStreams by default, and 0 means no limit.
+	// Announce it to the peer with SETTINGS_MAX_CONCURRENT_STREAMS
+	// (SendInitialSettings sets this field from it).
+	MaxConcurrentStreams	int
+	// The number of credential slots of a server: the CREDENTIAL frames
+	// for slot 0, or for slots beyond it, are ignored. If 0,
+	// DefaultCredentialSlots is used. See Credential.
+	CredentialSlots	int
+	credentials	map[uint16]*CredentialFrame	// The last CREDENTIAL received for each slot
 }
 
+// The default of Session.MaxConcurrentStreams, which is also the minimum
+// recommended by the spec.
+const DefaultMaxConcurrentStreams = 100
+
+// The default of Session.CredentialSlots, which is also the default of
+// SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE in the spec.
+const DefaultCredentialSlots = 8
+
+// ErrStreamLimit is returned when opening a stream while the peer's
+// SETTINGS_MAX_CONCURRENT_STREAMS streams are open.
+var ErrStreamLimit = errors.New("Can't open stream: too many concurrent streams")
+
+// ErrPushLimit is returned by Stream.Push when the peer's concurrent stream
+// limit (minus Session.PushHeadroom) is reached.
+var ErrPushLimit = errors.New("Can't push: too many concurrent streams")
+
 
 func NewSession(handler http.Handler, server bool) *Session {
-	outputR, outputW := Pipe(4096)
+	return NewSessionSize(handler, server, 4096)
+}
+
+// NewSessionSize is like NewSession, but bounds the queue of frames waiting
+// to be sent to `size` frames (for the session, and for each stream). Once
+// the queues are full, writing on a stream blocks until the peer reads
+// frames from the session: producers can't outpace a slow connection. See
+// Saturated.
+func NewSessionSize(handler http.Handler, server bool, size int) *Session {
+	if size < 1 {
+		size = 1
+	}
+	outputR, outputW := Pipe(size)
 	session := &Session{
+		queueSize:	size,
+		done:		make(chan struct{}),
 		Server:		server,
 		streams:	make(map[uint32]*Stream),
 		handler:	handler,
 		outputR:	outputR,
 		outputW:	outputW,
+		StrictMode:	true,
+		MaxConcurrentStreams:	DefaultMaxConcurrentStreams,
 	}
+	session.forwarded = sync.NewCond(&session.lock)
 	if session.handler == nil {
 		session.outputW.WriteFrame(&GoAwayFrame{})
 	}
@@ -54,16 +219,229 @@ func NewSession(handler http.Handler, server bool) *Session {
 }
 
 func (session *Session) Close() {
-	session.closed = true
+	session.lock.Lock()
+	if !session.closed {
+		session.closed = true
+		close(session.done)
+		session.forwarded.Broadcast()
+	}
+	ids := make([]uint32, 0, len(session.streams))
 	for id := range session.streams {
+		ids = append(ids, id)
+	}
+	session.lock.Unlock()
+	for _, id := range ids {
 		session.CloseStream(id)
 	}
 }
 
 func (session *Session) Closed() bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
 	return session.closed
 }
 
+// Shutdown closes the session gracefully: a GOAWAY frame tells the peer the
+// last stream it opened which is processed, and the streams it opens
+// afterwards are refused with REFUSED_STREAM. Once all the streams ended
+// and their frames are sent, the session is closed, which closes the
+// connection when served with Serve. If GoAwayGracePeriod is set and the
+// streams stall for longer, the session is closed anyway.
+//
+// Shutdown is GoAway with the status OK (0).
+func (session *Session) Shutdown() error {
+	return session.GoAway(0)
+}
+
+// GoAway is like Shutdown, with `status` telling the peer why the session
+// ends (the status is only on the wire since SPDY/3).
+func (session *Session) GoAway(status StatusCode) error {
+	session.lock.Lock()
+	if session.goAwaySent || session.closed {
+		session.lock.Unlock()
+		return nil
+	}
+	session.goAwaySent = true
+	lastGood := session.lastStreamIdIn
+	session.lock.Unlock()
+	if err := session.outputW.WriteFrame(&GoAwayFrame{LastGoodStreamId: lastGood, Status: status}); err != nil {
+		return err
+	}
+	go session.closeAfterStreams()
+	return nil
+}
+
+/*
+** Pass a message to the session logger, or to the package logger if it has none
+*/
+
+func (session *Session) debug(msg string, args ...interface{}) {
+	if session.Logger != nil {
+		session.Logger.Printf(msg, args...)
+		return
+	}
+	debug(msg, args...)
+}
+
+/*
+** Close the session once the output of all its streams is forwarded, or
+** after GoAwayGracePeriod
+*/
+
+func (session *Session) closeAfterStreams() {
+	forwarded := make(chan struct{})
+	go func() {
+		session.lock.Lock()
+		for session.forwarding > 0 && !session.closed {
+			session.forwarded.Wait()
+		}
+		session.lock.Unlock()
+		close(forwarded)
+	}()
+	var timeout <-chan time.Time
+	if session.GoAwayGracePeriod > 0 {
+		timeout = clockOrDefault(session.Clock).After(session.GoAwayGracePeriod)
+	}
+	select {
+		case <-forwarded:
+			atomic.StoreInt32(&session.drainOutput, 1)
+		case <-timeout:
+			session.debug("Streams still open %s after GOAWAY. Closing", session.GoAwayGracePeriod)
+	}
+	session.Close()
+}
+
+// Returned by newStream for the streams opened by the peer after GOAWAY
+var errGoingAway = errors.New("GOAWAY sent")
+
+// ErrGoAwayReceived is returned when opening a stream on a session whose
+// peer sent GOAWAY: the peer won't process new streams, which must be opened
+// on another session.
+var ErrGoAwayReceived = errors.New("GOAWAY received")
+
+// ErrConnectionClosed is returned by the streams of a session whose
+// connection went away before they ended.
+var ErrConnectionClosed = errors.New("Connection closed")
+
+/*
+** Close the session, and end all its streams with `err` in both directions.
+*/
+
+func (session *Session) abort(err error) {
+	session.lock.Lock()
+	peers := make([]*Stream, 0, len(session.streams))
+	for _, peer := range session.streams {
+		peers = append(peers, peer)
+	}
+	session.lock.Unlock()
+	for _, peer := range peers {
+		err := err
+		if w, isWrite := err.(*WriteError); isWrite {
+			err = w.forStream(peer)
+		}
+		peer.end(err)
+		peer.output.CloseWithError(err)
+		peer.input.CloseWithError(err)
+		peer.signalWindow()
+	}
+	session.Close()
+}
+
+// WriteErrorKind classifies the failures to write to the connection.
+type WriteErrorKind int
+
+const (
+	WriteFailed		WriteErrorKind = iota	// Unknown: assume the worst
+	WriteTimeout		// A write deadline expired
+	WriteConnectionReset	// The peer reset the connection
+	WriteBrokenPipe		// The connection was already closed
+)
+
+func (k WriteErrorKind) String() string {
+	switch k {
+		case WriteTimeout:		return "timeout"
+		case WriteConnectionReset:	return "connection reset"
+		case WriteBrokenPipe:		return "broken pipe"
+	}
+	return "write failed"
+}
+
+// A WriteError is returned by Serve when writing to the connection failed,
+// and the streams aborted because of it fail with a copy of it.
+//
+// A local stream whose SYN_STREAM wasn't written to the connection yet
+// never reached the peer: if the write failure is classified (Kind isn't
+// WriteFailed), its error has Replayable set, and the request it carried
+// can be sent again on another session.
+type WriteError struct {
+	Kind		WriteErrorKind
+	Err		error	// As returned by the connection
+	Replayable	bool	// Only set in the errors of the streams
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("Write error (%s): %s", e.Kind, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+func newWriteError(err error) *WriteError {
+	return &WriteError{Kind: classifyWriteError(err), Err: err}
+}
+
+/*
+** Return the kind of the write error `err`
+*/
+
+func classifyWriteError(err error) WriteErrorKind {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return WriteTimeout
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return WriteConnectionReset
+	}
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) {
+		return WriteBrokenPipe
+	}
+	return WriteFailed
+}
+
+/*
+** Return the error of `peer`, a stream aborted because of `e`
+*/
+
+func (e *WriteError) forStream(peer *Stream) *WriteError {
+	streamErr := *e
+	streamErr.Replayable = e.Kind != WriteFailed && peer.local && atomic.LoadInt32(&peer.synWritten) == 0
+	return &streamErr
+}
+
+// A ProtocolViolation is returned by Serve when the peer violated the
+// protocol badly enough for the session to be aborted. Its Status is sent
+// to the peer in a GOAWAY frame (the status is only on the wire since
+// SPDY/3).
+//
+// It is not named ProtocolError, which is the PROTOCOL_ERROR StatusCode.
+type ProtocolViolation struct {
+	Status	StatusCode
+	Message	string
+	Frame	Frame	// The offending frame, or nil if it couldn't be parsed
+}
+
+func (e *ProtocolViolation) Error() string {
+	if e.Frame == nil {
+		return fmt.Sprintf("Protocol error (status %d): %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("Protocol error on %s (status %d): %s", frameTypeName(e.Frame), e.Status, e.Message)
+}
+
+func newProtocolViolation(err *Error, frame Frame) *ProtocolViolation {
+	return &ProtocolViolation{Status: ProtocolError, Message: string(err.Err), Frame: frame}
+}
+
 /*
  * Compute the ID which should be used to open the next stream
  * 
@@ -78,14 +456,12 @@ func (session *Session) Closed() bool {
  *    wrap: when a client or server cannot create a new stream id without
  *    exceeding a 31 bit value, it MUST NOT create a new stream.
  * >>
+ *
+ * Must be called with the lock held.
  */
 func (session *Session) nextIdOut() (uint32, error) {
 	if session.lastStreamIdOut == 0 {
-		if session.Server {
-			return 2, nil
-		} else {
-			return 1, nil
-		}
+		return session.firstId(session.Server), nil
 	}
 	if session.lastStreamIdOut >= 0xffffffff - 1 {
 		return 0, errors.New("Can't allocate new streams: uint32 overflow")
@@ -93,13 +469,27 @@ func (session *Session) nextIdOut() (uint32, error) {
 	return session.lastStreamIdOut + 2, nil
 }
 
+// SetNextStreamId sets the id of the next stream created by InitiateStream,
+// for example to continue the numbering of a previous connection.
+// The id must have the right parity (odd for a client, even for a server)
+// and be higher than any id already allocated.
+func (session *Session) SetNextStreamId(id uint32) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if !session.streamIdIsValid(id, true) || id > 0x7fffffff {
+		return &Error{Err: InvalidStreamId, StreamId: id}
+	}
+	if id > 2 {
+		session.lastStreamIdOut = id - 2
+	} else {
+		session.lastStreamIdOut = 0
+	}
+	return nil
+}
+
 func (session *Session) nextIdIn() (uint32, error) {
 	if session.lastStreamIdIn == 0 {
-		if session.Server {
-			return 1, nil
-		} else {
-			return 2, nil
-		}
+		return session.firstId(!session.Server), nil
 	}
 	if session.lastStreamIdIn + 2 > 0xffffffff {
 		return 0, errors.New("Can't allocate new streams: uint32 overflow")
@@ -107,24 +497,115 @@ func (session *Session) nextIdIn() (uint32, error) {
 	return session.lastStreamIdIn + 2, nil
 }
 
+/*
+** The first stream id of the server, or of the client
+*/
+
+func (session *Session) firstId(server bool) uint32 {
+	if server {
+		return 2
+	}
+	return 1
+}
+
 /*
 ** InitiateStream() initiates a new local stream. It does not send SYN_STREAM or
 ** any other frame. That is the responsibility of the caller. 
+** It fails with ErrStreamLimit if the peer's SETTINGS_MAX_CONCURRENT_STREAMS
+** local streams are open.
 */
 
 func (session *Session) InitiateStream() (*Stream, error) {
+	return session.initiatePriority(0)
+}
+
+/*
+** InitiateStream, with the stream at `priority` from the start
+*/
+
+func (session *Session) initiatePriority(priority uint8) (*Stream, error) {
+	stream, err := session.initiateStream(0, ErrStreamLimit, priority)
+	if err != nil {
+		return nil, err
+	}
+	stream.ResponseHeaderTimeout = session.ResponseHeaderTimeout
+	session.startStream(stream)
+	return stream, nil
+}
+
+/*
+** Check the peer's stream limit, keeping `headroom` streams free, then
+** allocate an id and register a new local stream at that id, all in one
+** step under the lock: concurrent callers never get the same id, nor exceed
+** the limit together. Fails with `full` if the limit is reached. The stream
+** must then be started with startStream.
+*/
+
+func (session *Session) initiateStream(headroom int, full error, priority uint8) (*Stream, error) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if max := session.peerMaxStreams; max > 0 && session.countLocalStreams() + headroom >= int(max) {
+		return nil, full
+	}
 	newId, err := session.nextIdOut()
 	if err != nil {
 		return nil, err
 	}
-	if stream, err := session.newStream(newId, true); err != nil {
+	return session.registerStream(newId, true, priority)
+}
+
+// OpenStream initiates a new local stream and sends its SYN_STREAM with
+// `headers`, without FLAG_FIN: the caller sends the body (if any) and
+// half-closes the stream. Concurrent calls are serialized. It fails with
+// ErrStreamLimit while as many streams as the peer's
+// SETTINGS_MAX_CONCURRENT_STREAMS are open.
+func (session *Session) OpenStream(headers *http.Header) (*Stream, error) {
+	return session.openStream(nil, headers, 0)
+}
+
+// OpenStreamPriority is like OpenStream, but the stream is sent at
+// `priority` (see Stream.Priority and Session.PrioritizeStreams).
+func (session *Session) OpenStreamPriority(headers *http.Header, priority uint8) (*Stream, error) {
+	return session.openStream(nil, headers, priority)
+}
+
+// OpenStreamContext is like OpenStream, but the stream is bound to `ctx`, as
+// with NewStreamContext: once it is done, the stream is reset with CANCEL
+// and its reads and writes return ctx.Err().
+func (session *Session) OpenStreamContext(ctx context.Context, headers *http.Header) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
-	} else {
-		return stream, nil
 	}
-	return nil, nil
+	return session.openStream(ctx, headers, 0)
+}
+
+func (session *Session) openStream(ctx context.Context, headers *http.Header, priority uint8) (*Stream, error) {
+	session.openLock.Lock()
+	defer session.openLock.Unlock()
+	stream, err := session.initiatePriority(priority)
+	if err != nil {
+		return nil, err
+	}
+	stream.ctx = ctx
+	if err := stream.Syn(headers, false); err != nil {
+		session.CloseStream(stream.Id)
+		return nil, err
+	}
+	session.waitSynForwarded(stream)
+	return stream, nil
 }
 
+/*
+** Wait until the SYN_STREAM of the local stream `stream` reached the session
+** output, so that the next one can't overtake it. Called with openLock held.
+*/
+
+func (session *Session) waitSynForwarded(stream *Stream) {
+	select {
+		case <-stream.synForwarded:
+		case <-session.done:
+	}
+}
 
 /*
  * Create a new stream and register it at `id` in `session`
@@ -132,33 +613,204 @@ func (session *Session) InitiateStream() (*Stream, error) {
  * If `id` is invalid or already registered, the call will fail.
  */
 
-func (session *Session) newStream(id uint32, local bool) (*Stream, error) {
+func (session *Session) newStream(id uint32, local bool, priority uint8) (*Stream, error) {
+	session.lock.Lock()
+	stream, err := session.registerStream(id, local, priority)
+	session.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	session.startStream(stream)
+	return stream, nil
+}
+
+/*
+** Create a new stream at `priority` and register it at `id`, without
+** starting it. Must be called with the lock held.
+*/
+
+func (session *Session) registerStream(id uint32, local bool, priority uint8) (*Stream, error) {
 	/* If the ID is valid, register the stream. Otherwise, send a protocol error */
 	if !session.streamIdIsValid(id, local) {
-		return nil, &Error{InvalidStreamId, id}
+		return nil, &Error{Err: InvalidStreamId, StreamId: id}
+	}
+	if !local && session.goAwaySent {
+		return nil, errGoingAway
+	}
+	if local && session.goAwayReceived {
+		return nil, ErrGoAwayReceived
+	}
+	stream, streamPeer := newStreamSize(id, local, DefaultStreamBuffer, session.queueSize)
+	streamPeer.output.strict = session.StrictMode
+	stream.clock = session.Clock
+	stream.logger, streamPeer.logger = session.Logger, session.Logger
+	// Set before the stream is registered, where nextByPriority reads it
+	stream.Priority, streamPeer.Priority = priority, priority
+	stream.ReceiveWindow = session.ReceiveWindow
+	if !local && !session.Server && session.PushReceiveWindow != 0 {
+		// Streams initiated by a server are pushes
+		stream.ReceiveWindow = session.PushReceiveWindow
+	}
+	stream.control = session.outputW
+	stream.padding = &session.padding
+	stream.session = session
+	if session.peerInitialWindow != 0 {
+		stream.setInitialSendWindow(session.peerInitialWindow)
 	}
-	stream, streamPeer := NewStream(id, local)
 	session.streams[id] = streamPeer
 	if local {
+		stream.synForwarded = make(chan struct{})
 		session.lastStreamIdOut = id
 	} else {
 		session.lastStreamIdIn = id
 	}
+	session.forwarding++
+	return stream, nil
+}
+
+/*
+** Start forwarding the output of a stream returned by registerStream to the
+** session
+*/
+
+func (session *Session) startStream(stream *Stream) {
+	id, streamPeer := stream.Id, stream.peer
+	if session.Observer != nil {
+		session.Observer.StreamOpened(stream)
+	}
 	/* Copy stream output to session output */
 	go func() {
-		err := Copy(session.outputW, streamPeer)
-		/* Close the stream if there's an error (inluding EOF) */
+		var output Writer = session.outputW
+		if stream.synForwarded != nil {
+			first := &firstFrameWriter{Writer: session.outputW, first: stream.synForwarded}
+			defer first.notify()
+			output = first
+		}
+		err := Copy(output, streamPeer)
+		/* Close the stream if there's an error (inluding EOF), or after we reset it */
 		if err != nil {
 			session.CloseStream(id)
 		} else {
-			if streamPeer.Closed {
+			if streamPeer.isClosed() || atomic.LoadInt32(&streamPeer.output.reset) != 0 {
 				session.CloseStream(id)
 			}
 		}
+		session.lock.Lock()
+		session.forwarding--
+		session.forwarded.Broadcast()
+		session.lock.Unlock()
 	}()
-	return stream, nil
 }
 
+/*
+** A Writer which closes `first` once the first frame was written to it, or
+** when notify is called
+*/
+
+type firstFrameWriter struct {
+	Writer
+	first	chan struct{}
+	once	sync.Once
+}
+
+func (w *firstFrameWriter) WriteFrame(frame Frame) error {
+	err := w.Writer.WriteFrame(frame)
+	w.notify()
+	return err
+}
+
+func (w *firstFrameWriter) notify() {
+	w.once.Do(func() { close(w.first) })
+}
+
+/*
+** Return true if accepting `frame` would exceed MaxPushesPerStream for its
+** associated stream.
+*/
+
+func (session *Session) tooManyPushes(frame *SynStreamFrame) bool {
+	if session.MaxPushesPerStream <= 0 || frame.AssociatedToStreamId == 0 {
+		return false
+	}
+	parent, exists := session.getStream(frame.AssociatedToStreamId)
+	if !exists {
+		return false
+	}
+	return len(parent.Pushes()) >= session.MaxPushesPerStream
+}
+
+// EnableAccept makes the session queue the streams opened by the peer for
+// AcceptStream, instead of serving them with its handler. At most `size`
+// streams wait to be accepted: while the queue is full, new streams are
+// refused with REFUSED_STREAM, so a slow application pushes back on the
+// peer. It must be called before the session receives any frame.
+func (session *Session) EnableAccept(size int) {
+	if size < 1 {
+		size = 1
+	}
+	session.lock.Lock()
+	session.accept = make(chan *Stream, size)
+	session.lock.Unlock()
+}
+
+// ErrSessionClosed is returned by AcceptStream once the session is closed.
+var ErrSessionClosed = errors.New("Session closed")
+
+// AcceptStream waits for the next stream opened by the peer, and returns it.
+// The first frame read from the stream is its SYN_STREAM. See EnableAccept.
+func (session *Session) AcceptStream() (*Stream, error) {
+	accept := session.acceptQueue()
+	if accept == nil {
+		return nil, errors.New("AcceptStream requires EnableAccept")
+	}
+	select {
+		case stream := <-accept:	return stream, nil
+		case <-session.done:		return nil, ErrSessionClosed
+	}
+}
+
+func (session *Session) acceptQueue() chan *Stream {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.accept
+}
+
+/*
+** Reserve a slot for a new handler, or return false if MaxConcurrentHandlers
+** are already running. Every successful call must be followed by a call to
+** releaseHandler.
+*/
+
+func (session *Session) acquireHandler() bool {
+	session.lock.Lock()
+	if session.handlers == nil && session.MaxConcurrentHandlers > 0 {
+		session.handlers = make(chan bool, session.MaxConcurrentHandlers)
+	}
+	handlers := session.handlers
+	session.lock.Unlock()
+	if handlers == nil {
+		return true
+	}
+	select {
+		case handlers <- true:	return true
+		default:		return false
+	}
+}
+
+func (session *Session) releaseHandler() {
+	session.lock.Lock()
+	handlers := session.handlers
+	session.lock.Unlock()
+	if handlers != nil {
+		<-handlers
+	}
+}
+
+/*
+** Return true if `id` can be the next local (or remote) stream id. For local
+** ids, must be called with the lock held.
+*/
+
 func (session *Session) streamIdIsValid(id uint32, local bool) bool {
 	if id == 0 {
 	    return false
@@ -188,92 +840,994 @@ func (session *Session) streamIdIsValid(id uint32, local bool) bool {
 
 
 func (session *Session) CloseStream(id uint32) error {
+	session.lock.Lock()
 	stream, exists := session.streams[id]
+	delete(session.streams, id)
+	if exists && session.isLocalId(id) {
+		session.freeStreamSlot()
+	}
+	session.lock.Unlock()
 	if !exists {
 		return errors.New(fmt.Sprintf("No such stream: %v", id))
 	}
 	stream.Close()
-	delete(session.streams, id)
 	return nil
 }
 
-
 /*
-** Return the number of open streams
+** Return the stream registered at `id`, if any
 */
 
-func (session *Session) NStreams() int {
-	return len(session.streams)
+func (session *Session) getStream(id uint32) (*Stream, bool) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	stream, exists := session.streams[id]
+	return stream, exists
 }
 
-func (session *Session) ReadFrame() (Frame, error) {
-	return session.outputR.ReadFrame()
-}
 
-func (session *Session) WriteFrame(frame Frame) error {
-	debug("Received frame: %#v", frame)
-	/* Is this frame stream-specific? */
-	if streamId, exists := frame.GetStreamId(); exists {
-		/* SYN_STREAM frame: create the stream */
-		if _, ok := frame.(*SynStreamFrame); ok {
-			if stream, err := session.newStream(streamId, false); err != nil {
-				if e, sendable := err.(*Error); sendable {
-					if err := session.outputW.WriteFrame(e.ToFrame()); err != nil {
-						return err
-					}
-					return nil
-				} else {
-					return err
-				}
-			} else {
-				go stream.Serve(session.handler)
-			}
-		}
-		streamPeer, exists := session.streams[streamId]
-		if !exists {
-			session.outputW.WriteFrame(&RstStreamFrame{StreamId: streamId, Status: ProtocolError})
-			return nil
-		}
-		err := streamPeer.WriteFrame(frame)
-		if err != nil {
-			debug("Error while passing frame to stream: %s. Closing stream.", err)
-			session.CloseStream(streamId)
-			return err
-		} else if streamPeer.Closed {
-			debug("Stream %d is fully closed. De-registering", streamId)
-		}
-	/* Is this frame session-wide? */
-	} else {
-		switch frame.(type) {
-			case *SettingsFrame:		debug("SETTINGS\n")
-			case *NoopFrame:		debug("NOOP\n")
-			case *PingFrame:		session.outputW.WriteFrame(frame)
-			case *GoAwayFrame:		debug("GOAWAY\n")
-			default:			debug("Unknown frame type!")
-		}
+/*
+** Open a stream pushed from `parent`
+*/
+
+func (session *Session) push(parent *Stream, headers *http.Header) (*Stream, error) {
+	if !session.Server {
+		return nil, errors.New("Can't push: only servers can push")
 	}
-	return nil
+	session.openLock.Lock()
+	defer session.openLock.Unlock()
+	stream, err := session.initiateStream(session.PushHeadroom, ErrPushLimit, 0)
+	if err != nil {
+		return nil, err
+	}
+	stream.ResponseHeaderTimeout = session.ResponseHeaderTimeout
+	session.startStream(stream)
+	stream.associate(parent)
+	stream.setUnidirectional()
+	session.lock.Lock()
+	if window := session.initialSendWindow(true); window != 0 {
+		stream.setInitialSendWindow(window)
+	}
+	session.lock.Unlock()
+	if headers == nil {
+		headers = new(http.Header)
+	}
+	syn := &SynStreamFrame{StreamId: stream.Id, AssociatedToStreamId: parent.Id, Headers: *headers}
+	syn.CFHeader.Flags = ControlFlagUnidirectional
+	if err := stream.WriteFrame(syn); err != nil {
+		return nil, err
+	}
+	session.waitSynForwarded(stream)
+	return stream, nil
 }
 
+/*
+** The send window announced by the peer for new streams, or for pushes if
+** `push` is true. 0 means the peer didn't announce any. Must be called with
+** the lock held.
+*/
 
-func (session *Session) Serve(peer ReadWriter) error {
-	defer session.Close()
-	if err := Splice(session, peer, true); err != nil {
-		return err
+func (session *Session) initialSendWindow(push bool) uint32 {
+	if push && session.peerPushWindow != 0 {
+		return session.peerPushWindow
 	}
-	return nil
+	return session.peerInitialWindow
 }
 
 /*
- * Return true if it's legal for `id` to be locally created
- * (eg. even-numbered if we're the server, odd-numbered if we're the client)
- */
-func (session *Session) isLocalId(id uint32) bool {
-	if id == 0 {
-	    return false
+** Return the number of open streams initiated by us (including pushes)
+*/
+
+func (session *Session) nLocalStreams() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.countLocalStreams()
+}
+
+/*
+** Wait until the peer's SETTINGS_MAX_CONCURRENT_STREAMS leaves room for a
+** new local stream, or `ctx` is done, or the session is closed. Another
+** caller may take the room first: OpenStream can still fail with
+** ErrStreamLimit.
+*/
+
+func (session *Session) waitStreamSlot(ctx context.Context) error {
+	session.lock.Lock()
+	if max := session.peerMaxStreams; max == 0 || session.countLocalStreams() < int(max) {
+		session.lock.Unlock()
+		return nil
 	}
-	if session.Server {
-		return (id%2 == 0) /* Return true if id is even */
+	if session.streamSlot == nil {
+		session.streamSlot = make(chan struct{})
 	}
-	return (id%2 != 0) /* Return true if id is odd */
+	slot := session.streamSlot
+	session.lock.Unlock()
+	select {
+		case <-slot:			return nil
+		case <-ctx.Done():		return ctx.Err()
+		case <-session.done:		return ErrConnectionClosed
+	}
+}
+
+/*
+** Wake up the callers of waitStreamSlot. Must be called with the lock held.
+*/
+
+func (session *Session) freeStreamSlot() {
+	if session.streamSlot != nil {
+		close(session.streamSlot)
+		session.streamSlot = nil
+	}
+}
+
+/*
+** Like nLocalStreams, with the lock held
+*/
+
+func (session *Session) countLocalStreams() int {
+	n := 0
+	for id := range session.streams {
+		if session.isLocalId(id) {
+			n += 1
+		}
+	}
+	return n
+}
+
+/*
+** The number of open streams initiated by the peer
+*/
+
+func (session *Session) nPeerStreams() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	n := 0
+	for id := range session.streams {
+		if !session.isLocalId(id) {
+			n += 1
+		}
+	}
+	return n
+}
+
+// Pending returns the number of frames queued for the peer, which haven't
+// been read from the session yet.
+func (session *Session) Pending() int {
+	return len(session.outputR.ch) + session.nScheduled()
+}
+
+func (session *Session) nScheduled() int {
+	session.scheduledLock.Lock()
+	defer session.scheduledLock.Unlock()
+	return len(session.scheduled)
+}
+
+// Saturated returns true if the queue of frames for the peer is full. While
+// it is, streams trying to send more frames eventually block: upper layers
+// may want to shed load.
+func (session *Session) Saturated() bool {
+	return len(session.outputR.ch) == cap(session.outputR.ch)
+}
+
+/*
+** Return the number of open streams
+*/
+
+func (session *Session) NStreams() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return len(session.streams)
+}
+
+// ReadFrame returns the next frame to send to the peer. Once the session is
+// closed, the frames queued before are still returned, and then io.EOF.
+func (session *Session) ReadFrame() (Frame, error) {
+	frame, err := session.nextFrame(nil, session.done)
+	if err == errPipeCancelled {
+		if session.nScheduled() == 0 && len(session.outputR.ch) == 0 {
+			return nil, io.EOF
+		}
+		frame, err = session.nextFrame(nil, nil)
+	}
+	if err == nil {
+		session.recordFrameSize(&session.dataSizesOut, frame)
+	}
+	return frame, err
+}
+
+/*
+** Return the next frame to send to the peer, errPipeTimeout if `timeout`
+** fires first, or errPipeCancelled once `done` is closed. With PrioritizeReplyBeforeData, all the frames already queued
+** are taken, and the first SYN_REPLY among them is sent first. Since a
+** SYN_REPLY is always the first frame of its stream, this never reorders
+** the frames of a stream. With PrioritizeStreams, the next frame is chosen
+** by nextByPriority.
+*/
+
+func (session *Session) nextFrame(timeout <-chan time.Time, done <-chan struct{}) (Frame, error) {
+	if session.nScheduled() == 0 {
+		if !session.PrioritizeReplyBeforeData && !session.PrioritizeStreams {
+			return session.outputR.readFrameUntil(timeout, done)
+		}
+		frame, err := session.outputR.readFrameUntil(timeout, done)
+		if err != nil {
+			return nil, err
+		}
+		session.scheduledLock.Lock()
+		session.scheduled = append(session.scheduled, frame)
+	} else {
+		session.scheduledLock.Lock()
+	}
+	defer session.scheduledLock.Unlock()
+	for len(session.outputR.ch) > 0 {
+		frame, err := session.outputR.readFrame(nil)
+		if err != nil {
+			break
+		}
+		session.scheduled = append(session.scheduled, frame)
+	}
+	next := -1
+	if session.PrioritizeReplyBeforeData {
+		for i, frame := range session.scheduled {
+			if _, isReply := frame.(*SynReplyFrame); isReply {
+				next = i
+				break
+			}
+		}
+	}
+	if next < 0 && session.PrioritizeStreams {
+		next = session.nextByPriority()
+	}
+	if next < 0 {
+		next = 0
+	}
+	frame := session.scheduled[next]
+	session.scheduled = append(session.scheduled[:next], session.scheduled[next+1:]...)
+	return frame, nil
+}
+
+/*
+** Return the index in `scheduled` of the next frame to send by the priority
+** of its stream, with the starvation counters of a PriorityFramer. Only the
+** first frame of each stream is a candidate, and only the first SYN_STREAM.
+** Must be called with scheduledLock held.
+*/
+
+func (session *Session) nextByPriority() int {
+	var sources []*prioritySource
+	streams := make(map[uint32]*prioritySource)
+	first := make(map[*prioritySource]int)	// The index of the first frame of each source
+	ids := make(map[*prioritySource]uint32)
+	synWaiting := false
+	for i, frame := range session.scheduled {
+		id, _ := frame.GetStreamId()
+		if _, seen := streams[id]; seen {
+			continue
+		}
+		s := &prioritySource{queue: []Frame{frame}}
+		streams[id] = s
+		if _, isSyn := frame.(*SynStreamFrame); isSyn {
+			if synWaiting {
+				// Sent once the SYN_STREAMs before it are
+				continue
+			}
+			synWaiting = true
+		}
+		if stream, exists := session.getStream(id); exists && id != 0 {
+			s.priority = stream.peer.Priority
+		}
+		s.skipped = session.skipped[id]
+		sources = append(sources, s)
+		first[s], ids[s] = i, id
+	}
+	next := 0
+	best := pickSource(sources, &next, DefaultPatience)
+	session.skipped = make(map[uint32]int)
+	for _, s := range sources {
+		if s.skipped > 0 {
+			session.skipped[ids[s]] = s.skipped
+		}
+	}
+	return first[best]
+}
+
+func (session *Session) WriteFrame(frame Frame) error {
+	session.debug("Received frame: %v", frame)
+	session.recordFrameSize(&session.dataSizesIn, frame)
+	if frame.IsSessionLevel() {
+		return session.writeSessionFrame(frame)
+	}
+	return session.writeStreamFrame(frame)
+}
+
+/*
+** Handle a frame which applies to the whole session
+*/
+
+func (session *Session) writeSessionFrame(frame Frame) error {
+	switch f := frame.(type) {
+		case *SettingsFrame:		session.applySettings(f)
+		case *NoopFrame:		session.debug("NOOP\n")
+		case *PingFrame:		session.echoPing(frame)
+		case *GoAwayFrame:		return session.goAway(f)
+		case *CredentialFrame:		session.storeCredential(f)
+		default:			session.debug("Unknown frame type!")
+	}
+	return nil
+}
+
+/*
+** Handle a GOAWAY received from the peer. A peer may send several, but its
+** last-good-stream-id can only decrease: otherwise the session is aborted
+** with a protocol error.
+*/
+
+func (session *Session) goAway(frame *GoAwayFrame) error {
+	session.debug("GOAWAY (last good stream: %d)\n", frame.LastGoodStreamId)
+	session.lock.Lock()
+	increasing := session.goAwayReceived && frame.LastGoodStreamId > session.lastGoAwayId
+	session.goAwayReceived = true
+	session.lastGoAwayId = frame.LastGoodStreamId
+	session.lock.Unlock()
+	if increasing {
+		err := &Error{Err: IncreasingGoAway, StreamId: 0}
+		session.abort(err)
+		return err
+	}
+	return nil
+}
+
+/*
+** Return true if the peer opened the stream `id` after a stream with a higher
+** id, which is a session error (a repeated id is only a stream error)
+*/
+
+func (session *Session) decreasingStreamId(id uint32) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return id != 0 && !session.isLocalId(id) && id < session.lastStreamIdIn
+}
+
+/*
+** Refuse the stream `id` opened by the peer with REFUSED_STREAM
+*/
+
+func (session *Session) refuseStream(id uint32) error {
+	return session.rejectStream(id, RefusedStream)
+}
+
+/*
+** Reset the stream `id` opened by the peer with `status`, without opening it
+*/
+
+func (session *Session) rejectStream(id uint32, status StatusCode) error {
+	session.lock.Lock()
+	session.lastStreamIdIn = id
+	session.lock.Unlock()
+	return session.outputW.WriteFrame(&RstStreamFrame{StreamId: id, Status: status})
+}
+
+/*
+** Return why a client must reject the stream pushed with `frame`, or nil: a
+** push must be unidirectional, and associated to an open stream.
+*/
+
+func (session *Session) checkPush(frame *SynStreamFrame) *Error {
+	if _, exists := session.getStream(frame.AssociatedToStreamId); !exists {
+		return &Error{Err: UnassociatedPush, StreamId: frame.StreamId, Frame: frame}
+	}
+	if frame.CFHeader.Flags&ControlFlagUnidirectional == 0 {
+		return &Error{Err: BidirectionalPush, StreamId: frame.StreamId, Frame: frame}
+	}
+	return nil
+}
+
+/*
+** Pass a frame to its stream, creating the stream on SYN_STREAM
+*/
+
+func (session *Session) writeStreamFrame(frame Frame) error {
+	streamId, _ := frame.GetStreamId()
+	/* SYN_STREAM frame: create the stream */
+	if synStream, ok := frame.(*SynStreamFrame); ok {
+		if session.DisableServerPush && synStream.AssociatedToStreamId != 0 && session.streamIdIsValid(streamId, false) {
+			session.debug("Server push is disabled. Refusing stream %d", streamId)
+			return session.refuseStream(streamId)
+		}
+		if session.tooManyPushes(synStream) && session.streamIdIsValid(streamId, false) {
+			session.debug("Too many pushes from stream %d. Refusing stream %d", synStream.AssociatedToStreamId, streamId)
+			return session.refuseStream(streamId)
+		}
+		valid := session.streamIdIsValid(streamId, false)
+		if valid && !session.Server {
+			if err := session.checkPush(synStream); err != nil {
+				session.debug("Invalid push (%s). Resetting stream %d", err, streamId)
+				return session.rejectStream(streamId, err.ToFrame().Status)
+			}
+		}
+		if valid && session.MaxConcurrentStreams > 0 && session.nPeerStreams() >= session.MaxConcurrentStreams {
+			session.debug("%d streams open. Refusing stream %d", session.MaxConcurrentStreams, streamId)
+			return session.refuseStream(streamId)
+		}
+		accept := session.acceptQueue()
+		if valid && accept != nil && len(accept) == cap(accept) {
+			session.debug("Accept queue full. Refusing stream %d", streamId)
+			return session.refuseStream(streamId)
+		}
+		if valid && accept == nil && !session.acquireHandler() {
+			session.debug("Too many concurrent handlers. Refusing stream %d", streamId)
+			return session.refuseStream(streamId)
+		}
+		if stream, err := session.newStream(streamId, false, uint8(synStream.Priority)); err != nil {
+			if valid && accept == nil {
+				session.releaseHandler()
+			}
+			if err == errGoingAway {
+				session.debug("GOAWAY sent. Refusing stream %d", streamId)
+				return session.refuseStream(streamId)
+			}
+			if e, sendable := err.(*Error); sendable {
+				if err := session.outputW.WriteFrame(e.ToFrame()); err != nil {
+					return err
+				}
+				if session.decreasingStreamId(streamId) {
+					session.debug("Stream %d opened after a higher stream id. Aborting", streamId)
+					return &Error{Err: DecreasingStreamId, StreamId: streamId}
+				}
+				return nil
+			} else {
+				return err
+			}
+		} else {
+			if synStream.CFHeader.Flags&ControlFlagUnidirectional != 0 {
+				stream.setUnidirectional()
+			}
+			if parent, exists := session.getStream(synStream.AssociatedToStreamId); exists {
+				stream.associate(parent)
+			}
+			if accept != nil {
+				accept <- stream
+			} else {
+				go func() {
+					defer session.releaseHandler()
+					stream.Serve(session.handler)
+				}()
+			}
+		}
+	}
+	/* WINDOW_UPDATE: grow the send window of the stream */
+	if update, isWindowUpdate := frame.(*WindowUpdateFrame); isWindowUpdate {
+		if stream, exists := session.getStream(streamId); exists {
+			stream.windowUpdated(update.DeltaWindowSize)
+		} else {
+			session.debug("Ignoring WINDOW_UPDATE on unknown stream %d", streamId)
+		}
+		return nil
+	}
+	streamPeer, exists := session.getStream(streamId)
+	if !exists {
+		session.unknownStream(frame, streamId)
+		return nil
+	}
+	err := streamPeer.WriteFrame(frame)
+	if err != nil {
+		session.debug("Error while passing frame to stream: %s. Closing stream.", err)
+		session.CloseStream(streamId)
+		return err
+	} else if streamPeer.isClosed() {
+		session.debug("Stream %d is fully closed. De-registering", streamId)
+	}
+	return nil
+}
+
+
+/*
+** Handle a frame received for a stream which doesn't exist
+*/
+
+func (session *Session) unknownStream(frame Frame, id uint32) {
+	// Never answer a RST_STREAM with a RST_STREAM
+	if _, isRst := frame.(*RstStreamFrame); isRst {
+		session.debug("Ignoring RST_STREAM for unknown stream %d", id)
+		return
+	}
+	if session.IgnoreUnknownStreams {
+		session.debug("Ignoring frame for unknown stream %d", id)
+		return
+	}
+	session.outputW.WriteFrame(&RstStreamFrame{StreamId: id, Status: InvalidStream})
+}
+
+/*
+** Keep the certificate chain presented by the client in its slot, as is:
+** neither the chain nor the proof is verified
+*/
+
+func (session *Session) storeCredential(frame *CredentialFrame) {
+	slots := session.CredentialSlots
+	if slots == 0 {
+		slots = DefaultCredentialSlots
+	}
+	if !session.Server || frame.Slot == 0 || int(frame.Slot) > slots {
+		session.debug("Ignoring CREDENTIAL for slot %d", frame.Slot)
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.credentials == nil {
+		session.credentials = make(map[uint16]*CredentialFrame)
+	}
+	session.credentials[frame.Slot] = frame
+}
+
+// Credential returns the last CREDENTIAL frame received by a server for
+// `slot`, and whether there was one. The streams opened by the client for
+// the origin of the certificate refer to the slot (see SynStreamFrame.Slot).
+//
+// The frame is returned as received: the certificate chain is NOT verified,
+// and neither is the Proof that the client holds the private key of its
+// certificate. Anyone can present any chain: it must not be used to
+// authenticate the client unless the caller verifies both (the proof is
+// signed over keying material exported from the TLS connection, which the
+// session doesn't see).
+func (session *Session) Credential(slot uint16) (*CredentialFrame, bool) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	frame, received := session.credentials[slot]
+	return frame, received
+}
+
+func (session *Session) applySettings(frame *SettingsFrame) {
+	session.debug("SETTINGS\n")
+	session.persistSettings(frame)
+	session.lock.Lock()
+	if session.peerSettings == nil {
+		session.peerSettings = make(map[SettingsId]uint32)
+	}
+	for _, setting := range frame.FlagIdValues {
+		session.peerSettings[setting.Id] = setting.Value
+	}
+	session.lock.Unlock()
+	for _, setting := range frame.FlagIdValues {
+		switch setting.Id {
+			case SettingsDataPadding:
+				session.padding.setPeerEnabled()
+			case SettingsMaxConcurrentStreams:
+				session.lock.Lock()
+				session.peerMaxStreams = setting.Value
+				session.freeStreamSlot()
+				session.lock.Unlock()
+			case SettingsInitialWindowSize, SettingsPushWindowSize:
+				// Applies to existing streams too, whose window
+				// may become negative
+				session.lock.Lock()
+				if setting.Id == SettingsInitialWindowSize {
+					session.peerInitialWindow = setting.Value
+				} else {
+					session.peerPushWindow = setting.Value
+				}
+				for _, stream := range session.streams {
+					if window := session.initialSendWindow(stream.handle().associated != nil); window != 0 {
+						stream.setInitialSendWindow(window)
+					}
+				}
+				session.lock.Unlock()
+		}
+	}
+}
+
+// SendInitialSettings sends a SETTINGS frame announcing `settings` to the
+// peer. Clients and servers alike must call it before opening their first
+// stream, so that the peer applies the settings to all streams.
+//
+// SETTINGS_INITIAL_WINDOW_SIZE is the receive window of every stream: it also
+// sets ReceiveWindow, so that the streams acknowledge the DATA they consume.
+// A peer which implements flow control won't send more than the window
+// before it is acknowledged. SETTINGS_MAX_CONCURRENT_STREAMS sets
+// MaxConcurrentStreams, so that the streams beyond it are refused.
+func (session *Session) SendInitialSettings(settings ...SettingsFlagIdValue) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.lastStreamIdOut != 0 {
+		return errors.New("Initial SETTINGS must be sent before opening streams")
+	}
+	for _, setting := range settings {
+		switch setting.Id {
+			case SettingsInitialWindowSize:	session.ReceiveWindow = setting.Value
+			case SettingsPushWindowSize:	session.PushReceiveWindow = setting.Value
+			case SettingsMaxConcurrentStreams:	session.MaxConcurrentStreams = int(setting.Value)
+		}
+	}
+	return session.outputW.WriteFrame(&SettingsFrame{FlagIdValues: settings})
+}
+
+// EnableDataPadding announces to the peer, with a non-standard setting, that
+// the session supports padded DATA frames. Once the peer announced it too,
+// the data sent on all streams is padded to a multiple of `blockSize` bytes,
+// to hide its exact size.
+//
+// A padded frame has DataFlagPadded set, and its payload is the length of the
+// data (4 bytes, big-endian), the data, and then zeroes. Padding is removed
+// by Stream.ReadFrame, so it is invisible to the application.
+func (session *Session) EnableDataPadding(blockSize int) error {
+	if blockSize <= 0 || blockSize > MaxDataLength {
+		return fmt.Errorf("Invalid padding block size: %d", blockSize)
+	}
+	session.padding.setLocal(blockSize)
+	return session.outputW.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Id: SettingsDataPadding, Value: uint32(blockSize)},
+	}})
+}
+
+// PingEchoDelay delays the echo of every PING received by `d`, to simulate
+// a slow or distant peer in tests. The delay is measured with the session
+// Clock.
+func (session *Session) PingEchoDelay(d time.Duration) {
+	session.pingEchoDelay = d
+}
+
+func (session *Session) echoPing(frame Frame) {
+	// A PING with our parity is the echo of one of ours: echoing it again
+	// would bounce it forever
+	if id := frame.(*PingFrame).Id; session.isLocalId(id) {
+		session.lock.Lock()
+		echo, waiting := session.pings[id]
+		delete(session.pings, id)
+		session.lock.Unlock()
+		if !waiting {
+			session.debug("Ignoring the echo of unknown PING %d", id)
+			return
+		}
+		session.debug("Received the echo of PING %d", id)
+		close(echo)
+		return
+	}
+	if session.pingEchoDelay <= 0 {
+		session.outputW.WriteFrame(frame)
+		return
+	}
+	timeout := clockOrDefault(session.Clock).After(session.pingEchoDelay)
+	go func() {
+		<-timeout
+		session.outputW.WriteFrame(frame)
+	}()
+}
+
+// ErrPingTimeout is returned by Ping when the echo isn't received in time.
+var ErrPingTimeout = errors.New("timeout awaiting PING echo")
+
+// Ping sends a PING frame, waits for the peer to echo it, and returns the
+// round-trip time measured with the session Clock. It fails with
+// ErrPingTimeout if the echo isn't received within `timeout` (0 means no
+// timeout), and with ErrSessionClosed if the session closes first.
+//
+// The ids of the PINGs sent are increasing, odd for a client and even for
+// a server: echoes of other ids are ignored.
+func (session *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	session.lock.Lock()
+	id := session.lastPingId + 2
+	if session.lastPingId == 0 && !session.Server {
+		id = 1
+	}
+	session.lastPingId = id
+	echo := make(chan struct{})
+	if session.pings == nil {
+		session.pings = make(map[uint32]chan struct{})
+	}
+	session.pings[id] = echo
+	session.lock.Unlock()
+	defer func() {
+		session.lock.Lock()
+		delete(session.pings, id)
+		session.lock.Unlock()
+	}()
+	clock := clockOrDefault(session.Clock)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = clock.After(timeout)
+	}
+	sent := clock.Now()
+	if err := session.outputW.WriteFrame(&PingFrame{Id: id}); err != nil {
+		return 0, err
+	}
+	select {
+		case <-echo:		return clock.Now().Sub(sent), nil
+		case <-expired:		return 0, ErrPingTimeout
+		case <-session.done:	return 0, ErrSessionClosed
+	}
+}
+
+// SessionStats is a snapshot of statistics about a session.
+type SessionStats struct {
+	// Header compression, for frames received and sent.
+	// Only available if the session is served over a Framer.
+	HeadersIn	HeaderStats
+	HeadersOut	HeaderStats
+	// The open streams, by id
+	Streams		map[uint32]StreamStats
+	// The payload sizes of the DATA frames received and sent. Only
+	// available if Session.RecordFrameSizes is set.
+	DataSizesIn	*FrameSizeHistogram
+	DataSizesOut	*FrameSizeHistogram
+}
+
+// The upper bounds (exclusive) of the buckets of a FrameSizeHistogram, in
+// bytes. A last bucket counts the larger frames.
+var frameSizeBounds = [...]int{256, 1024, 4096, 16384}
+
+// FrameSizeHistogram counts frames by payload size: Counts holds the number
+// of frames below 256 bytes, 1KB, 4KB, 16KB and above, each frame being
+// counted in the first bucket it fits. Many small frames hint that writes
+// should be coalesced (see Session.WriteCoalesceDelay and
+// BufferedBodyWriter).
+type FrameSizeHistogram struct {
+	Counts	[len(frameSizeBounds) + 1]uint64
+}
+
+// Total returns the number of frames counted.
+func (h FrameSizeHistogram) Total() uint64 {
+	var total uint64
+	for _, n := range h.Counts {
+		total += n
+	}
+	return total
+}
+
+func (h *FrameSizeHistogram) add(size int) {
+	bucket := len(frameSizeBounds)
+	for i, bound := range frameSizeBounds {
+		if size < bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&h.Counts[bucket], 1)
+}
+
+func (h *FrameSizeHistogram) load() *FrameSizeHistogram {
+	snapshot := new(FrameSizeHistogram)
+	for i := range h.Counts {
+		snapshot.Counts[i] = atomic.LoadUint64(&h.Counts[i])
+	}
+	return snapshot
+}
+
+/*
+** Count `frame` in `histogram` if it is a DATA frame and RecordFrameSizes is
+** set
+*/
+
+func (session *Session) recordFrameSize(histogram *FrameSizeHistogram, frame Frame) {
+	if data, isData := frame.(*DataFrame); isData && session.RecordFrameSizes {
+		histogram.add(len(data.Data))
+	}
+}
+
+// StreamStats is a snapshot of statistics about a stream.
+type StreamStats struct {
+	BytesSent	int64
+	BytesReceived	int64
+	SendWindow	int
+	RecvWindow	int
+}
+
+func (session *Session) Stats() SessionStats {
+	var stats SessionStats
+	session.lock.Lock()
+	framer := session.framer
+	stats.Streams = make(map[uint32]StreamStats, len(session.streams))
+	for id, stream := range session.streams {
+		stats.Streams[id] = StreamStats{
+			BytesSent:	stream.BytesSent(),
+			BytesReceived:	stream.BytesReceived(),
+			SendWindow:	stream.SendWindow(),
+			RecvWindow:	stream.RecvWindow(),
+		}
+	}
+	session.lock.Unlock()
+	if framer != nil {
+		stats.HeadersIn, stats.HeadersOut = framer.HeaderStats()
+	}
+	if session.RecordFrameSizes {
+		stats.DataSizesIn, stats.DataSizesOut = session.dataSizesIn.load(), session.dataSizesOut.load()
+	}
+	return stats
+}
+
+// Serve runs the session over `peer` (typically a Framer on a connection):
+// frames read from the peer are passed to the session, and frames sent by the
+// session are written to the peer.
+//
+// Serve returns when either direction fails, or when the peer closes the
+// connection. Streams which haven't ended by then fail with
+// ErrConnectionClosed, and the session is closed. A connection closed
+// between two frames returns nil; in the middle of a frame, the error of
+// the peer (io.ErrUnexpectedEOF for a Framer). If writing to the peer fails,
+// the error is a *WriteError, which the streams fail with instead of
+// ErrConnectionClosed.
+func (session *Session) Serve(peer ReadWriter) error {
+	if framer, isFramer := peer.(*Framer); isFramer {
+		session.lock.Lock()
+		session.framer = framer
+		session.lock.Unlock()
+	}
+	results := make(chan error, 2)
+	go func() { results <- session.readLoop(peer) }()
+	go func() { results <- session.writeLoop(peer) }()
+	err := <-results
+	if v, isViolation := err.(*ProtocolViolation); isViolation {
+		session.abort(v)
+		// Once the write loop is done, tell the peer why we're leaving,
+		// after the frames queued before the violation (eg. the
+		// RST_STREAM of the offending stream)
+		<-results
+		if err := session.flushOutput(peer); err != nil {
+			session.debug("Can't send the queued frames: %s", err)
+		}
+		goAway := &GoAwayFrame{LastGoodStreamId: session.lastStreamIdIn, Status: v.Status}
+		if err := peer.WriteFrame(goAway); err != nil {
+			session.debug("Can't send GOAWAY: %s", err)
+		}
+		return v
+	}
+	if w, isWrite := err.(*WriteError); isWrite {
+		session.abort(w)
+		return w
+	}
+	session.abort(ErrConnectionClosed)
+	return err
+}
+
+/*
+** Write all the frames left for the peer to `peer`, including those the
+** write loop took from the queue but didn't send yet (see nextFrame). Only
+** once the write loop is done.
+*/
+
+func (session *Session) flushOutput(peer Writer) error {
+	for session.nScheduled() > 0 || len(session.outputR.ch) > 0 {
+		frame, err := session.nextFrame(nil, nil)
+		if err != nil {
+			return nil
+		}
+		if err := peer.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+** Pass all frames read from `peer` to the session
+*/
+
+func (session *Session) readLoop(peer Reader) error {
+	for {
+		frame, err := peer.ReadFrame()
+		if err == io.EOF {
+			session.debug("Connection closed by the peer")
+			return nil
+		} else if e, isProtocol := err.(*Error); isProtocol {
+			session.debug("Invalid frame from the peer: %s", err)
+			return newProtocolViolation(e, nil)
+		} else if err != nil {
+			session.debug("Error reading from the peer: %s", err)
+			return err
+		}
+		if err := session.WriteFrame(frame); err != nil {
+			if e, isProtocol := err.(*Error); isProtocol {
+				return newProtocolViolation(e, frame)
+			}
+			return err
+		}
+	}
+}
+
+/*
+** Write all frames sent by the session to `peer`, until the session is closed
+*/
+
+func (session *Session) writeLoop(peer Writer) error {
+	var buffer *bufio.Writer
+	if session.WriteCoalesceDelay > 0 && session.framer != nil {
+		buffer = bufio.NewWriter(session.framer.w)
+		unbuffered := session.framer.w
+		session.framer.w = buffer
+		defer func() { session.framer.w = unbuffered }()
+	}
+	var buffered []uint32 // The streams whose SYN_STREAM is buffered
+	flush := func() error {
+		if buffer != nil {
+			if err := buffer.Flush(); err != nil {
+				session.debug("Error writing to the peer: %s", err)
+				return newWriteError(err)
+			}
+		}
+		for _, id := range buffered {
+			if peer, exists := session.getStream(id); exists {
+				atomic.StoreInt32(&peer.synWritten, 1)
+			}
+		}
+		buffered = buffered[:0]
+		return nil
+	}
+	var deadline <-chan time.Time // When the buffered frames must be written
+	for {
+		frame, err := session.nextFrame(deadline, session.done)
+		if err == errPipeTimeout {
+			deadline = nil
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		} else if err == errPipeCancelled {
+			if atomic.LoadInt32(&session.drainOutput) != 0 {
+				// Closed by Shutdown: send what is left, typically
+				// the end of the last responses
+				if err := session.flushOutput(peer); err != nil {
+					return newWriteError(err)
+				}
+			}
+			return flush()
+		} else if err != nil {
+			return err
+		}
+		session.recordFrameSize(&session.dataSizesOut, frame)
+		if err := peer.WriteFrame(frame); err != nil {
+			session.debug("Error writing to the peer: %s", err)
+			return newWriteError(err)
+		}
+		if syn, isSyn := frame.(*SynStreamFrame); isSyn {
+			buffered = append(buffered, syn.StreamId)
+		}
+		if buffer == nil {
+			if len(buffered) > 0 {
+				flush()
+			}
+			continue
+		}
+		if isLatencySensitive(frame) {
+			deadline = nil
+			if err := flush(); err != nil {
+				return err
+			}
+		} else if deadline == nil {
+			deadline = clockOrDefault(session.Clock).After(session.WriteCoalesceDelay)
+		}
+	}
+	return nil
+}
+
+/*
+** Frames which are never held back by WriteCoalesceDelay
+*/
+
+func isLatencySensitive(frame Frame) bool {
+	switch frame.(type) {
+		case *SynStreamFrame, *SynReplyFrame, *PingFrame:	return true
+	}
+	return false
+}
+
+/*
+ * Return true if it's legal for `id` to be locally created
+ * (eg. even-numbered if we're the server, odd-numbered if we're the client)
+ */
+func (session *Session) isLocalId(id uint32) bool {
+	if session.Server {
+		return isServerId(id)
+	}
+	return isClientId(id)
+}
+
+/*
+ * Stream ids (and PING ids) chosen by the client are odd, those chosen
+ * by the server are even. 0 is neither.
+ */
+func isClientId(id uint32) bool {
+	return id%2 == 1
+}
+
+func isServerId(id uint32) bool {
+	return id != 0 && id%2 == 0
 }
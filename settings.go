@@ -0,0 +1,102 @@
+package spdy
+
+import (
+	"sync"
+)
+
+// A SettingsStore keeps the settings a server asks a client to persist
+// (with FlagSettingsPersistValue), so that the client sends them back when
+// it connects to the same server again. See Session.SettingsStore.
+type SettingsStore interface {
+	// Load returns the settings persisted for `server`.
+	Load(server string) []SettingsFlagIdValue
+	// Store replaces the settings persisted for `server`. An empty list
+	// clears them.
+	Store(server string, settings []SettingsFlagIdValue)
+}
+
+// MemorySettingsStore is a SettingsStore which keeps the settings in memory,
+// for the lifetime of the process. Its zero value is ready to use.
+type MemorySettingsStore struct {
+	lock		sync.Mutex
+	settings	map[string][]SettingsFlagIdValue
+}
+
+func (s *MemorySettingsStore) Load(server string) []SettingsFlagIdValue {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]SettingsFlagIdValue(nil), s.settings[server]...)
+}
+
+func (s *MemorySettingsStore) Store(server string, settings []SettingsFlagIdValue) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(settings) == 0 {
+		delete(s.settings, server)
+		return
+	}
+	if s.settings == nil {
+		s.settings = make(map[string][]SettingsFlagIdValue)
+	}
+	s.settings[server] = append([]SettingsFlagIdValue(nil), settings...)
+}
+
+/*
+** Save the settings of `frame` which the peer asked to persist, if we are a
+** client with a SettingsStore
+*/
+
+func (session *Session) persistSettings(frame *SettingsFrame) {
+	if session.SettingsStore == nil || session.Server {
+		return
+	}
+	clear := frame.CFHeader.Flags&ControlFlagClearSettings != 0
+	var persisted []SettingsFlagIdValue
+	if !clear {
+		persisted = session.SettingsStore.Load(session.SettingsKey)
+	}
+	changed := clear
+	for _, setting := range frame.FlagIdValues {
+		if setting.Flag&FlagSettingsPersistValue == 0 {
+			continue
+		}
+		changed = true
+		setting.Flag = FlagSettingsPersisted
+		replaced := false
+		for i := range persisted {
+			if persisted[i].Id == setting.Id {
+				persisted[i], replaced = setting, true
+			}
+		}
+		if !replaced {
+			persisted = append(persisted, setting)
+		}
+	}
+	if changed {
+		session.SettingsStore.Store(session.SettingsKey, persisted)
+	}
+}
+
+// SendPersistedSettings sends the settings persisted for the peer in
+// SettingsStore (if any) back to it, with FlagSettingsPersisted. A client
+// calls it when it connects, before opening streams.
+func (session *Session) SendPersistedSettings() error {
+	if session.SettingsStore == nil {
+		return nil
+	}
+	settings := session.SettingsStore.Load(session.SettingsKey)
+	if len(settings) == 0 {
+		return nil
+	}
+	return session.outputW.WriteFrame(&SettingsFrame{FlagIdValues: settings})
+}
+
+// PeerSetting returns the last value of the setting `id` received from the
+// peer, and whether it was received at all. Settings without an effect on
+// the session (such as SETTINGS_UPLOAD_BANDWIDTH) are only recorded.
+func (session *Session) PeerSetting(id SettingsId) (uint32, bool) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	value, received := session.peerSettings[id]
+	return value, received
+}
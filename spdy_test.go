@@ -5,17 +5,35 @@
 package spdy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/base64"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"errors"
+	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -48,16 +66,16 @@ func TestHeaderParsing(t *testing.T) {
 		"Version": []string{"http/1.1"},
 	}
 	var headerValueBlockBuf bytes.Buffer
-	writeHeaderValueBlock(&headerValueBlockBuf, headers)
-
 	const bogusStreamId = 1
-	newHeaders, err := parseHeaderValueBlock(&headerValueBlockBuf, bogusStreamId)
-	if err != nil {
-		t.Fatal("parseHeaderValueBlock:", err)
-	}
-
-	if !reflect.DeepEqual(headers, newHeaders) {
-		t.Fatal("got: ", newHeaders, "\nwant: ", headers)
+	for _, version := range []uint16{2, 3} {
+		writeHeaderValueBlock(&headerValueBlockBuf, headers, version)
+		newHeaders, err := parseHeaderValueBlock(&headerValueBlockBuf, bogusStreamId, version)
+		if err != nil {
+			t.Fatal("parseHeaderValueBlock:", err)
+		}
+		if !reflect.DeepEqual(headers, newHeaders) {
+			t.Fatal("got: ", newHeaders, "\nwant: ", headers)
+		}
 	}
 }
 
@@ -424,7 +442,7 @@ func TestCompressionContextAcrossFrames(t *testing.T) {
 	if err := framer.WriteFrame(&headersFrame); err != nil {
 		t.Fatal("WriteFrame (HEADERS):", err)
 	}
-	synStreamFrame := SynStreamFrame{ControlFrameHeader{Version, TypeSynStream, 0, 0}, 2, 0, 0, nil}
+	synStreamFrame := SynStreamFrame{ControlFrameHeader{Version, TypeSynStream, 0, 0}, 2, 0, 0, 0, nil}
 	synStreamFrame.Headers = http.Header{
 		"Url":     []string{"http://www.google.com/"},
 		"Method":  []string{"get"},
@@ -713,7 +731,8 @@ func TestStream2AfterStream3(t *testing.T) {
 			t.Error("Second client-initiated stream should have ID=3")
 		}
 	}
-	if _, err := SendExpect(s, &SynStreamFrame{StreamId: 2}, nil); err != nil {
+	push := &SynStreamFrame{StreamId: 2, AssociatedToStreamId: 3, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}}
+	if _, err := SendExpect(s, push, nil); err != nil {
 		t.Error(err)
 	}
 }	
@@ -725,11 +744,80 @@ func TestStream7AfterStream9(t *testing.T) {
 	if err := s.WriteFrame(&SynStreamFrame{StreamId:9}); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := SendExpect(s, &SynStreamFrame{StreamId:7}, reflect.TypeOf(&RstStreamFrame{})); err != nil {
-		t.Fatal(err)
+	// The stream is reset, and the session aborted with a protocol error
+	err := s.WriteFrame(&SynStreamFrame{StreamId:7})
+	if e, isError := err.(*Error); !isError || e.Err != DecreasingStreamId {
+		t.Errorf("Stream 7 after stream 9 should be a session error, not %v", err)
+	}
+	frame, err := ReadFrameTimeout(s)
+	if rst, isRst := frame.(*RstStreamFrame); err != nil || !isRst || rst.StreamId != 7 || rst.Status != ProtocolError {
+		t.Errorf("Expected stream 7 to be reset with PROTOCOL_ERROR, not (%v, %v)", frame, err)
 	}
 }	
 
+// A SYN_STREAM with the wrong parity or a repeated id is a stream error, and
+// one with a lower id than a previous one a session error: the session is
+// aborted with GOAWAY.
+func TestStreamIdLegality(t *testing.T) {
+	s := NewSession(new(DummyHandler), true)
+	for _, id := range []uint32{1, 2, 1} {
+		if err := s.WriteFrame(&SynStreamFrame{StreamId: id, Headers: http.Header{"Url": {"/"}}}); err != nil {
+			t.Errorf("SYN_STREAM %d should be a stream error, not %v", id, err)
+		}
+	}
+	for _, id := range []uint32{2, 1} {
+		for {
+			frame, err := s.outputR.readFrame(time.After(time.Second))
+			if err != nil {
+				t.Fatalf("Expected stream %d to be reset: %v", id, err)
+			}
+			if rst, isRst := frame.(*RstStreamFrame); isRst {
+				if rst.StreamId != id || rst.Status != ProtocolError {
+					t.Errorf("Expected stream %d to be reset with PROTOCOL_ERROR, not %v", id, rst)
+				}
+				break
+			}
+		}
+	}
+	if s.Closed() {
+		t.Errorf("Stream errors shouldn't close the session")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	if _, err := Serve(serverConn, new(DummyHandler), true); err != nil {
+		t.Fatal(err)
+	}
+	framer, err := NewFramer(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan Frame, 10)
+	go func() {
+		defer close(received)
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			received <- frame
+		}
+	}()
+	for _, id := range []uint32{5, 3} {
+		if err := framer.WriteFrame(&SynStreamFrame{StreamId: id, Headers: http.Header{"Url": {"/"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for frame := range received {
+		if goAway, isGoAway := frame.(*GoAwayFrame); isGoAway {
+			if goAway.LastGoodStreamId != 5 {
+				t.Errorf("Expected stream 5 to be the last good stream, not %d", goAway.LastGoodStreamId)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected GOAWAY after a decreasing stream id")
+}
+
 //    Stream IDs do not
 //    wrap: when a client or server cannot create a new stream id without
 //    exceeding a 31 bit value, it MUST NOT create a new stream.
@@ -877,6 +965,65 @@ func TestHeadersCrash(t *testing.T) {
 	}
 }
 
+// The input and output of a stream are used by different goroutines: the
+// frame counts and headers checked by one are updated by the other.
+func TestStreamConcurrentInputOutput(t *testing.T) {
+	stream, peer := NewStream(1, false)
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Reply(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// Output: written by the stream, read by the peer
+	go func() {
+		defer close(written)
+		for i := 0; i < 1000; i++ {
+			if err := stream.WriteDataFrame([]byte("x"), false); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1001; i++ {
+			if _, err := peer.ReadFrame(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	// Input: written by the peer, read by the stream
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			headers := http.Header{"A": {fmt.Sprint(i)}, "B": {fmt.Sprint(i)}}
+			if err := peer.WriteFrame(&HeadersFrame{StreamId: 1, Headers: headers}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for done := false; !done; {
+		select {
+			case <-written:	done = true
+			default:
+		}
+		if err := stream.WriteInterim(100, nil); err == nil {
+			t.Fatal("Interim reply sent after the reply")
+		}
+		headers := stream.InputHeaders()
+		if len(headers["A"]) != len(headers["B"]) {
+			t.Fatalf("Partial headers: %v", headers)
+		}
+	}
+	wg.Wait()
+}
+
 func TestBodyWrite(t *testing.T) {
 	data := []byte("hello world\n")
 	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1067,6 +1214,40 @@ func TestSendOneFrame(t *testing.T) {
 	}
 }
 
+func TestCopyN(t *testing.T) {
+	send := func() *PipeReader {
+		r, w := Pipe(10)
+		for i := 0; i < 3; i++ {
+			w.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("hello")})
+		}
+		w.WriteFrame(&NoopFrame{})
+		w.WriteFrame(&DataFrame{StreamId: 1, Flags: DataFlagFin})
+		w.Close()
+		return r
+	}
+	dstR, dstW := Pipe(10)
+	if frames, bytes, err := CopyN(dstW, send()); err != nil || frames != 5 || bytes != 15 {
+		t.Errorf("Expected 5 frames and 15 bytes copied, not (%d, %d, %v)", frames, bytes, err)
+	}
+	if n := len(dstR.ch); n != 5 {
+		t.Errorf("Expected 5 frames in the destination, not %d", n)
+	}
+	// Discarded frames are counted
+	if frames, bytes, err := CopyN(nil, send()); err != nil || frames != 5 || bytes != 15 {
+		t.Errorf("Expected 5 frames and 15 bytes discarded, not (%d, %d, %v)", frames, bytes, err)
+	}
+	// On error, the frames copied so far are counted
+	r, w := Pipe(10)
+	w.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("hello")})
+	w.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("world")})
+	w.WriteFrame(&SynStreamFrame{StreamId: 3})
+	w.WriteFrame(&DataFrame{StreamId: 3, Data: []byte("lost")})
+	failure := errors.New("write failed")
+	if frames, bytes, err := CopyN(&failingPeer{failOn: 3, err: failure}, r); err != failure || frames != 2 || bytes != 10 {
+		t.Errorf("Expected 2 frames and 10 bytes copied before the error, not (%d, %d, %v)", frames, bytes, err)
+	}
+}
+
 func TestCloseWriter(t *testing.T) {
 	r, w := Pipe(1)
 	frame_in := &NoopFrame{}
@@ -1094,6 +1275,89 @@ func TestCloseReader(t *testing.T) {
 	}
 }
 
+// Closing a pipe while frames are written to it makes the writers fail
+// with the error of the pipe, instead of panicking.
+func TestCloseWhileWriting(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		r, w := Pipe(1)
+		var writers sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			writers.Add(1)
+			go func() {
+				defer writers.Done()
+				for {
+					if err := w.WriteFrame(&NoopFrame{}); err != nil {
+						if err != io.ErrClosedPipe {
+							t.Errorf("WriteFrame() on a closed pipe returned %#v instead of ErrClosedPipe", err)
+						}
+						return
+					}
+				}
+			}()
+		}
+		go r.discard()
+		r.Close()
+		writers.Wait()
+	}
+}
+
+// Once a copy of Splice(a, b, false) ends, a and b are closed, and the other
+// copy stops before Splice returns.
+func TestSpliceNoWait(t *testing.T) {
+	a := NewSession(new(DummyHandler), false)
+	b := NewSession(new(DummyHandler), true)
+	before := runtime.NumGoroutine()
+	spliced := Promise(func() error { return Splice(a, b, false) })
+	b.Close()
+	select {
+		case err := <-spliced:
+			if err != nil {
+				t.Errorf("Splice should return nil at the end of a copy, not %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Splice should return once a copy ends")
+	}
+	if !a.Closed() {
+		t.Errorf("Splice should close both ends")
+	}
+	waitFor(t, "the copies to stop", func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// A ReadWriter which reads a single frame, and fails to write with `err`
+type oneFramePeer struct {
+	err	error
+	read	int32
+}
+
+func (p *oneFramePeer) ReadFrame() (Frame, error) {
+	if atomic.AddInt32(&p.read, 1) == 1 {
+		return &NoopFrame{}, nil
+	}
+	return nil, io.EOF
+}
+
+func (p *oneFramePeer) WriteFrame(frame Frame) error {
+	return p.err
+}
+
+// Splice(a, b, true) reports the errors of both directions
+func TestSpliceErrors(t *testing.T) {
+	errA, errB := errors.New("can't write to a"), errors.New("can't write to b")
+	err := Splice(&oneFramePeer{err: errA}, &oneFramePeer{err: errB}, true)
+	if e, isSplice := err.(*SpliceError); !isSplice || e.AtoB != errB || e.BtoA != errA {
+		t.Errorf("Expected both errors, not %v", err)
+	}
+	if err := Splice(&oneFramePeer{}, &oneFramePeer{err: errB}, true); err != errB {
+		t.Errorf("Expected the error from a to b, not %v", err)
+	}
+	if err := Splice(&oneFramePeer{err: errA}, &oneFramePeer{}, true); err != errA {
+		t.Errorf("Expected the error from b to a, not %v", err)
+	}
+	if err := Splice(&oneFramePeer{}, &oneFramePeer{}, true); err != nil {
+		t.Errorf("Expected no error, not %v", err)
+	}
+}
+
 //	[...] The stream-id MUST increase with each new stream.  If an endpoint
 //	receives a SYN_STREAM with a stream id which is less than any
 //	previously received SYN_STREAM, it MUST issue a session error
@@ -1125,3 +1389,5588 @@ func TestRstLoop(t *testing.T) {
 	}
 }
 
+
+func TestRstWithReason(t *testing.T) {
+	stream, peer := NewStream(1, false)
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Reply(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	stream.SendResetReason = true
+	if err := stream.RstWithReason(Cancel, "not interested"); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, isReply := frame.(*SynReplyFrame); !isReply {
+		t.Fatalf("Expected a SYN_REPLY frame, got %#v", frame)
+	}
+	frame, err := peer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers, isHeaders := frame.(*HeadersFrame); !isHeaders {
+		t.Fatalf("Expected a HEADERS frame before RST_STREAM, got %#v", frame)
+	} else if reason := headers.Headers.Get(ResetReasonHeader); reason != "not interested" {
+		t.Errorf("Reset reason should be 'not interested', not '%s'", reason)
+	}
+	frame, err = peer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.Status != Cancel {
+		t.Errorf("Expected RST_STREAM with status CANCEL, got %#v", frame)
+	}
+}
+
+func TestRstWithReasonDisabled(t *testing.T) {
+	stream, peer := NewStream(1, false)
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Reply(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RstWithReason(Cancel, "not interested"); err != nil {
+		t.Fatal(err)
+	}
+	peer.ReadFrame()
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, isRst := frame.(*RstStreamFrame); !isRst {
+		t.Errorf("Reset reason should not be sent unless enabled (got %#v)", frame)
+	}
+}
+
+func TestBufferedBodyWriter(t *testing.T) {
+	stream, peer := NewStream(1, false)
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Reply(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	body := stream.BufferedBodyWriter(64)
+	for i := 0; i < 100; i += 1 {
+		if _, err := body.Write([]byte("01234567")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := body.Write([]byte("too late")); err == nil {
+		t.Error("Writing to a closed BufferedBodyWriter should fail")
+	}
+	peer.ReadFrame() // SYN_REPLY
+	var nFrames, nBytes int
+	for {
+		frame, err := peer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := frame.(*DataFrame)
+		nFrames += 1
+		nBytes += len(data.Data)
+		if len(data.Data) > 64 {
+			t.Errorf("DATA frame is larger than the buffer (%d bytes)", len(data.Data))
+		}
+		if data.GetFinFlag() {
+			break
+		}
+	}
+	if nBytes != 800 {
+		t.Errorf("Sent %d bytes instead of 800", nBytes)
+	}
+	if nFrames != 13 {
+		t.Errorf("100 small writes should be coalesced into 13 DATA frames, not %d", nFrames)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.ResponseHeaderTimeout = 50 * time.Millisecond
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	// The server accepts the stream but never replies
+	if _, err := stream.ReadFrame(); err != ErrResponseHeaderTimeout {
+		t.Fatalf("ReadFrame should time out waiting for SYN_REPLY, returned %#v", err)
+	}
+	if _, err := SendExpect(session, &NoopFrame{}, reflect.TypeOf(&SynStreamFrame{})); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.Status != Cancel {
+		t.Errorf("Client should cancel the stream after timing out, sent %#v", frame)
+	}
+}
+
+func TestResponseHeaderTimeoutReply(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.ResponseHeaderTimeout = time.Second
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&SynReplyFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, isReply := frame.(*SynReplyFrame); !isReply {
+		t.Errorf("Expected SYN_REPLY, received %#v", frame)
+	}
+}
+
+// Measure the cost of setting up the framer of a new session, including
+// the compression contexts.
+func BenchmarkNewFramer(b *testing.B) {
+	headers := http.Header{"Url": {"/"}, "Method": {"GET"}, "Version": {"HTTP/1.1"}}
+	buffer := new(bytes.Buffer)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+		framer, err := NewFramer(buffer, buffer)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := framer.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: headers}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := framer.ReadFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Send a borderline-malformed sequence of frames to a client stream:
+// a repeated SYN_REPLY, then DATA after FLAG_FIN.
+func borderlineExchange(t *testing.T, strict bool) (*Stream, *Stream) {
+	stream, peer := NewStream(1, true)
+	peer.output.strict = strict
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []Frame{
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{"status": {"200"}}},
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{"foo": {"bar"}}},
+		&DataFrame{StreamId: 1, Data: []byte("hello"), Flags: DataFlagFin},
+		&DataFrame{StreamId: 1, Data: []byte("extra")},
+	} {
+		if err := peer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stream, peer
+}
+
+func TestStrictMode(t *testing.T) {
+	_, peer := borderlineExchange(t, true)
+	// Errors are sent before any pending frame, in reverse order
+	for _, status := range []StatusCode{StreamAlreadyClosed, StreamInUse} {
+		frame, err := peer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.Status != status {
+			t.Errorf("Strict mode should reset with status %d, sent %#v", status, frame)
+		}
+	}
+}
+
+func TestLenientMode(t *testing.T) {
+	stream, _ := borderlineExchange(t, false)
+	stream.ReadFrame() // SYN_REPLY
+	if frame, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if headers, isHeaders := frame.(*HeadersFrame); !isHeaders {
+		t.Errorf("Lenient mode should pass a repeated SYN_REPLY as HEADERS, got %#v", frame)
+	} else if headers.Headers["foo"][0] != "bar" {
+		t.Errorf("Headers of the repeated SYN_REPLY were lost: %#v", headers.Headers)
+	}
+	if frame, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if data, isData := frame.(*DataFrame); !isData || string(data.Data) != "hello" {
+		t.Errorf("Expected DATA 'hello', got %#v", frame)
+	}
+	if frame, err := stream.ReadFrame(); err != io.EOF {
+		t.Errorf("Lenient mode should drop frames after FLAG_FIN, got (%#v, %#v)", frame, err)
+	}
+}
+
+func TestStrictModeSession(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		session := NewSession(new(DummyHandler), false)
+		session.StrictMode = strict
+		stream, err := session.InitiateStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.streams[stream.Id].output.strict != strict {
+			t.Errorf("Session.StrictMode=%v was not applied to new streams", strict)
+		}
+	}
+}
+
+func TestHeaderCompressionRatio(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := http.Header{
+		"Url":        {"/images/logo.png"},
+		"Method":     {"GET"},
+		"Version":    {"HTTP/1.1"},
+		"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36"},
+		"Cookie":     {"session=4a7f1a98c4d02fe71d29b1c3a87e2b5f"},
+	}
+	var ratios []float64
+	for i := 0; i < 10; i += 1 {
+		if err := framer.WriteFrame(&SynStreamFrame{StreamId: uint32(2*i + 1), Headers: headers}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := framer.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+		in, out := framer.HeaderStats()
+		if in != out {
+			t.Fatalf("Stats for headers read (%#v) and written (%#v) should be equal", in, out)
+		}
+		ratios = append(ratios, out.Ratio())
+	}
+	if ratios[0] <= 0 {
+		t.Fatalf("Compression ratio should be positive, not %f", ratios[0])
+	}
+	if ratios[9] <= ratios[0] {
+		t.Errorf("Compression ratio should improve as the context warms up (%f -> %f)", ratios[0], ratios[9])
+	}
+}
+
+func TestHeaderCompressor(t *testing.T) {
+	headers := http.Header{
+		"Method":		{"GET"},
+		"Url":			{"/index.html"},
+		"Version":		{"HTTP/1.1"},
+		"Host":			{"www.example.com"},
+		"User-Agent":		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)"},
+		"Accept":		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		"Accept-Encoding":	{"gzip,deflate,sdch"},
+		"Accept-Language":	{"en-US,en;q=0.8"},
+		"Cookie":		{"session=0123456789abcdef"},
+	}
+	for _, version := range []uint16{2, 3} {
+		raw := new(bytes.Buffer)
+		if _, err := writeHeaderValueBlock(raw, headers, version); err != nil {
+			t.Fatal(err)
+		}
+		compressed := new(bytes.Buffer)
+		compressor, err := NewHeaderCompressor(compressed, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sizes []int
+		for i := 0; i < 2; i++ {
+			before := compressed.Len()
+			if _, err := writeHeaderValueBlock(compressor, headers, version); err != nil {
+				t.Fatal(err)
+			}
+			if err := compressor.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, compressed.Len() - before)
+		}
+		// The id of the SPDY/3 dictionary in the zlib header, per the spec
+		if id := binary.BigEndian.Uint32(compressed.Bytes()[2:6]); version == 3 && id != 0xe3c6a7c2 {
+			t.Errorf("The id of the SPDY/3 dictionary should be 0xe3c6a7c2, not %#x", id)
+		}
+		// Without the dictionary, the first block compresses worse
+		plain := new(bytes.Buffer)
+		writer, _ := zlib.NewWriterLevel(plain, zlib.BestCompression)
+		writer.Write(raw.Bytes())
+		writer.Flush()
+		if sizes[0] >= plain.Len() || sizes[0] >= raw.Len() {
+			t.Errorf("SPDY/%d: compressed to %d bytes, %d without the dictionary, %d raw", version, sizes[0], plain.Len(), raw.Len())
+		}
+		// The second block is compressed in the context of the first
+		if sizes[1] >= sizes[0] {
+			t.Errorf("SPDY/%d: the second block should compress better than the first (%d bytes, then %d)", version, sizes[0], sizes[1])
+		}
+		decompressor := NewHeaderDecompressor(version)
+		input := bytes.NewReader(compressed.Bytes())
+		for _, size := range sizes {
+			reader, err := decompressor.Decompress(input, int64(size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err := parseHeaderValueBlock(reader, 1, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decompressed, headers) {
+				t.Errorf("SPDY/%d: decompressed %v, not %v", version, decompressed, headers)
+			}
+			if n := decompressor.Remaining(); n != 0 {
+				t.Errorf("SPDY/%d: %d bytes of the block were left", version, n)
+			}
+		}
+	}
+}
+
+// The SPDY/3 dictionary holds the names as a SPDY/3 header block encodes
+// them, with 32 bit lengths, so that blocks compress against it.
+func TestHeaderDictionaryV3(t *testing.T) {
+	for _, name := range []string{"accept", "content-type", "user-agent", "host"} {
+		block := new(bytes.Buffer)
+		if _, err := writeHeaderValueBlock(block, http.Header{name: {""}}, 3); err != nil {
+			t.Fatal(err)
+		}
+		// Skip the count: the name follows, with its length
+		if encoded := block.Bytes()[4:8+len(name)]; !bytes.Contains(headerDictionaryV3, encoded) {
+			t.Errorf("%q isn't in the dictionary as %x", name, encoded)
+		}
+	}
+	// A compressed block is the SPDY/3 layout for any zlib with the dictionary
+	compressed := new(bytes.Buffer)
+	compressor, err := NewHeaderCompressor(compressed, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeHeaderValueBlock(compressor, http.Header{"Accept": {"*/*"}}, 3); err != nil {
+		t.Fatal(err)
+	}
+	compressor.Flush()
+	reader, err := zlib.NewReaderDict(compressed, headerDictionaryV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte("\x00\x00\x00\x01\x00\x00\x00\x06accept\x00\x00\x00\x03*/*")
+	block := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, block); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, expected) {
+		t.Errorf("Decompressed %q, not %q", block, expected)
+	}
+}
+
+// Fail if two of `sessions` share a compression context: zlib contexts are
+// streaming, so a shared one corrupts the header blocks of both sessions.
+func checkCompressionContexts(t *testing.T, sessions []*Session) {
+	seen := make(map[interface{}]int)
+	for i, session := range sessions {
+		session.lock.Lock()
+		framer := session.framer
+		session.lock.Unlock()
+		if framer == nil {
+			t.Fatalf("Session %d isn't served by a Framer", i)
+		}
+		for _, context := range []interface{}{framer.headerCompressor, framer.headerDecompressor} {
+			if context == nil {
+				continue
+			}
+			if j, shared := seen[context]; shared {
+				t.Errorf("Sessions %d and %d share a compression context", j, i)
+			}
+			seen[context] = i
+		}
+	}
+}
+
+// Sessions opened with the same Framing each have their own compression
+// contexts, so headers sent on several sessions concurrently decode
+// correctly.
+func TestCompressionContextIsolation(t *testing.T) {
+	handler := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo", r.Header.Get("X-Request"))
+	}))
+	var lock sync.Mutex
+	var sessions []*Session
+	transports := make([]*Transport, 2)
+	for i := range transports {
+		transports[i] = &Transport{
+			Framing:	SPDY3,
+			Dial: func(network, addr string) (net.Conn, error) {
+				clientConn, serverConn := net.Pipe()
+				server, err := ServeFraming(serverConn, handler, true, SPDY3)
+				if err != nil {
+					return nil, err
+				}
+				lock.Lock()
+				sessions = append(sessions, server)
+				lock.Unlock()
+				return clientConn, nil
+			},
+		}
+		defer transports[i].CloseIdleConnections()
+	}
+	var requests sync.WaitGroup
+	for i, transport := range transports {
+		requests.Add(1)
+		go func(i int, transport *Transport) {
+			defer requests.Done()
+			for j := 0; j < 50; j++ {
+				value := strings.Repeat(fmt.Sprintf("session %d request %d;", i, j), j % 7 + 1)
+				req := &http.Request{
+					Method:	"GET",
+					URL:	&url.URL{Scheme: "http", Host: "example.com", Path: fmt.Sprintf("/%d/%d", i, j)},
+					Header:	http.Header{"X-Request": {value}},
+				}
+				resp, err := transport.RoundTrip(req)
+				if err != nil {
+					t.Errorf("Session %d request %d: %s", i, j, err)
+					return
+				}
+				resp.Body.Close()
+				if echo := resp.Header.Get("X-Echo"); echo != value {
+					t.Errorf("Session %d request %d: received %q instead of %q", i, j, echo, value)
+					return
+				}
+			}
+		}(i, transport)
+	}
+	requests.Wait()
+	for _, transport := range transports {
+		transport.lock.Lock()
+		for _, session := range transport.sessions {
+			sessions = append(sessions, session.Session)
+		}
+		transport.lock.Unlock()
+	}
+	if len(sessions) != 4 {
+		t.Fatalf("Expected 2 sessions on each side, not %d in all", len(sessions))
+	}
+	checkCompressionContexts(t, sessions)
+}
+
+func TestSessionHeaderStats(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(ioutil.Discard, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := NewFramer(buffer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"Url": {"/"}}}); err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(new(DummyHandler), true)
+	go session.Serve(framer)
+	for i := 0; session.Stats().HeadersIn.Uncompressed == 0; i += 1 {
+		if i > 100 {
+			t.Fatal("Session.Stats() did not account for received headers")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFrameSizeHistogram(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	if stats := session.Stats(); stats.DataSizesIn != nil || stats.DataSizesOut != nil {
+		t.Errorf("Frame sizes should only be recorded if RecordFrameSizes is set")
+	}
+	session.RecordFrameSizes = true
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{10, 300, 300, 2000, 5000, 20000} {
+		if err := stream.WriteDataFrame(make([]byte, size), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := session.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := []Frame{
+		&SynReplyFrame{StreamId: 1},
+		&DataFrame{StreamId: 1},
+		&DataFrame{StreamId: 1, Data: make([]byte, 1023)},
+		&DataFrame{StreamId: 1, Data: make([]byte, 1024)},
+	}
+	for _, frame := range frames {
+		if err := session.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := session.Stats()
+	if counts := stats.DataSizesOut.Counts; counts != [5]uint64{1, 2, 1, 1, 1} {
+		t.Errorf("Unexpected sizes of DATA frames sent: %v", counts)
+	}
+	if counts := stats.DataSizesIn.Counts; counts != [5]uint64{1, 1, 1, 0, 0} {
+		t.Errorf("Unexpected sizes of DATA frames received: %v", counts)
+	}
+	if total := stats.DataSizesOut.Total(); total != 6 {
+		t.Errorf("6 DATA frames were sent, not %d", total)
+	}
+}
+
+func TestMockClock(t *testing.T) {
+	clock := NewMockClock(time.Unix(0, 0))
+	timer := clock.NewTimer(time.Minute)
+	after := clock.After(time.Hour)
+	clock.Advance(59 * time.Second)
+	select {
+		case <-timer.C(): t.Fatal("Timer fired too early")
+		default:
+	}
+	clock.Advance(time.Second)
+	select {
+		case now := <-timer.C(): if !now.Equal(time.Unix(60, 0)) { t.Errorf("Timer fired at %v", now) }
+		default: t.Fatal("Timer didn't fire after advancing the clock")
+	}
+	if timer.Stop() {
+		t.Error("Stop() should return false for a timer which already fired")
+	}
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop() should return true for a pending timer")
+	}
+	clock.Advance(time.Hour)
+	select {
+		case <-stopped.C(): t.Error("Stopped timer fired")
+		default:
+	}
+	select {
+		case <-after:
+		default: t.Error("After() didn't fire after advancing the clock")
+	}
+}
+
+func TestResponseHeaderTimeoutMockClock(t *testing.T) {
+	clock := NewMockClock(time.Now())
+	session := NewSession(new(DummyHandler), false)
+	session.Clock = clock
+	session.ResponseHeaderTimeout = time.Hour
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	result := Promise(func() error { _, err := stream.ReadFrame(); return err })
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	select {
+		case err := <-result: if err != ErrResponseHeaderTimeout { t.Errorf("ReadFrame returned %#v", err) }
+		case <-time.After(time.Second): t.Fatal("Advancing the mock clock didn't trigger the timeout")
+	}
+}
+
+func TestPushTree(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []Frame{
+		&SynReplyFrame{StreamId: 1},
+		&SynStreamFrame{StreamId: 2, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}},
+		&SynStreamFrame{StreamId: 4, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}},
+		&SynStreamFrame{StreamId: 6, AssociatedToStreamId: 2, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}},
+	} {
+		if err := session.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stream.Associated() != nil {
+		t.Errorf("Stream 1 was not pushed, but is associated to %#v", stream.Associated())
+	}
+	pushes := stream.Pushes()
+	if len(pushes) != 2 || pushes[0].Id != 2 || pushes[1].Id != 4 {
+		t.Fatalf("Stream 1 should have pushes [2 4], not %v", pushes)
+	}
+	if pushes[0].Associated() != stream {
+		t.Errorf("Stream 2 should be associated to stream 1")
+	}
+	grandchildren := pushes[0].Pushes()
+	if len(grandchildren) != 1 || grandchildren[0].Id != 6 {
+		t.Fatalf("Stream 2 should have pushes [6], not %v", grandchildren)
+	}
+	// Closing a stream removes it from the tree
+	session.CloseStream(2)
+	if pushes := stream.Pushes(); len(pushes) != 1 || pushes[0].Id != 4 {
+		t.Errorf("After closing stream 2, stream 1 should have pushes [4], not %v", pushes)
+	}
+	if grandchildren[0].Associated() != nil {
+		t.Errorf("After closing stream 2, stream 6 should not be associated")
+	}
+}
+
+func TestWriteInterim(t *testing.T) {
+	client, clientPeer := NewStream(1, true)
+	server, serverPeer := NewStream(1, false)
+	var interims []int
+	var hints http.Header
+	client.OnInterim = func(status int, headers http.Header) {
+		interims = append(interims, status)
+		hints = headers
+	}
+	if err := client.Syn(&http.Header{"Url": {"/"}}, true); err != nil {
+		t.Fatal(err)
+	}
+	syn, err := clientPeer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serverPeer.WriteFrame(syn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WriteInterim(103, http.Header{"Link": {"</style.css>; rel=preload"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Reply(&http.Header{"Status": {"200"}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WriteInterim(100, nil); err == nil {
+		t.Errorf("WriteInterim after the final reply should fail")
+	}
+	// Relay the reply to the client
+	for _, expected := range []reflect.Type{reflect.TypeOf(&SynReplyFrame{}), reflect.TypeOf(&HeadersFrame{})} {
+		frame, err := serverPeer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.TypeOf(frame) != expected {
+			t.Fatalf("Expected %s on the wire, not %#v", expected, frame)
+		}
+		if err := clientPeer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reply.(*SynReplyFrame); !ok {
+		t.Fatalf("The final reply should be read as SYN_REPLY, not %#v", reply)
+	}
+	if status := reply.GetHeaders().Get("status"); status != "200" {
+		t.Errorf("Final status should be 200, not %s", status)
+	}
+	if !reflect.DeepEqual(interims, []int{103}) {
+		t.Errorf("Expected interim replies [103], not %v", interims)
+	}
+	if link := hints.Get("Link"); link != "</style.css>; rel=preload" {
+		t.Errorf("Wrong Link header in early hints: %q", link)
+	}
+	if status := clientPeer.output.Headers.Get("status"); status != "200" {
+		t.Errorf("Interim replies should not be stored with the stream headers (status=%s)", status)
+	}
+}
+
+func TestUnknownDataFlags(t *testing.T) {
+	// DATA frame on stream 1 with FLAG_FIN and an unknown flag (0x80)
+	raw := []byte{0x00, 0x00, 0x00, 0x01, 0x81, 0x00, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	framer, err := NewFramer(ioutil.Discard, bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatalf("A DATA frame with unknown flags should be accepted: %s", err)
+	}
+	data, ok := frame.(*DataFrame)
+	if !ok {
+		t.Fatalf("Expected a DataFrame, not %#v", frame)
+	}
+	if data.Flags != 0x81 || !data.GetFinFlag() || string(data.Data) != "hello" {
+		t.Errorf("Wrong frame: %#v", data)
+	}
+	// The stream doesn't mind the unknown flag either
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []Frame{&SynReplyFrame{StreamId: 1}, data} {
+		if err := peer.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.ReadFrame()
+	if f, err := stream.ReadFrame(); err != nil || !f.GetFinFlag() {
+		t.Errorf("Expected the DATA frame with FIN, not %#v (err=%v)", f, err)
+	}
+	// Unknown flags are never sent
+	buffer := new(bytes.Buffer)
+	framer, err = NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := framer.WriteFrame(&DataFrame{StreamId: 1, Flags: 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	if flags := buffer.Bytes()[4]; flags != byte(knownDataFlags) {
+		t.Errorf("Expected flags %#x on the wire, not %#x", knownDataFlags, flags)
+	}
+}
+
+func TestServerPush(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	server, err := Serve(serverConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := w.(*ResponseWriter).Push(&http.Header{"Url": {"/style.css"}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := push.WriteDataFrame([]byte("body {}"), true); err != nil {
+			t.Error(err)
+		}
+		fmt.Fprint(w, "hello")
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := NewSession(new(DummyHandler), false)
+	client.EnableAccept(1)
+	framer, err := NewFramer(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve(framer)
+	defer client.Close()
+	stream, err := client.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := http.Header{"Method": {"GET"}, "Url": {"/"}, "Version": {"HTTP/1.1"}}
+	if err := stream.Syn(&headers, true); err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := client.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Id != 2 || pushed.Associated() != stream || !pushed.Unidirectional() {
+		t.Errorf("Expected stream 2, unidirectional and associated to stream 1, not stream %d associated to %v (unidirectional=%v)", pushed.Id, pushed.Associated(), pushed.Unidirectional())
+	}
+	body, err := ioutil.ReadAll(pushed.BodyReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url := pushed.InputHeaders().Get("Url"); url != "/style.css" || string(body) != "body {}" {
+		t.Errorf("Expected /style.css with \"body {}\", not %s with %q", url, body)
+	}
+	if body, err := ioutil.ReadAll(stream.BodyReader()); err != nil || string(body) != "hello" {
+		t.Errorf("Expected the response \"hello\", not %q (%v)", body, err)
+	}
+
+	// A client resets invalid pushes with PROTOCOL_ERROR
+	client = NewSession(new(DummyHandler), false)
+	client.EnableAccept(2)
+	if _, err := client.InitiateStream(); err != nil {
+		t.Fatal(err)
+	}
+	unidirectional := ControlFrameHeader{Flags: ControlFlagUnidirectional}
+	for _, push := range []*SynStreamFrame{
+		{StreamId: 2, AssociatedToStreamId: 3, CFHeader: unidirectional},
+		{StreamId: 4, CFHeader: unidirectional},
+		{StreamId: 6, AssociatedToStreamId: 1},
+	} {
+		frame, err := SendExpect(client, push, reflect.TypeOf(new(RstStreamFrame)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst := frame.(*RstStreamFrame); rst.StreamId != push.StreamId || rst.Status != ProtocolError {
+			t.Errorf("Expected RST_STREAM (PROTOCOL_ERROR) for %#v, not %#v", push, rst)
+		}
+	}
+	if n := len(client.acceptQueue()); n != 0 {
+		t.Errorf("Invalid pushes shouldn't be accepted, but %d were", n)
+	}
+}
+
+func TestMaxPushesPerStream(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.MaxPushesPerStream = 2
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []Frame{
+		&SynReplyFrame{StreamId: 1},
+		&SynStreamFrame{StreamId: 2, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}},
+		&SynStreamFrame{StreamId: 4, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}},
+		&SynStreamFrame{StreamId: 6, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}},
+	} {
+		if err := session.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Once a push completes, there is room for another one
+	session.CloseStream(2)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 8, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}}); err != nil {
+		t.Fatal(err)
+	}
+	refused := []uint32{}
+	for {
+		frame, err := ReadFrameTimeout(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame == nil {
+			break
+		}
+		if rst, isRst := frame.(*RstStreamFrame); isRst && rst.Status == RefusedStream {
+			refused = append(refused, rst.StreamId)
+		}
+	}
+	if !reflect.DeepEqual(refused, []uint32{6}) {
+		t.Errorf("Only stream 6 should have been refused, not %v", refused)
+	}
+	pushes := stream.Pushes()
+	if len(pushes) != 2 || pushes[0].Id != 4 || pushes[1].Id != 8 {
+		t.Errorf("Stream 1 should have pushes [4 8], not %v", pushes)
+	}
+}
+
+func TestSynStreamPriority(t *testing.T) {
+	type testCase struct {
+		version  uint16
+		priority uint16
+		slot     uint8
+		word     uint16
+	}
+	tests := []testCase{
+		{2, 0, 0, 0x0000},
+		{2, 1, 0, 0x4000},
+		{2, 2, 0, 0x8000},
+		{2, 3, 0, 0xc000},
+	}
+	for priority := uint16(0); priority <= 7; priority++ {
+		for _, slot := range []uint8{0, 1, 0x7f, 0xff} {
+			tests = append(tests, testCase{3, priority, slot, priority<<13 | uint16(slot)})
+		}
+	}
+	for _, test := range tests {
+		buffer := new(bytes.Buffer)
+		framer, err := NewFramer(buffer, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		framer.version = test.version
+		frame := &SynStreamFrame{StreamId: 1, Priority: test.priority, Slot: test.slot, Headers: http.Header{}}
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatalf("v%d priority=%d slot=%d: %s", test.version, test.priority, test.slot, err)
+		}
+		// Control frame header (8 bytes), stream id, associated stream id
+		if word := uint16(buffer.Bytes()[16])<<8 | uint16(buffer.Bytes()[17]); word != test.word {
+			t.Errorf("v%d priority=%d slot=%d: encoded as %#04x, not %#04x", test.version, test.priority, test.slot, word, test.word)
+		}
+		parsed, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		synStream := parsed.(*SynStreamFrame)
+		if synStream.Priority != test.priority || synStream.Slot != test.slot {
+			t.Errorf("v%d priority=%d slot=%d: decoded priority=%d slot=%d", test.version, test.priority, test.slot, synStream.Priority, synStream.Slot)
+		}
+	}
+	// Priorities which don't fit are rejected
+	for version, priority := range map[uint16]uint16{2: 4, 3: 8} {
+		framer, err := NewFramer(ioutil.Discard, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		framer.version = version
+		if err := framer.WriteFrame(&SynStreamFrame{StreamId: 1, Priority: priority}); err == nil {
+			t.Errorf("v%d: priority %d should be rejected", version, priority)
+		}
+	}
+}
+
+func TestRawFramer(t *testing.T) {
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Headers: http.Header{"Url": {"/"}, "Method": {"GET"}}},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&PingFrame{Id: 42},
+		&HeadersFrame{StreamId: 1, Headers: http.Header{"Foo": {"bar"}}},
+	}
+	wire := new(bytes.Buffer)
+	writer, err := NewFramer(wire, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded [][]byte
+	for _, frame := range frames {
+		offset := wire.Len()
+		if err := writer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, append([]byte(nil), wire.Bytes()[offset:]...))
+	}
+	reader, err := NewRawFramer(ioutil.Discard, wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Forward everything raw to another connection
+	forwarded := new(bytes.Buffer)
+	for i := range frames {
+		frame, err := reader.ReadRawFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame.Raw, encoded[i]) {
+			t.Errorf("Frame %d: raw bytes %v, expected %v", i, frame.Raw, encoded[i])
+		}
+		if reflect.TypeOf(frame.Frame) != reflect.TypeOf(frames[i]) {
+			t.Errorf("Frame %d: parsed as %#v", i, frame.Frame)
+		}
+		forwarded.Write(frame.Raw)
+	}
+	// The other end can decode the forwarded frames
+	peer, err := NewFramer(ioutil.Discard, forwarded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range frames {
+		frame, err := peer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Frame %d: %s", i, err)
+		}
+		if headers := frame.GetHeaders(); headers != nil && !reflect.DeepEqual(*headers, *frames[i].GetHeaders()) {
+			t.Errorf("Frame %d: headers %v, expected %v", i, *headers, *frames[i].GetHeaders())
+		}
+	}
+}
+
+func TestFinOnClose(t *testing.T) {
+	// Local stream: a FIN is synthesized after the SYN_STREAM
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*SynStreamFrame); !ok {
+		t.Fatalf("Expected SYN_STREAM, not %#v", frame)
+	}
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if data, ok := frame.(*DataFrame); !ok || !data.GetFinFlag() || len(data.Data) != 0 {
+		t.Fatalf("Expected an empty DATA frame with FIN, not %#v", frame)
+	}
+	if frame, err := peer.ReadFrame(); err == nil {
+		t.Errorf("Expected the end of the stream, not %#v", frame)
+	}
+	// Remote stream which never replied: it is cancelled
+	stream, peer = NewStream(2, false)
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 2}); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if rst, ok := frame.(*RstStreamFrame); !ok || rst.Status != Cancel {
+		t.Fatalf("Expected RST_STREAM (CANCEL), not %#v", frame)
+	}
+	// Stream already half-closed: nothing more is sent
+	stream, peer = NewStream(3, true)
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*SynStreamFrame); !ok {
+		t.Fatalf("Expected SYN_STREAM, not %#v", frame)
+	}
+	if frame, err := peer.ReadFrame(); err == nil {
+		t.Errorf("Expected the end of the stream, not %#v", frame)
+	}
+	// Disabled
+	stream, peer = NewStream(5, true)
+	stream.FinOnClose = false
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*SynStreamFrame); !ok {
+		t.Fatalf("Expected SYN_STREAM, not %#v", frame)
+	}
+	if frame, err := peer.ReadFrame(); err == nil {
+		t.Errorf("FinOnClose=false: expected the end of the stream, not %#v", frame)
+	}
+}
+
+type lineLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *lineLogger) Printf(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestSetLogger(t *testing.T) {
+	logged := func(logger *lineLogger, substr string) bool {
+		logger.lock.Lock()
+		defer logger.lock.Unlock()
+		for _, line := range logger.lines {
+			if strings.Contains(line, substr) {
+				return true
+			}
+		}
+		return false
+	}
+	logger := &lineLogger{}
+	SetLogger(logger)
+	defer SetLogger(nil)
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !logged(logger, "Passing") {
+		t.Errorf("Writing a frame should be logged to the package logger")
+	}
+	// A session logger takes precedence
+	own := &lineLogger{}
+	session = NewSession(new(DummyHandler), false)
+	session.Logger = own
+	if err := session.WriteFrame(&NoopFrame{}); err != nil {
+		t.Fatal(err)
+	}
+	if !logged(own, "NOOP") {
+		t.Errorf("Session messages should go to the session logger")
+	}
+	// Without a logger (and without DEBUG), nothing is output
+	if DEBUG || os.Getenv("DEBUG") != "" {
+		t.Skip("DEBUG is set")
+	}
+	SetLogger(nil)
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	stream, _ = NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("Expected no output without a logger, not %q", output.String())
+	}
+}
+
+func TestStreamLogger(t *testing.T) {
+	logger := &lineLogger{}
+	session := NewSession(new(DummyHandler), false)
+	session.Logger = logger
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Logger().Printf("hello %s", "world")
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if len(logger.lines) < 2 {
+		t.Fatalf("Expected at least 2 lines, not %v", logger.lines)
+	}
+	if logger.lines[0] != "[STREAM 1 local] hello world" {
+		t.Errorf("Wrong log line: %q", logger.lines[0])
+	}
+	for _, line := range logger.lines {
+		if !strings.HasPrefix(line, "[STREAM 1 local] ") {
+			t.Errorf("Log line is not attributed to stream 1: %q", line)
+		}
+	}
+}
+
+func TestPingEchoDelay(t *testing.T) {
+	const pingTimeout = time.Second
+	clock := NewMockClock(time.Unix(0, 0))
+	session := NewSession(new(DummyHandler), true)
+	session.Clock = clock
+	session.PingEchoDelay(pingTimeout - time.Millisecond)
+	sent := clock.Now()
+	if err := session.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(pingTimeout - 2*time.Millisecond)
+	if frame, err := session.outputR.readFrame(time.After(100 * time.Millisecond)); err != errPipeTimeout {
+		t.Fatalf("The echo should be delayed, but received %#v", frame)
+	}
+	clock.Advance(time.Millisecond)
+	frame, err := session.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping, ok := frame.(*PingFrame); !ok || ping.Id != 1 {
+		t.Fatalf("Expected the PING echo, not %#v", frame)
+	}
+	if rtt := clock.Now().Sub(sent); rtt >= pingTimeout {
+		t.Errorf("The echo arrived after the timeout (%v)", rtt)
+	}
+	if session.Closed() {
+		t.Errorf("The session should still be alive")
+	}
+}
+
+func TestPing(t *testing.T) {
+	// Over a connection, both ends can measure the round-trip time
+	clientConn, serverConn := net.Pipe()
+	server, err := Serve(serverConn, new(DummyHandler), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Serve(clientConn, new(DummyHandler), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, session := range []*Session{client, server, client} {
+		if rtt, err := session.Ping(time.Second); err != nil || rtt <= 0 {
+			t.Errorf("Ping from the server=%v end returned (%v, %v)", session.Server, rtt, err)
+		}
+	}
+	if client.lastPingId != 3 || server.lastPingId != 2 {
+		t.Errorf("Unexpected PING ids: %d from the client, %d from the server", client.lastPingId, server.lastPingId)
+	}
+
+	// Echoes of other PINGs are ignored
+	clock := NewMockClock(time.Unix(0, 0))
+	session := NewSession(new(DummyHandler), false)
+	session.Clock = clock
+	type result struct {
+		rtt	time.Duration
+		err	error
+	}
+	results := make(chan result, 1)
+	go func() {
+		rtt, err := session.Ping(time.Second)
+		results <- result{rtt, err}
+	}()
+	frame, err := session.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping, isPing := frame.(*PingFrame)
+	if !isPing || ping.Id != 1 {
+		t.Fatalf("Expected PING 1, not %v", frame)
+	}
+	for _, id := range []uint32{3, 5} {
+		if err := session.WriteFrame(&PingFrame{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(10 * time.Millisecond)
+	select {
+		case r := <-results:	t.Fatalf("Ping returned (%v, %v) on the echo of another PING", r.rtt, r.err)
+		case <-time.After(50 * time.Millisecond):
+	}
+	if err := session.WriteFrame(ping); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-results; r.err != nil || r.rtt != 10 * time.Millisecond {
+		t.Errorf("Expected a round-trip time of 10ms, not (%v, %v)", r.rtt, r.err)
+	}
+
+	// Without an echo, Ping times out
+	go func() {
+		rtt, err := session.Ping(time.Second)
+		results <- result{rtt, err}
+	}()
+	if frame, err := session.ReadFrame(); err != nil || frame.(*PingFrame).Id != 3 {
+		t.Fatalf("Expected PING 3, not (%v, %v)", frame, err)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if r := <-results; r.err != ErrPingTimeout {
+		t.Errorf("Expected ErrPingTimeout, not (%v, %v)", r.rtt, r.err)
+	}
+}
+
+func TestStreamIdParity(t *testing.T) {
+	for _, c := range []struct {
+		id		uint32
+		client, server	bool
+	}{
+		{0, false, false},
+		{1, true, false},
+		{2, false, true},
+		{3, true, false},
+		{0x7ffffffe, false, true},
+		{0x7fffffff, true, false},
+	} {
+		if isClientId(c.id) != c.client {
+			t.Errorf("isClientId(%d) should be %v", c.id, c.client)
+		}
+		if isServerId(c.id) != c.server {
+			t.Errorf("isServerId(%d) should be %v", c.id, c.server)
+		}
+		if NewSession(nil, false).isLocalId(c.id) != c.client {
+			t.Errorf("A client should see %d as local: %v", c.id, c.client)
+		}
+		if NewSession(nil, true).isLocalId(c.id) != c.server {
+			t.Errorf("A server should see %d as local: %v", c.id, c.server)
+		}
+	}
+	// A server echoes the client's pings, but not the echo of its own
+	session := NewSession(new(DummyHandler), true)
+	if err := session.WriteFrame(&PingFrame{Id: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping, ok := frame.(*PingFrame); !ok || ping.Id != 1 {
+		t.Fatalf("Expected the echo of PING 1, not %#v", frame)
+	}
+	if n := session.Pending(); n != 0 {
+		t.Errorf("The echo of our own PING shouldn't be echoed back (%d frames pending)", n)
+	}
+}
+
+func TestSlowBodyReader(t *testing.T) {
+	const window = 16384
+	stream, peer := NewStream(1, false)
+	stream.ReceiveWindow = window
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	chunk := bytes.Repeat([]byte{'x'}, 4096)
+	for i := 0; i < 16; i++ {
+		var flags DataFlags
+		if i == 15 {
+			flags = DataFlagFin
+		}
+		if err := peer.WriteFrame(&DataFrame{StreamId: 1, Data: chunk, Flags: flags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := stream.ParseHTTPRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := req.Body.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is prefetched beyond the first DATA frame
+	if n := stream.input.NFrames; n != 2 {
+		t.Errorf("Reading 1 byte should pull 2 frames (SYN_STREAM and DATA), not %d", n)
+	}
+	total := 1
+	for {
+		n, err := req.Body.Read(b)
+		total += n
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != 16*4096 {
+		t.Fatalf("Read %d bytes instead of %d", total, 16*4096)
+	}
+	// Reading 1 byte at a time still sends one WINDOW_UPDATE per half window
+	updates, acked := 0, 0
+	for {
+		frame, err := peer.input.readFrame(time.After(10 * time.Millisecond))
+		if err != nil {
+			break
+		}
+		if update, ok := frame.(*WindowUpdateFrame); ok {
+			updates += 1
+			acked += int(update.DeltaWindowSize)
+		}
+	}
+	if updates != 16*4096/(window/2) || acked != 16*4096 {
+		t.Errorf("Expected %d WINDOW_UPDATE frames acknowledging %d bytes, not %d frames acknowledging %d bytes",
+			16*4096/(window/2), 16*4096, updates, acked)
+	}
+}
+
+// The padding of DATA frames counts towards the receive window, and is
+// acknowledged along with the data read.
+func TestPaddedBodyWindow(t *testing.T) {
+	const window = 16384
+	const blockSize = 1024
+	stream, peer := NewStream(1, false)
+	stream.ReceiveWindow = window
+	stream.padding = &padding{local: blockSize}
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Several windows of padded frames, carrying little data
+	chunk := bytes.Repeat([]byte{'x'}, 100)
+	const frames = 4 * window / blockSize
+	for i := 0; i < frames; i++ {
+		var flags DataFlags
+		if i == frames - 1 {
+			flags = DataFlagFin
+		}
+		if err := peer.WriteFrame(padDataFrame(&DataFrame{StreamId: 1, Data: chunk, Flags: flags}, blockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := stream.ParseHTTPRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != frames*len(chunk) {
+		t.Fatalf("Read %d bytes instead of %d", len(body), frames*len(chunk))
+	}
+	acked := 0
+	for {
+		frame, err := peer.input.readFrame(time.After(10 * time.Millisecond))
+		if err != nil {
+			break
+		}
+		if update, ok := frame.(*WindowUpdateFrame); ok {
+			acked += int(update.DeltaWindowSize)
+		}
+	}
+	if unacked := window - stream.RecvWindow(); unacked >= window/2 || acked + unacked != frames*blockSize {
+		t.Errorf("Expected %d bytes acknowledged but for less than half the window, not %d (%d unacknowledged)",
+			frames*blockSize, acked, unacked)
+	}
+}
+
+func TestSetNextStreamId(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	if err := session.SetNextStreamId(101); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []uint32{101, 103} {
+		stream, err := session.InitiateStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.Id != expected {
+			t.Errorf("Expected stream id %d, not %d", expected, stream.Id)
+		}
+	}
+	// Wrong parity, already used, zero, or out of range
+	for _, id := range []uint32{0, 104, 99, 103, 0x80000001} {
+		if err := session.SetNextStreamId(id); err == nil {
+			t.Errorf("SetNextStreamId(%d) should fail", id)
+		}
+	}
+	if err := session.SetNextStreamId(201); err != nil {
+		t.Fatal(err)
+	}
+	if stream, err := session.InitiateStream(); err != nil || stream.Id != 201 {
+		t.Errorf("Expected stream id 201, not %v (err=%v)", stream, err)
+	}
+	// The first id of a fresh server session
+	server := NewSession(new(DummyHandler), true)
+	if err := server.SetNextStreamId(2); err != nil {
+		t.Fatal(err)
+	}
+	if stream, err := server.InitiateStream(); err != nil || stream.Id != 2 {
+		t.Errorf("Expected stream id 2, not %v (err=%v)", stream, err)
+	}
+}
+
+func TestConcurrentInitiateStream(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	ids := make(chan uint32, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := session.InitiateStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- stream.Id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[uint32]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("Stream id %d was allocated twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 100 {
+		t.Errorf("Expected 100 streams, not %d", len(seen))
+	}
+}
+
+func TestUnknownStream(t *testing.T) {
+	session := NewSession(new(DummyHandler), true)
+	if err := session.WriteFrame(&DataFrame{StreamId: 3, Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst, ok := frame.(*RstStreamFrame); !ok || rst.StreamId != 3 || rst.Status != InvalidStream {
+		t.Errorf("Expected RST_STREAM (INVALID_STREAM) on stream 3, not %#v", frame)
+	}
+	// RST_STREAM for an unknown stream is ignored
+	if err := session.WriteFrame(&RstStreamFrame{StreamId: 5, Status: Cancel}); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := session.outputR.readFrame(time.After(50 * time.Millisecond)); err != errPipeTimeout {
+		t.Errorf("RST_STREAM for an unknown stream should be ignored, but received %#v", frame)
+	}
+	// Optionally, everything is ignored
+	session.IgnoreUnknownStreams = true
+	if err := session.WriteFrame(&HeadersFrame{StreamId: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := session.outputR.readFrame(time.After(50 * time.Millisecond)); err != errPipeTimeout {
+		t.Errorf("IgnoreUnknownStreams: expected nothing, but received %#v", frame)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata/")
+
+// MustSerialize encodes `f` with a new Framer speaking `version`, and returns
+// the bytes written.
+func MustSerialize(t *testing.T, f Frame, version uint16) []byte {
+	data, err := SerializeFrame(f, version)
+	if err != nil {
+		t.Fatalf("Can't serialize %#v: %s", f, err)
+	}
+	return data
+}
+
+// The frames serialized in testdata/ for `version`, by name. The SPDY/3
+// frames use the SPDY/3 header names.
+func goldenFrames(version uint16) map[string]Frame {
+	headers := http.Header{
+		"Method":     {"GET"},
+		"Url":        {"/index.html"},
+		"Version":    {"HTTP/1.1"},
+		"Host":       {"example.com"},
+		"Accept":     {"text/html", "text/plain"},
+		"User-Agent": {"spdy-go"},
+	}
+	reply := http.Header{"Status": {"200 OK"}, "Version": {"HTTP/1.1"}}
+	if version >= 3 {
+		headers = http.Header{
+			":method":    {"GET"},
+			":path":      {"/index.html"},
+			":version":   {"HTTP/1.1"},
+			":host":      {"example.com"},
+			":scheme":    {"https"},
+			"Accept":     {"text/html", "text/plain"},
+			"User-Agent": {"spdy-go"},
+		}
+		reply = http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}}
+	}
+	return map[string]Frame{
+		"syn_stream": &SynStreamFrame{StreamId: 1, Priority: 2, Headers: headers, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+		"syn_reply":  &SynReplyFrame{StreamId: 1, Headers: reply},
+		"data":       &DataFrame{StreamId: 1, Data: []byte("hello world"), Flags: DataFlagFin},
+		"rst_stream": &RstStreamFrame{StreamId: 1, Status: Cancel},
+		"ping":       &PingFrame{Id: 7},
+	}
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, version := range []uint16{2, 3} {
+		for name, frame := range goldenFrames(version) {
+			checkGoldenFrame(t, fmt.Sprintf("%s_v%d", name, version), frame, version)
+		}
+	}
+}
+
+// Check that `frame` serializes as `version` to the bytes of the golden file
+// testdata/`name`.bin
+func checkGoldenFrame(t *testing.T, name string, frame Frame, version uint16) {
+	data := MustSerialize(t, frame, version)
+	// Serialization is deterministic
+	if again := MustSerialize(t, frame, version); !bytes.Equal(data, again) {
+		t.Errorf("%s: two serializations differ", name)
+	}
+	path := filepath.Join("testdata", name+".bin")
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Errorf("%s: serialized as\n%v\ninstead of\n%v", name, data, golden)
+	}
+}
+
+// The golden frames parse back to the frames they were serialized from.
+func TestParseGoldenFrames(t *testing.T) {
+	for _, version := range []uint16{2, 3} {
+		for name, frame := range goldenFrames(version) {
+			name = fmt.Sprintf("%s_v%d", name, version)
+			golden, err := ioutil.ReadFile(filepath.Join("testdata", name+".bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseFrame(golden)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				continue
+			}
+			// Set the version, type and length of the control frames
+			MustSerialize(t, frame, version)
+			if !reflect.DeepEqual(parsed, frame) {
+				t.Errorf("%s: parsed as\n%#v\ninstead of\n%#v", name, parsed, frame)
+			}
+		}
+	}
+}
+
+// The SPDY/3 golden frames have the layouts of the spec. They are decoded
+// here by hand, so that the encoder doesn't check itself.
+func TestGoldenFramesV3Layout(t *testing.T) {
+	for name, fields := range map[string]int{"syn_stream": 10, "syn_reply": 4} {
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", name+"_v3.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version := binary.BigEndian.Uint16(golden) &^ 0x8000; version != 3 {
+			t.Errorf("%s: version %d", name, version)
+		}
+		if length := binary.BigEndian.Uint32(golden[4:]) & 0xffffff; int(length) != len(golden) - 8 {
+			t.Errorf("%s: length %d, for %d bytes", name, length, len(golden) - 8)
+		}
+		reader, err := zlib.NewReaderDict(bytes.NewReader(golden[8+fields:]), headerDictionaryV3)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		block, _ := ioutil.ReadAll(reader)
+		// Every count and length is 32 bits
+		next := func() string {
+			if len(block) < 4 {
+				t.Fatalf("%s: truncated header block", name)
+			}
+			length := binary.BigEndian.Uint32(block)
+			if int(length) > len(block) - 4 {
+				t.Fatalf("%s: length %d past the header block", name, length)
+			}
+			value := string(block[4:4+length])
+			block = block[4+length:]
+			return value
+		}
+		if len(block) < 4 {
+			t.Fatalf("%s: empty header block", name)
+		}
+		count := binary.BigEndian.Uint32(block)
+		block = block[4:]
+		headers := make(http.Header)
+		for i := uint32(0); i < count; i++ {
+			name := next()
+			headers[http.CanonicalHeaderKey(name)] = strings.Split(next(), "\x00")
+		}
+		if len(block) != 0 {
+			t.Errorf("%s: %d bytes after the headers", name, len(block))
+		}
+		expected := make(http.Header)
+		for key, values := range *goldenFrames(3)[name].GetHeaders() {
+			expected[http.CanonicalHeaderKey(key)] = values
+		}
+		if !reflect.DeepEqual(headers, expected) {
+			t.Errorf("%s: decoded %v, not %v", name, headers, expected)
+		}
+	}
+}
+
+// Malformed frames fail to parse, with the length of the control frames
+// checked before their fields are read.
+func TestParseMalformedFrames(t *testing.T) {
+	rst := MustSerialize(t, &RstStreamFrame{StreamId: 1, Status: Cancel}, 3)
+	for name, data := range map[string][]byte{
+		"unknown type":		{0x80, 0x03, 0x00, 0x63, 0x00, 0x00, 0x00, 0x00},
+		"short RST_STREAM":	{0x80, 0x03, 0x00, 0x03, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01},
+		"short SYN_STREAM":	{0x80, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00},
+		"too many settings":	{0x80, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x04, 0xff, 0xff, 0xff, 0xff},
+		"long GOAWAY v2":	{0x80, 0x02, 0x00, 0x07, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+	} {
+		if _, err := ParseFrame(data); err == nil {
+			t.Errorf("%s: parsed", name)
+		} else if e, isError := err.(*Error); !isError || e.Err != InvalidControlFrame {
+			t.Errorf("%s: expected %q, not %v", name, InvalidControlFrame, err)
+		}
+	}
+	for n := 1; n < len(rst); n++ {
+		if _, err := ParseFrame(rst[:n]); err != io.ErrUnexpectedEOF {
+			t.Errorf("RST_STREAM truncated to %d bytes: expected io.ErrUnexpectedEOF, not %v", n, err)
+		}
+	}
+}
+
+func TestStatusCodeNames(t *testing.T) {
+	for status, name := range map[StatusCode]string{
+		ProtocolError:		"PROTOCOL_ERROR",
+		InvalidStream:		"INVALID_STREAM",
+		RefusedStream:		"REFUSED_STREAM",
+		UnsupportedVersion:	"UNSUPPORTED_VERSION",
+		Cancel:			"CANCEL",
+		InternalError:		"INTERNAL_ERROR",
+		FlowControlError:	"FLOW_CONTROL_ERROR",
+		StreamInUse:		"STREAM_IN_USE",
+		StreamAlreadyClosed:	"STREAM_ALREADY_CLOSED",
+		InvalidCredentials:	"INVALID_CREDENTIALS",
+		FrameTooLarge:		"FRAME_TOO_LARGE",
+		42:			"STATUS_42",
+	} {
+		if s := status.String(); s != name {
+			t.Errorf("Status %d should be named %s, not %s", uint32(status), name, s)
+		}
+	}
+}
+
+// The status codes introduced in SPDY/3 are sent as PROTOCOL_ERROR to SPDY/2
+// peers.
+func TestRstStatusVersion(t *testing.T) {
+	for _, test := range []struct {
+		status	StatusCode
+		v2, v3	StatusCode
+	}{
+		{Cancel, Cancel, Cancel},
+		{FlowControlError, FlowControlError, FlowControlError},
+		{StreamInUse, ProtocolError, StreamInUse},
+		{StreamAlreadyClosed, ProtocolError, StreamAlreadyClosed},
+		{FrameTooLarge, ProtocolError, FrameTooLarge},
+	} {
+		for version, expected := range map[uint16]StatusCode{2: test.v2, 3: test.v3} {
+			frame := &RstStreamFrame{StreamId: 1, Status: test.status}
+			parsed, err := ParseFrame(MustSerialize(t, frame, version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := parsed.(*RstStreamFrame).Status; status != expected {
+				t.Errorf("%s sent as %s on SPDY/%d instead of %s", test.status, status, version, expected)
+			}
+			if frame.Status != test.status {
+				t.Errorf("Serializing %s on SPDY/%d changed the frame", test.status, version)
+			}
+		}
+	}
+}
+
+func TestFrameStrings(t *testing.T) {
+	for _, test := range []struct {
+		frame	Frame
+		s	string
+	}{
+		{&DataFrame{StreamId: 1, Data: []byte("hello"), Flags: DataFlagFin}, "DATA stream=1 length=5 flags=FIN"},
+		{&SynStreamFrame{StreamId: 3, Priority: 2, CFHeader: ControlFrameHeader{Flags: ControlFlagFin | ControlFlagUnidirectional}, Headers: http.Header{"url": {"/"}}},
+			"SYN_STREAM stream=3 associated=0 priority=2 flags=FIN|UNIDIRECTIONAL headers=1"},
+		{&SynReplyFrame{StreamId: 3}, "SYN_REPLY stream=3 flags=0 headers=0"},
+		{&HeadersFrame{StreamId: 3, CFHeader: ControlFrameHeader{Flags: 0x81}}, "HEADERS stream=3 flags=FIN|0x80 headers=0"},
+		{&RstStreamFrame{StreamId: 5, Status: RefusedStream}, "RST_STREAM stream=5 status=REFUSED_STREAM"},
+		{&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{Id: SettingsInitialWindowSize, Value: 1024}}}, "SETTINGS flags=0 settings=1"},
+		{&NoopFrame{}, "NOOP"},
+		{&PingFrame{Id: 7}, "PING id=7"},
+		{&GoAwayFrame{LastGoodStreamId: 9, Status: ProtocolError}, "GOAWAY last-good-stream=9 status=1"},
+		{&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 1024}, "WINDOW_UPDATE stream=1 delta=1024"},
+	} {
+		if s := fmt.Sprint(test.frame); s != test.s {
+			t.Errorf("Expected %q, not %q", test.s, s)
+		}
+	}
+}
+
+func TestRepeatedSynReply(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := session.WriteFrame(&SynReplyFrame{StreamId: stream.Id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The reset may be sent before or after the SYN_STREAM
+	for i := 0; i < 2; i++ {
+		frame, err := session.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst, ok := frame.(*RstStreamFrame); ok {
+			if rst.StreamId != stream.Id || rst.Status != StreamInUse {
+				t.Errorf("A second SYN_REPLY should reset the stream with STREAM_IN_USE, not %#v", frame)
+			}
+			return
+		}
+	}
+	t.Errorf("A second SYN_REPLY should reset the stream")
+}
+
+// On a stream we initiated, DATA can't precede the SYN_REPLY, even after a
+// WINDOW_UPDATE: the stream is reset with PROTOCOL_ERROR.
+func TestDataBeforeSynReply(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&DataFrame{StreamId: stream.Id, Data: []byte("early")}); err != nil {
+		t.Fatal(err)
+	}
+	// The reset may be sent before or after the SYN_STREAM
+	for i := 0; ; i++ {
+		frame, err := session.outputR.readFrame(time.After(time.Second))
+		if err != nil || i == 2 {
+			t.Fatalf("DATA before SYN_REPLY should reset the stream")
+		}
+		if rst, isRst := frame.(*RstStreamFrame); isRst {
+			if rst.StreamId != stream.Id || rst.Status != ProtocolError {
+				t.Errorf("DATA before SYN_REPLY should reset the stream with PROTOCOL_ERROR, not %v", frame)
+			}
+			break
+		}
+	}
+
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteFrame(&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("early")}); err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan error, 1)
+	go func() { ended <- stream.Wait() }()
+	select {
+		case err := <-ended:
+			if rst, isRst := err.(*StreamResetError); !isRst || rst.Status != ProtocolError {
+				t.Errorf("DATA after WINDOW_UPDATE but before SYN_REPLY should reset the stream with PROTOCOL_ERROR, not %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("DATA after WINDOW_UPDATE but before SYN_REPLY should reset the stream")
+	}
+}
+
+func TestDataPadding(t *testing.T) {
+	const blockSize = 32
+	body := "hello, padded world"
+	client := NewSession(new(DummyHandler), false)
+	server := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}), true)
+	// Relay the next frame from src to dst
+	relay := func(src, dst *Session) Frame {
+		frame, err := src.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+	for _, session := range []*Session{client, server} {
+		if err := session.EnableDataPadding(blockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	relay(client, server)
+	relay(server, client)
+	stream, err := client.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(&http.Header{"Url": {"/"}}, true); err != nil {
+		t.Fatal(err)
+	}
+	relay(client, server)
+	received := ""
+	for {
+		if frame := relay(server, client); frame.GetFinFlag() {
+			break
+		} else if data, ok := frame.(*DataFrame); ok {
+			if data.Flags&DataFlagPadded == 0 || len(data.Data)%blockSize != 0 {
+				t.Errorf("DATA frame should be padded to %d bytes: %#v", blockSize, data)
+			}
+		}
+	}
+	if _, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame, err := stream.ReadFrame()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*DataFrame); ok {
+			if data.Flags&DataFlagPadded != 0 {
+				t.Errorf("Padding should be removed: %#v", data)
+			}
+			received += string(data.Data)
+		}
+	}
+	if received != body {
+		t.Errorf("Expected body %q, not %q", body, received)
+	}
+}
+
+func TestPushLimit(t *testing.T) {
+	pushed := make(chan []error)
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var errs []error
+		for i := 0; i < 3; i++ {
+			_, err := w.(*ResponseWriter).Push(&http.Header{"Url": {fmt.Sprintf("/%d.css", i)}})
+			errs = append(errs, err)
+		}
+		pushed <- errs
+	}), true)
+	session.PushHeadroom = 1
+	settings := &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{Id: SettingsMaxConcurrentStreams, Value: 3}}}
+	if err := session.WriteFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"Url": {"/"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// 2 pushes fit under the limit of 3, keeping 1 stream for replies
+	errs := <-pushed
+	if errs[0] != nil || errs[1] != nil || errs[2] != ErrPushLimit {
+		t.Errorf("Expected [nil nil ErrPushLimit], not %v", errs)
+	}
+	if n := session.nLocalStreams(); n != 2 {
+		t.Errorf("Expected 2 pushed streams, not %d", n)
+	}
+	// Raising the limit makes room for more pushes
+	settings.FlagIdValues[0].Value = 10
+	if err := session.WriteFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 3, Headers: http.Header{"Url": {"/"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := <-pushed; errs[0] != nil || errs[1] != nil || errs[2] != nil {
+		t.Errorf("Expected no errors, not %v", errs)
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	settings := &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Id: SettingsMaxConcurrentStreams, Value: 2},
+		{Id: SettingsUploadBandwidth, Value: 100},
+	}}
+	if err := session.WriteFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	if value, received := session.PeerSetting(SettingsUploadBandwidth); !received || value != 100 {
+		t.Errorf("Expected the upload bandwidth to be recorded, not (%d, %v)", value, received)
+	}
+	if _, received := session.PeerSetting(SettingsRoundTripTime); received {
+		t.Errorf("The round-trip time wasn't received")
+	}
+	var streams []*Stream
+	for i := 0; i < 2; i++ {
+		stream, err := session.OpenStream(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	if _, err := session.OpenStream(nil); err != ErrStreamLimit {
+		t.Errorf("Expected ErrStreamLimit, not %v", err)
+	}
+	// Closing a stream makes room for another
+	session.CloseStream(streams[0].Id)
+	if _, err := session.OpenStream(nil); err != nil {
+		t.Errorf("A stream should fit after closing one: %v", err)
+	}
+	// So does raising the limit
+	settings.FlagIdValues[0].Value = 3
+	if err := session.WriteFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.OpenStream(nil); err != nil {
+		t.Errorf("A stream should fit under the new limit: %v", err)
+	}
+}
+
+// Concurrent callers never exceed the peer's limit together, and their
+// SYN_STREAMs are sent in id order.
+func TestMaxConcurrentStreamsConcurrent(t *testing.T) {
+	session := NewSessionSize(new(DummyHandler), false, 64)
+	settings := &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{Id: SettingsMaxConcurrentStreams, Value: 5}}}
+	if err := session.WriteFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan uint32, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := session.OpenStream(nil)
+			if err == nil {
+				opened <- stream.Id
+			} else if err != ErrStreamLimit {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(opened) != 5 {
+		t.Errorf("Expected 5 streams, not %d", len(opened))
+	}
+	for i := 0; i < len(opened); i++ {
+		frame, err := session.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if syn, ok := frame.(*SynStreamFrame); !ok || syn.StreamId != uint32(2*i+1) {
+			t.Errorf("Expected SYN_STREAM %d, not %v", 2*i+1, frame)
+		}
+	}
+}
+
+// Streams opened by the peer beyond MaxConcurrentStreams are refused, until
+// one of the open streams closes.
+func TestMaxConcurrentStreamsIn(t *testing.T) {
+	release := make(chan bool)
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}), true)
+	session.MaxConcurrentStreams = 2
+	syn := func(id uint32) {
+		frame := &SynStreamFrame{StreamId: id, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}, Headers: http.Header{"Url": {"/"}}}
+		if err := session.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syn(1)
+	syn(3)
+	syn(5)
+	frame, err := session.outputR.readFrame(time.After(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.StreamId != 5 || rst.Status != RefusedStream {
+		t.Errorf("Stream 5 should be refused, not answered with %v", frame)
+	}
+	if n := session.NStreams(); n != 2 {
+		t.Errorf("Expected 2 open streams, not %d", n)
+	}
+	// Once a stream closes, another fits
+	release <- true
+	waitFor(t, "a stream to close", func() bool { return session.NStreams() == 1 })
+	syn(7)
+	if n := session.NStreams(); n != 2 {
+		t.Errorf("Stream 7 should be accepted, but %d streams are open", n)
+	}
+	close(release)
+}
+
+func TestPersistedSettings(t *testing.T) {
+	store := new(MemorySettingsStore)
+	session := NewSession(new(DummyHandler), false)
+	session.SettingsStore, session.SettingsKey = store, "example.com:443"
+	err := session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Flag: FlagSettingsPersistValue, Id: SettingsCurrentCwnd, Value: 10},
+		{Id: SettingsMaxConcurrentStreams, Value: 100},
+		{Flag: FlagSettingsPersistValue, Id: SettingsRoundTripTime, Value: 50},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A later value replaces the persisted one
+	err = session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Flag: FlagSettingsPersistValue, Id: SettingsCurrentCwnd, Value: 20},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SettingsFlagIdValue{
+		{Flag: FlagSettingsPersisted, Id: SettingsCurrentCwnd, Value: 20},
+		{Flag: FlagSettingsPersisted, Id: SettingsRoundTripTime, Value: 50},
+	}
+	if persisted := store.Load("example.com:443"); !reflect.DeepEqual(persisted, expected) {
+		t.Errorf("Expected %v to be persisted, not %v", expected, persisted)
+	}
+	if persisted := store.Load("example.org:443"); len(persisted) != 0 {
+		t.Errorf("Nothing should be persisted for another server: %v", persisted)
+	}
+
+	// The next session to the server sends them back
+	next := NewSession(new(DummyHandler), false)
+	next.SettingsStore, next.SettingsKey = store, "example.com:443"
+	if err := next.SendPersistedSettings(); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := next.outputR.readFrame(time.After(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings, isSettings := frame.(*SettingsFrame); !isSettings || !reflect.DeepEqual(settings.FlagIdValues, expected) {
+		t.Errorf("Expected the persisted settings, not %v", frame)
+	}
+	// Until the server clears them
+	clear := &SettingsFrame{CFHeader: ControlFrameHeader{Flags: ControlFlagClearSettings}}
+	if err := next.WriteFrame(clear); err != nil {
+		t.Fatal(err)
+	}
+	if persisted := store.Load("example.com:443"); len(persisted) != 0 {
+		t.Errorf("The persisted settings should be cleared, not %v", persisted)
+	}
+}
+
+func TestSessionLevelFrames(t *testing.T) {
+	for _, test := range []struct {
+		frame        Frame
+		sessionLevel bool
+	}{
+		{&SynStreamFrame{StreamId: 1}, false},
+		{&SynReplyFrame{StreamId: 1}, false},
+		{&HeadersFrame{StreamId: 1}, false},
+		{&RstStreamFrame{StreamId: 1}, false},
+		{&DataFrame{StreamId: 1}, false},
+		{&WindowUpdateFrame{StreamId: 1}, false},
+		{&SettingsFrame{}, true},
+		{&NoopFrame{}, true},
+		{&PingFrame{Id: 1}, true},
+		{&GoAwayFrame{}, true},
+	} {
+		if test.frame.IsSessionLevel() != test.sessionLevel {
+			t.Errorf("%T: IsSessionLevel() should be %v", test.frame, test.sessionLevel)
+		}
+	}
+	// A stream frame with stream id 0 is routed to (invalid) stream 0,
+	// not handled as a session frame
+	session := NewSession(new(DummyHandler), true)
+	if err := session.WriteFrame(&DataFrame{StreamId: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := session.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if rst, ok := frame.(*RstStreamFrame); !ok || rst.StreamId != 0 || rst.Status != InvalidStream {
+		t.Errorf("Expected RST_STREAM (INVALID_STREAM) for stream 0, not %#v", frame)
+	}
+	// A session frame is handled by the session
+	if err := session.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := session.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*PingFrame); !ok {
+		t.Errorf("Expected the PING echo, not %#v", frame)
+	}
+}
+
+func TestSessionBackpressure(t *testing.T) {
+	const nFrames = 20
+	session := NewSessionSize(new(DummyHandler), false, 2)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written int32
+	done := make(chan error)
+	go func() {
+		if err := stream.Syn(nil, false); err != nil {
+			done <- err
+			return
+		}
+		for i := 0; i < nFrames; i++ {
+			if err := stream.WriteDataFrame([]byte("x"), false); err != nil {
+				done <- err
+				return
+			}
+			atomic.AddInt32(&written, 1)
+		}
+		done <- nil
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !session.Saturated() {
+		if time.Now().After(deadline) {
+			t.Fatal("The session never got saturated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The producer is blocked
+	time.Sleep(50 * time.Millisecond)
+	stalled := atomic.LoadInt32(&written)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&written); n != stalled || n >= nFrames {
+		t.Fatalf("The producer should be blocked, but wrote %d then %d frames", stalled, n)
+	}
+	// Reading from the session lets it resume
+	for i := 0; i < nFrames + 1; i++ {
+		if _, err := session.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if session.Saturated() || session.Pending() != 0 {
+		t.Errorf("The queue should be empty, not %d frames", session.Pending())
+	}
+}
+
+// Serve a client session over a connection which sends a SYN_REPLY for
+// stream 1 (truncated to `cut` bytes if not 0), then closes.
+func serveClosingConnection(t *testing.T, cut int) (*Session, *Stream, error) {
+	wire := new(bytes.Buffer)
+	framer, err := NewFramer(wire, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := framer.WriteFrame(&SynReplyFrame{StreamId: 1, Headers: http.Header{"Status": {"200"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if cut > 0 {
+		wire.Truncate(cut)
+	}
+	conn, err := NewFramer(ioutil.Discard, wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	return session, stream, session.Serve(conn)
+}
+
+func TestConnectionClosedBetweenFrames(t *testing.T) {
+	session, stream, err := serveClosingConnection(t, 0)
+	if err != nil {
+		t.Errorf("A connection closed between frames should not be an error: %s", err)
+	}
+	if !session.Closed() {
+		t.Errorf("The session should be closed")
+	}
+	if frame, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*SynReplyFrame); !ok {
+		t.Fatalf("Expected SYN_REPLY, not %#v", frame)
+	}
+	if frame, err := stream.ReadFrame(); err != ErrConnectionClosed {
+		t.Errorf("The stream should be aborted with ErrConnectionClosed, not (%#v, %v)", frame, err)
+	}
+	if err := stream.WriteDataFrame([]byte("hello"), false); err != ErrConnectionClosed {
+		t.Errorf("Writing to an aborted stream should fail with ErrConnectionClosed, not %v", err)
+	}
+}
+
+func TestConnectionClosedMidFrame(t *testing.T) {
+	session, stream, err := serveClosingConnection(t, 10)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("A truncated frame should fail with io.ErrUnexpectedEOF, not %v", err)
+	}
+	if !session.Closed() {
+		t.Errorf("The session should be closed")
+	}
+	if frame, err := stream.ReadFrame(); err != ErrConnectionClosed {
+		t.Errorf("The stream should be aborted with ErrConnectionClosed, not (%#v, %v)", frame, err)
+	}
+}
+
+func TestPrioritizeReplyBeforeData(t *testing.T) {
+	const nChunks = 5
+	handled := make(chan bool, 2)
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Body") != "" {
+			for i := 0; i < nChunks; i++ {
+				w.Write([]byte("chunk"))
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		handled <- true
+	}), true)
+	session.PrioritizeReplyBeforeData = true
+	waitPending := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for session.Pending() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d queued frames, not %d", n, session.Pending())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Stream 1 queues a reply and its body, which the peer doesn't read yet
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"X-Body": {"yes"}}}); err != nil {
+		t.Fatal(err)
+	}
+	<-handled
+	waitPending(1 + nChunks + 1) // SYN_REPLY, chunks, FIN
+	// Stream 3 replies behind it
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 3}); err != nil {
+		t.Fatal(err)
+	}
+	<-handled
+	waitPending(1 + nChunks + 1 + 2)
+	var order []string
+	for len(order) < 2 + nChunks {
+		frame, err := session.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := frame.GetStreamId()
+		switch f := frame.(type) {
+			case *SynReplyFrame:	order = append(order, fmt.Sprintf("SYN_REPLY %d", id))
+			case *DataFrame:	if len(f.Data) > 0 { order = append(order, fmt.Sprintf("DATA %d", id)) }
+		}
+	}
+	if order[0] != "SYN_REPLY 1" || order[1] != "SYN_REPLY 3" {
+		t.Fatalf("The SYN_REPLY for stream 3 should jump ahead of the DATA for stream 1: %v", order)
+	}
+	for _, name := range order[2:] {
+		if name != "DATA 1" {
+			t.Fatalf("Unexpected frame order: %v", order)
+		}
+	}
+}
+
+// The frames taken from the queue by the write loop but not sent yet are
+// flushed too, eg. before the GOAWAY of a protocol violation.
+func TestFlushScheduledOutput(t *testing.T) {
+	session := NewSession(new(DummyHandler), true)
+	session.PrioritizeReplyBeforeData = true
+	for _, frame := range []Frame{&PingFrame{Id: 2}, &PingFrame{Id: 4}, &PingFrame{Id: 6}} {
+		if err := session.outputW.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := session.nextFrame(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := NewRecordingFramer()
+	if err := session.flushOutput(peer); err != nil {
+		t.Fatal(err)
+	}
+	if frames := peer.Frames(); len(frames) != 2 {
+		t.Errorf("Expected the 2 scheduled frames, not %#v", frames)
+	}
+}
+
+// With PrioritizeStreams, the frames queued for a high priority stream are
+// sent before those of a low priority stream, and each stream stays in order.
+func TestPrioritizeStreams(t *testing.T) {
+	const nChunks = 5
+	handled := make(chan bool, 2)
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < nChunks; i++ {
+			w.Write([]byte("chunk"))
+		}
+		handled <- true
+	}), true)
+	session.PrioritizeStreams = true
+	for _, syn := range []*SynStreamFrame{{StreamId: 1, Priority: 7}, {StreamId: 3, Priority: 0}} {
+		if err := session.WriteFrame(syn); err != nil {
+			t.Fatal(err)
+		}
+		<-handled
+	}
+	waitFor(t, "the frames of both streams", func() bool { return session.Pending() == 2 * (1 + nChunks + 1) })
+	order := ""
+	for i := 0; i < 2 * (1 + nChunks + 1); i++ {
+		frame, err := session.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if _, isReply := frame.(*SynReplyFrame); !isReply {
+				t.Errorf("Expected a SYN_REPLY first, not %v", frame)
+			}
+		}
+		id, _ := frame.GetStreamId()
+		order += fmt.Sprint(id)
+	}
+	if order != "33333331111111" {
+		t.Errorf("Stream 3 should be sent before stream 1, not %s", order)
+	}
+	// Streams opened locally are sent at the priority given
+	client := NewSession(new(DummyHandler), false)
+	stream, err := client.OpenStreamPriority(&http.Header{"Url": {"/"}}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Priority != 3 {
+		t.Errorf("Expected priority 3, not %d", stream.Priority)
+	}
+	if frame, err := client.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if syn, isSyn := frame.(*SynStreamFrame); !isSyn || syn.Priority != 3 {
+		t.Errorf("Expected a SYN_STREAM at priority 3, not %v", frame)
+	}
+}
+
+func TestCheckPreface(t *testing.T) {
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	err := CheckPreface(bufio.NewReader(strings.NewReader(request)))
+	if e, ok := err.(*PrefaceError); !ok {
+		t.Fatalf("An HTTP/1.1 request should be rejected with a PrefaceError, not %v", err)
+	} else if !strings.Contains(e.Error(), "GET ") {
+		t.Errorf("The error should show what was received: %s", e)
+	}
+	// A SPDY frame passes, and can still be read
+	input := bufio.NewReader(bytes.NewReader(MustSerialize(t, &SynStreamFrame{StreamId: 1}, Version)))
+	if err := CheckPreface(input); err != nil {
+		t.Fatal(err)
+	}
+	framer, err := NewFramer(nil, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*SynStreamFrame); !ok {
+		t.Errorf("Expected SYN_STREAM, not %#v", frame)
+	}
+}
+
+func TestServeRejectsHTTP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	session, err := Serve(server, new(DummyHandler), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("The connection should be closed, not (%d, %v)", n, err)
+	}
+	if !session.Closed() {
+		t.Errorf("The session should be closed")
+	}
+}
+
+// An io.Writer which discards its input, and counts how many times it is called
+type countingWriter struct {
+	writes	int32
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	atomic.AddInt32(&w.writes, 1)
+	return len(data), nil
+}
+
+func (w *countingWriter) Writes() int {
+	return int(atomic.LoadInt32(&w.writes))
+}
+
+// Serve `session` over a connection which counts writes, and never receives
+// anything until the returned function is called.
+func serveCounting(session *Session) (*countingWriter, func() error) {
+	conn := new(countingWriter)
+	input, closeInput := io.Pipe()
+	framer, _ := NewFramer(conn, input)
+	result := Promise(func() error { return session.Serve(framer) })
+	return conn, func() error {
+		closeInput.Close()
+		return <-result
+	}
+}
+
+func waitWrites(t *testing.T, conn *countingWriter, n int) {
+	deadline := time.Now().Add(time.Second)
+	for conn.Writes() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d writes, not %d", n, conn.Writes())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteCoalesceDelay(t *testing.T) {
+	clock := NewMockClock(time.Now())
+	session := NewSession(new(DummyHandler), false)
+	session.Clock = clock
+	session.WriteCoalesceDelay = time.Millisecond
+	conn, stop := serveCounting(session)
+	defer stop()
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SYN_STREAM is written immediately
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	waitWrites(t, conn, 1)
+	synWrites := conn.Writes()
+	// DATA waits for the delay
+	for i := 0; i < 10; i++ {
+		if err := stream.WriteDataFrame([]byte("hello"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.BlockUntil(1)
+	for session.Pending() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := conn.Writes(); n != synWrites {
+		t.Fatalf("DATA should be buffered until the delay elapses, but %d writes happened", n - synWrites)
+	}
+	clock.Advance(time.Millisecond)
+	waitWrites(t, conn, synWrites + 1)
+	time.Sleep(10 * time.Millisecond)
+	if n := conn.Writes(); n != synWrites + 1 {
+		t.Fatalf("The buffered DATA should be written at once, not in %d writes", n - synWrites)
+	}
+	// PING flushes what is buffered before it
+	if err := stream.WriteDataFrame([]byte("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.outputW.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitWrites(t, conn, synWrites + 2)
+	time.Sleep(10 * time.Millisecond)
+	if n := conn.Writes(); n != synWrites + 2 {
+		t.Fatalf("DATA and PING should be written at once, not in %d writes", n - synWrites - 1)
+	}
+}
+
+// Send bursts of small DATA frames through a served session, and report
+// how many writes reach the connection per frame.
+func benchmarkWriteCoalesce(b *testing.B, delay time.Duration) {
+	session := NewSession(new(DummyHandler), false)
+	session.WriteCoalesceDelay = delay
+	conn, stop := serveCounting(session)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		b.Fatal(err)
+	}
+	data := []byte("hello")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := stream.WriteDataFrame(data, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for session.Pending() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	session.Close()
+	stop()
+	b.ReportMetric(float64(conn.Writes()) / float64(b.N), "writes/frame")
+}
+
+func BenchmarkWriteNoCoalesce(b *testing.B) {
+	benchmarkWriteCoalesce(b, 0)
+}
+
+func BenchmarkWriteCoalesce(b *testing.B) {
+	benchmarkWriteCoalesce(b, time.Millisecond)
+}
+
+func TestStreamByteCounters(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	// Padding isn't counted
+	stream.padding = &padding{local: 16}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{"hello", " ", "world"} {
+		if err := stream.WriteDataFrame([]byte(chunk), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.WriteHeadersFrame(&http.Header{"X-Foo": {"bar"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := stream.BytesSent(); n != 11 {
+		t.Errorf("Sent 11 DATA bytes, not %d", n)
+	}
+	// Receive a reply and 7 bytes of padded DATA
+	peer.WriteFrame(&SynReplyFrame{StreamId: 1})
+	peer.WriteFrame(padDataFrame(&DataFrame{StreamId: 1, Data: []byte("goodbye")}, 64))
+	for i := 0; i < 2; i++ {
+		if _, err := stream.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := stream.BytesReceived(); n != 7 {
+		t.Errorf("Received 7 DATA bytes, not %d", n)
+	}
+	if n := peer.BytesSent(); n != 11 {
+		t.Errorf("Both ends of a stream should share counters: %d", n)
+	}
+}
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	const limit = 3
+	var running, maxRunning int32
+	release := make(chan bool)
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+	}), true)
+	session.MaxConcurrentHandlers = limit
+	for id := uint32(1); id < 20; id += 2 {
+		if err := session.WriteFrame(&SynStreamFrame{StreamId: id, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The excess streams are refused
+	refused := 0
+	for refused < 10 - limit {
+		frame, err := session.outputR.readFrame(time.After(time.Second))
+		if err != nil {
+			t.Fatalf("Expected %d streams to be refused, not %d (%s)", 10 - limit, refused, err)
+		}
+		if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.Status != RefusedStream {
+			t.Fatalf("Expected RST_STREAM (REFUSED_STREAM), not %#v", frame)
+		}
+		refused += 1
+	}
+	waitFor(t, "all handlers running", func() bool { return atomic.LoadInt32(&running) == limit })
+	// Once a handler returns, a new stream is accepted
+	release <- true
+	waitFor(t, "a handler slot", func() bool { return len(session.handlers) == limit - 1 })
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 21, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "all handlers running", func() bool { return atomic.LoadInt32(&running) == limit })
+	close(release)
+	if max := atomic.LoadInt32(&maxRunning); max != limit {
+		t.Errorf("At most %d handlers should run at the same time, not %d", limit, max)
+	}
+}
+
+func TestHandlerTeardown(t *testing.T) {
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+			case "/hello":	w.Write([]byte("hello")) // No FIN
+			case "/empty":	// Nothing sent at all
+			case "/panic":
+				w.Write([]byte("hello"))
+				panic("oops")
+		}
+	}), true)
+	// Read the frames sent on stream `id`, until it ends
+	readStream := func(id uint32) []Frame {
+		var frames []Frame
+		for {
+			frame, err := session.outputR.readFrame(time.After(time.Second))
+			if err != nil {
+				t.Fatalf("Stream %d didn't end: %s", id, err)
+			}
+			if frameId, _ := frame.GetStreamId(); frameId != id {
+				continue
+			}
+			frames = append(frames, frame)
+			if _, isRst := frame.(*RstStreamFrame); isRst || frame.GetFinFlag() {
+				return frames
+			}
+		}
+	}
+	for i, path := range []string{"/hello", "/empty", "/panic"} {
+		id := uint32(2 * i + 1)
+		syn := &SynStreamFrame{StreamId: id, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}, Headers: http.Header{"Url": {path}}}
+		if err := session.WriteFrame(syn); err != nil {
+			t.Fatal(err)
+		}
+		frames := readStream(id)
+		last := frames[len(frames) - 1]
+		if path == "/panic" {
+			if rst, isRst := last.(*RstStreamFrame); !isRst || rst.Status != InternalError {
+				t.Errorf("%s: a panicking handler should reset its stream with INTERNAL_ERROR, not send %v", path, last)
+			}
+		} else {
+			if _, isReply := frames[0].(*SynReplyFrame); !isReply {
+				t.Errorf("%s: expected SYN_REPLY, not %v", path, frames[0])
+			}
+			if !last.GetFinFlag() {
+				t.Errorf("%s: the stream should be half-closed when the handler returns, not end with %v", path, last)
+			}
+		}
+		waitFor(t, "the stream to be removed", func() bool {
+			_, exists := session.getStream(id)
+			return !exists
+		})
+	}
+}
+
+// Wait up to a second for `condition` to become true
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// The adapter never compresses bodies: a body which is already compressed
+// is sent as is.
+func TestResponseContentEncoding(t *testing.T) {
+	body := new(bytes.Buffer)
+	gz := gzip.NewWriter(body)
+	gz.Write([]byte("hello world\n"))
+	gz.Close()
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body.Bytes())
+	}), true)
+	session.WriteFrame(&SynStreamFrame{StreamId: 1})
+	frame, err := session.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, isReply := frame.(*SynReplyFrame); !isReply {
+		t.Fatalf("Expected SYN_REPLY, not %#v", frame)
+	} else if encoding := reply.Headers.Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("The content encoding should be sent as is, not %q", encoding)
+	}
+	frame, err = session.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, isData := frame.(*DataFrame); !isData || !bytes.Equal(data.Data, body.Bytes()) {
+		t.Errorf("The compressed body should be sent as is, not %#v", frame)
+	}
+}
+
+// Run a handler on a stream spliced with a RecordingFramer, and check the
+// frames it sent.
+func ExampleRecordingFramer() {
+	recorder := NewRecordingFramer(&SynStreamFrame{
+		StreamId:	1,
+		CFHeader:	ControlFrameHeader{Flags: ControlFlagFin},
+		Headers:	http.Header{"Url": {"/hello"}},
+	})
+	stream, peer := NewStream(1, false)
+	go Copy(peer, recorder)
+	stream.Serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	stream.Close()
+	Copy(recorder, peer)
+	for _, frame := range recorder.Frames() {
+		switch f := frame.(type) {
+			case *SynReplyFrame:	fmt.Printf("SYN_REPLY %s %s\n", f.Headers.Get("Status"), f.Headers.Get("Content-Type"))
+			case *DataFrame:	fmt.Printf("DATA %q fin=%v\n", f.Data, f.GetFinFlag())
+			default:		fmt.Printf("%#v\n", frame)
+		}
+	}
+	// Output:
+	// SYN_REPLY 200 text/plain
+	// DATA "hello /hello" fin=false
+	// DATA "" fin=true
+}
+
+func TestStreamWindows(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(send, recv int) {
+		if n := stream.SendWindow(); n != send {
+			t.Errorf("Send window should be %d, not %d", send, n)
+		}
+		if n := stream.RecvWindow(); n != recv {
+			t.Errorf("Receive window should be %d, not %d", recv, n)
+		}
+		if stats := session.Stats().Streams[stream.Id]; stats.SendWindow != send || stats.RecvWindow != recv {
+			t.Errorf("Session stats should show windows %d/%d, not %#v", send, recv, stats)
+		}
+	}
+	check(DefaultWindowSize, DefaultWindowSize)
+	stream.Syn(nil, false)
+	stream.WriteDataFrame(make([]byte, 1000), false)
+	check(DefaultWindowSize - 1000, DefaultWindowSize)
+	session.WriteFrame(&WindowUpdateFrame{StreamId: stream.Id, DeltaWindowSize: 500})
+	check(DefaultWindowSize - 500, DefaultWindowSize)
+	// Shrinking the initial window applies to open streams
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{Id: SettingsInitialWindowSize, Value: 100}}})
+	check(-400, DefaultWindowSize)
+	// Received DATA, and acknowledged
+	session.WriteFrame(&SynReplyFrame{StreamId: stream.Id})
+	session.WriteFrame(&DataFrame{StreamId: stream.Id, Data: make([]byte, 300)})
+	check(-400, DefaultWindowSize - 300)
+	if err := stream.sendWindowUpdate(300); err != nil {
+		t.Fatal(err)
+	}
+	check(-400, DefaultWindowSize)
+}
+
+func TestStreamDrain(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	stream.Syn(nil, false)
+	peer.ReadFrame()
+	peer.WriteFrame(&SynReplyFrame{StreamId: 1})
+	// The peer keeps sending
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+				case <-stop:	return
+				default:
+			}
+			if err := peer.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("more")}); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	defer close(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+	if err := stream.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Drain should time out, not return %v", err)
+	}
+	for {
+		frame, err := peer.input.readFrame(time.After(time.Second))
+		if err != nil {
+			t.Fatalf("Expected RST_STREAM (CANCEL): %s", err)
+		}
+		if rst, isRst := frame.(*RstStreamFrame); isRst {
+			if rst.Status != Cancel {
+				t.Errorf("Expected CANCEL, not %d", rst.Status)
+			}
+			break
+		}
+	}
+	// A stream which ends is drained without a reset
+	stream, peer = NewStream(3, true)
+	stream.Syn(nil, false)
+	peer.WriteFrame(&SynReplyFrame{StreamId: 3})
+	peer.WriteFrame(&DataFrame{StreamId: 3, Data: []byte("last"), Flags: DataFlagFin})
+	if err := stream.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncreasingGoAway(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GOAWAYs may repeat, and narrow
+	for _, id := range []uint32{5, 5, 3} {
+		if err := session.WriteFrame(&GoAwayFrame{LastGoodStreamId: id}); err != nil {
+			t.Fatalf("GOAWAY %d should be accepted: %s", id, err)
+		}
+	}
+	if session.Closed() {
+		t.Fatal("The session should still be open")
+	}
+	protocolErr := session.WriteFrame(&GoAwayFrame{LastGoodStreamId: 7})
+	if e, ok := protocolErr.(*Error); !ok || e.Err != IncreasingGoAway {
+		t.Fatalf("An increasing GOAWAY should be a protocol error, not %v", protocolErr)
+	}
+	if !session.Closed() {
+		t.Errorf("The session should be aborted")
+	}
+	if _, err := stream.ReadFrame(); err != protocolErr {
+		t.Errorf("Streams should fail with the protocol error, not %v", err)
+	}
+}
+
+func TestClientInitialSettings(t *testing.T) {
+	pushed := make(chan error, 1)
+	server := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := w.(*ResponseWriter).Push(&http.Header{"Url": {"/pushed"}})
+		if err != nil {
+			pushed <- err
+			return
+		}
+		pushed <- push.WriteDataFrame(make([]byte, 250), true)
+	}), true)
+	client := NewSession(new(DummyHandler), false)
+	if err := client.SendInitialSettings(SettingsFlagIdValue{Id: SettingsInitialWindowSize, Value: 100}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := stream.RecvWindow(); n != 100 {
+		t.Errorf("The client streams should have a receive window of 100, not %d", n)
+	}
+	if err := client.SendInitialSettings(); err == nil {
+		t.Errorf("Initial SETTINGS can't be sent after opening a stream")
+	}
+	// SETTINGS comes first, then SYN_STREAM
+	for _, expected := range []string{"*spdy.SettingsFrame", "*spdy.SynStreamFrame"} {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := fmt.Sprintf("%T", frame); name != expected {
+			t.Fatalf("Expected %s, not %s", expected, name)
+		}
+		if err := server.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The server sends no more pushed DATA than the client's window
+	readPushedData := func() int {
+		n := 0
+		for {
+			frame, err := server.outputR.readFrame(time.After(50 * time.Millisecond))
+			if err == errPipeTimeout {
+				return n
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if data, isData := frame.(*DataFrame); isData && data.StreamId == 2 {
+				n += len(data.Data)
+			}
+		}
+	}
+	if n := readPushedData(); n != 100 {
+		t.Fatalf("The server should send 100 bytes of DATA before WINDOW_UPDATE, not %d", n)
+	}
+	server.WriteFrame(&WindowUpdateFrame{StreamId: 2, DeltaWindowSize: 200})
+	if n := readPushedData(); n != 150 {
+		t.Fatalf("The server should send the last 150 bytes after WINDOW_UPDATE, not %d", n)
+	}
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushWindowSize(t *testing.T) {
+	pushed := make(chan error, 1)
+	server := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := w.(*ResponseWriter).Push(&http.Header{"Url": {"/pushed"}})
+		if err != nil {
+			pushed <- err
+			return
+		}
+		pushed <- push.WriteDataFrame(make([]byte, 250), true)
+	}), true)
+	client := NewSession(new(DummyHandler), false)
+	client.EnableAccept(1)
+	settings := []SettingsFlagIdValue{
+		{Id: SettingsInitialWindowSize, Value: 1000},
+		{Id: SettingsPushWindowSize, Value: 100},
+	}
+	if err := client.SendInitialSettings(settings...); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := stream.RecvWindow(); n != 1000 {
+		t.Errorf("The client streams should have a receive window of 1000, not %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The server sends no more pushed DATA than the push window
+	n := 0
+	for {
+		frame, err := server.outputR.readFrame(time.After(50 * time.Millisecond))
+		if err == errPipeTimeout {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if data, isData := frame.(*DataFrame); isData && data.StreamId == 2 {
+			n += len(data.Data)
+		}
+	}
+	if n != 100 {
+		t.Fatalf("The server should send 100 bytes of pushed DATA before WINDOW_UPDATE, not %d", n)
+	}
+	server.WriteFrame(&WindowUpdateFrame{StreamId: 2, DeltaWindowSize: 200})
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	// The client gives pushed streams the push window
+	if err := client.WriteFrame(&SynStreamFrame{StreamId: 2, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}, Headers: http.Header{"Url": {"/pushed"}}}); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := client.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := accepted.RecvWindow(); n != 100 {
+		t.Errorf("Pushed streams should have a receive window of 100, not %d", n)
+	}
+}
+
+func TestTraceFramer(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewMockClock(time.Unix(0, 0))
+	tracer := NewTraceFramer(framer, 3)
+	tracer.Clock = clock
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Headers: http.Header{"Url": {"/"}}},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&PingFrame{Id: 1},
+	}
+	for _, frame := range frames {
+		if err := tracer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	if _, err := tracer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	// The ring only keeps the last 3 events
+	events := tracer.Events()
+	expected := []TraceEvent{
+		{time.Unix(0, 0).Add(1 * time.Millisecond), TraceOut, 1, "DATA", 13},
+		{time.Unix(0, 0).Add(2 * time.Millisecond), TraceOut, 0, "PING", 12},
+		{time.Unix(0, 0).Add(3 * time.Millisecond), TraceIn, 1, "SYN_STREAM", 8 + int(frames[0].(*SynStreamFrame).CFHeader.length)},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Unexpected events:\n%#v\ninstead of\n%#v", events, expected)
+	}
+	rendered := new(bytes.Buffer)
+	if err := RenderTrace(rendered, events); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(rendered.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "+1ms") || !strings.Contains(lines[2], "SYN_STREAM") {
+		t.Errorf("Unexpected rendering:\n%s", rendered)
+	}
+}
+
+func TestByteLimit(t *testing.T) {
+	// Sending
+	stream, peer := NewStream(1, true)
+	stream.SetByteLimit(10)
+	stream.Syn(nil, false)
+	peer.ReadFrame()
+	if err := stream.WriteDataFrame([]byte("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.WriteDataFrame([]byte("world!"), false); err != ErrByteLimit {
+		t.Fatalf("Sending beyond the limit should fail with ErrByteLimit, not %v", err)
+	}
+	for _, expected := range []string{"*spdy.DataFrame", "*spdy.RstStreamFrame"} {
+		frame, err := peer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := fmt.Sprintf("%T", frame); name != expected {
+			t.Fatalf("Expected %s, not %#v", expected, frame)
+		} else if rst, isRst := frame.(*RstStreamFrame); isRst && rst.Status != Cancel {
+			t.Errorf("Expected CANCEL, not %d", rst.Status)
+		}
+	}
+	if err := stream.WriteDataFrame([]byte("x"), false); err == nil {
+		t.Errorf("Writing after the limit was exceeded should fail")
+	}
+	// Receiving, with a custom status
+	stream, peer = NewStream(3, true)
+	stream.SetByteLimit(10)
+	stream.ByteLimitStatus = RefusedStream
+	stream.Syn(nil, false)
+	peer.ReadFrame()
+	peer.WriteFrame(&SynReplyFrame{StreamId: 3})
+	peer.WriteFrame(&DataFrame{StreamId: 3, Data: []byte("0123456789")})
+	peer.WriteFrame(&DataFrame{StreamId: 3, Data: []byte("overflow")})
+	for i := 0; i < 2; i++ {
+		if _, err := stream.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stream.ReadFrame(); err != ErrByteLimit {
+		t.Fatalf("Receiving beyond the limit should fail with ErrByteLimit, not %v", err)
+	}
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.Status != RefusedStream {
+		t.Errorf("Expected RST_STREAM (REFUSED_STREAM), not %#v", frame)
+	}
+	// Only the selected direction counts
+	stream, peer = NewStream(5, true)
+	stream.SetByteLimit(1)
+	stream.ByteLimitDirection = LimitReceived
+	stream.Syn(nil, false)
+	if err := stream.WriteDataFrame([]byte("hello"), false); err != nil {
+		t.Errorf("Sent DATA shouldn't count towards a receive limit: %s", err)
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	var dialed []string
+	var server net.Conn
+	dial := func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network + " " + addr)
+		if len(dialed) > 1 {
+			return nil, errors.New("network is down")
+		}
+		client, s := net.Pipe()
+		server = s
+		return client, nil
+	}
+	session, err := Dial(dial, "pipe", "server", new(DummyHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The session runs over the injected connection
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Syn(&http.Header{"Url": {"/"}}, true)
+	framer, _ := NewFramer(server, server)
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, isSyn := frame.(*SynStreamFrame); !isSyn {
+		t.Errorf("Expected SYN_STREAM, not %#v", frame)
+	}
+	// Dropping the connection ends the session
+	server.Close()
+	if _, err := stream.ReadFrame(); err != ErrConnectionClosed {
+		t.Errorf("Expected ErrConnectionClosed, not %v", err)
+	}
+	// Dial errors are returned
+	if _, err := Dial(dial, "pipe", "server", new(DummyHandler)); err == nil || err.Error() != "network is down" {
+		t.Errorf("Expected the dial error, not %v", err)
+	}
+	if len(dialed) != 2 || dialed[0] != "pipe server" {
+		t.Errorf("Unexpected dials: %v", dialed)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	frames, bytes, err := Drain(NewRecordingFramer(
+		&SynReplyFrame{StreamId: 1},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&HeadersFrame{StreamId: 1},
+		&DataFrame{StreamId: 1, Data: []byte(" world"), Flags: DataFlagFin},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames != 4 || bytes != 11 {
+		t.Errorf("Expected 4 frames and 11 bytes, not %d frames and %d bytes", frames, bytes)
+	}
+	// Errors other than EOF are returned, along with the totals so far
+	reader, writer := Pipe(2)
+	writer.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("hello")})
+	writer.CloseWithError(io.ErrUnexpectedEOF)
+	if frames, bytes, err := Drain(reader); err != io.ErrUnexpectedEOF || frames != 1 || bytes != 5 {
+		t.Errorf("Expected (1, 5, io.ErrUnexpectedEOF), not (%d, %d, %v)", frames, bytes, err)
+	}
+	// Like CopyN, the reset which follows a RST_STREAM isn't reported
+	stream, peer := NewStream(1, true)
+	stream.Syn(nil, false)
+	peer.Reply(nil, false)
+	peer.WriteDataFrame([]byte("hello"), false)
+	peer.Rst(Cancel)
+	if frames, bytes, err := Drain(stream); err != nil || frames != 3 || bytes != 5 {
+		t.Errorf("Expected (3, 5, nil), not (%d, %d, %v)", frames, bytes, err)
+	}
+}
+
+func TestControlBit(t *testing.T) {
+	// The highest stream id: every bit but the control bit is set
+	data := &DataFrame{StreamId: 0x7fffffff, Data: []byte("hello")}
+	wire := MustSerialize(t, data, Version)
+	if wire[0] != 0x7f {
+		t.Fatalf("The control bit of a DATA frame should be clear: %x", wire[:4])
+	}
+	framer, _ := NewFramer(nil, bytes.NewReader(wire))
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(frame, data) {
+		t.Errorf("Expected %#v, not %#v", data, frame)
+	}
+	// A stream id with the high bit set can't be encoded as DATA
+	framer, _ = NewFramer(ioutil.Discard, nil)
+	if err := framer.WriteFrame(&DataFrame{StreamId: 0x80000001}); err == nil {
+		t.Errorf("A DATA frame with the control bit set should be rejected")
+	}
+	// Set on the wire, the same bit makes the frame a control frame (NOOP)
+	wire = []byte{0x80, Version, 0x00, byte(TypeNoop), 0, 0, 0, 0}
+	framer, _ = NewFramer(nil, bytes.NewReader(wire))
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, isNoop := frame.(*NoopFrame); !isNoop {
+		t.Errorf("Expected NOOP, not %#v", frame)
+	}
+	// Control frames are encoded with the bit set
+	for _, frame := range []Frame{&NoopFrame{}, &PingFrame{Id: 1}, &RstStreamFrame{StreamId: 1, Status: Cancel}} {
+		if wire := MustSerialize(t, frame, Version); wire[0]&0x80 == 0 {
+			t.Errorf("The control bit of %#v should be set: %x", frame, wire[:4])
+		}
+	}
+}
+
+func TestAcceptQueue(t *testing.T) {
+	session := NewSession(new(DummyHandler), true)
+	session.EnableAccept(2)
+	for _, id := range []uint32{1, 3, 5} {
+		if err := session.WriteFrame(&SynStreamFrame{StreamId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The third stream is refused
+	if frame, err := session.outputR.readFrame(time.After(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.StreamId != 5 || rst.Status != RefusedStream {
+		t.Fatalf("Expected RST_STREAM (REFUSED_STREAM) on stream 5, not %#v", frame)
+	}
+	// Accepting makes room for another stream
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if syn, isSyn := frame.(*SynStreamFrame); !isSyn || syn.StreamId != 1 {
+		t.Errorf("The first frame of an accepted stream should be its SYN_STREAM, not %#v", frame)
+	}
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 7}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []uint32{3, 7} {
+		if stream, err := session.AcceptStream(); err != nil {
+			t.Fatal(err)
+		} else if stream.Id != expected {
+			t.Errorf("Expected stream %d, not %d", expected, stream.Id)
+		}
+	}
+	if _, err := session.outputR.readFrame(time.After(10 * time.Millisecond)); err != errPipeTimeout {
+		t.Errorf("Nothing should be refused once there is room")
+	}
+	session.Close()
+	if _, err := session.AcceptStream(); err != ErrSessionClosed {
+		t.Errorf("Expected ErrSessionClosed, not %v", err)
+	}
+}
+
+// A trivial Framing: frames are gob-encoded, and any client is accepted.
+type gobFraming struct{}
+
+type gobFramer struct {
+	encoder	*gob.Encoder
+	decoder	*gob.Decoder
+}
+
+func (gobFraming) NewFramer(w io.Writer, r io.Reader) (ReadWriter, error) {
+	return &gobFramer{gob.NewEncoder(w), gob.NewDecoder(r)}, nil
+}
+
+func (gobFraming) CheckPreface(r *bufio.Reader) error {
+	return nil
+}
+
+func (f *gobFramer) WriteFrame(frame Frame) error {
+	return f.encoder.Encode(&frame)
+}
+
+func (f *gobFramer) ReadFrame() (Frame, error) {
+	var frame Frame
+	err := f.decoder.Decode(&frame)
+	return frame, err
+}
+
+func TestAlternateFraming(t *testing.T) {
+	for _, frame := range []Frame{&SynStreamFrame{}, &SynReplyFrame{}, &DataFrame{}, &RstStreamFrame{}, &HeadersFrame{}, &GoAwayFrame{}, &WindowUpdateFrame{}} {
+		gob.Register(frame)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	_, err := ServeFraming(serverConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}), true, gobFraming{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ServeFraming(clientConn, new(DummyHandler), false, gobFraming{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(&http.Header{"Url": {"/gob"}}, true); err != nil {
+		t.Fatal(err)
+	}
+	body := new(bytes.Buffer)
+	if err := CopyBytes(body, stream); err != nil {
+		t.Fatal(err)
+	}
+	if body.String() != "hello /gob" {
+		t.Errorf("Unexpected response over the alternate framing: %q", body)
+	}
+}
+
+func TestReplyHeaders(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []Frame{
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{"status": {"200"}}},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&HeadersFrame{StreamId: 1, Headers: http.Header{"x-later": {"yes"}}},
+		&DataFrame{StreamId: 1, Data: []byte(" world"), Flags: DataFlagFin},
+	} {
+		if err := peer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		headers, err := stream.ReplyHeaders()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if headers.Get("status") != "200" || headers.Get("x-later") != "" {
+			t.Errorf("Wrong reply headers: %#v", headers)
+		}
+	}
+	var body []byte
+	for {
+		frame, err := stream.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, isData := frame.(*DataFrame); isData {
+			body = append(body, data.Data...)
+		}
+		if frame.GetFinFlag() {
+			break
+		}
+	}
+	if string(body) != "hello world" {
+		t.Errorf("The body should be untouched by ReplyHeaders, read %q", body)
+	}
+	if headers, _ := stream.ReplyHeaders(); headers.Get("x-later") != "" {
+		t.Errorf("Later HEADERS shouldn't change the reply headers")
+	}
+
+	stream, peer = NewStream(3, true)
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteFrame(&RstStreamFrame{StreamId: 3, Status: RefusedStream}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := stream.ReplyHeaders()
+	if reset, ok := err.(*StreamResetError); !ok || reset.Status != RefusedStream || reset.StreamId != 3 {
+		t.Errorf("A reset before the reply should return a StreamResetError, not %#v", err)
+	}
+}
+
+// A sequence of frames on several streams, for ChaosFramer to mistreat
+func chaosInput() []Frame {
+	var frames []Frame
+	for id := uint32(1); id < 40; id += 2 {
+		frames = append(frames,
+			&SynStreamFrame{StreamId: id},
+			&PingFrame{Id: id},
+			&DataFrame{StreamId: id, Data: []byte("x")},
+			&HeadersFrame{StreamId: id},
+			&DataFrame{StreamId: id, Flags: DataFlagFin},
+		)
+	}
+	return frames
+}
+
+func readAllFrames(t *testing.T, r Reader) []Frame {
+	var frames []Frame
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestChaosFramer(t *testing.T) {
+	options := ChaosOptions{Seed: 42, DropRate: 0.2, ReorderRate: 0.5}
+	chaos := NewChaosFramer(NewRecordingFramer(chaosInput()...), options)
+	frames := readAllFrames(t, chaos)
+	if len(frames) + chaos.Dropped() != len(chaosInput()) {
+		t.Errorf("%d frames read and %d dropped, out of %d", len(frames), chaos.Dropped(), len(chaosInput()))
+	}
+	if chaos.Dropped() == 0 || chaos.Reordered() == 0 {
+		t.Errorf("Expected drops and reorderings, not %d and %d", chaos.Dropped(), chaos.Reordered())
+	}
+	again := readAllFrames(t, NewChaosFramer(NewRecordingFramer(chaosInput()...), options))
+	describe := func(frames []Frame) (s string) {
+		for _, frame := range frames {
+			s += fmt.Sprintf("%v\n", frame)
+		}
+		return s
+	}
+	if describe(again) != describe(frames) {
+		t.Errorf("The same seed should mistreat frames the same way")
+	}
+	// Legal reorderings keep the frames of each stream in order, and new
+	// stream ids increasing
+	var lastSyn uint32
+	position := map[uint32]int{}
+	for _, frame := range frames {
+		id, exists := frame.GetStreamId()
+		if !exists {
+			continue
+		}
+		var rank int
+		switch f := frame.(type) {
+			case *SynStreamFrame:
+				if f.StreamId < lastSyn {
+					t.Errorf("SYN_STREAM %d after SYN_STREAM %d", f.StreamId, lastSyn)
+				}
+				lastSyn = f.StreamId
+			case *HeadersFrame:	rank = 2
+			case *DataFrame:
+				rank = 1
+				if f.GetFinFlag() {
+					rank = 3
+				}
+		}
+		if rank < position[id] {
+			t.Errorf("The frames of stream %d were reordered: %#v", id, frame)
+		}
+		position[id] = rank
+	}
+
+	clock := NewMockClock(time.Unix(0, 0))
+	chaos = NewChaosFramer(NewRecordingFramer(&NoopFrame{}), ChaosOptions{MaxDelay: time.Second, Clock: clock})
+	result := Promise(func() error { _, err := chaos.ReadFrame(); return err })
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Serve a server session over a ChaosFramer, and return the frames it read and
+// wrote, and a function to write frames to it.
+func serveChaos(session *Session, options ChaosOptions) (*ChaosFramer, *TraceFramer, *PipeWriter) {
+	input, inputW := Pipe(100)
+	chaos := NewChaosFramer(struct{ Reader; Writer }{input, NewRecordingFramer()}, options)
+	trace := NewTraceFramer(chaos, 1000)
+	go session.Serve(trace)
+	return chaos, trace, inputW
+}
+
+func countTrace(trace *TraceFramer, dir TraceDirection, frameType string) int {
+	n := 0
+	for _, event := range trace.Events() {
+		if event.Dir == dir && event.FrameType == frameType {
+			n++
+		}
+	}
+	return n
+}
+
+func TestChaosSession(t *testing.T) {
+	// Lost pings: the session echoes those it gets
+	session := NewSession(new(DummyHandler), true)
+	chaos, trace, input := serveChaos(session, ChaosOptions{Seed: 1, DropRate: 0.5})
+	for id := uint32(1); id < 40; id += 2 {
+		if err := input.WriteFrame(&PingFrame{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "all pings to be read or dropped", func() bool {
+		return chaos.Dropped() + countTrace(trace, TraceIn, "PING") == 20
+	})
+	if chaos.Dropped() == 0 {
+		t.Errorf("Expected some pings to be dropped")
+	}
+	waitFor(t, "the echo of every ping received", func() bool {
+		return countTrace(trace, TraceOut, "PING") == countTrace(trace, TraceIn, "PING")
+	})
+	input.Close()
+
+	// Legal reorderings are accepted...
+	for _, illegal := range []bool{false, true} {
+		session = NewSession(new(DummyHandler), true)
+		session.EnableAccept(10)
+		_, trace, input = serveChaos(session, ChaosOptions{ReorderRate: 1, AllowIllegal: illegal})
+		for _, frame := range []Frame{
+			&SynStreamFrame{StreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+			&SynStreamFrame{StreamId: 3, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+			&PingFrame{Id: 5},
+		} {
+			if err := input.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !illegal {
+			for _, id := range []uint32{1, 3} {
+				if stream, err := session.AcceptStream(); err != nil || stream.Id != id {
+					t.Errorf("Expected stream %d, not %#v (%v)", id, stream, err)
+				}
+			}
+		} else {
+			// ... illegal ones are rejected
+			waitFor(t, "SYN_STREAM 1 after 3 to be reset", func() bool {
+				return countTrace(trace, TraceOut, "RST_STREAM") == 1
+			})
+		}
+		input.Close()
+	}
+}
+
+func TestProtocolViolation(t *testing.T) {
+	offending := &GoAwayFrame{LastGoodStreamId: 7}
+	peer := NewRecordingFramer(&GoAwayFrame{LastGoodStreamId: 5}, offending)
+	err := NewSession(new(DummyHandler), false).Serve(peer)
+	v, ok := err.(*ProtocolViolation)
+	if !ok {
+		t.Fatalf("Serve should return a ProtocolViolation, not %#v", err)
+	}
+	if v.Status != ProtocolError || v.Frame != offending || v.Message != string(IncreasingGoAway) {
+		t.Errorf("Wrong violation: %#v", v)
+	}
+	frames := peer.Frames()
+	if len(frames) == 0 {
+		t.Fatal("Nothing was sent")
+	}
+	if goAway, ok := frames[len(frames) - 1].(*GoAwayFrame); !ok || goAway.Status != ProtocolError {
+		t.Errorf("The session should end with a GOAWAY carrying the status, not %#v", frames[len(frames) - 1])
+	}
+
+	// Frames which can't be parsed have no Frame
+	var wire bytes.Buffer
+	wire.Write([]byte{0x80, Version, 0, byte(TypePing), 0, 0, 0, 4, 0, 0, 0, 0})
+	framer, err := NewFramer(ioutil.Discard, &wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewSession(new(DummyHandler), true).Serve(framer)
+	if v, ok := err.(*ProtocolViolation); !ok || v.Frame != nil || v.Message != string(ZeroStreamId) {
+		t.Errorf("A PING with id 0 should be a violation, not %#v", err)
+	}
+}
+
+func TestStreamPriority(t *testing.T) {
+	stream, peer := NewStreamOptions(1, true, StreamOptions{Priority: 3})
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if syn, ok := frame.(*SynStreamFrame); !ok || syn.Priority != 3 {
+		t.Errorf("The SYN_STREAM should carry the priority, not %#v", frame)
+	}
+	session := NewSession(new(DummyHandler), true)
+	session.EnableAccept(1)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1, Priority: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if accepted, err := session.AcceptStream(); err != nil {
+		t.Fatal(err)
+	} else if accepted.Priority != 2 {
+		t.Errorf("The stream should have the priority of its SYN_STREAM, not %d", accepted.Priority)
+	}
+}
+
+// Queue `n` frames on each of `sources` (stream id -> priority) and return
+// the order in which a PriorityFramer emits them, as a string of stream ids.
+func priorityOrder(t *testing.T, patience int, n map[uint32]int, sources map[uint32]uint8) string {
+	p := NewPriorityFramer(16)
+	p.Patience = patience
+	total := 0
+	for id, priority := range sources {
+		r, w := Pipe(16)
+		for i := 0; i < n[id]; i++ {
+			if err := w.WriteFrame(&DataFrame{StreamId: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+		p.Add(r, priority)
+		total += n[id]
+	}
+	waitFor(t, "every frame to be queued", func() bool { return p.buffered() == total })
+	p.Close()
+	order := ""
+	for {
+		frame, err := p.ReadFrame()
+		if err == io.EOF {
+			return order
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := frame.GetStreamId()
+		order += fmt.Sprint(id)
+	}
+}
+
+func TestDemux(t *testing.T) {
+	resets := NewRecordingFramer()
+	demux := NewDemux(2, resets)
+	stream1 := NewRecordingFramer()
+	if err := demux.Register(1, stream1); err != nil {
+		t.Fatal(err)
+	}
+	// A frame for an imminent stream is delivered once it registers
+	headers := &HeadersFrame{StreamId: 3}
+	data := &DataFrame{StreamId: 3, Data: []byte("hello")}
+	for _, frame := range []Frame{headers, &DataFrame{StreamId: 1}, data} {
+		if err := demux.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(stream1.Frames()); n != 1 {
+		t.Errorf("Stream 1 should receive its frame, not %d frames", n)
+	}
+	if n := demux.Held(); n != 2 {
+		t.Errorf("Expected 2 frames held for stream 3, not %d", n)
+	}
+	stream3 := NewRecordingFramer()
+	if err := demux.Register(3, stream3); err != nil {
+		t.Fatal(err)
+	}
+	if frames := stream3.Frames(); len(frames) != 2 || frames[0] != headers || frames[1] != data {
+		t.Errorf("Stream 3 should receive its held frames in order, not %#v", frames)
+	}
+	if n := demux.Held(); n != 0 {
+		t.Errorf("No frame should be held anymore, not %d", n)
+	}
+	if err := demux.WriteFrame(&PingFrame{Id: 1}); err != ErrNoStreamId {
+		t.Errorf("Expected ErrNoStreamId for a PING, not %v", err)
+	}
+
+	// Exceeding the limit resets the stream
+	for _, frame := range []Frame{&HeadersFrame{StreamId: 5}, &HeadersFrame{StreamId: 7}, &DataFrame{StreamId: 7}} {
+		if err := demux.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := resets.Frames()
+	if len(frames) != 1 {
+		t.Fatalf("Expected a RST_STREAM, not %#v", frames)
+	}
+	if rst, isRst := frames[0].(*RstStreamFrame); !isRst || rst.StreamId != 7 || rst.Status != InvalidStream {
+		t.Errorf("Expected RST_STREAM (INVALID_STREAM) for stream 7, not %#v", frames[0])
+	}
+	if n := demux.Held(); n != 1 {
+		t.Errorf("Only the frame of stream 5 should still be held, not %d frames", n)
+	}
+
+	// The frames of a stream which ended are dropped
+	demux.Unregister(3)
+	if err := demux.WriteFrame(&DataFrame{StreamId: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if n := demux.Held(); n != 1 || len(stream3.Frames()) != 2 {
+		t.Errorf("A frame for an ended stream should be dropped (%d frames held)", n)
+	}
+
+	// A RST_STREAM past the limit is dropped, not answered with a reset
+	for _, frame := range []Frame{&HeadersFrame{StreamId: 9}, &RstStreamFrame{StreamId: 11, Status: Cancel}} {
+		if err := demux.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frames := resets.Frames(); len(frames) != 1 {
+		t.Errorf("A RST_STREAM shouldn't be answered with a reset: %#v", frames)
+	}
+
+	// The frames held for each stream are limited too
+	resets = NewRecordingFramer()
+	demux = NewDemux(10, resets)
+	demux.StreamLimit = 2
+	for i := 0; i < 3; i++ {
+		if err := demux.WriteFrame(&DataFrame{StreamId: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frames := resets.Frames(); len(frames) != 1 || frames[0].(*RstStreamFrame).StreamId != 1 {
+		t.Errorf("Expected stream 1 to be reset, not %#v", frames)
+	}
+	if n := demux.Held(); n != 0 {
+		t.Errorf("The frames of the reset stream should be dropped, not %d held", n)
+	}
+}
+
+func TestPriorityFramer(t *testing.T) {
+	order := priorityOrder(t, 0, map[uint32]int{1: 5, 3: 5}, map[uint32]uint8{1: 0, 3: 7})
+	if order != "1111133333" {
+		t.Errorf("Priority 0 should be emitted before priority 7, not %s", order)
+	}
+	order = priorityOrder(t, 0, map[uint32]int{1: 3, 3: 3}, map[uint32]uint8{1: 4, 3: 4})
+	if order != "131313" && order != "313131" {
+		t.Errorf("Equal priorities should take turns, not %s", order)
+	}
+	order = priorityOrder(t, 2, map[uint32]int{1: 10, 3: 3}, map[uint32]uint8{1: 0, 3: 7})
+	if order != "1131131131111" {
+		t.Errorf("A low priority stream should make progress, not %s", order)
+	}
+}
+
+func TestStreamWriteDeadline(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{Id: SettingsInitialWindowSize, Value: 10}}})
+	var streams [2]*Stream
+	for i := range streams {
+		stream, err := session.InitiateStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Syn(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = stream
+	}
+	slow, healthy := streams[0], streams[1]
+	// Waiting for the send window
+	slow.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	err := slow.WriteDataFrame(make([]byte, 20), false)
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("Expected a timeout, not %v", err)
+	}
+	if sent := slow.BytesSent(); sent != 10 {
+		t.Errorf("The data within the window should be sent, not %d bytes", sent)
+	}
+	if err := healthy.WriteDataFrame(make([]byte, 10), true); err != nil {
+		t.Errorf("Other streams shouldn't be affected: %s", err)
+	}
+	slow.SetWriteDeadline(time.Time{})
+	slow.windowUpdated(10)
+	if err := slow.WriteDataFrame(make([]byte, 10), true); err != nil {
+		t.Errorf("Clearing the deadline should let writes wait again: %s", err)
+	}
+
+	// Waiting for room in the queue
+	stream, _ := NewStreamOptions(1, true, StreamOptions{BufferSize: 1})
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := stream.WriteDataFrame([]byte("x"), false); err != ErrWriteTimeout {
+		t.Errorf("Expected ErrWriteTimeout on a full queue, not %v", err)
+	}
+	// The headers of a frame which timed out aren't recorded
+	stream.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := stream.WriteHeadersFrame(&http.Header{"X-Late": {"1"}}, false); err != ErrWriteTimeout {
+		t.Errorf("Expected ErrWriteTimeout on a full queue, not %v", err)
+	}
+	if headers := stream.output.headers(); headers.Get("X-Late") != "" {
+		t.Errorf("The headers of an undelivered frame shouldn't be recorded: %v", headers)
+	}
+}
+
+func TestStreamResetReader(t *testing.T) {
+	reset := func() (*Stream, *Stream) {
+		stream, peer := NewStream(1, true)
+		if err := stream.Syn(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.Reply(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.WriteDataFrame([]byte("hello"), false); err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.Rst(Cancel); err != nil {
+			t.Fatal(err)
+		}
+		return stream, peer
+	}
+	expectReset := func(err error) {
+		if e, isReset := err.(*StreamResetError); !isReset || e.Status != Cancel || e.Local {
+			t.Errorf("Expected a reset by the peer (CANCEL), not %#v", err)
+		}
+	}
+	// The frames received before the RST_STREAM are still read
+	stream, _ := reset()
+	for i, expected := range []string{"*spdy.SynReplyFrame", "*spdy.DataFrame", "*spdy.RstStreamFrame"} {
+		if frame, err := stream.ReadFrame(); err != nil {
+			t.Fatalf("Frame %d: %s", i, err)
+		} else if name := fmt.Sprintf("%T", frame); name != expected {
+			t.Errorf("Frame %d: expected %s, not %s", i, expected, name)
+		}
+	}
+	_, err := stream.ReadFrame()
+	expectReset(err)
+	// A body reader fails with the reset
+	stream, _ = reset()
+	data, err := ioutil.ReadAll(stream.BodyReader())
+	if string(data) != "hello" {
+		t.Errorf("Expected the data before the reset, not %q", data)
+	}
+	expectReset(err)
+	// Copy passes the RST_STREAM on, and doesn't report the reset
+	stream, _ = reset()
+	recorder := NewRecordingFramer()
+	if err := Copy(recorder, stream); err != nil {
+		t.Errorf("Copy shouldn't fail after passing the RST_STREAM: %s", err)
+	}
+	if frames := recorder.Frames(); len(frames) != 3 {
+		t.Errorf("Expected 3 frames, not %#v", frames)
+	} else if _, isRst := frames[2].(*RstStreamFrame); !isRst {
+		t.Errorf("Expected the RST_STREAM to be copied, not %#v", frames[2])
+	}
+}
+
+func TestStreamState(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	expect := func(step string, expected StreamState) {
+		for _, end := range []*Stream{stream, peer} {
+			if state := end.State(); state != expected {
+				t.Errorf("%s: expected %s, not %s", step, expected, state)
+			}
+		}
+	}
+	expect("new stream", StateIdle)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	expect("SYN_STREAM", StateOpen)
+	if err := peer.Reply(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.WriteDataFrame([]byte("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	expect("DATA", StateOpen)
+	if err := stream.WriteDataFrame([]byte(" world"), true); err != nil {
+		t.Fatal(err)
+	}
+	expect("local FIN", StateLocalHalfClosed)
+	if err := peer.WriteDataFrame(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	expect("remote FIN", StateClosed)
+
+	// The peer may half-close first
+	stream, peer = NewStream(3, true)
+	stream.Syn(nil, false)
+	peer.Reply(nil, true)
+	expect("remote FIN first", StateRemoteHalfClosed)
+	// A reset closes the stream
+	stream.Rst(Cancel)
+	expect("RST_STREAM", StateClosed)
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"*spdy.SynStreamFrame", "*spdy.DataFrame"} {
+		if frame, err := peer.ReadFrame(); err != nil {
+			t.Fatal(err)
+		} else if name := fmt.Sprintf("%T", frame); name != expected {
+			t.Errorf("Expected %s, not %s", expected, name)
+		} else if data, isData := frame.(*DataFrame); isData && (len(data.Data) != 0 || !data.GetFinFlag()) {
+			t.Errorf("Expected an empty DATA frame with FLAG_FIN, not %#v", data)
+		}
+	}
+	// The output rejects frames...
+	if err := stream.WriteDataFrame([]byte("late"), false); err == nil || err.(*Error).Err != StreamClosed {
+		t.Errorf("Writing after CloseWrite should fail with StreamClosed, not %v", err)
+	}
+	if err := stream.WriteHeadersFrame(&http.Header{"X-Late": {"1"}}, false); err == nil {
+		t.Errorf("Writing headers after CloseWrite should fail")
+	}
+	// ... while inbound frames are still delivered
+	if err := peer.Reply(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteDataFrame([]byte("hello"), true); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"*spdy.SynReplyFrame", "*spdy.DataFrame"} {
+		if frame, err := stream.ReadFrame(); err != nil {
+			t.Fatalf("ReadFrame should work after CloseWrite: %s", err)
+		} else if name := fmt.Sprintf("%T", frame); name != expected {
+			t.Errorf("Expected %s, not %s", expected, name)
+		}
+	}
+	if err := stream.Wait(); err != nil {
+		t.Errorf("The stream should end cleanly, not with %v", err)
+	}
+}
+
+func TestStreamProtocolError(t *testing.T) {
+	expect := func(err error, code ErrorCode, frame Frame) {
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("Expected an *Error (%s), not %#v", code, err)
+			return
+		}
+		if e.Err != code || e.StreamId != 1 || e.Frame != frame {
+			t.Errorf("Expected %s on stream 1 for %#v, not %s on stream %d for %#v", code, frame, e.Err, e.StreamId, e.Frame)
+		}
+	}
+	// Sending HEADERS before SYN_STREAM
+	stream, _ := NewStream(1, true)
+	headers := &HeadersFrame{StreamId: 1}
+	err := stream.WriteFrame(headers)
+	expect(fmt.Errorf("writing: %w", err), IllegalFirstFrame, headers)
+	// Receiving HEADERS before SYN_REPLY
+	_, input := StreamPipe(1, true)
+	expect(input.WriteFrame(headers), IllegalFirstFrame, headers)
+	// A frame for another stream
+	other := &DataFrame{StreamId: 3}
+	expect(input.WriteFrame(other), WrongStreamId, other)
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Reply(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	// A deadline in the past fails immediately, even with a frame queued
+	stream.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := stream.ReadFrame(); err != ErrReadTimeout {
+		t.Errorf("Expected ErrReadTimeout, not %v", err)
+	}
+	// A zero deadline means no deadline
+	stream.SetReadDeadline(time.Time{})
+	if frame, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, isReply := frame.(*SynReplyFrame); !isReply {
+		t.Errorf("Expected the SYN_REPLY, not %#v", frame)
+	}
+	// A future deadline fires when no frame arrives
+	stream.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := stream.ReadFrame()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("Expected a timeout, not %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20 * time.Millisecond {
+		t.Errorf("ReadFrame returned after %v, before the deadline", elapsed)
+	}
+	// The stream is still usable
+	stream.SetReadDeadline(time.Time{})
+	if err := peer.WriteDataFrame([]byte("hello"), true); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := stream.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if data, isData := frame.(*DataFrame); !isData || string(data.Data) != "hello" {
+		t.Errorf("Expected the DATA frame, not %#v", frame)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	expectCancel := func(peer *Stream) {
+		if frame, err := peer.ReadFrame(); err != nil {
+			t.Fatal(err)
+		} else if rst, isRst := frame.(*RstStreamFrame); !isRst || rst.Status != Cancel {
+			t.Errorf("Expected RST_STREAM (CANCEL), not %#v", frame)
+		}
+	}
+	// A parked ReadFrame is unblocked
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, peer := NewStreamContext(ctx, 1, true)
+	if stream.Context() != ctx {
+		t.Errorf("The stream should carry its context")
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := stream.ReadFrame()
+		read <- err
+	}()
+	cancel()
+	select {
+		case err := <-read:
+			if err != context.Canceled {
+				t.Errorf("Expected context.Canceled, not %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Cancelling the context should unblock ReadFrame")
+	}
+	expectCancel(peer)
+	if err := stream.WriteDataFrame([]byte("x"), false); err != context.Canceled {
+		t.Errorf("Writes after cancellation should fail with context.Canceled, not %v", err)
+	}
+
+	// So is a WriteFrame waiting for the send window
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream, peer = NewStreamContext(ctx, 3, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	stream.setInitialSendWindow(0)
+	written := make(chan error, 1)
+	go func() {
+		written <- stream.WriteDataFrame([]byte("hello"), false)
+	}()
+	cancel()
+	select {
+		case err := <-written:
+			if err != context.Canceled {
+				t.Errorf("Expected context.Canceled, not %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Cancelling the context should unblock WriteFrame")
+	}
+	expectCancel(peer)
+
+	// Without a context, streams can't be cancelled
+	if plain, _ := NewStream(5, true); plain.Context() != context.Background() {
+		t.Errorf("A stream without a context should report context.Background()")
+	}
+}
+
+func TestUnidirectionalStream(t *testing.T) {
+	// A client can't send anything but RST_STREAM on a push
+	client := NewSession(new(DummyHandler), false)
+	client.EnableAccept(1)
+	if _, err := client.InitiateStream(); err != nil {
+		t.Fatal(err)
+	}
+	flags := ControlFlagFin | ControlFlagUnidirectional
+	if err := client.WriteFrame(&SynStreamFrame{StreamId: 2, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: flags}}); err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := client.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pushed.Unidirectional() {
+		t.Fatal("The pushed stream should be unidirectional")
+	}
+	if err := pushed.Reply(nil, false); err == nil || err.(*Error).Err != UnidirectionalStream {
+		t.Errorf("A reply to a push should be a protocol error, not %v", err)
+	}
+	if err := pushed.WriteDataFrame([]byte("x"), true); err == nil || err.(*Error).Err != UnidirectionalStream {
+		t.Errorf("DATA on a push should be a protocol error, not %v", err)
+	}
+	if err := pushed.Rst(Cancel); err != nil {
+		t.Errorf("A push can be cancelled: %s", err)
+	}
+
+	// The initiator resets a stream on which the peer sends anything
+	stream, peer := NewStreamOptions(1, true, StreamOptions{Unidirectional: true})
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if frame.(*SynStreamFrame).CFHeader.Flags&ControlFlagUnidirectional == 0 {
+		t.Errorf("The SYN_STREAM should have FLAG_UNIDIRECTIONAL")
+	}
+	if err := peer.WriteFrame(&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteFrame(&SynReplyFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if rst, ok := frame.(*RstStreamFrame); !ok || rst.Status != ProtocolError {
+		t.Errorf("A reply on a unidirectional stream should be reset with PROTOCOL_ERROR, not %#v", frame)
+	}
+}
+
+func TestDisableServerPush(t *testing.T) {
+	pushed := make(chan *Stream, 1)
+	server := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := w.(*ResponseWriter).Push(&http.Header{"Url": {"/pushed"}})
+		if err != nil {
+			t.Error(err)
+		}
+		pushed <- push
+		fmt.Fprint(w, "ok")
+	}), true)
+	handled := make(chan string, 1)
+	client := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled <- r.URL.Path
+	}), false)
+	client.DisableServerPush = true
+	go Splice(client, server, false)
+	stream, err := client.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := CopyBytes(&body, stream); err != nil {
+		t.Fatal(err)
+	}
+	if body.String() != "ok" {
+		t.Errorf("The response should still arrive, not %q", body.String())
+	}
+	frame, err := (<-pushed).ReadFrame()
+	if rst, ok := frame.(*RstStreamFrame); !ok || rst.Status != RefusedStream {
+		t.Errorf("The push should be refused, not %#v (%v)", frame, err)
+	}
+	select {
+		case path := <-handled:	t.Errorf("The push shouldn't reach the client handler (%s)", path)
+		default:
+	}
+}
+
+func TestStreamBufferSize(t *testing.T) {
+	stream, peer := NewStreamOptions(1, true, StreamOptions{BufferSize: 1})
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	written := Promise(func() error { return stream.WriteDataFrame([]byte("x"), true) })
+	select {
+		case err := <-written:	t.Fatalf("The second frame should wait for a read (%v)", err)
+		case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+		case err := <-written:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):	t.Fatal("The second frame should be written after a read")
+	}
+}
+
+func TestStreamWait(t *testing.T) {
+	waitResult := func(stream *Stream) error {
+		select {
+			case err := <-Promise(stream.Wait):	return err
+			case <-time.After(time.Second):		t.Fatal("The stream should have ended")
+		}
+		return nil
+	}
+	// Clean completion: both sides half-close
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.WriteDataFrame([]byte("request"), true); err != nil {
+		t.Fatal(err)
+	}
+	ended := Promise(stream.Wait)
+	if err := peer.WriteFrame(&SynReplyFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+		case err := <-ended:	t.Fatalf("The stream shouldn't end before the peer half-closes it (%v)", err)
+		case <-time.After(50 * time.Millisecond):
+	}
+	if err := peer.WriteFrame(&DataFrame{StreamId: 1, Flags: DataFlagFin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitResult(stream); err != nil {
+		t.Errorf("A clean completion should return nil, not %v", err)
+	}
+
+	// Reset by the peer
+	stream, peer = NewStream(1, false)
+	if err := peer.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteFrame(&RstStreamFrame{StreamId: 1, Status: Cancel}); err != nil {
+		t.Fatal(err)
+	}
+	err := waitResult(stream)
+	if reset, ok := err.(*StreamResetError); !ok || reset.Status != Cancel || reset.Local {
+		t.Errorf("Expected a reset by the peer, not %#v", err)
+	}
+
+	// Reset locally
+	stream, _ = NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Rst(InternalError); err != nil {
+		t.Fatal(err)
+	}
+	err = waitResult(stream)
+	if reset, ok := err.(*StreamResetError); !ok || reset.Status != InternalError || !reset.Local {
+		t.Errorf("Expected a local reset, not %#v", err)
+	}
+
+	// Closed by the application
+	stream, _ = NewStream(1, true)
+	stream.Close()
+	if err := waitResult(stream); err != nil {
+		t.Errorf("Closing a stream isn't an error: %v", err)
+	}
+}
+
+func TestBodyReader(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []Frame{
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{"status": {"200"}}},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&HeadersFrame{StreamId: 1, Headers: http.Header{"x-trailer": {"yes"}}},
+		&DataFrame{StreamId: 1},
+		&DataFrame{StreamId: 1, Data: []byte(", world"), Flags: DataFlagFin},
+	} {
+		if err := peer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := stream.BodyReader()
+	var read []byte
+	buffer := make([]byte, 2)
+	for {
+		n, err := body.Read(buffer)
+		read = append(read, buffer[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(read) != "hello, world" {
+		t.Errorf("Read %q", read)
+	}
+	headers := stream.InputHeaders()
+	if headers.Get("status") != "200" || headers.Get("x-trailer") != "yes" {
+		t.Errorf("Headers received mid-stream should be merged: %#v", headers)
+	}
+}
+
+func TestStreamTrailers(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []Frame{
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{"status": {"200"}}},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&HeadersFrame{StreamId: 1, Headers: http.Header{"x-checksum": {"5d41402a"}}, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+	} {
+		if err := peer.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := stream.BodyReader()
+	if _, err := body.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil || len(data) != 0 {
+		t.Fatalf("Expected EOF after the data, not %q (%v)", data, err)
+	}
+	if trailers := stream.Trailers(); trailers.Get("x-checksum") != "5d41402a" {
+		t.Errorf("Expected the trailers after EOF, not %#v", trailers)
+	}
+	if headers := stream.InputHeaders(); headers.Get("x-checksum") != "" || headers.Get("status") != "200" {
+		t.Errorf("Trailers shouldn't be merged in the headers: %#v", headers)
+	}
+
+	// Trailers are only available once the peer half-closed the stream
+	stream, peer = NewStream(3, true)
+	stream.Syn(nil, true)
+	peer.Reply(nil, false)
+	peer.WriteDataFrame([]byte("hello"), false)
+	if trailers := stream.Trailers(); trailers != nil {
+		t.Errorf("Expected no trailers before the end of the stream, not %#v", trailers)
+	}
+	peer.WriteDataFrame(nil, true)
+	if trailers := stream.Trailers(); trailers == nil || len(trailers) != 0 {
+		t.Errorf("Expected empty trailers at the end of a stream without any, not %#v", trailers)
+	}
+}
+
+func TestSimultaneousReset(t *testing.T) {
+	// Frames from the peer crossing our RST_STREAM are dropped, without
+	// answering them
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Rst(Cancel); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []Frame{&SynReplyFrame{StreamId: 1}, &RstStreamFrame{StreamId: 1, Status: Cancel}} {
+		if err := peer.WriteFrame(frame); err != nil {
+			t.Errorf("%T crossing a RST_STREAM should be dropped: %s", frame, err)
+		}
+	}
+	for _, expected := range []string{"*spdy.SynStreamFrame", "*spdy.RstStreamFrame"} {
+		if frame, err := peer.ReadFrame(); err != nil || fmt.Sprintf("%T", frame) != expected {
+			t.Fatalf("Expected %s, not %#v (%v)", expected, frame, err)
+		}
+	}
+	if frame, err := peer.input.readFrame(time.After(50 * time.Millisecond)); err == nil {
+		t.Errorf("Nothing should be sent after RST_STREAM, not %#v", frame)
+	}
+
+	// Between sessions
+	client := NewSession(new(DummyHandler), false)
+	server := NewSession(new(DummyHandler), true)
+	server.EnableAccept(1)
+	stream, err := client.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	syn, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WriteFrame(syn); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both sides reset the stream before receiving the other's RST_STREAM
+	if err := stream.Rst(Cancel); err != nil {
+		t.Fatal(err)
+	}
+	if err := accepted.Rst(InternalError); err != nil {
+		t.Fatal(err)
+	}
+	var rsts [2]Frame
+	for i, session := range []*Session{client, server} {
+		if rsts[i], err = session.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.WriteFrame(rsts[1]); err != nil {
+		t.Errorf("The client should accept the crossing RST_STREAM: %s", err)
+	}
+	if err := server.WriteFrame(rsts[0]); err != nil {
+		t.Errorf("The server should accept the crossing RST_STREAM: %s", err)
+	}
+	for _, session := range []*Session{client, server} {
+		if frame, err := session.outputR.readFrame(time.After(50 * time.Millisecond)); err != errPipeTimeout {
+			t.Errorf("A RST_STREAM should never answer a RST_STREAM, sent %#v", frame)
+		}
+		if session.Closed() {
+			t.Errorf("The session should survive the reset")
+		}
+		waitFor(t, "the stream to be released", func() bool { return session.NStreams() == 0 })
+	}
+	for _, s := range []*Stream{stream, accepted} {
+		if reset, ok := s.Wait().(*StreamResetError); !ok || !reset.Local {
+			t.Errorf("Each side should see its own reset, not %#v", s.Wait())
+		}
+	}
+}
+
+func TestBodyWriter(t *testing.T) {
+	stream, peer := NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	body := stream.BodyWriter()
+	if n, err := body.Write(make([]byte, 100 * 1024)); err != nil || n != 100 * 1024 {
+		t.Fatalf("Wrote %d bytes: %v", n, err)
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := body.Write([]byte("x")); err == nil {
+		t.Errorf("Writing after Close should fail")
+	}
+	if _, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	frames, total := 0, 0
+	for {
+		frame, err := peer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := frame.(*DataFrame)
+		if len(data.Data) > DefaultMaxPayload {
+			t.Errorf("DATA frame of %d bytes", len(data.Data))
+		}
+		frames, total = frames + 1, total + len(data.Data)
+		if data.GetFinFlag() {
+			if len(data.Data) != 0 {
+				t.Errorf("Close should send an empty DATA frame with FLAG_FIN")
+			}
+			break
+		}
+	}
+	if frames != 8 || total != 100 * 1024 {
+		t.Errorf("Expected 7 frames of DATA and a FIN, with 100KB, not %d frames with %d bytes", frames, total)
+	}
+
+	// A reset stream can't be written to
+	stream, _ = NewStream(1, true)
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	stream.Rst(Cancel)
+	if _, err := stream.BodyWriter().Write([]byte("x")); err == nil {
+		t.Errorf("Writing on a reset stream should fail")
+	}
+}
+
+func TestOpenStream(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	_, err := Serve(serverConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Serve(clientConn, new(DummyHandler), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.OpenStream(&http.Header{"url": {"/world"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Id != 1 {
+		t.Errorf("The first client stream should be 1, not %d", stream.Id)
+	}
+	if err := stream.BodyWriter().Close(); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, stream.BodyReader()); err != nil {
+		t.Fatal(err)
+	}
+	if body.String() != "hello /world" {
+		t.Errorf("Unexpected response: %q", body.String())
+	}
+	if next, err := client.OpenStream(nil); err != nil || next.Id != 3 {
+		t.Errorf("The next stream should be 3, not %#v (%v)", next, err)
+	}
+}
+
+// A client which read enough of a response cancels the rest of it, whether
+// or not it half-closed the stream.
+func TestStopReceiving(t *testing.T) {
+	for _, halfClosed := range []bool{false, true} {
+		session := NewSession(nil, false)
+		stream, err := session.OpenStream(&http.Header{"url": {"/big"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if halfClosed {
+			if err := stream.BodyWriter().Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		session.WriteFrame(&SynReplyFrame{StreamId: stream.Id, Headers: http.Header{"status": {"200"}}})
+		for i := 0; i < 3; i++ {
+			session.WriteFrame(&DataFrame{StreamId: stream.Id, Data: []byte("chunk")})
+		}
+		if _, err := stream.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.StopReceiving(); err != nil {
+			t.Fatalf("halfClosed=%v: %s", halfClosed, err)
+		}
+		if frame, err := stream.ReadFrame(); err == nil {
+			t.Errorf("halfClosed=%v: buffered frames should be discarded, not read: %#v", halfClosed, frame)
+		}
+		for {
+			frame, err := session.outputR.readFrame(time.After(time.Second))
+			if err != nil {
+				t.Fatalf("halfClosed=%v: no RST_STREAM sent: %s", halfClosed, err)
+			}
+			if rst, isRst := frame.(*RstStreamFrame); isRst {
+				if rst.Status != Cancel {
+					t.Errorf("halfClosed=%v: the stream should be reset with CANCEL, not %d", halfClosed, rst.Status)
+				}
+				break
+			}
+		}
+		waitFor(t, "the stream to be removed", func() bool {
+			_, exists := session.getStream(stream.Id)
+			return !exists
+		})
+		if rst, isRst := stream.Wait().(*StreamResetError); !isRst || rst.Status != Cancel || !rst.Local {
+			t.Errorf("halfClosed=%v: the stream should end with a local CANCEL, not %v", halfClosed, stream.Wait())
+		}
+		if err := stream.StopReceiving(); err != nil {
+			t.Errorf("halfClosed=%v: stopping an ended stream should do nothing, not fail with %s", halfClosed, err)
+		}
+	}
+}
+
+// After Shutdown, the connection stays open for the streams in flight, but
+// is closed after GoAwayGracePeriod if they stall.
+func TestGoAwayGracePeriod(t *testing.T) {
+	for _, stall := range []bool{false, true} {
+		release := make(chan bool)
+		clientConn, serverConn := net.Pipe()
+		server, err := Serve(serverConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+			<-release
+			w.Write([]byte(" world"))
+		}), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock := NewMockClock(time.Unix(0, 0))
+		server.Clock = clock
+		server.GoAwayGracePeriod = time.Minute
+		client, err := Serve(clientConn, new(DummyHandler), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := client.OpenStream(&http.Header{"url": {"/"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.BodyWriter().Close()
+		body := stream.BodyReader()
+		hello := make([]byte, 5)
+		if _, err := io.ReadFull(body, hello); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "GOAWAY", func() bool { return !client.reusable() })
+		if stall {
+			clock.BlockUntil(1)
+			if client.Closed() {
+				t.Errorf("The connection should stay open during the grace period")
+			}
+			clock.Advance(time.Minute)
+			waitFor(t, "the connection to close", client.Closed)
+			if _, err := ioutil.ReadAll(body); err != ErrConnectionClosed {
+				t.Errorf("A stalled stream should fail with ErrConnectionClosed, not %v", err)
+			}
+			close(release)
+			continue
+		}
+		// A peer which opens a stream before it receives GOAWAY is refused
+		client.lock.Lock()
+		client.goAwayReceived = false
+		client.lock.Unlock()
+		refused, err := client.OpenStream(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := refused.ReplyHeaders(); err == nil || err.(*StreamResetError).Status != RefusedStream {
+			t.Errorf("Streams opened after GOAWAY should be refused, not %v", err)
+		}
+		close(release)
+		if rest, err := ioutil.ReadAll(body); err != nil || string(rest) != " world" {
+			t.Errorf("The stream in flight should complete, not end with %q (%v)", rest, err)
+		}
+		waitFor(t, "the connection to close", client.Closed)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	release := make(chan bool)
+	clientConn, serverConn := net.Pipe()
+	server, err := Serve(serverConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("hello"))
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Serve(clientConn, new(DummyHandler), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.OpenStream(&http.Header{"url": {"/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.BodyWriter().Close()
+	waitFor(t, "the stream to reach the server", func() bool { return server.NStreams() == 1 })
+	if err := server.GoAway(InternalError); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "GOAWAY", func() bool { return !client.reusable() })
+	if _, err := client.OpenStream(nil); err != ErrGoAwayReceived {
+		t.Errorf("Opening a stream after GOAWAY should fail with ErrGoAwayReceived, not %v", err)
+	}
+	// The stream in flight completes, then the session closes
+	close(release)
+	if body, err := ioutil.ReadAll(stream.BodyReader()); err != nil || string(body) != "hello" {
+		t.Errorf("The stream in flight should complete, not end with %q (%v)", body, err)
+	}
+	waitFor(t, "the connection to close", client.Closed)
+
+	// The GOAWAY carries the status, and the last stream opened by the peer
+	session := NewSession(new(DummyHandler), true)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.GoAway(InternalError); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame, err := session.outputR.readFrame(time.After(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if goAway, isGoAway := frame.(*GoAwayFrame); isGoAway {
+			if goAway.LastGoodStreamId != 1 || goAway.Status != InternalError {
+				t.Errorf("Unexpected %v", goAway)
+			}
+			break
+		}
+	}
+}
+
+// A StreamObserver recording the events of the streams as strings
+type recordingObserver struct {
+	lock	sync.Mutex
+	events	[]string
+}
+
+func (o *recordingObserver) record(format string, args ...interface{}) {
+	o.lock.Lock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+	o.lock.Unlock()
+}
+
+func (o *recordingObserver) StreamOpened(stream *Stream) {
+	o.record("opened %d", stream.Id)
+}
+
+func (o *recordingObserver) ReplyReceived(stream *Stream, headers http.Header) {
+	o.record("reply %d %s", stream.Id, headers.Get("status"))
+}
+
+func (o *recordingObserver) FirstByteReceived(stream *Stream) {
+	o.record("first byte %d", stream.Id)
+}
+
+func (o *recordingObserver) LastByteReceived(stream *Stream) {
+	o.record("last byte %d", stream.Id)
+}
+
+func (o *recordingObserver) StreamClosed(stream *Stream, err error) {
+	o.record("closed %d %v", stream.Id, err)
+}
+
+func (o *recordingObserver) Events() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]string(nil), o.events...)
+}
+
+func TestStreamObserver(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	_, err := Serve(serverConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("oops")
+		}
+		w.Write([]byte("hello"))
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Serve(clientConn, new(DummyHandler), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer := new(recordingObserver)
+	client.Observer = observer
+	for _, path := range []string{"/hello", "/panic"} {
+		stream, err := client.OpenStream(&http.Header{"url": {path}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.BodyWriter().Close()
+		ioutil.ReadAll(stream.BodyReader())
+		stream.Wait()
+	}
+	expected := []string{
+		"opened 1", "reply 1 200", "first byte 1", "last byte 1", "closed 1 <nil>",
+		"opened 3", "closed 3 Stream 3 reset by peer (status 6)",
+	}
+	waitFor(t, "the events", func() bool { return len(observer.Events()) >= len(expected) })
+	if events := observer.Events(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected the events\n%q\nnot\n%q", expected, events)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request", fmt.Sprintf("%s %s://%s%s %s", r.Method, r.URL.Scheme, r.Host, r.URL.RequestURI(), r.Proto))
+		if r.URL.Query().Get("trailer") != "" {
+			w.Header().Set("Trailer", "X-Length")
+		}
+		w.WriteHeader(http.StatusCreated)
+		n, _ := io.Copy(w, r.Body)
+		w.Header().Set("X-Length", fmt.Sprint(n))
+	})
+	if _, err := Serve(serverConn, HTTPHandler(echo), true); err != nil {
+		t.Fatal(err)
+	}
+	client, err := Serve(clientConn, new(DummyHandler), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Send `body` with `headers`, and return the frames received in response
+	request := func(headers http.Header, body string) []Frame {
+		stream, err := client.OpenStream(&headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := stream.BodyWriter()
+		if _, err := writer.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var frames []Frame
+		for {
+			frame, err := stream.ReadFrame()
+			if err == io.EOF {
+				return frames
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, frame)
+		}
+	}
+	frameBody := func(frames []Frame) string {
+		body := ""
+		for _, frame := range frames {
+			if data, isData := frame.(*DataFrame); isData {
+				body += string(data.Data)
+			}
+		}
+		return body
+	}
+	// SPDY/2 headers: the last DATA frame carries FLAG_FIN
+	frames := request(http.Header{"method": {"POST"}, "url": {"/echo"}, "host": {"example.com"}, "version": {"HTTP/1.1"}}, "hello")
+	reply, isReply := frames[0].(*SynReplyFrame)
+	if !isReply {
+		t.Fatalf("Expected SYN_REPLY, not %v", frames[0])
+	}
+	if status := reply.Headers.Get("status"); status != "201 Created" {
+		t.Errorf("Unexpected status %q", status)
+	}
+	if r := reply.Headers.Get("x-request"); r != "POST https://example.com/echo HTTP/1.1" {
+		t.Errorf("Unexpected request %q", r)
+	}
+	if body := frameBody(frames); body != "hello" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if last, isData := frames[len(frames) - 1].(*DataFrame); !isData || !last.GetFinFlag() || string(last.Data) != "hello" {
+		t.Errorf("The last chunk of body should carry FLAG_FIN, not %v", frames[len(frames) - 1])
+	}
+	// SPDY/3 headers, with trailers sent in the last frame
+	frames = request(http.Header{":method": {"PUT"}, ":path": {"/echo?trailer=1"}, ":host": {"example.com"}, ":scheme": {"http"}, ":version": {"HTTP/1.0"}}, "hello world")
+	reply = frames[0].(*SynReplyFrame)
+	if status := reply.Headers.Get(":status"); status != "201 Created" {
+		t.Errorf("Unexpected status %q", status)
+	}
+	if r := reply.Headers.Get("x-request"); r != "PUT http://example.com/echo?trailer=1 HTTP/1.0" {
+		t.Errorf("Unexpected request %q", r)
+	}
+	if reply.Headers.Get("x-length") != "" {
+		t.Errorf("Trailers should not be sent in the SYN_REPLY")
+	}
+	if body := frameBody(frames); body != "hello world" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if last, isHeaders := frames[len(frames) - 1].(*HeadersFrame); !isHeaders || !last.GetFinFlag() || last.Headers.Get("x-length") != "11" {
+		t.Errorf("The trailers should be sent in a HEADERS frame with FLAG_FIN, not %v", frames[len(frames) - 1])
+	}
+}
+
+func TestTransport(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request", fmt.Sprintf("%s %s %s", r.Method, r.Host, r.URL.RequestURI()))
+		w.Header().Set("Trailer", "X-Length")
+		n, _ := io.Copy(w, r.Body)
+		w.Header().Set("X-Length", fmt.Sprint(n))
+	})
+	for _, framing := range []Framing{SPDY2, SPDY3} {
+		dials := 0
+		transport := &Transport{
+			Framing: framing,
+			Dial: func(network, addr string) (net.Conn, error) {
+				if addr != "example.com:80" {
+					t.Errorf("Unexpected address %s", addr)
+				}
+				dials++
+				clientConn, serverConn := net.Pipe()
+				if _, err := ServeFraming(serverConn, HTTPHandler(echo), true, framing); err != nil {
+					return nil, err
+				}
+				return clientConn, nil
+			},
+		}
+		client := &http.Client{Transport: transport}
+		for i := 0; i < 3; i++ {
+			body := strings.Repeat("hello", i * 10000)
+			resp, err := client.Post("http://example.com/echo?i=" + fmt.Sprint(i), "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Unexpected status %q", resp.Status)
+			}
+			if r := resp.Header.Get("X-Request"); r != fmt.Sprintf("POST example.com /echo?i=%d", i) {
+				t.Errorf("Unexpected request %q", r)
+			}
+			received, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if string(received) != body {
+				t.Errorf("The body should be echoed: sent %d bytes, received %d", len(body), len(received))
+			}
+			if n := resp.Trailer.Get("X-Length"); n != fmt.Sprint(len(body)) {
+				t.Errorf("Unexpected trailer %q", n)
+			}
+		}
+		if dials != 1 {
+			t.Errorf("Requests to the same host should share a session, not dial %d times", dials)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+// A Writer which fails to write the SYN_STREAM of stream `failOn` with `err`
+type failingPeer struct {
+	failOn	uint32
+	err	error
+	closed	chan struct{}
+	syns	int32	// SYN_STREAMs written
+}
+
+func (p *failingPeer) WriteFrame(frame Frame) error {
+	if syn, isSyn := frame.(*SynStreamFrame); isSyn {
+		if syn.StreamId == p.failOn {
+			return p.err
+		}
+		atomic.AddInt32(&p.syns, 1)
+	}
+	return nil
+}
+
+func (p *failingPeer) ReadFrame() (Frame, error) {
+	<-p.closed
+	return nil, io.EOF
+}
+
+// A connection which can't be written to
+type brokenConn struct {
+	net.Conn
+}
+
+func (c *brokenConn) Write(data []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}
+}
+
+// Write errors are classified, and the requests which didn't reach the peer
+// are marked as replayable.
+func TestWriteError(t *testing.T) {
+	syscallError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", errno)}
+	}
+	for _, test := range []struct {
+		err	error
+		kind	WriteErrorKind
+	}{
+		{os.ErrDeadlineExceeded, WriteTimeout},
+		{syscallError(syscall.ECONNRESET), WriteConnectionReset},
+		{syscallError(syscall.EPIPE), WriteBrokenPipe},
+		{io.ErrClosedPipe, WriteBrokenPipe},
+		{errors.New("oops"), WriteFailed},
+	} {
+		if kind := classifyWriteError(test.err); kind != test.kind {
+			t.Errorf("%v should be classified as %s, not %s", test.err, test.kind, kind)
+		}
+	}
+
+	peer := &failingPeer{failOn: 3, err: syscallError(syscall.EPIPE), closed: make(chan struct{})}
+	defer close(peer.closed)
+	session := NewSession(new(DummyHandler), false)
+	served := make(chan error, 1)
+	go func() { served <- session.Serve(peer) }()
+	sent, err := session.OpenStream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first SYN_STREAM to be written", func() bool {
+		return atomic.LoadInt32(&peer.syns) == 1
+	})
+	unsent, err := session.OpenStream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, isWrite := (<-served).(*WriteError); !isWrite || w.Kind != WriteBrokenPipe {
+		t.Errorf("Serve should fail with a broken pipe, not %#v", w)
+	}
+	if w, isWrite := sent.Wait().(*WriteError); !isWrite || w.Replayable {
+		t.Errorf("A stream which reached the peer should fail with a non-replayable WriteError, not %#v", sent.Wait())
+	}
+	if w, isWrite := unsent.Wait().(*WriteError); !isWrite || !w.Replayable {
+		t.Errorf("A stream which never reached the peer should fail with a replayable WriteError, not %#v", unsent.Wait())
+	}
+
+	// The Transport retries unsent requests on a new session
+	dials := 0
+	transport := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials++
+			clientConn, serverConn := net.Pipe()
+			if _, err := Serve(serverConn, HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "hello")
+			})), true); err != nil {
+				return nil, err
+			}
+			if dials == 1 {
+				return &brokenConn{clientConn}, nil
+			}
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "hello" {
+		t.Errorf("Unexpected response %q (%v)", body, err)
+	}
+	if dials != 2 {
+		t.Errorf("The request should be retried on a second connection, not %d", dials)
+	}
+}
+
+func TestTransportRefusedStream(t *testing.T) {
+	var attempts int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.(*ResponseWriter).Rst(RefusedStream)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	dials := 0
+	clock := NewMockClock(time.Unix(0, 0))
+	transport := &Transport{
+		RetryBackoff:	time.Second,
+		MaxRefusals:	2,
+		Clock:		clock,
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials++
+			clientConn, serverConn := net.Pipe()
+			if _, err := Serve(serverConn, handler, true); err != nil {
+				return nil, err
+			}
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	done := make(chan error, 1)
+	go func() {
+		resp, err := transport.RoundTrip(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}})
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(resp.Body)
+			if err == nil && string(body) != "ok" {
+				err = fmt.Errorf("Unexpected body %q", body)
+			}
+		}
+		done <- err
+	}()
+	// Each refusal doubles the delay before the next attempt
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second} {
+		clock.BlockUntil(1)
+		clock.Advance(backoff - time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		if n := atomic.LoadInt32(&attempts); n != int32(i + 1) {
+			t.Fatalf("Retried before the backoff of %s: %d attempts", backoff, n)
+		}
+		clock.Advance(time.Millisecond)
+		waitFor(t, "a retry", func() bool { return atomic.LoadInt32(&attempts) == int32(i + 2) })
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if dials != 2 {
+		t.Errorf("After 2 refusals in a row, the session should be replaced (%d dials)", dials)
+	}
+	// Without retries, the refusal is returned
+	atomic.StoreInt32(&attempts, 0)
+	transport.MaxRetries = -1
+	_, err := transport.RoundTrip(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}})
+	if reset, isReset := err.(*StreamResetError); !isReset || reset.Status != RefusedStream {
+		t.Errorf("Expected REFUSED_STREAM, not %v", err)
+	}
+}
+
+// The timeout of an http.Client interrupts a request whose response never
+// comes, and resets its stream.
+func TestTransportTimeout(t *testing.T) {
+	reset := make(chan Frame, 1)
+	transport := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			clientConn, serverConn := net.Pipe()
+			framer, err := NewFramer(serverConn, serverConn)
+			if err != nil {
+				return nil, err
+			}
+			// A server which never replies
+			go func() {
+				for {
+					frame, err := framer.ReadFrame()
+					if err != nil {
+						return
+					}
+					if _, isRst := frame.(*RstStreamFrame); isRst {
+						reset <- frame
+					}
+				}
+			}()
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 50 * time.Millisecond}
+	if _, err := client.Get("http://example.com/"); err == nil {
+		t.Fatal("The request should time out")
+	} else if e, isNetError := err.(net.Error); !isNetError || !e.Timeout() {
+		t.Fatalf("Expected a timeout, not %v", err)
+	}
+	select {
+		case frame := <-reset:
+			if status := frame.(*RstStreamFrame).Status; status != Cancel {
+				t.Errorf("Expected CANCEL, not %s", status)
+			}
+		case <-time.After(time.Second):
+			t.Error("The stream wasn't reset")
+	}
+}
+
+// Once the connection of its session drops, a Transport dials again.
+func TestTransportRedial(t *testing.T) {
+	ok := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	var lock sync.Mutex
+	var conns []net.Conn
+	transport := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			clientConn, serverConn := net.Pipe()
+			if _, err := Serve(serverConn, ok, true); err != nil {
+				return nil, err
+			}
+			lock.Lock()
+			conns = append(conns, serverConn)
+			lock.Unlock()
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	dials := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(conns)
+	}
+	for i := 1; i <= 2; i++ {
+		resp, err := transport.RoundTrip(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "ok" {
+			t.Fatalf("Unexpected response %q (%v)", body, err)
+		}
+		if dials() != i {
+			t.Fatalf("Expected %d dials, not %d", i, dials())
+		}
+		// Drop the connection
+		lock.Lock()
+		conns[i - 1].Close()
+		lock.Unlock()
+	}
+}
+
+// A body which records that it was closed
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (body *closeRecorder) Close() error {
+	close(body.closed)
+	return nil
+}
+
+// The body of a request which can't be sent is closed all the same.
+func TestTransportDialErrorClosesBody(t *testing.T) {
+	transport := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return nil, errors.New("Connection refused")
+		},
+	}
+	body := &closeRecorder{Reader: strings.NewReader("hello"), closed: make(chan struct{})}
+	req, err := http.NewRequest("POST", "http://example.com/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("The request should fail")
+	}
+	select {
+		case <-body.closed:
+		default:
+			t.Error("The body wasn't closed")
+	}
+}
+
+// A slow dial doesn't hold up the requests to other servers, and the
+// requests to the same server wait for it rather than dialing again.
+func TestTransportSlowDial(t *testing.T) {
+	ok := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	release := make(chan struct{})
+	var lock sync.Mutex
+	dials := make(map[string]int)
+	transport := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			lock.Lock()
+			dials[addr]++
+			lock.Unlock()
+			if addr == "slow.example.com:80" {
+				<-release
+			}
+			clientConn, serverConn := net.Pipe()
+			if _, err := Serve(serverConn, ok, true); err != nil {
+				return nil, err
+			}
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	get := func(host string) error {
+		resp, err := transport.RoundTrip(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: host, Path: "/"}})
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	slow := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { slow <- get("slow.example.com") }()
+	}
+	waitFor(t, "the slow dial", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return dials["slow.example.com:80"] == 1
+	})
+	fast := make(chan error, 1)
+	go func() { fast <- get("fast.example.com") }()
+	select {
+		case err := <-fast:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("The request to another server waited for the slow dial")
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-slow; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := dials["slow.example.com:80"]; n != 1 {
+		t.Errorf("The requests to the slow server should share its dial, not dial %d times", n)
+	}
+}
+
+// Beyond the server's SETTINGS_MAX_CONCURRENT_STREAMS, requests wait for a
+// stream of the same session to end, until their context is done.
+func TestTransportStreamLimit(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	handler := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		fmt.Fprint(w, "ok")
+	}))
+	dials := 0
+	transport := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials++
+			clientConn, serverConn := net.Pipe()
+			server, err := Serve(serverConn, handler, true)
+			if err != nil {
+				return nil, err
+			}
+			if err := server.SendInitialSettings(SettingsFlagIdValue{Id: SettingsMaxConcurrentStreams, Value: 1}); err != nil {
+				return nil, err
+			}
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	get := func(ctx context.Context) error {
+		req := (&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}}).WithContext(ctx)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	first := make(chan error, 1)
+	go func() { first <- get(context.Background()) }()
+	<-entered
+	waitFor(t, "the SETTINGS of the server", func() bool {
+		transport.lock.Lock()
+		defer transport.lock.Unlock()
+		_, received := transport.sessions["http://example.com:80"].PeerSetting(SettingsMaxConcurrentStreams)
+		return received
+	})
+	// The peer's limit is reached: the request waits until its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if err := get(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline of the request, not %v", err)
+	}
+	if len(entered) != 0 {
+		t.Error("The request beyond the limit shouldn't be sent")
+	}
+	second := make(chan error, 1)
+	go func() { second <- get(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for _, done := range []chan error{first, second} {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dials != 1 {
+		t.Errorf("The requests should wait on the same session, not dial %d times", dials)
+	}
+}
+
+// A session idle for IdlePingThreshold is pinged before it is reused, and
+// replaced if the echo doesn't come.
+func TestTransportIdlePing(t *testing.T) {
+	ok := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	dials := 0
+	clock := NewMockClock(time.Unix(0, 0))
+	transport := &Transport{
+		IdlePingThreshold:	time.Minute,
+		IdlePingTimeout:	50 * time.Millisecond,
+		Clock:			clock,
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials++
+			clientConn, serverConn := net.Pipe()
+			server, err := Serve(serverConn, ok, true)
+			if err != nil {
+				return nil, err
+			}
+			if dials == 1 {
+				// A stale connection: the server never answers the PING
+				server.Clock = NewMockClock(time.Unix(0, 0))
+				server.PingEchoDelay(time.Hour)
+			}
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	get := func() error {
+		resp, err := transport.RoundTrip(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil && string(body) != "ok" {
+			err = fmt.Errorf("Unexpected body %q", body)
+		}
+		return err
+	}
+	for i, test := range []struct {
+		idle	time.Duration
+		dials	int
+	}{
+		{0, 1},
+		{time.Second, 1},	// Not idle for long enough to be pinged
+		{time.Minute, 2},	// The PING fails: a new session is dialed
+		{time.Minute, 2},	// The PING is echoed: the session is reused
+	} {
+		clock.Advance(test.idle)
+		if err := get(); err != nil {
+			t.Fatalf("Request %d: %s", i, err)
+		}
+		if dials != test.dials {
+			t.Errorf("Request %d: expected %d dials, not %d", i, test.dials, dials)
+		}
+	}
+}
+
+// CloseIdleConnections leaves the sessions in use open, until the end of the
+// response bodies.
+func TestTransportCloseIdleConnections(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/busy" {
+			close(entered)
+			<-release
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	dials := 0
+	transport := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials++
+			clientConn, serverConn := net.Pipe()
+			if _, err := Serve(serverConn, handler, true); err != nil {
+				return nil, err
+			}
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	get := func(path string) (string, error) {
+		resp, err := transport.RoundTrip(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: path}})
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+	busy := make(chan error, 1)
+	go func() {
+		body, err := get("/busy")
+		if err == nil && body != "ok" {
+			err = fmt.Errorf("Unexpected body %q", body)
+		}
+		busy <- err
+	}()
+	<-entered
+	transport.CloseIdleConnections()
+	close(release)
+	if err := <-busy; err != nil {
+		t.Fatalf("A request in progress should survive CloseIdleConnections: %v", err)
+	}
+	if _, err := get("/"); err != nil || dials != 1 {
+		t.Errorf("The session should still be open (%d dials, err=%v)", dials, err)
+	}
+	// Once idle, the session is closed
+	transport.CloseIdleConnections()
+	if _, err := get("/"); err != nil || dials != 2 {
+		t.Errorf("The idle session should be closed (%d dials, err=%v)", dials, err)
+	}
+}
+
+// Idempotent requests are retried when their session fails before the
+// response, the others fail with the error of the session.
+func TestTransportIdempotentRetry(t *testing.T) {
+	for _, test := range []struct {
+		method	string
+		header	string
+		retried	bool
+	}{
+		{"GET", "", true},
+		{"PUT", "", true},
+		{"POST", "", false},
+		{"POST", "Idempotency-Key", true},
+	} {
+		var attempts int32
+		dials := 0
+		transport := &Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				dials++
+				clientConn, serverConn := net.Pipe()
+				// The first connection is lost once the request reached the server
+				handler := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if atomic.AddInt32(&attempts, 1) == 1 {
+						serverConn.Close()
+						return
+					}
+					body, _ := ioutil.ReadAll(r.Body)
+					fmt.Fprintf(w, "%s %s", r.Method, body)
+				}))
+				if _, err := Serve(serverConn, handler, true); err != nil {
+					return nil, err
+				}
+				return clientConn, nil
+			},
+		}
+		req, err := http.NewRequest(test.method, "http://example.com/", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			req.Header.Set(test.header, "42")
+		}
+		resp, err := transport.RoundTrip(req)
+		if !test.retried {
+			if _, isWrite := err.(*WriteError); err != ErrConnectionClosed && !isWrite {
+				t.Errorf("%s %s: expected the error of the session, not %v", test.method, test.header, err)
+			}
+			if dials != 1 || atomic.LoadInt32(&attempts) != 1 {
+				t.Errorf("%s %s shouldn't be retried (%d dials)", test.method, test.header, dials)
+			}
+			transport.CloseIdleConnections()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.method, test.header, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != test.method + " hello" {
+			t.Errorf("%s %s: unexpected response %q (%v)", test.method, test.header, body, err)
+		}
+		if dials != 2 {
+			t.Errorf("%s %s should be retried on a second connection, not %d", test.method, test.header, dials)
+		}
+		transport.CloseIdleConnections()
+	}
+	// The retries are capped by MaxRetries
+	dials := 0
+	transport := &Transport{
+		MaxRetries:	2,
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials++
+			clientConn, serverConn := net.Pipe()
+			handler := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serverConn.Close()
+			}))
+			if _, err := Serve(serverConn, handler, true); err != nil {
+				return nil, err
+			}
+			return clientConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	_, err := transport.RoundTrip(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}})
+	if _, isWrite := err.(*WriteError); err != ErrConnectionClosed && !isWrite {
+		t.Errorf("Expected the error of the session, not %v", err)
+	}
+	if dials != 3 {
+		t.Errorf("The request should be sent 3 times, not %d", dials)
+	}
+}
+
+func TestTLSNegotiation(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	ConfigureHTTPServer(server.Config)
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	// The protocol negotiated decides the version of SPDY of the session
+	for _, protos := range [][]string{nil, {"spdy/3"}, {"spdy/2"}, {"http/1.1"}} {
+		config := &tls.Config{RootCAs: roots, ServerName: "example.com", NextProtos: protos}
+		if protos == nil {
+			ConfigureClient(config)
+		}
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		session, err := NewClientTLS(conn, new(DummyHandler))
+		negotiated := conn.ConnectionState().NegotiatedProtocol
+		if protos != nil && protos[0] == "http/1.1" {
+			if err != ErrNotSPDY {
+				t.Errorf("Negotiating %q should return ErrNotSPDY, not %v", negotiated, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		expected := "spdy/3"
+		if protos != nil {
+			expected = protos[0]
+		}
+		if negotiated != expected {
+			t.Errorf("Expected %s to be negotiated, not %q", expected, negotiated)
+		}
+		stream, err := session.OpenStream(&http.Header{"method": {"GET"}, "url": {"/"}, ":method": {"GET"}, ":path": {"/"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.BodyWriter().Close(); err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(stream.BodyReader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello" {
+			t.Errorf("Unexpected response over %s: %q", negotiated, body)
+		}
+	}
+	// A Transport uses the header names of the version negotiated, unless
+	// it is given a Framing
+	for _, framing := range []Framing{nil, SPDY3, SPDY2} {
+		transport := &Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}, Framing: framing}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "hello" {
+			t.Errorf("Unexpected response with %v: %q (%v)", framing, body, err)
+		}
+		transport.CloseIdleConnections()
+	}
+	// Clients without SPDY fall back to HTTP/1.1
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); resp.Proto != "HTTP/1.1" || string(body) != "hello" {
+		t.Errorf("Unexpected %s response: %q", resp.Proto, body)
+	}
+}
+
+func TestCredentialSlots(t *testing.T) {
+	session := NewSession(new(DummyHandler), true)
+	session.CredentialSlots = 2
+	chain := [][]byte{[]byte("leaf"), []byte("issuer")}
+	for _, slot := range []uint16{0, 1, 3} {
+		if err := session.WriteFrame(&CredentialFrame{Slot: slot, Certificates: chain}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if credential, received := session.Credential(1); !received || len(credential.Certificates) != 2 {
+		t.Errorf("Expected the chain in slot 1, not (%v, %v)", credential, received)
+	}
+	for _, slot := range []uint16{0, 2, 3} {
+		if _, received := session.Credential(slot); received {
+			t.Errorf("Slot %d should be empty", slot)
+		}
+	}
+	// Clients don't keep credentials
+	client := NewSession(new(DummyHandler), false)
+	if err := client.WriteFrame(&CredentialFrame{Slot: 1, Certificates: chain}); err != nil {
+		t.Fatal(err)
+	}
+	if _, received := client.Credential(1); received {
+		t.Errorf("A client shouldn't keep credentials")
+	}
+}
@@ -9,11 +9,18 @@
 package spdy
 
 import (
+	"context"
 	"net/http"
 	"errors"
 	"io"
 	"io/ioutil"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 
@@ -22,51 +29,777 @@ import (
 */
 
 type Stream struct {
+	// DATA payload bytes sent and received by the application. First in
+	// the struct, so that they are 64-bit aligned for the atomic package.
+	bytesSent	int64
+	bytesReceived	int64
+	byteLimit	int64	// See SetByteLimit. 0 means no limit
+	// Flow-control accounting, in bytes of DATA on the wire: sent minus
+	// acknowledged by the peer, received minus acknowledged by us, and the
+	// peer's initial window.
+	sendConsumed	int64
+	recvConsumed	int64
+	sendInitial	int64
+	enforceWindow	int32	// Set once the peer announced its window: see SendWindow
+	synWritten	int32	// Set on the peer end once our SYN_STREAM was written to the connection
+	windowChanged	*sync.Cond	// Signalled when the send window grows, or the stream closes
 	Id		uint32
 	input		*StreamPipeReader
 	output		*StreamPipeWriter
 	errors		[]*Error
+	errorsLock	sync.Mutex	// errors are queued and sent from different goroutines
 	local		bool	// Was this stream created locally?
 	sendErrors	bool
 	Closed		bool
-	// FIXME: unidirectional
-	// FIXME: priority
+	closeLock	sync.Mutex	// Protects Closed: the session and the application may close a stream concurrently
+	// If true, RstWithReason sends its reason to the peer in a HEADERS
+	// frame before the RST_STREAM. This is not part of the spec.
+	SendResetReason	bool
+	// If non-zero, the maximum amount of time to wait for a SYN_REPLY
+	// after sending SYN_STREAM on a locally initiated stream.
+	ResponseHeaderTimeout	time.Duration
+	synSent		time.Time
+	clock		Clock	// Used for all timeouts. If nil, RealClock is used.
+	peer		*Stream	// The other end of the stream
+	synForwarded	chan struct{}	// Closed once the first frame of a local stream reached the session
+	associated	*Stream	// The stream this stream was pushed from
+	pushes		[]*Stream	// The streams pushed from this stream
+	// If set, called by ReadFrame for each informational (1xx) reply
+	// received on the stream. Interim replies are never returned by
+	// ReadFrame itself.
+	OnInterim	func(status int, headers http.Header)
+	interimSent	bool	// True if we sent interim replies but no final reply yet
+	interimReceived	bool	// True if we received interim replies but no final reply yet
+	// If true (the default), closing the stream before its output was
+	// half-closed sends a final empty DATA frame with FLAG_FIN, so the
+	// peer knows the stream ended cleanly. If nothing was sent yet on
+	// a stream initiated by the peer, RST_STREAM (CANCEL) is sent instead.
+	FinOnClose	bool
+	logger		Logger	// The session logger. If nil, debug() is used.
+	// If non-zero, the flow-control window for data received on the
+	// stream. As the body returned by ParseHTTPRequest is read, consumed
+	// bytes are acknowledged to the peer with WINDOW_UPDATE frames,
+	// batched until half of the window is consumed.
+	ReceiveWindow	uint32
+	// Where to send WINDOW_UPDATE frames, which must get through even after
+	// the stream is half-closed. If nil, they are written on the stream.
+	control		Writer
+	// Only used on the handle, from the goroutine receiving the frames
+	replyObserved		bool	// Was StreamObserver.ReplyReceived called?
+	firstByteObserved	bool	// Was StreamObserver.FirstByteReceived called?
+	padding		*padding	// Shared with the session. See Session.EnableDataPadding.
+	paddingRead	int	// Padding stripped by ReadFrame, not acknowledged by a bodyReader yet
+	// The DATA counted by SetByteLimit. If 0, both directions are counted.
+	ByteLimitDirection	LimitDirection
+	// The status of the RST_STREAM sent when the byte limit is exceeded.
+	// If 0, CANCEL is used.
+	ByteLimitStatus	StatusCode
+	session		*Session	// The session the stream belongs to, if any
+	replyHeaders	http.Header	// The headers of the final reply, once received. See ReplyHeaders
+	reset		*StreamResetError	// Set when a RST_STREAM is received
+	// 0 is the highest priority, 3 the lowest in SPDY/2 and 7 in SPDY/3.
+	// Sent in the SYN_STREAM of local streams, and set from it otherwise.
+	// See Session.PrioritizeStreams.
+	Priority	uint8
+	writeDeadline	time.Time	// See SetWriteDeadline
+	readDeadline	time.Time	// See SetReadDeadline
+	deadlineLock	sync.Mutex
+	unidirectional	bool	// See Unidirectional
+	writeClosed	int32	// Set by CloseWrite
+	ctx		context.Context	// See NewStreamContext. nil if none
+	// The outcome of the stream, for Wait (on the handle only)
+	ended		chan struct{}	// Closed when the stream ends
+	endErr		error	// Why it ended. nil if it completed cleanly
+	endLock		sync.Mutex	// Protects ended, endErr, finSent and finReceived
+	finSent		bool
+	finReceived	bool
 }
 
 func NewStream(id uint32, local bool) (*Stream, *Stream) {
+	return newStreamSize(id, local, DefaultStreamBuffer, DefaultStreamBuffer)
+}
+
+// NewStreamContext is like NewStream, but the stream is bound to `ctx`: once
+// it is done, ReadFrame and WriteFrame stop waiting, reset the stream with
+// CANCEL and return ctx.Err().
+func NewStreamContext(ctx context.Context, id uint32, local bool) (*Stream, *Stream) {
+	stream, peer := NewStream(id, local)
+	stream.ctx = ctx
+	return stream, peer
+}
+
+// Context returns the context the stream was created with, or
+// context.Background() if there is none.
+func (s *Stream) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+/*
+** Reset the stream with CANCEL because its context is done, and return why.
+** Like StopReceiving, this works after we half-closed the stream.
+*/
+
+func (s *Stream) cancelled() error {
+	s.debug("Context done (%s). Cancelling", s.ctx.Err())
+	s.StopReceiving()
+	return s.ctx.Err()
+}
+
+// The number of frames buffered in each direction of a stream, unless set
+// with StreamOptions.BufferSize.
+const DefaultStreamBuffer = 4096
+
+// StreamOptions are the settings of a new stream, for NewStreamOptions.
+type StreamOptions struct {
+	Priority	uint8	// See Stream.Priority
+	Unidirectional	bool	// See Stream.Unidirectional
+	// How many frames can be queued in each direction of the stream before
+	// the writer blocks. If 0, DefaultStreamBuffer is used. A queue holds
+	// pointers to frames, so an empty slot costs a few bytes: a small
+	// buffer saves memory on short-lived streams, a large one lets a bulk
+	// transfer run ahead of its reader (the frames themselves are held in
+	// memory until read).
+	BufferSize	int
+}
+
+// NewStreamOptions is like NewStream, with the settings in `options`.
+func NewStreamOptions(id uint32, local bool, options StreamOptions) (*Stream, *Stream) {
+	size := options.BufferSize
+	if size <= 0 {
+		size = DefaultStreamBuffer
+	}
+	stream, peer := newStreamSize(id, local, size, size)
+	stream.Priority, peer.Priority = options.Priority, options.Priority
+	if options.Unidirectional {
+		stream.setUnidirectional()
+	}
+	return stream, peer
+}
+
+// Unidirectional returns true if the stream was opened with
+// FLAG_UNIDIRECTIONAL (eg. a server push): frames only flow from the
+// endpoint which opened it. The other endpoint may only send RST_STREAM and
+// WINDOW_UPDATE frames: anything else is rejected with a PROTOCOL_ERROR.
+func (s *Stream) Unidirectional() bool {
+	return s.handle().unidirectional
+}
+
+/*
+** Close the direction of the stream towards its initiator
+*/
+
+func (s *Stream) setUnidirectional() {
+	h := s.handle()
+	h.unidirectional, h.peer.unidirectional = true, true
+	if h.local {
+		h.peer.output.unidirectional = true
+	} else {
+		h.output.unidirectional = true
+	}
+}
+
+/*
+** Like NewStream, but buffer at most `inputSize` incoming frames and
+** `outputSize` outgoing frames
+*/
+
+func newStreamSize(id uint32, local bool, inputSize, outputSize int) (*Stream, *Stream) {
 	debug("NewStream(%d)", id)
-	inputR, inputW := StreamPipe(id, local)
-	outputR, outputW := StreamPipe(id, !local)
-	stream := &Stream{input: inputR,  output: outputW, sendErrors: false, Id: id, local: local}
+	inputR, inputW := streamPipe(id, local, inputSize)
+	outputR, outputW := streamPipe(id, !local, outputSize)
+	stream := &Stream{input: inputR,  output: outputW, sendErrors: false, Id: id, local: local, FinOnClose: true}
 	peer   := &Stream{input: outputR, output:  inputW, sendErrors: true,  Id: id, local: local}
+	stream.peer, peer.peer = peer, stream
+	stream.sendInitial = DefaultWindowSize
+	stream.windowChanged = sync.NewCond(new(sync.Mutex))
+	stream.ended = make(chan struct{})
 	return stream, peer
 }
 
 func (s *Stream) ReadFrame() (Frame, error) {
+	if s.ctx == nil {
+		return s.readFrameUntil(nil)
+	}
+	if s.ctx.Err() != nil {
+		return nil, s.cancelled()
+	}
+	frame, err := s.readFrameUntil(s.ctx.Done())
+	if err == errPipeCancelled {
+		return nil, s.cancelled()
+	}
+	return frame, err
+}
+
+/*
+** Like ReadFrame, but give up and return errPipeCancelled once `done` is
+** closed. A nil `done` is never closed.
+*/
+
+func (s *Stream) readFrameUntil(done <-chan struct{}) (Frame, error) {
 	// Inject errors, if any
-	if len(s.errors) > 0 {
-		err := s.errors[len(s.errors) - 1]
-		s.errors = s.errors[:len(s.errors) - 1]
+	if err := s.popError(); err != nil {
 		return err.ToFrame(), nil
 	}
-	frame, err := s.input.ReadFrame()
-	if err != nil {
-		return nil, err
+	var frame Frame
+	for {
+		var err error
+		if frame, err = s.readInputUntil(done); err != nil {
+			return nil, err
+		}
+		status, interim := interimStatus(frame)
+		if !interim || s.sendErrors {
+			break
+		}
+		s.debug("Received interim reply (%d)", status)
+		s.interimReceived = true
+		if s.OnInterim != nil {
+			s.OnInterim(status, *frame.GetHeaders())
+		}
 	}
-	if _, isRst := frame.(*RstStreamFrame); isRst {
+	if data, isData := frame.(*DataFrame); isData && data.Flags&DataFlagPadded != 0 && s.padding.enabled() && !s.sendErrors {
+		var err error
+		if frame, err = unpadDataFrame(data); err != nil {
+			return nil, err
+		}
+		// The padding counts towards the receive window all the same
+		s.paddingRead += len(data.Data) - len(frame.(*DataFrame).Data)
+	}
+	if data, isData := frame.(*DataFrame); isData && !s.sendErrors {
+		received := atomic.AddInt64(&s.bytesReceived, int64(len(data.Data)))
+		if err := s.checkByteLimit(LimitReceived, received); err != nil {
+			return nil, err
+		}
+	}
+	if headers, isHeaders := frame.(*HeadersFrame); isHeaders && s.interimReceived {
+		// The final reply follows interim replies in a HEADERS frame:
+		// present it as the SYN_REPLY it stands for.
+		s.interimReceived = false
+		frame = &SynReplyFrame{CFHeader: headers.CFHeader, StreamId: headers.StreamId, Headers: headers.Headers}
+	}
+	if reply, isReply := frame.(*SynReplyFrame); isReply && !s.sendErrors && s.replyHeaders == nil {
+		s.replyHeaders = make(http.Header)
+		UpdateHeaders(&s.replyHeaders, &reply.Headers)
+	}
+	if rst, isRst := frame.(*RstStreamFrame); isRst {
+		if !s.sendErrors {
+			s.reset = &StreamResetError{StreamId: s.Id, Status: rst.Status}
+		}
+		// Nothing may be sent after a RST_STREAM
+		s.output.setClosed()
 		s.Close()
 	}
-	s.debug("Received %#v err=%#v", frame, err)
+	s.debug("Received %v", frame)
 	return frame, nil
 }
 
+/*
+** Read the next frame of the input pipe, before the read deadline and the
+** reply timeout
+*/
+
+func (s *Stream) readInputUntil(done <-chan struct{}) (Frame, error) {
+	clock := clockOrDefault(s.clock)
+	s.deadlineLock.Lock()
+	deadline := s.readDeadline
+	s.deadlineLock.Unlock()
+	if !deadline.IsZero() && !clock.Now().Before(deadline) {
+		return nil, ErrReadTimeout
+	}
+	// Wait until the read deadline, or the reply timeout if it's earlier
+	waitingForReply := false
+	if s.waitingForReply() {
+		replyDeadline := s.synSent.Add(s.ResponseHeaderTimeout)
+		if deadline.IsZero() || replyDeadline.Before(deadline) {
+			deadline, waitingForReply = replyDeadline, true
+		}
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := clock.NewTimer(deadline.Sub(clock.Now()))
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	frame, err := s.input.readFrameUntil(timeout, done)
+	if err == errPipeTimeout && waitingForReply {
+		s.debug("No SYN_REPLY after %v. Cancelling", s.ResponseHeaderTimeout)
+		s.Rst(Cancel)
+		return nil, ErrResponseHeaderTimeout
+	} else if err == errPipeTimeout {
+		s.debug("Read deadline exceeded")
+		return nil, ErrReadTimeout
+	} else if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Drain reads and discards the frames received on the stream until the peer
+// half-closes it (or resets it). If `ctx` expires first, the stream is reset
+// with CANCEL and ctx.Err() is returned. This lets an application which is
+// done with a response end the stream without depending on the peer.
+func (s *Stream) Drain(ctx context.Context) error {
+	for {
+		frame, err := s.readFrameUntil(ctx.Done())
+		if err == errPipeCancelled {
+			s.debug("Drain interrupted (%s). Cancelling", ctx.Err())
+			s.Rst(Cancel)
+			return ctx.Err()
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, isRst := frame.(*RstStreamFrame); isRst || frame.GetFinFlag() {
+			return nil
+		}
+	}
+}
+
+// A StreamResetError is returned when a stream was reset with RST_STREAM.
+type StreamResetError struct {
+	StreamId	uint32
+	Status		StatusCode
+	Local		bool	// Did we send the RST_STREAM? Otherwise the peer did
+}
+
+func (e *StreamResetError) Error() string {
+	if e.Local {
+		return fmt.Sprintf("Stream %d reset (status %d)", e.StreamId, e.Status)
+	}
+	return fmt.Sprintf("Stream %d reset by peer (status %d)", e.StreamId, e.Status)
+}
+
+// Wait blocks until the stream ends, and returns nil if it completed
+// cleanly: both endpoints half-closed it, or it was closed without a reset.
+// If it was reset by either endpoint (including because the peer violated
+// the protocol), the error is a *StreamResetError. If the session went away
+// first, the error is the reason, eg. ErrConnectionClosed.
+func (s *Stream) Wait() error {
+	h := s.handle()
+	<-h.ended
+	h.endLock.Lock()
+	defer h.endLock.Unlock()
+	return h.endErr
+}
+
+// StreamState is the stage of the lifecycle of a stream. See Stream.State.
+type StreamState int
+
+const (
+	StateIdle		StreamState = iota	// No frame was sent or received yet
+	StateOpen		// Frames may flow both ways
+	StateLocalHalfClosed	// We sent FLAG_FIN: only the peer sends frames
+	StateRemoteHalfClosed	// The peer sent FLAG_FIN: only we send frames
+	StateClosed		// Both endpoints sent FLAG_FIN, or the stream was reset or closed
+)
+
+func (st StreamState) String() string {
+	switch st {
+		case StateIdle:			return "idle"
+		case StateOpen:			return "open"
+		case StateLocalHalfClosed:	return "half-closed (local)"
+		case StateRemoteHalfClosed:	return "half-closed (remote)"
+	}
+	return "closed"
+}
+
+// State returns the current stage of the lifecycle of the stream, as seen
+// by this endpoint. A frame counts as received as soon as it reaches the
+// stream, even if it wasn't read yet.
+func (s *Stream) State() StreamState {
+	h := s.handle()
+	h.endLock.Lock()
+	defer h.endLock.Unlock()
+	select {
+		case <-h.ended:
+			return StateClosed
+		default:
+	}
+	switch {
+		case h.finSent:		return StateLocalHalfClosed
+		case h.finReceived:	return StateRemoteHalfClosed
+	}
+	if h.output.frames() == 0 && h.peer.output.frames() == 0 {
+		return StateIdle
+	}
+	return StateOpen
+}
+
+/*
+** Record how the stream ended, unless it already did
+*/
+
+func (s *Stream) end(err error) {
+	h := s.handle()
+	h.endLock.Lock()
+	ended := h.endLocked(err)
+	h.endLock.Unlock()
+	if observer := h.observer(); ended && observer != nil {
+		observer.StreamClosed(h, err)
+	}
+}
+
+/*
+** Like end, with endLock held. Return true if the stream ended now
+*/
+
+func (s *Stream) endLocked(err error) bool {
+	select {
+		case <-s.ended:
+			return false
+		default:
+	}
+	s.endErr = err
+	close(s.ended)
+	return true
+}
+
+/*
+** Record a FLAG_FIN passing through `s`, and end the stream once both
+** directions are half-closed
+*/
+
+func (s *Stream) finPassed() {
+	h := s.handle()
+	h.endLock.Lock()
+	if s.sendErrors {
+		h.finReceived = true
+	} else {
+		h.finSent = true
+	}
+	ended := h.finSent && h.finReceived && h.endLocked(nil)
+	h.endLock.Unlock()
+	if observer := h.observer(); ended && observer != nil {
+		observer.StreamClosed(h, nil)
+	}
+}
+
+/*
+** Return the StreamObserver of the session of the stream, if any
+*/
+
+func (s *Stream) observer() StreamObserver {
+	if h := s.handle(); h.session != nil {
+		return h.session.Observer
+	}
+	return nil
+}
+
+/*
+** Notify the StreamObserver of a frame received from the peer, if it marks
+** a step in the life of the stream
+*/
+
+func (s *Stream) observeReceived(frame Frame) {
+	observer := s.observer()
+	if observer == nil {
+		return
+	}
+	h := s.handle()
+	switch f := frame.(type) {
+		case *SynReplyFrame, *HeadersFrame:
+			headers := *frame.GetHeaders()
+			if _, interim := interimStatus(frame); h.local && !h.replyObserved && !interim && spdyHeader(headers, "status") != "" {
+				h.replyObserved = true
+				observer.ReplyReceived(h, headers)
+			}
+		case *DataFrame:
+			if !h.firstByteObserved && payloadLength(f) > 0 {
+				h.firstByteObserved = true
+				observer.FirstByteReceived(h)
+			}
+	}
+	if frame.GetFinFlag() {
+		observer.LastByteReceived(h)
+	}
+}
+
+// ReplyHeaders blocks until the SYN_REPLY of a locally initiated stream is
+// received, and returns its headers. Informational replies are skipped (see
+// OnInterim). No DATA is consumed, so the body can be read afterwards with
+// ReadFrame. Headers received later in HEADERS frames are not included.
+//
+// If the stream is reset before the reply, the error is a *StreamResetError.
+func (s *Stream) ReplyHeaders() (http.Header, error) {
+	for s.replyHeaders == nil {
+		if s.reset != nil {
+			return nil, s.reset
+		}
+		if !s.local {
+			return nil, errors.New("Can't wait for a reply: the stream was initiated by the peer")
+		}
+		if _, err := s.ReadFrame(); err != nil {
+			return nil, err
+		}
+	}
+	return s.replyHeaders, nil
+}
+
+/*
+** Return the last error queued for sending, if any
+*/
+
+func (s *Stream) popError() *Error {
+	s.errorsLock.Lock()
+	defer s.errorsLock.Unlock()
+	if len(s.errors) == 0 {
+		return nil
+	}
+	err := s.errors[len(s.errors) - 1]
+	s.errors = s.errors[:len(s.errors) - 1]
+	return err
+}
+
+// ErrResponseHeaderTimeout is returned by ReadFrame when the peer doesn't
+// reply to a locally initiated stream within its ResponseHeaderTimeout.
+var ErrResponseHeaderTimeout = errors.New("timeout awaiting SYN_REPLY")
+
+/*
+** Return true if the stream sent a SYN_STREAM and is still
+** waiting for the SYN_REPLY, with a timeout.
+*/
+
+func (s *Stream) waitingForReply() bool {
+	return !s.sendErrors && s.local && !s.unidirectional && s.ResponseHeaderTimeout > 0 && !s.synSent.IsZero() && s.input.NFrames == 0
+}
+
 func (s *Stream) debug(msg string, args ...interface{}) {
-	debug(fmt.Sprintf("[STREAM %d %p] %s", s.Id, s, msg), args...)
+	s.Logger().Printf(msg, args...)
+}
+
+// Logger returns a logger for messages about the stream. Messages are passed
+// to the session logger, prefixed with the stream id and whether the stream
+// was initiated locally or by the peer.
+func (s *Stream) Logger() Logger {
+	var logger Logger = debugLogger{}
+	if s.logger != nil {
+		logger = s.logger
+	}
+	direction := "remote"
+	if s.local {
+		direction = "local"
+	}
+	return &prefixLogger{logger, fmt.Sprintf("[STREAM %d %s] ", s.Id, direction)}
 }
 
 func (s *Stream) WriteFrame(frame Frame) error {
-	s.debug("Passing %#v", frame)
-	err := s.output.WriteFrame(frame)
+	// RST_STREAM can still be sent after CloseWrite
+	if _, isRst := frame.(*RstStreamFrame); !isRst && atomic.LoadInt32(&s.writeClosed) != 0 {
+		return &Error{Err: StreamClosed, StreamId: s.Id, Frame: frame}
+	}
+	var timeout <-chan time.Time
+	if timer := s.writeTimer(); timer != nil {
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	// The RST_STREAM sent on cancellation must not be cancelled itself
+	if _, isRst := frame.(*RstStreamFrame); !isRst && s.ctx != nil {
+		if s.ctx.Err() != nil {
+			return s.cancelled()
+		}
+		merged, stop := s.timeoutOrDone(timeout)
+		defer stop()
+		err := s.writeFrameOrData(frame, merged)
+		if err == ErrWriteTimeout && s.ctx.Err() != nil {
+			return s.cancelled()
+		}
+		return err
+	}
+	return s.writeFrameOrData(frame, timeout)
+}
+
+/*
+** Return a channel which fires when `timeout` fires or the context of the
+** stream is done, whichever comes first. Call `stop` once done waiting.
+*/
+
+func (s *Stream) timeoutOrDone(timeout <-chan time.Time) (merged <-chan time.Time, stop func()) {
+	fired := make(chan time.Time, 1)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+			case t := <-timeout:	fired <- t
+			case <-s.ctx.Done():	fired <- time.Time{}
+			case <-stopped:
+		}
+	}()
+	return fired, func() { close(stopped) }
+}
+
+/*
+** The body of WriteFrame: write DATA frames within the send window
+*/
+
+func (s *Stream) writeFrameOrData(frame Frame, timeout <-chan time.Time) error {
+	if data, isData := frame.(*DataFrame); isData && !s.sendErrors {
+		if err := s.checkByteLimit(LimitSent, s.BytesSent() + int64(payloadLength(data))); err != nil {
+			return err
+		}
+		if atomic.LoadInt32(&s.enforceWindow) != 0 {
+			return s.writeDataInWindow(data, timeout)
+		}
+	}
+	return s.writeFrameUntil(frame, timeout)
+}
+
+// ErrWriteTimeout is returned by the writes on a stream once its write
+// deadline has passed. It is a net.Error, whose Timeout method returns true.
+var ErrWriteTimeout net.Error = &timeoutError{"stream write deadline exceeded"}
+
+// ErrReadTimeout is returned by ReadFrame once the read deadline of the
+// stream has passed. Like ErrWriteTimeout, it is a net.Error.
+var ErrReadTimeout net.Error = &timeoutError{"stream read deadline exceeded"}
+
+type timeoutError struct {
+	msg	string
+}
+
+func (e *timeoutError) Error() string	{ return e.msg }
+func (e *timeoutError) Timeout() bool	{ return true }
+func (e *timeoutError) Temporary() bool	{ return true }
+
+// SetWriteDeadline sets the time after which writes on the stream stop
+// waiting and fail with ErrWriteTimeout. A write waits while the stream's
+// outgoing queue is full, or its send window is exhausted: the deadline
+// only applies to these waits, so other streams of the session are never
+// held up, and frames already queued are still sent. A zero value means no
+// deadline. The deadline applies to writes started after it is set.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	s.writeDeadline = t
+	s.deadlineLock.Unlock()
+	return nil
+}
+
+// SetReadDeadline sets the time after which ReadFrame stops waiting for a
+// frame and fails with ErrReadTimeout. Once the deadline has passed,
+// ReadFrame fails immediately, even if frames are queued. A zero value means
+// no deadline. Unlike ResponseHeaderTimeout, it doesn't reset the stream.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	s.readDeadline = t
+	s.deadlineLock.Unlock()
+	return nil
+}
+
+// SetDeadline sets both the read and the write deadlines, like
+// net.Conn.SetDeadline.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+/*
+** Return a timer which fires at the write deadline, or nil if there is none
+*/
+
+func (s *Stream) writeTimer() Timer {
+	s.deadlineLock.Lock()
+	deadline := s.writeDeadline
+	s.deadlineLock.Unlock()
+	if deadline.IsZero() {
+		return nil
+	}
+	clock := clockOrDefault(s.clock)
+	return clock.NewTimer(deadline.Sub(clock.Now()))
+}
+
+/*
+** Write a DATA frame without exceeding the send window: wait for the window
+** to open, and split the frame if it is larger than the window. Padded frames
+** can't be split, so they wait for the whole window they need.
+*/
+
+func (s *Stream) writeDataInWindow(frame *DataFrame, timeout <-chan time.Time) error {
+	for {
+		size := len(frame.Data)
+		if frame.Flags&DataFlagPadded == 0 && size > 1 {
+			size = 1
+		}
+		window, err := s.waitForWindow(size, timeout)
+		if err != nil {
+			return err
+		}
+		if window >= len(frame.Data) {
+			return s.writeFrameUntil(frame, timeout)
+		}
+		chunk := &DataFrame{StreamId: frame.StreamId, Flags: frame.Flags &^ DataFlagFin, Data: frame.Data[:window]}
+		if err := s.writeFrameUntil(chunk, timeout); err != nil {
+			return err
+		}
+		frame = &DataFrame{StreamId: frame.StreamId, Flags: frame.Flags, Data: frame.Data[window:]}
+	}
+}
+
+/*
+** Wait until the send window is at least `size` bytes, and return it. Give up
+** with ErrWriteTimeout if `timeout` fires first.
+*/
+
+func (s *Stream) waitForWindow(size int, timeout <-chan time.Time) (int, error) {
+	s.windowChanged.L.Lock()
+	defer s.windowChanged.L.Unlock()
+	expired := false
+	if timeout != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+				case <-timeout:
+					s.windowChanged.L.Lock()
+					expired = true
+					s.windowChanged.Broadcast()
+					s.windowChanged.L.Unlock()
+				case <-stop:
+			}
+		}()
+	}
+	for {
+		if err := s.output.error(); err != nil {
+			return 0, err
+		}
+		if window := s.SendWindow(); window >= size {
+			return window, nil
+		}
+		if expired {
+			s.debug("Write deadline exceeded while waiting for WINDOW_UPDATE")
+			return 0, ErrWriteTimeout
+		}
+		s.debug("Send window exhausted. Waiting for WINDOW_UPDATE")
+		s.windowChanged.Wait()
+	}
+}
+
+/*
+** Wake up writers waiting for the send window
+*/
+
+func (s *Stream) signalWindow() {
+	h := s.handle()
+	h.windowChanged.L.Lock()
+	h.windowChanged.Broadcast()
+	h.windowChanged.L.Unlock()
+}
+
+func (s *Stream) writeFrame(frame Frame) error {
+	return s.writeFrameUntil(frame, nil)
+}
+
+/*
+** Like writeFrame, but give up with ErrWriteTimeout if `timeout` fires while
+** the outgoing queue is full.
+*/
+
+func (s *Stream) writeFrameUntil(frame Frame, timeout <-chan time.Time) error {
+	s.debug("Passing %v", frame)
+	err := s.output.writeFrameUntil(frame, timeout)
+	if err == errPipeTimeout {
+		s.debug("Write deadline exceeded while the queue is full")
+		return ErrWriteTimeout
+	}
 	if err != nil {
 		// Send err as an RST_FRAME if possible and if sendErrors=true
 		if e, sendable := err.(*Error); sendable && s.sendErrors {
@@ -75,7 +808,10 @@ func (s *Stream) WriteFrame(frame Frame) error {
 			// loops [...]
 			if _, receivedRst := frame.(*RstStreamFrame); !receivedRst {
 				s.debug("Sending error (%s) as RST_STREAM frame", e)
+				s.errorsLock.Lock()
 				s.errors = append(s.errors, e)
+				s.errorsLock.Unlock()
+				s.end(&StreamResetError{StreamId: s.Id, Status: e.ToFrame().Status, Local: true})
 			}
 			return nil
 		}
@@ -83,19 +819,212 @@ func (s *Stream) WriteFrame(frame Frame) error {
 		s.debug("Error %s is not sendable. Returning", err)
 		return err
 	}
-	if _, isRst := frame.(*RstStreamFrame); isRst {
+	if data, isData := frame.(*DataFrame); isData {
+		// Frames written on the peer end were received from the network
+		if s.sendErrors {
+			atomic.AddInt64(&s.handle().recvConsumed, int64(len(data.Data)))
+		} else {
+			atomic.AddInt64(&s.sendConsumed, int64(len(data.Data)))
+		}
+	}
+	if data, isData := frame.(*DataFrame); isData && !s.sendErrors {
+		atomic.AddInt64(&s.bytesSent, int64(payloadLength(data)))
+	}
+	if s.sendErrors {
+		s.observeReceived(frame)
+	}
+	if frame.GetFinFlag() {
+		s.finPassed()
+	}
+	if rst, isRst := frame.(*RstStreamFrame); isRst {
+		// Frames written on the peer end were received from the network
+		reset := &StreamResetError{StreamId: s.Id, Status: rst.Status, Local: !s.sendErrors}
+		s.end(reset)
+		// Once the frames received so far are read, ReadFrame returns
+		// the reset instead of io.EOF
+		if s.sendErrors {
+			s.output.CloseWithError(reset)
+		} else {
+			s.input.CloseWithError(reset)
+		}
+		if !s.sendErrors {
+			// The peer may have sent frames (even its own RST_STREAM)
+			// before receiving ours: they must be ignored
+			atomic.StoreInt32(&s.peer.output.reset, 1)
+		}
 		s.Close()
 	}
 	return nil
 }
 
+// LimitDirection selects the DATA counted by Stream.SetByteLimit.
+type LimitDirection int
+
+const (
+	LimitSent	LimitDirection = 1 << iota
+	LimitReceived
+	LimitBoth	= LimitSent | LimitReceived
+)
+
+// ErrByteLimit is returned when a stream exceeds the limit set with
+// SetByteLimit.
+var ErrByteLimit = errors.New("Stream byte limit exceeded")
+
+// SetByteLimit limits the DATA payload bytes transferred on the stream to
+// `n`, counting the directions selected by ByteLimitDirection separately.
+// Sending DATA beyond the limit, or receiving it, resets the stream with
+// ByteLimitStatus and fails with ErrByteLimit. A limit of 0 removes it.
+func (s *Stream) SetByteLimit(n int64) {
+	atomic.StoreInt64(&s.handle().byteLimit, n)
+}
+
+/*
+** Reset the stream and return ErrByteLimit if `total` bytes in direction
+** `dir` exceed the byte limit
+*/
+
+func (s *Stream) checkByteLimit(dir LimitDirection, total int64) error {
+	h := s.handle()
+	limit := atomic.LoadInt64(&h.byteLimit)
+	if limit <= 0 || total <= limit {
+		return nil
+	}
+	if h.ByteLimitDirection != 0 && h.ByteLimitDirection&dir == 0 {
+		return nil
+	}
+	status := h.ByteLimitStatus
+	if status == 0 {
+		status = Cancel
+	}
+	s.debug("Byte limit (%d) exceeded. Resetting", limit)
+	s.Rst(status)
+	return ErrByteLimit
+}
+
+// BytesSent returns the number of DATA payload bytes successfully written on
+// the stream so far, excluding padding. Together with BytesReceived, it lets
+// an application resume an interrupted transfer.
+func (s *Stream) BytesSent() int64 {
+	return atomic.LoadInt64(&s.handle().bytesSent)
+}
+
+// BytesReceived returns the number of DATA payload bytes read from the
+// stream so far, excluding padding.
+func (s *Stream) BytesReceived() int64 {
+	return atomic.LoadInt64(&s.handle().bytesReceived)
+}
+
+/*
+** Like reading Closed, but safe while the stream is being closed
+*/
+
+func (s *Stream) isClosed() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.Closed
+}
+
 func (s *Stream) Close() {
+	s.closeLock.Lock()
 	if s.Closed {
+		s.closeLock.Unlock()
 		return
 	}
 	s.Closed = true
+	s.closeLock.Unlock()
+	if s.FinOnClose && !s.sendErrors && !s.output.isClosed() {
+		s.finish()
+	}
 	s.output.Close()
 	s.input.Close()
+	s.signalWindow()
+	s.handle().dissociate()
+	s.end(nil)
+}
+
+/*
+** Signal the end of the stream to the peer, if the output was left open.
+*/
+
+func (s *Stream) finish() {
+	var err error
+	if s.output.frames() > 0 {
+		s.debug("Closing without FIN. Sending it")
+		err = s.WriteDataFrame(nil, true)
+	} else if !s.local && !s.unidirectional {
+		s.debug("Closing without a reply. Cancelling")
+		err = s.Rst(Cancel)
+	}
+	if err != nil {
+		s.debug("Can't signal end of stream: %s", err)
+	}
+}
+
+/*
+** Return the end of the stream which is handed to the application
+** (as opposed to the end used internally by the session).
+*/
+
+func (s *Stream) handle() *Stream {
+	if s.sendErrors {
+		return s.peer
+	}
+	return s
+}
+
+// Protects the association graph of all streams
+var associations sync.Mutex
+
+// Associated returns the stream this stream was pushed from (per the
+// Associated-To-Stream-ID of its SYN_STREAM), or nil.
+func (s *Stream) Associated() *Stream {
+	associations.Lock()
+	defer associations.Unlock()
+	return s.handle().associated
+}
+
+// Pushes returns the streams which were pushed from this stream and are
+// still open.
+func (s *Stream) Pushes() []*Stream {
+	associations.Lock()
+	defer associations.Unlock()
+	pushes := s.handle().pushes
+	return append(make([]*Stream, 0, len(pushes)), pushes...)
+}
+
+/*
+** Record that `s` was pushed from `parent`.
+*/
+
+func (s *Stream) associate(parent *Stream) {
+	associations.Lock()
+	defer associations.Unlock()
+	child, parent := s.handle(), parent.handle()
+	child.associated = parent
+	parent.pushes = append(parent.pushes, child)
+}
+
+/*
+** Remove the stream from the association graph, so that closed streams
+** don't keep each other from being garbage-collected.
+*/
+
+func (s *Stream) dissociate() {
+	associations.Lock()
+	defer associations.Unlock()
+	if parent := s.associated; parent != nil {
+		for i, push := range parent.pushes {
+			if push == s {
+				parent.pushes = append(parent.pushes[:i], parent.pushes[i+1:]...)
+				break
+			}
+		}
+		s.associated = nil
+	}
+	for _, push := range s.pushes {
+		push.associated = nil
+	}
+	s.pushes = nil
 }
 
 
@@ -103,6 +1032,14 @@ func (s *Stream) Reply(headers *http.Header, fin bool) error {
 	if headers == nil {
 		headers = new(http.Header)
 	}
+	// The SYN_REPLY was already used by an interim reply
+	if s.interimSent {
+		if err := s.WriteHeadersFrame(headers, fin); err != nil {
+			return err
+		}
+		s.interimSent = false
+		return nil
+	}
 	var flags ControlFlags
 	if fin {
 		flags = ControlFlagFin
@@ -114,6 +1051,50 @@ func (s *Stream) Reply(headers *http.Header, fin bool) error {
 	})
 }
 
+// WriteInterim sends an informational (1xx) reply, such as 100 Continue or
+// 103 Early Hints, without closing the stream. The first interim reply is
+// sent as SYN_REPLY, and any other reply (including the final one sent with
+// Reply) as HEADERS.
+func (s *Stream) WriteInterim(status int, headers http.Header) error {
+	if status < 100 || status > 199 {
+		return fmt.Errorf("Not an informational status: %d", status)
+	}
+	if s.local || (s.output.frames() > 0 && !s.interimSent) {
+		return errors.New("Can't send interim reply: stream already replied")
+	}
+	reply := http.Header{}
+	UpdateHeaders(&reply, &headers)
+	reply.Set("status", fmt.Sprintf("%d", status))
+	var err error
+	if s.interimSent {
+		err = s.WriteHeadersFrame(&reply, false)
+	} else {
+		err = s.WriteFrame(&SynReplyFrame{StreamId: s.Id, Headers: reply})
+	}
+	if err != nil {
+		return err
+	}
+	s.interimSent = true
+	return nil
+}
+
+/*
+** Return the status of `frame` if it is an interim (1xx) reply.
+*/
+
+func interimStatus(frame Frame) (int, bool) {
+	switch frame.(type) {
+		case *SynReplyFrame, *HeadersFrame:
+		default: return 0, false
+	}
+	fields := strings.Fields(frame.GetHeaders().Get("status"))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	status, err := strconv.Atoi(fields[0])
+	return status, err == nil && status >= 100 && status <= 199
+}
+
 func (s *Stream) Syn(headers *http.Header, fin bool) error {
 	if headers == nil {
 		headers = new(http.Header)
@@ -122,11 +1103,19 @@ func (s *Stream) Syn(headers *http.Header, fin bool) error {
 	if fin {
 		flags = ControlFlagFin
 	}
-	return s.WriteFrame(&SynStreamFrame{
+	if s.unidirectional {
+		flags |= ControlFlagUnidirectional
+	}
+	err := s.WriteFrame(&SynStreamFrame{
 		StreamId:	s.Id,
+		Priority:	uint16(s.Priority),
 		Headers:	*headers,
 		CFHeader:	ControlFrameHeader{Flags:flags},
 	})
+	if err == nil {
+		s.synSent = clockOrDefault(s.clock).Now()
+	}
+	return err
 }
 
 func (s *Stream) WriteHeadersFrame(headers *http.Header, fin bool) error {
@@ -144,16 +1133,32 @@ func (s *Stream) WriteHeadersFrame(headers *http.Header, fin bool) error {
 	})
 }
 
+// CloseWrite half-closes the stream with an empty DATA frame carrying
+// FLAG_FIN. Writing afterwards fails with StreamClosed, but the frames of
+// the peer are still received, until it half-closes (or resets) the stream
+// too: eg. a client sends the end of a request, then reads the response.
+func (s *Stream) CloseWrite() error {
+	if err := s.WriteDataFrame(nil, true); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.writeClosed, 1)
+	return nil
+}
+
 func (s *Stream) WriteDataFrame(data []byte, fin bool) error {
 	var flags DataFlags
 	if fin {
 		flags = DataFlagFin
 	}
-	return s.WriteFrame(&DataFrame{
+	frame := &DataFrame{
 		StreamId:	s.Id,
 		Data:		data,
 		Flags:		flags,
-	})
+	}
+	if blockSize := s.padding.blockSize(); blockSize > 0 {
+		frame = padDataFrame(frame, blockSize)
+	}
+	return s.WriteFrame(frame)
 }
 
 func (s *Stream) CopyFrom(src io.Reader) error {
@@ -172,10 +1177,154 @@ func (s *Stream) CopyFrom(src io.Reader) error {
 	return nil
 }
 
+// Push opens a new stream, associated to this one, to push a resource to the
+// client. It sends the SYN_STREAM frame with `headers` and
+// FLAG_UNIDIRECTIONAL: the client may only cancel the push, or update its
+// window. The client resets pushes associated to a stream it doesn't know,
+// or without FLAG_UNIDIRECTIONAL, with PROTOCOL_ERROR. Pushing is limited by
+// the number of concurrent streams the client accepts (see
+// Session.PushHeadroom): past the limit, ErrPushLimit is returned.
+func (s *Stream) Push(headers *http.Header) (*Stream, error) {
+	if s.session == nil {
+		return nil, errors.New("Can't push: the stream doesn't belong to a session")
+	}
+	return s.session.push(s, headers)
+}
+
+/*
+** Grow the peer's send window by `delta` bytes
+*/
+
+func (s *Stream) sendWindowUpdate(delta uint32) error {
+	frame := &WindowUpdateFrame{StreamId: s.Id, DeltaWindowSize: delta}
+	var err error
+	if s.control != nil {
+		err = s.control.WriteFrame(frame)
+	} else {
+		err = s.WriteFrame(frame)
+	}
+	if err == nil {
+		atomic.AddInt64(&s.handle().recvConsumed, -int64(delta))
+	}
+	return err
+}
+
+/*
+** Account for a WINDOW_UPDATE received from the peer
+*/
+
+func (s *Stream) windowUpdated(delta uint32) {
+	atomic.AddInt64(&s.handle().sendConsumed, -int64(delta))
+	s.signalWindow()
+}
+
+/*
+** Account for a new SETTINGS_INITIAL_WINDOW_SIZE from the peer
+*/
+
+func (s *Stream) setInitialSendWindow(size uint32) {
+	atomic.StoreInt64(&s.handle().sendInitial, int64(size))
+	atomic.StoreInt32(&s.handle().enforceWindow, 1)
+	s.signalWindow()
+}
+
+// SendWindow returns how many more bytes of DATA the peer allows the stream
+// to send: its initial window, minus the DATA sent, plus the WINDOW_UPDATEs
+// received. It may be negative if the peer shrank the initial window with
+// SETTINGS. A window stuck at or below 0 usually means the peer doesn't send
+// WINDOW_UPDATE.
+//
+// The window is only enforced once the peer announced its initial window
+// with SETTINGS_INITIAL_WINDOW_SIZE, as SPDY/2 peers don't send WINDOW_UPDATE.
+// From then on, writing DATA blocks while the window is exhausted.
+func (s *Stream) SendWindow() int {
+	h := s.handle()
+	return int(atomic.LoadInt64(&h.sendInitial) - atomic.LoadInt64(&h.sendConsumed))
+}
+
+// RecvWindow returns how many more bytes of DATA the peer may send on the
+// stream: ReceiveWindow (or DefaultWindowSize), minus the DATA received, plus
+// the WINDOW_UPDATEs sent.
+func (s *Stream) RecvWindow() int {
+	h := s.handle()
+	window := int64(DefaultWindowSize)
+	if h.ReceiveWindow != 0 {
+		window = int64(h.ReceiveWindow)
+	}
+	return int(window - atomic.LoadInt64(&h.recvConsumed))
+}
+
 func (s *Stream) Rst(status StatusCode) error {
 	return s.WriteFrame(&RstStreamFrame{StreamId: s.Id, Status: status})
 }
 
+// StopReceiving tells the peer that nothing more is wanted from the stream,
+// eg. once enough of a response was read: the stream is reset with CANCEL,
+// the frames received but not read yet are discarded, and the session
+// forgets the stream. Unlike Rst, it works after we half-closed the stream,
+// and it returns nil if the stream already ended.
+func (s *Stream) StopReceiving() error {
+	h := s.handle()
+	select {
+		case <-h.ended:
+			return nil
+		default:
+	}
+	if !h.output.isClosed() || h.control == nil {
+		// Closing the stream ends its output: the session removes it
+		// once the RST_STREAM is sent
+		if err := h.Rst(Cancel); err != nil {
+			return err
+		}
+		if n := h.input.discard(); n > 0 {
+			h.debug("Discarded %d frames", n)
+		}
+		return nil
+	}
+	// We sent FLAG_FIN: the RST_STREAM goes with the control frames
+	if err := h.control.WriteFrame(&RstStreamFrame{StreamId: h.Id, Status: Cancel}); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&h.peer.output.reset, 1)
+	h.end(&StreamResetError{StreamId: h.Id, Status: Cancel, Local: true})
+	h.Close()
+	if n := h.input.discard(); n > 0 {
+		h.debug("Discarded %d frames", n)
+	}
+	if h.session != nil {
+		h.session.CloseStream(h.Id)
+	}
+	return nil
+}
+
+// The header used by RstWithReason to carry the reason of a reset.
+const ResetReasonHeader = "x-reset-reason"
+
+// RstWithReason resets the stream like Rst. If SendResetReason is set,
+// a HEADERS frame carrying `reason` in the x-reset-reason header is sent
+// right before the RST_STREAM frame.
+//
+// This is a non-standard extension meant for controlled deployments: a
+// strict peer may ignore the extra header. If the HEADERS frame can't be
+// sent (eg. because the stream hasn't sent its first frame yet), the reason
+// is dropped and the stream is reset anyway.
+func (s *Stream) RstWithReason(status StatusCode, reason string) error {
+	if s.SendResetReason && reason != "" && s.output.frames() > 0 {
+		headers := http.Header{}
+		headers.Set(ResetReasonHeader, reason)
+		if err := s.WriteHeadersFrame(&headers, false); err != nil {
+			s.debug("Can't send reset reason (%s). Resetting anyway", err)
+		}
+	}
+	return s.Rst(status)
+}
+
+// Serve parses the request received on the stream, and passes it to
+// `handler`. Once the handler returns, the stream is torn down: if the
+// handler left the output open, it is half-closed with FLAG_FIN (after a
+// 200 reply if nothing was sent, unless the stream was pushed). If the
+// handler panics, the stream is reset with INTERNAL_ERROR instead. The
+// remaining input is drained, and the stream is removed from its session.
 func (stream *Stream) Serve(handler http.Handler) {
 	stream.debug("Running handler")
 	if handler == nil {
@@ -189,16 +1338,95 @@ func (stream *Stream) Serve(handler http.Handler) {
 		stream.debug("Error parsing http request: %s\n", err)
 		return
 	}
-	handler.ServeHTTP(w, r)
-	stream.debug("Handler returned. Cleaning up.")
-	stream.WriteDataFrame(nil, true) // Close the stream in case the handler hasn't
-	_, err = io.Copy(ioutil.Discard, r.Body) // Drain all remaining input
-	if err != nil {
-		stream.debug("Error while draining: %s", err)
+	if stream.runHandler(handler, w, r) {
+		stream.debug("Handler returned. Cleaning up.")
+		// Pushed streams are never replied to
+		pushed := stream.unidirectional || (stream.session != nil && !stream.session.Server)
+		if stream.output.frames() == 0 && !pushed {
+			w.WriteHeader(http.StatusOK)
+		}
+		if stream.output.frames() > 0 && !stream.output.isClosed() {
+			// Close the stream in case the handler hasn't
+			if err := stream.WriteDataFrame(nil, true); err != nil {
+				stream.debug("Can't send FIN: %s", err)
+			}
+		}
+	} else if err := stream.Rst(InternalError); err != nil {
+		stream.debug("Can't reset stream: %s", err)
+	}
+	select {
+		case <-stream.handle().ended:
+			// Reset, or both directions closed: nothing left to read
+		default:
+			_, err = io.Copy(ioutil.Discard, r.Body) // Drain all remaining input
+			if err != nil {
+				stream.debug("Error while draining: %s", err)
+			}
+	}
+	if atomic.LoadInt32(&stream.peer.output.reset) != 0 {
+		// The RST_STREAM may still be queued: removing the stream now
+		// would answer the frames the peer sends until it receives it
+		// with INVALID_STREAM, maybe ahead of our RST_STREAM. End the
+		// output instead, and the session removes the stream once the
+		// RST_STREAM is sent.
+		stream.output.PipeWriter.Close()
+	} else if stream.session != nil {
+		stream.session.CloseStream(stream.Id)
 	}
 	stream.debug("Done cleaning up")
 }
 
+/*
+** Run `handler`, and return false if it panicked
+*/
+
+func (stream *Stream) runHandler(handler http.Handler, w http.ResponseWriter, r *http.Request) (returned bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			stream.debug("Handler panicked: %v", err)
+			returned = false
+		}
+	}()
+	handler.ServeHTTP(w, r)
+	return true
+}
+
+// BodyReader returns an io.Reader over the DATA received on the stream. It
+// reads frames from the stream as needed: the payloads of DATA frames are
+// concatenated, and other frames are skipped (the headers of HEADERS frames
+// are still merged in InputHeaders, or kept in Trailers). Read returns
+// io.EOF after a DATA frame with FLAG_FIN, or once the stream is closed, and
+// a *StreamResetError if the stream is reset. If ReceiveWindow is set,
+// consumed data is acknowledged to the peer with WINDOW_UPDATE frames.
+func (s *Stream) BodyReader() io.Reader {
+	return &bodyReader{stream: s}
+}
+
+// InputHeaders returns a copy of all the headers received on the stream so
+// far: those of its SYN_STREAM or SYN_REPLY, and of the HEADERS frames which
+// followed, merged. Informational replies are left out (see OnInterim).
+func (s *Stream) InputHeaders() http.Header {
+	return s.handle().peer.output.headers()
+}
+
+// Trailers returns a copy of the trailers received on the stream: the
+// headers of a HEADERS frame which half-closes the stream after DATA. They
+// are not merged in InputHeaders, unlike those of the HEADERS frames received
+// mid-stream. Trailers returns nil until the FLAG_FIN of the peer reached the
+// stream, which may be before the frames preceding it were read: the
+// trailers are final once the BodyReader returned io.EOF (or ReadFrame
+// returned the frame with FLAG_FIN).
+func (s *Stream) Trailers() http.Header {
+	h := s.handle()
+	h.endLock.Lock()
+	received := h.finReceived
+	h.endLock.Unlock()
+	if !received {
+		return nil
+	}
+	return h.peer.output.trailers()
+}
+
 func (s *Stream) ParseHTTPRequest() (*http.Request, error) {
 	if s.input.NFrames > 0 {
 		return nil, errors.New("Can't parse HTTP request: first SPDY frame already read")
@@ -218,12 +1446,7 @@ func (s *Stream) ParseHTTPRequest() (*http.Request, error) {
 		path = "/"
 	}
 	s.debug("path = %s", (*headers)["url"])
-	bodyReader, bodyWriter := io.Pipe()
-	go func() {
-		ExtractData(s, bodyWriter)
-		bodyWriter.Close()
-	}()
-	r, err := http.NewRequest(method, path, bodyReader)
+	r, err := http.NewRequest(method, path, &bodyReader{stream: s})
 	if err != nil {
 		return nil, err
 	}
@@ -233,9 +1456,13 @@ func (s *Stream) ParseHTTPRequest() (*http.Request, error) {
 
 
 func StreamPipe(id uint32, reply bool) (*StreamPipeReader, *StreamPipeWriter) {
-	pipeReader, pipeWriter := Pipe(4096) // Buffering is Ok after writing, but not before (for sendErrors)
+	return streamPipe(id, reply, DefaultStreamBuffer)
+}
+
+func streamPipe(id uint32, reply bool, size int) (*StreamPipeReader, *StreamPipeWriter) {
+	pipeReader, pipeWriter := Pipe(size) // Buffering is Ok after writing, but not before (for sendErrors)
 	reader := &StreamPipeReader{PipeReader: pipeReader}
-	writer := &StreamPipeWriter{PipeWriter: pipeWriter, id: id, reply: reply, Headers: make(http.Header)}
+	writer := &StreamPipeWriter{PipeWriter: pipeWriter, id: id, reply: reply, strict: true, Headers: make(http.Header), Trailers: make(http.Header)}
 	return reader, writer
 }
 
@@ -246,56 +1473,159 @@ type StreamPipeReader struct {
 type StreamPipeWriter struct {
 	*PipeWriter
 	reply	bool	// If true, must start with SYN_REPLY. Otherwise must start with SYN_STREAM
-	closed	bool
+	strict	bool	// If false, tolerate some deviations instead of failing. See Session.StrictMode
+	closed	int32	// Set once a FIN or RST_STREAM was written. Both ends of the stream may set it
+	// If true, the pipe carries frames to the initiator of a unidirectional
+	// stream: only RST_STREAM and WINDOW_UPDATE are allowed.
+	unidirectional	bool
 	id	uint32
 	Headers	http.Header
+	Trailers	http.Header	// The headers of a HEADERS frame with FLAG_FIN written after DATA
+	headersLock	sync.Mutex	// Headers are written by one end of the stream, and read by the other
+	data		int32	// Set once a DATA frame was written
+	reset		int32	// Set once we reset the stream: frames from the peer are dropped
+	opened		int32	// Set once the SYN_STREAM or SYN_REPLY was written
+}
+
+func (p *StreamPipeWriter) isClosed() bool {
+	return atomic.LoadInt32(&p.closed) != 0
+}
+
+func (p *StreamPipeWriter) setClosed() {
+	atomic.StoreInt32(&p.closed, 1)
 }
 
 func (p *StreamPipeWriter) WriteFrame(frame Frame) error {
-	if p.closed {
-		return &Error{StreamClosed, p.id}
+	return p.writeFrameUntil(frame, nil)
+}
+
+/*
+** Like WriteFrame, but give up and return errPipeTimeout if `timeout` fires
+** while the pipe is full.
+*/
+
+func (p *StreamPipeWriter) writeFrameUntil(frame Frame, timeout <-chan time.Time) error {
+	if atomic.LoadInt32(&p.reset) != 0 {
+		debug("Dropping frame received after stream %d was reset", p.id)
+		return nil
+	}
+	if p.isClosed() {
+		if !p.strict {
+			debug("Dropping frame received after stream %d was closed", p.id)
+			return nil
+		}
+		return &Error{Err: StreamClosed, StreamId: p.id, Frame: frame}
+	}
+	if p.unidirectional {
+		switch frame.(type) {
+			case *RstStreamFrame, *WindowUpdateFrame:
+			default: return &Error{Err: UnidirectionalStream, StreamId: p.id, Frame: frame}
+		}
 	}
 	if id, exists := frame.GetStreamId(); !exists || id != p.id {
-		return errors.New("Wrong stream ID")
+		return &Error{Err: WrongStreamId, StreamId: p.id, Frame: frame}
 	}
 	// Check for the correct sequence of frames
-	switch frame.(type) {
+	switch f := frame.(type) {
 		// SYN_STREAM is only allowed as the first frame and if reply=false
 		case *SynStreamFrame: {
-			if p.NFrames > 0 || p.reply {
-				return &Error{IllegalSynStream, p.id}
+			if p.frames() > 0 || p.reply {
+				return &Error{Err: IllegalSynStream, StreamId: p.id, Frame: frame}
 			}
 		}
 		// SYN_REPLY is only allowed as the first frame and  if reply=true
 		case *SynReplyFrame: {
-			if p.NFrames > 0 || !p.reply {
-				return &Error{IllegalSynReply, p.id}
+			if !p.reply {
+				return &Error{Err: IllegalSynReply, StreamId: p.id, Frame: frame}
+			} else if atomic.LoadInt32(&p.opened) != 0 && p.strict {
+				return &Error{Err: RepeatedSynReply, StreamId: p.id, Frame: frame}
+			} else if atomic.LoadInt32(&p.opened) != 0 {
+				// Tolerate a repeated SYN_REPLY by passing it as HEADERS
+				debug("Converting repeated SYN_REPLY to HEADERS on stream %d", p.id)
+				frame = &HeadersFrame{CFHeader: f.CFHeader, StreamId: f.StreamId, Headers: f.Headers}
 			}
 		}
-		// Any other frames are forbidden as the first frame
+		// RST_STREAM can be sent at any time, including instead of
+		// a SYN_REPLY to refuse or cancel a stream
+		// So can WINDOW_UPDATE
+		case *RstStreamFrame, *WindowUpdateFrame:
+		// Any other frames are forbidden before the SYN_STREAM or
+		// SYN_REPLY, even after a WINDOW_UPDATE: eg. a DATA frame
+		// can't precede the reply
 		default: {
-			if p.NFrames == 0 {
-				return &Error{IllegalFirstFrame, p.id}
+			if atomic.LoadInt32(&p.opened) == 0 {
+				return &Error{Err: IllegalFirstFrame, StreamId: p.id, Frame: frame}
 			}
 		}
 	}
-	if err := p.PipeWriter.WriteFrame(frame); err != nil {
+	/*
+	** Store headers, except those of interim replies, and apart from the
+	** others if they end the stream after DATA (trailers). Before passing
+	** the frame, so that whoever reads it sees its headers in InputHeaders,
+	** and undone if the frame isn't passed (eg. after a write timeout).
+	*/
+	var stored *http.Header
+	var previous http.Header
+	if _, interim := interimStatus(frame); !interim && frame.GetHeaders() != nil {
+		p.headersLock.Lock()
+		if _, isHeaders := frame.(*HeadersFrame); isHeaders && frame.GetFinFlag() && atomic.LoadInt32(&p.data) != 0 {
+			stored = &p.Trailers
+		} else {
+			stored = &p.Headers
+		}
+		previous = make(http.Header)
+		UpdateHeaders(&previous, stored)
+		UpdateHeaders(stored, frame.GetHeaders())
+		p.headersLock.Unlock()
+	}
+	if err := p.PipeWriter.writeFrameUntil(frame, timeout); err != nil {
+		if stored != nil {
+			p.headersLock.Lock()
+			*stored = previous
+			p.headersLock.Unlock()
+		}
 		return err
 	}
+	switch frame.(type) {
+		case *SynStreamFrame, *SynReplyFrame:
+			atomic.StoreInt32(&p.opened, 1)
+		case *DataFrame:
+			atomic.StoreInt32(&p.data, 1)
+	}
 	/* If FLAG_FIN=true, close the pipe */
 	if frame.GetFinFlag() {
 		debug("FIN=1, closing StreamPipe")
-		p.closed = true
+		p.setClosed()
 		p.PipeWriter.Close()
 	}
 	/* On a RST_STREAM, close the pipe */
 	if _, isRst := frame.(*RstStreamFrame); isRst {
 		debug("Received RST_STREAM. Closing")
-		p.closed = true
-	}
-	/* Store headers */
-	if headers := frame.GetHeaders(); headers != nil {
-		UpdateHeaders(&p.Headers, headers)
+		p.setClosed()
 	}
 	return nil
 }
+
+/*
+** A copy of the headers written so far
+*/
+
+func (p *StreamPipeWriter) headers() http.Header {
+	p.headersLock.Lock()
+	defer p.headersLock.Unlock()
+	headers := make(http.Header)
+	UpdateHeaders(&headers, &p.Headers)
+	return headers
+}
+
+/*
+** A copy of the trailers written so far
+*/
+
+func (p *StreamPipeWriter) trailers() http.Header {
+	p.headersLock.Lock()
+	defer p.headersLock.Unlock()
+	trailers := make(http.Header)
+	UpdateHeaders(&trailers, &p.Trailers)
+	return trailers
+}
@@ -0,0 +1,182 @@
+package spdy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TraceDirection tells whether a traced frame was read or written.
+type TraceDirection int
+
+const (
+	TraceIn TraceDirection = iota	// Read from the traced ReadWriter
+	TraceOut			// Written to the traced ReadWriter
+)
+
+func (d TraceDirection) String() string {
+	if d == TraceIn {
+		return "in"
+	}
+	return "out"
+}
+
+// TraceEvent records a frame passing through a TraceFramer.
+type TraceEvent struct {
+	Time		time.Time
+	Dir		TraceDirection
+	StreamId	uint32	// 0 for session-level frames
+	FrameType	string	// eg. "SYN_STREAM", "DATA"
+	Bytes		int	// The size of the frame on the wire, header included
+}
+
+// TraceFramer wraps a ReadWriter (typically a Framer) and records an event
+// for each frame read or written, to reconstruct the timeline of a session
+// and find where latency comes from.
+//
+// Only the last events are kept, in a ring buffer allocated upfront, so
+// that tracing a busy session doesn't allocate. Bytes is only accurate if
+// the traced ReadWriter is a Framer, which sets the length of control
+// frames as it reads and writes them.
+type TraceFramer struct {
+	ReadWriter
+	// The source of timestamps. If nil, RealClock is used.
+	Clock	Clock
+	lock	sync.Mutex
+	events	[]TraceEvent
+	next	int	// Where the next event goes in events
+	full	bool	// Did events wrap around?
+}
+
+// NewTraceFramer returns a TraceFramer over `rw`, keeping the last `size`
+// events.
+func NewTraceFramer(rw ReadWriter, size int) *TraceFramer {
+	if size < 1 {
+		size = 1
+	}
+	return &TraceFramer{ReadWriter: rw, events: make([]TraceEvent, size)}
+}
+
+func (t *TraceFramer) ReadFrame() (Frame, error) {
+	frame, err := t.ReadWriter.ReadFrame()
+	if err == nil {
+		t.record(TraceIn, frame)
+	}
+	return frame, err
+}
+
+func (t *TraceFramer) WriteFrame(frame Frame) error {
+	err := t.ReadWriter.WriteFrame(frame)
+	if err == nil {
+		t.record(TraceOut, frame)
+	}
+	return err
+}
+
+func (t *TraceFramer) record(dir TraceDirection, frame Frame) {
+	now := clockOrDefault(t.Clock).Now()
+	id, _ := frame.GetStreamId()
+	t.lock.Lock()
+	t.events[t.next] = TraceEvent{now, dir, id, frameTypeName(frame), frameLength(frame)}
+	t.next = (t.next + 1) % len(t.events)
+	if t.next == 0 {
+		t.full = true
+	}
+	t.lock.Unlock()
+}
+
+// Events returns the recorded events, oldest first.
+func (t *TraceFramer) Events() []TraceEvent {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.full {
+		return append([]TraceEvent(nil), t.events[:t.next]...)
+	}
+	return append(append([]TraceEvent(nil), t.events[t.next:]...), t.events[:t.next]...)
+}
+
+// RenderTrace writes `events` to `w` as a timeline, one line per event: the
+// time since the first event, the time since the previous event, and the
+// frame.
+func RenderTrace(w io.Writer, events []TraceEvent) error {
+	for i, event := range events {
+		var sinceStart, sincePrevious time.Duration
+		if i > 0 {
+			sinceStart = event.Time.Sub(events[0].Time)
+			sincePrevious = event.Time.Sub(events[i-1].Time)
+		}
+		_, err := fmt.Fprintf(w, "%12s %12s %-3s %-13s stream=%d bytes=%d\n",
+			sinceStart, "+" + sincePrevious.String(), event.Dir, event.FrameType, event.StreamId, event.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A StreamObserver is notified as the streams of a session (see
+// Session.Observer) go through their life, eg. to open a tracing span per
+// stream. For a given stream, the calls are made in this order, although
+// the ones which don't apply are skipped: StreamOpened when the stream is
+// created, ReplyReceived when the final SYN_REPLY of a stream we initiated
+// is received, FirstByteReceived and LastByteReceived when the peer sends
+// its first byte of DATA and half-closes the stream, and StreamClosed when
+// the stream ends (`err` is a *StreamResetError if it was reset, see
+// Stream.Wait).
+//
+// The methods are called from the goroutines of the session and of the
+// application, while the stream is in use: they must not block, or call
+// blocking methods of the stream.
+type StreamObserver interface {
+	StreamOpened(stream *Stream)
+	ReplyReceived(stream *Stream, headers http.Header)
+	FirstByteReceived(stream *Stream)
+	LastByteReceived(stream *Stream)
+	StreamClosed(stream *Stream, err error)
+}
+
+/*
+** The name of the type of a frame, as in the spec
+*/
+
+func frameTypeName(frame Frame) string {
+	switch frame.(type) {
+		case *DataFrame:		return "DATA"
+		case *SynStreamFrame:		return "SYN_STREAM"
+		case *SynReplyFrame:		return "SYN_REPLY"
+		case *RstStreamFrame:		return "RST_STREAM"
+		case *SettingsFrame:		return "SETTINGS"
+		case *NoopFrame:		return "NOOP"
+		case *PingFrame:		return "PING"
+		case *GoAwayFrame:		return "GOAWAY"
+		case *HeadersFrame:		return "HEADERS"
+		case *WindowUpdateFrame:	return "WINDOW_UPDATE"
+		case *CredentialFrame:		return "CREDENTIAL"
+	}
+	return fmt.Sprintf("%T", frame)
+}
+
+/*
+** The size of a frame on the wire, including its 8-byte header. The length of
+** a control frame is only known once it was read or written by a Framer.
+*/
+
+func frameLength(frame Frame) int {
+	var length uint32
+	switch f := frame.(type) {
+		case *DataFrame:		length = uint32(len(f.Data))
+		case *SynStreamFrame:		length = f.CFHeader.length
+		case *SynReplyFrame:		length = f.CFHeader.length
+		case *RstStreamFrame:		length = f.CFHeader.length
+		case *SettingsFrame:		length = f.CFHeader.length
+		case *NoopFrame:		length = f.CFHeader.length
+		case *PingFrame:		length = f.CFHeader.length
+		case *GoAwayFrame:		length = f.CFHeader.length
+		case *HeadersFrame:		length = f.CFHeader.length
+		case *WindowUpdateFrame:	length = f.CFHeader.length
+		case *CredentialFrame:		length = f.CFHeader.length
+	}
+	return 8 + int(length)
+}
@@ -0,0 +1,687 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper which sends requests over SPDY, so that
+// an http.Client can use it transparently. Each request is sent on a new
+// stream, and requests to the same host share a session, which is opened on
+// the first request and kept until it is closed or the server sends GOAWAY.
+//
+// While the server's SETTINGS_MAX_CONCURRENT_STREAMS streams are open on a
+// session, new requests wait for one of them to end (or for their context
+// to be done) before they are sent on it. A request refused by the server
+// with REFUSED_STREAM (typically because it is overloaded) was not
+// processed, and is retried after a delay which doubles with each
+// consecutive refusal on the session. A request which never reached the
+// server because writing to the connection failed (see WriteError) is
+// retried right away on a new session. So is an idempotent request whose
+// session failed before the response was received: GET, HEAD, OPTIONS,
+// TRACE, PUT and DELETE requests, and requests with an Idempotency-Key or
+// X-Idempotency-Key header. Other requests may have been processed by the
+// server, and fail with the error of the session. A session which received
+// GOAWAY isn't used for new requests.
+//
+// Pushed streams are refused (see Session.DisableServerPush).
+type Transport struct {
+	// Opens the connections to the servers. If nil, "https" URLs are
+	// dialed with TLS (see TLSClientConfig), and "http" URLs with TCP.
+	Dial		DialFunc
+	// The TLS configuration used to dial "https" URLs when Dial is nil.
+	// Its NextProtos is set to the SPDY version of Framing, or to every
+	// version supported if Framing is nil: the session then uses the one
+	// the server selects.
+	TLSClientConfig	*tls.Config
+	// The wire format of the sessions. If nil, SPDY2 is used, unless
+	// another version was negotiated with TLS. With SPDY/3 and above,
+	// requests and responses use the SPDY/3 header names (:method, :path,
+	// etc.).
+	Framing		Framing
+	// How many times a request is retried, when refused, unsent or
+	// idempotent. If 0, DefaultMaxRetries is used. If negative, refused
+	// requests fail with a *StreamResetError, and the others with the
+	// error of their session. A request with a body is only retried if
+	// its GetBody is set.
+	MaxRetries	int
+	// The delay before retrying after the first refusal on a session. It
+	// doubles with each consecutive refusal, and is reset by a request
+	// which isn't refused. If 0, DefaultRetryBackoff is used.
+	RetryBackoff	time.Duration
+	// If non-zero, a session whose streams are refused MaxRefusals times
+	// in a row is replaced by a new one (on a new connection), in case the
+	// server behind it is the overloaded one.
+	MaxRefusals	int
+	// If non-zero, a session which no request used for IdlePingThreshold
+	// is checked with a PING before it is reused: unless the echo is
+	// received within IdlePingTimeout, the session is closed and the
+	// request goes to a new one. This catches the connections silently
+	// dropped by middleboxes.
+	IdlePingThreshold	time.Duration
+	// How long to wait for the echo of the PING of IdlePingThreshold. If 0,
+	// DefaultIdlePingTimeout is used.
+	IdlePingTimeout	time.Duration
+	// The source of time for the retry delays and the idle sessions. If
+	// nil, RealClock is used.
+	Clock		Clock
+	lock		sync.Mutex
+	sessions	map[string]*transportSession	// By scheme and address
+	dials		map[string]*transportDial	// In progress, by scheme and address
+}
+
+const (
+	DefaultMaxRetries	= 3
+	DefaultRetryBackoff	= 100 * time.Millisecond
+	DefaultIdlePingTimeout	= time.Second
+	// The retry delay stops doubling after this many refusals
+	maxBackoffDoublings	= 10
+)
+
+/*
+** A session of a Transport
+*/
+
+type transportSession struct {
+	*Session
+	key		string
+	refusals	int	// Consecutive REFUSED_STREAM. Protected by Transport.lock
+	active		int	// Requests using the session, until the end of their response. Protected by Transport.lock
+	retired		bool	// Closed once no request uses it. Protected by Transport.lock
+	idleSince	time.Time	// When active last dropped to 0. Protected by Transport.lock
+	framing		Framing
+}
+
+/*
+** The dial of a new session, which the requests to the same server wait for
+** rather than dialing in parallel
+*/
+
+type transportDial struct {
+	done	chan struct{}	// Closed once session or err is set
+	session	*transportSession
+	err	error
+}
+
+// ErrUnsupportedScheme is returned by Transport.RoundTrip for URLs other
+// than http and https.
+var ErrUnsupportedScheme = errors.New("Unsupported URL scheme")
+
+// ErrTLSFraming is returned for "https" URLs dialed by a Transport whose
+// Framing isn't a version of SPDY negotiated during the TLS handshake. Such
+// a Framing needs a Dial function.
+var ErrTLSFraming = errors.New("The framing of the transport isn't negotiated with TLS")
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := req.Body
+	// The body must be closed even if the request isn't sent. Closing it
+	// again after the stream was opened is harmless.
+	fail := func(err error) (*http.Response, error) {
+		if body != nil {
+			body.Close()
+		}
+		return nil, err
+	}
+	if req.URL == nil {
+		return fail(errors.New("Request has no URL"))
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fail(ErrUnsupportedScheme)
+	}
+	for retries := 0; ; retries++ {
+		session, err := t.session(req.Context(), req.URL)
+		if err != nil {
+			return fail(err)
+		}
+		resp, err := t.send(session, req, body)
+		if err != nil {
+			t.release(session)
+		}
+		var delay time.Duration
+		if reset, isReset := err.(*StreamResetError); isReset && reset.Status == RefusedStream {
+			delay = t.refused(session)
+		} else if !retriable(req, err) {
+			if err == nil {
+				t.accepted(session)
+				return resp, nil
+			}
+			return fail(err)
+		}
+		maxRetries := t.MaxRetries
+		if maxRetries == 0 {
+			maxRetries = DefaultMaxRetries
+		}
+		if retries >= maxRetries {
+			return fail(err)
+		}
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return fail(err)
+			}
+			body.Close()
+			if body, err = req.GetBody(); err != nil {
+				body = nil
+				return fail(err)
+			}
+		}
+		if delay == 0 {
+			// The request never reached the server, or can be
+			// processed twice: retry right away on a new session
+			debug("Session failed (%s). Retrying", err)
+			continue
+		}
+		debug("Request refused by the server. Retrying in %s", delay)
+		select {
+			case <-clockOrDefault(t.Clock).After(delay):
+			case <-req.Context().Done():	return fail(req.Context().Err())
+		}
+	}
+}
+
+/*
+** Return true if `req`, which failed with `err` before its response, can be
+** sent again on a new session
+*/
+
+func retriable(req *http.Request, err error) bool {
+	if w, isWrite := err.(*WriteError); isWrite {
+		return w.Replayable || idempotent(req)
+	}
+	if err == ErrGoAwayReceived {
+		// The GOAWAY arrived after the session was picked
+		return true
+	}
+	return err == ErrConnectionClosed && idempotent(req)
+}
+
+/*
+** Return true if sending `req` several times has the same effect as sending
+** it once
+*/
+
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+		case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+			return true
+	}
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
+
+/*
+** Send `req` with `body` on a new stream of `session`, and return the
+** response once its SYN_REPLY is received
+*/
+
+func (t *Transport) send(ts *transportSession, req *http.Request, body io.ReadCloser) (*http.Response, error) {
+	session := ts.Session
+	headers := synStreamHeaders(req, ts.spdy3())
+	// Cancelling the request (eg. the Timeout of an http.Client) resets
+	// the stream, while the response or its body are awaited
+	stream, err := session.OpenStreamContext(req.Context(), &headers)
+	for err == ErrStreamLimit {
+		// The server isn't refusing the request: wait for one of the
+		// streams of the session to end, rather than opening another one
+		if err = session.waitStreamSlot(req.Context()); err == nil {
+			stream, err = session.OpenStreamContext(req.Context(), &headers)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Send the body while the response is read, so that a server
+	// answering before the end of the request doesn't block
+	go func() {
+		writer := stream.BodyWriter()
+		if body != nil {
+			defer body.Close()
+			if _, err := io.Copy(writer, body); err != nil {
+				stream.debug("Can't send request body: %s", err)
+				stream.Rst(Cancel)
+				return
+			}
+		}
+		if err := writer.Close(); err != nil {
+			stream.debug("Can't half-close request: %s", err)
+		}
+	}()
+	reply, err := stream.ReplyHeaders()
+	if err != nil {
+		session.CloseStream(stream.Id)
+		return nil, err
+	}
+	resp, err := t.newResponse(reply)
+	if err != nil {
+		stream.Rst(ProtocolError)
+		session.CloseStream(stream.Id)
+		return nil, err
+	}
+	resp.Request = req
+	resp.Body = &responseBody{stream: stream, reader: stream.BodyReader(), reply: reply, trailer: resp.Trailer,
+		release: func() { t.release(ts) }}
+	return resp, nil
+}
+
+/*
+** Return true if the SPDY/3 header names must be used on the session
+*/
+
+func (ts *transportSession) spdy3() bool {
+	framing, isSPDY := ts.framing.(*SPDYFraming)
+	return isSPDY && framing.Version >= 3
+}
+
+// Headers of HTTP/1.1 which are meaningless on a SPDY stream
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Host"}
+
+/*
+** Translate `req` into the headers of a SYN_STREAM, with the SPDY/3 header
+** names if `spdy3` is true
+*/
+
+func synStreamHeaders(req *http.Request, spdy3 bool) http.Header {
+	headers := make(http.Header)
+	for name, values := range req.Header {
+		headers[name] = append([]string(nil), values...)
+	}
+	for _, name := range hopHeaders {
+		headers.Del(name)
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	names := map[string]string{"method": "method", "path": "url", "version": "version", "host": "host", "scheme": "scheme"}
+	if spdy3 {
+		for name := range names {
+			names[name] = ":" + name
+		}
+	}
+	headers.Set(names["method"], method)
+	headers.Set(names["path"], req.URL.RequestURI())
+	headers.Set(names["version"], "HTTP/1.1")
+	headers.Set(names["host"], host)
+	headers.Set(names["scheme"], req.URL.Scheme)
+	if req.ContentLength > 0 {
+		headers.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	return headers
+}
+
+/*
+** Build the response described by the headers of a SYN_REPLY. The body is
+** left to the caller.
+*/
+
+func (t *Transport) newResponse(reply http.Header) (*http.Response, error) {
+	status := spdyHeader(reply, "status")
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed status: %q", status)
+	}
+	proto := spdyHeader(reply, "version")
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, fmt.Errorf("Malformed HTTP version: %q", proto)
+	}
+	if !strings.Contains(status, " ") {
+		status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+	}
+	resp := &http.Response{
+		Status:		status,
+		StatusCode:	code,
+		Proto:		proto,
+		ProtoMajor:	major,
+		ProtoMinor:	minor,
+		Header:		make(http.Header),
+		ContentLength:	-1,
+		Trailer:	make(http.Header),
+	}
+	for name, values := range reply {
+		resp.Header[name] = append([]string(nil), values...)
+	}
+	for _, name := range []string{"status", "version"} {
+		resp.Header.Del(name)
+		resp.Header.Del(":" + name)
+	}
+	if length := resp.Header.Get("Content-Length"); length != "" {
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil && n >= 0 {
+			resp.ContentLength = n
+		}
+	}
+	return resp, nil
+}
+
+/*
+** Record a refusal on `session`, replace the session after MaxRefusals, and
+** return how long to wait before retrying
+*/
+
+func (t *Transport) refused(session *transportSession) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	session.refusals++
+	n := session.refusals
+	if t.MaxRefusals > 0 && n >= t.MaxRefusals && t.sessions[session.key] == session {
+		debug("%d refusals in a row. Replacing the session", n)
+		t.retire(session)
+	}
+	backoff := t.RetryBackoff
+	if backoff == 0 {
+		backoff = DefaultRetryBackoff
+	}
+	if n > maxBackoffDoublings {
+		n = maxBackoffDoublings
+	}
+	return backoff << uint(n - 1)
+}
+
+/*
+** Record a request accepted on `session`
+*/
+
+func (t *Transport) accepted(session *transportSession) {
+	t.lock.Lock()
+	session.refusals = 0
+	t.lock.Unlock()
+}
+
+/*
+** Stop using `session` for new requests, and close it once no request uses
+** it. Must be called with the lock held.
+*/
+
+func (t *Transport) retire(session *transportSession) {
+	if t.sessions[session.key] == session {
+		delete(t.sessions, session.key)
+	}
+	session.retired = true
+	if session.active == 0 {
+		session.Close()
+	}
+}
+
+/*
+** Record the end of a request on `session`, which was returned by
+** Transport.session
+*/
+
+func (t *Transport) release(session *transportSession) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	session.active--
+	if session.active == 0 {
+		session.idleSince = clockOrDefault(t.Clock).Now()
+		if session.retired {
+			session.Close()
+		}
+	}
+}
+
+/*
+** Return true if `session` must be pinged before it is reused (see
+** IdlePingThreshold). Must be called with the lock held.
+*/
+
+func (t *Transport) stale(session *transportSession) bool {
+	if t.IdlePingThreshold <= 0 || session.active != 0 {
+		return false
+	}
+	return clockOrDefault(t.Clock).Now().Sub(session.idleSince) >= t.IdlePingThreshold
+}
+
+/*
+** Return true if the peer of `session` echoes a PING in time
+*/
+
+func (t *Transport) healthy(session *transportSession) bool {
+	timeout := t.IdlePingTimeout
+	if timeout == 0 {
+		timeout = DefaultIdlePingTimeout
+	}
+	if _, err := session.Ping(timeout); err != nil {
+		debug("Idle session failed its PING (%s). Replacing it", err)
+		return false
+	}
+	return true
+}
+
+/*
+** Return the session to the server of `u`, opening it if needed. The
+** connection is dialed without holding the lock, so that a slow server
+** doesn't hold up the requests to the others. The caller must release the
+** session once its request is done.
+*/
+
+func (t *Transport) session(ctx context.Context, u *url.URL) (*transportSession, error) {
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if u.Scheme == "https" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	key := u.Scheme + "://" + addr
+	t.lock.Lock()
+	for {
+		session, exists := t.sessions[key]
+		if !exists {
+			break
+		}
+		if !session.Session.reusable() {
+			t.retire(session)
+			break
+		}
+		stale := t.stale(session)
+		session.active++
+		t.lock.Unlock()
+		if !stale || t.healthy(session) {
+			return session, nil
+		}
+		t.lock.Lock()
+		session.active--
+		t.retire(session)
+	}
+	// Wait for the dial in progress, if any
+	if dial, dialing := t.dials[key]; dialing {
+		t.lock.Unlock()
+		select {
+			case <-dial.done:
+			case <-ctx.Done():		return nil, ctx.Err()
+		}
+		if dial.err != nil {
+			return nil, dial.err
+		}
+		t.lock.Lock()
+		dial.session.active++
+		t.lock.Unlock()
+		return dial.session, nil
+	}
+	dial := &transportDial{done: make(chan struct{})}
+	if t.dials == nil {
+		t.dials = make(map[string]*transportDial)
+	}
+	t.dials[key] = dial
+	t.lock.Unlock()
+	dial.session, dial.err = t.open(u.Scheme, addr, key)
+	t.lock.Lock()
+	delete(t.dials, key)
+	if dial.err == nil {
+		if t.sessions == nil {
+			t.sessions = make(map[string]*transportSession)
+		}
+		t.sessions[key] = dial.session
+		dial.session.active++
+		dial.session.idleSince = clockOrDefault(t.Clock).Now()
+	}
+	t.lock.Unlock()
+	close(dial.done)
+	return dial.session, dial.err
+}
+
+/*
+** Dial a new session to `addr`, for the URLs of `key`
+*/
+
+func (t *Transport) open(scheme, addr, key string) (*transportSession, error) {
+	conn, err := t.dial(scheme, addr)
+	if err != nil {
+		return nil, err
+	}
+	framing := t.Framing
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS && t.Dial == nil {
+		if negotiated := negotiatedFraming(tlsConn); negotiated != nil {
+			framing = negotiated
+		}
+	}
+	if framing == nil {
+		framing = SPDY2
+	}
+	session, err := ServeFraming(conn, new(DummyHandler), false, framing)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	session.DisableServerPush = true
+	return &transportSession{Session: session, key: key, framing: framing}, nil
+}
+
+/*
+** Open a connection to `addr` for a URL of scheme `scheme`
+*/
+
+func (t *Transport) dial(scheme, addr string) (net.Conn, error) {
+	if t.Dial != nil {
+		return t.Dial("tcp", addr)
+	}
+	if scheme != "https" {
+		return net.Dial("tcp", addr)
+	}
+	config := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		config = t.TLSClientConfig.Clone()
+	}
+	config.NextProtos = nil
+	for _, proto := range tlsProtocols {
+		if sameFraming(t.Framing, proto.framing) {
+			config.NextProtos = append(config.NextProtos, proto.name)
+		}
+	}
+	if len(config.NextProtos) == 0 {
+		return nil, ErrTLSFraming
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return tls.Dial("tcp", addr, config)
+}
+
+/*
+** Return true if the Framing of a Transport, `framing`, may be negotiated
+** as `proto`. Every version of SPDY may be when it is nil.
+*/
+
+func sameFraming(framing, proto Framing) bool {
+	if framing == nil || framing == proto {
+		return true
+	}
+	version, isSPDY := framing.(*SPDYFraming)
+	protoVersion, isProtoSPDY := proto.(*SPDYFraming)
+	return isSPDY && isProtoSPDY && version.Version == protoVersion.Version
+}
+
+// CloseIdleConnections closes the sessions of the transport which no
+// request is using: a request uses its session until the end of its
+// response body. The sessions in use are left open. A session replaced
+// after MaxRefusals, or after a GOAWAY, is closed once its last request is
+// done.
+func (t *Transport) CloseIdleConnections() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, session := range t.sessions {
+		if session.active == 0 {
+			delete(t.sessions, key)
+			session.Close()
+		}
+	}
+}
+
+/*
+** Return true if new streams may be opened on the session
+*/
+
+func (session *Session) reusable() bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return !session.closed && !session.goAwayReceived
+}
+
+/*
+** The body of a response received by a Transport. Closing it before the end
+** cancels the stream.
+*/
+
+type responseBody struct {
+	stream	*Stream
+	reader	io.Reader
+	reply	http.Header	// The headers of the SYN_REPLY
+	trailer	http.Header	// Filled with the headers received after the SYN_REPLY
+	release	func()	// Called once, at the end of the body or when it's closed
+	eof	bool
+	closed	bool
+}
+
+func (b *responseBody) Read(data []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("Read on closed response body")
+	}
+	n, err := b.reader.Read(data)
+	if err == io.EOF && !b.eof {
+		b.eof = true
+		b.release()
+		for name, values := range b.stream.InputHeaders() {
+			if _, inReply := b.reply[name]; !inReply {
+				b.trailer[name] = values
+			}
+		}
+		for name, values := range b.stream.Trailers() {
+			b.trailer[name] = values
+		}
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if !b.eof {
+		// StopReceiving, unlike Rst, works after the request was half-closed
+		b.stream.StopReceiving()
+		b.release()
+	}
+	if session := b.stream.session; session != nil {
+		session.CloseStream(b.stream.Id)
+	}
+	return nil
+}
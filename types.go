@@ -10,9 +10,9 @@ package spdy
 
 import (
 	"bytes"
-	"compress/zlib"
 	"io"
 	"net/http"
+	"sync/atomic"
 )
 
 type Handler http.Handler
@@ -129,6 +129,13 @@ type Handler http.Handler
 // Version is the protocol version number that this package implements.
 const Version = 2
 
+// The first bit of a frame is set for control frames. For DATA frames, it is
+// the (always clear) high bit of the stream id.
+const (
+	controlBit	uint32 = 0x80000000
+	controlBit16	uint16 = 0x8000 // The same bit, in the first half-word
+)
+
 // ControlFrameType stores the type field in a control frame header.
 type ControlFrameType uint16
 
@@ -143,13 +150,16 @@ const (
 	TypeGoAway                        = 0x0007
 	TypeHeaders                       = 0x0008
 	TypeWindowUpdate                  = 0x0009
+	TypeCredential                    = 0x000a // introduced in version 3
 )
 
 // ControlFlags are the flags that can be set on a control frame.
 type ControlFlags uint8
 
 const (
-	ControlFlagFin ControlFlags = 0x01
+	ControlFlagFin            ControlFlags = 0x01
+	ControlFlagUnidirectional ControlFlags = 0x02 // SYN_STREAM only
+	ControlFlagClearSettings  ControlFlags = 0x01 // SETTINGS only. See Session.SettingsStore
 )
 
 // DataFlags are the flags that can be set on a data frame.
@@ -158,11 +168,21 @@ type DataFlags uint8
 const (
 	DataFlagFin        DataFlags = 0x01
 	DataFlagCompressed           = 0x02
+	// Not part of the spec. See Session.EnableDataPadding.
+	DataFlagPadded               = 0x40
 )
 
+// The data flags we know about. Other bits are preserved when reading a
+// frame (for forward compatibility), but never sent.
+const knownDataFlags = DataFlagFin | DataFlagCompressed | DataFlagPadded
+
 // MaxDataLength is the maximum number of bytes that can be stored in one frame.
 const MaxDataLength = 1<<24 - 1
 
+// DefaultWindowSize is the initial flow-control window of a stream, in both
+// directions, unless changed by SETTINGS_INITIAL_WINDOW_SIZE.
+const DefaultWindowSize = 64 * 1024
+
 // Frame is a single SPDY frame in its unpacked in-memory representation. Use
 // Framer to read and write it.
 type Frame interface {
@@ -174,6 +194,9 @@ type Frame interface {
 	GetHeaders() *http.Header
 	// Returns whether the FIN flag is set for this frame.
 	GetFinFlag() bool
+	// Return true if the frame applies to the whole session (SETTINGS,
+	// NOOP, PING, GOAWAY), and false if it belongs to a stream.
+	IsSessionLevel() bool
 }
 
 // ControlFrameHeader contains all the fields in a control frame header,
@@ -197,10 +220,12 @@ type SynStreamFrame struct {
 	CFHeader             ControlFrameHeader
 	StreamId             uint32
 	AssociatedToStreamId uint32
-	// Note, only 2 highest bits currently used
-	// Rest of Priority is unused.
+	// 0 is the highest priority. Version 2 has 4 priorities (0-3),
+	// version 3 has 8 (0-7).
 	Priority uint16
-	Headers  http.Header
+	// The credential slot (version 3 only).
+	Slot    uint8
+	Headers http.Header
 }
 
 // SynReplyFrame is the unpacked, in-memory representation of a SYN_REPLY frame.
@@ -214,16 +239,23 @@ type SynReplyFrame struct {
 type StatusCode uint32
 
 const (
-	ProtocolError      StatusCode = 1
-	InvalidStream                 = 2
-	RefusedStream                 = 3
-	UnsupportedVersion            = 4
-	Cancel                        = 5
-	InternalError                 = 6
-	FlowControlError              = 7
-	StreamAlreadyClosed           = 9 // introduced in version 3
+	ProtocolError       StatusCode = 1
+	InvalidStream       StatusCode = 2
+	RefusedStream       StatusCode = 3
+	UnsupportedVersion  StatusCode = 4
+	Cancel              StatusCode = 5
+	InternalError       StatusCode = 6
+	FlowControlError    StatusCode = 7
+	StreamInUse         StatusCode = 8 // introduced in version 3
+	StreamAlreadyClosed StatusCode = 9 // introduced in version 3
+	InvalidCredentials  StatusCode = 10 // introduced in version 3
+	FrameTooLarge       StatusCode = 11 // introduced in version 3
 )
 
+// The last status code of SPDY/2. The ones after it are sent as
+// PROTOCOL_ERROR to SPDY/2 peers, which don't know them.
+const lastStatusCodeV2 = FlowControlError
+
 // RstStreamFrame is the unpacked, in-memory representation of a RST_STREAM
 // frame.
 type RstStreamFrame struct {
@@ -249,6 +281,11 @@ const (
 	SettingsRoundTripTime                   = 3
 	SettingsMaxConcurrentStreams            = 4
 	SettingsCurrentCwnd                     = 5
+	SettingsInitialWindowSize               = 7
+	// Not part of the spec. See Session.EnableDataPadding.
+	SettingsDataPadding                     = 0xff0001
+	// Not part of the spec. See Session.PushReceiveWindow.
+	SettingsPushWindowSize                  = 0xff0002
 )
 
 // SettingsFlagIdValue is the unpacked, in-memory representation of the
@@ -281,6 +318,7 @@ type PingFrame struct {
 type GoAwayFrame struct {
 	CFHeader         ControlFrameHeader
 	LastGoodStreamId uint32
+	Status           StatusCode // Why the session ended. Only sent since SPDY/3
 }
 
 // HeadersFrame is the unpacked, in-memory representation of a HEADERS frame.
@@ -290,6 +328,26 @@ type HeadersFrame struct {
 	Headers  http.Header
 }
 
+// WindowUpdateFrame is the unpacked, in-memory representation of a
+// WINDOW_UPDATE frame (introduced in version 3).
+type WindowUpdateFrame struct {
+	CFHeader        ControlFrameHeader
+	StreamId        uint32
+	DeltaWindowSize uint32
+}
+
+// CredentialFrame is the unpacked, in-memory representation of a CREDENTIAL
+// frame (introduced in version 3), by which a client presents a certificate
+// chain for an origin. The streams opened for that origin refer to it by
+// its Slot (see SynStreamFrame.Slot). Nothing in this package verifies the
+// chain or the Proof (see Session.Credential).
+type CredentialFrame struct {
+	CFHeader     ControlFrameHeader
+	Slot         uint16
+	Proof        []byte
+	Certificates [][]byte // The chain, starting with the client certificate
+}
+
 // DataFrame is the unpacked, in-memory representation of a DATA frame.
 type DataFrame struct {
 	// Note, high bit is the "Control" bit. Should be 0 for data frames.
@@ -314,6 +372,11 @@ const HeaderDictionary = "optionsgetheadpostputdeletetrace" +
 	"chunkedtext/htmlimage/pngimage/jpgimage/gifapplication/xmlapplication/xhtmltext/plainpublicmax-age" +
 	"charset=iso-8859-1utf-8gzipdeflateHTTP/1.1statusversionurl\x00"
 
+// headerDictionary holds the bytes of HeaderDictionary. It is shared by all
+// compressors and decompressors, which only read it, so that setting up a
+// new session doesn't have to copy the dictionary.
+var headerDictionary = []byte(HeaderDictionary)
+
 // A SPDY specific error.
 type ErrorCode string
 
@@ -327,17 +390,28 @@ const (
 	ZeroStreamId               ErrorCode = "stream id zero is disallowed"
 	IllegalSynStream           ErrorCode = "SYN_STREAM at the wrong time"
 	IllegalSynReply            ErrorCode = "SYN_REPLY at the wrong time"
+	RepeatedSynReply           ErrorCode = "SYN_REPLY received twice"
 	IllegalFirstFrame          ErrorCode = "first frame must be SYN_STREAM or SYN_REPLY"
 	StreamClosed               ErrorCode = "stream is closed"
 	NoSuchStream               ErrorCode = "no such stream"
 	InvalidStreamId            ErrorCode = "illegal stream id"
+	DecreasingStreamId         ErrorCode = "SYN_STREAM with a lower stream id than a previous one"
+	IncreasingGoAway           ErrorCode = "GOAWAY with a higher last-good-stream-id than a previous one"
+	UnidirectionalStream       ErrorCode = "frame sent to the initiator of a unidirectional stream"
+	WrongStreamId              ErrorCode = "frame for another stream"
+	UnassociatedPush           ErrorCode = "pushed stream not associated with an open stream"
+	BidirectionalPush          ErrorCode = "pushed stream without FLAG_UNIDIRECTIONAL"
 )
 
 // Error contains both the type of error and additional values. StreamId is 0
-// if Error is not associated with a stream.
+// if Error is not associated with a stream. The frames rejected by a stream
+// because they break the protocol (eg. a HEADERS frame before SYN_REPLY)
+// are reported as an *Error carrying the offending Frame, so they can be
+// told apart from I/O errors with errors.As.
 type Error struct {
 	Err      ErrorCode
 	StreamId uint32
+	Frame    Frame // The offending frame, if known
 }
 
 func (e *Error) Error() string {
@@ -350,6 +424,8 @@ func (e *Error) ToFrame() *RstStreamFrame {
 	switch e.Err {
 		case StreamClosed:
 			status = StreamAlreadyClosed
+		case RepeatedSynReply:
+			status = StreamInUse
 		default:
 			status = ProtocolError
 	}
@@ -402,10 +478,76 @@ type Framer struct {
 	headerCompressionDisabled bool
 	w                         io.Writer
 	headerBuf                 *bytes.Buffer
-	headerCompressor          *zlib.Writer
+	headerCompressor          *HeaderCompressor // Created with the first header block sent
 	r                         io.Reader
-	headerReader              io.LimitedReader
-	headerDecompressor        io.ReadCloser
+	headerDecompressor        *HeaderDecompressor // Created with the first header block received
+	headerStatsIn             HeaderStats
+	headerStatsOut            HeaderStats
+	version                   uint16 // Version of the frames we write. 0 means Version.
+}
+
+// Return the version to set in the header of the frames we write.
+func (f *Framer) frameVersion() uint16 {
+	if f.version == 0 {
+		return Version
+	}
+	return f.version
+}
+
+// Pack the priority and slot of a SYN_STREAM frame in the 16 bits which
+// follow the Associated-To-Stream-ID. The layout depends on the version:
+//
+//	v2: |Pri (2 bits)|Unused (14 bits)|
+//	v3: |Pri (3 bits)|Unused (5 bits)|Slot (8 bits)|
+//
+// ok is false if the priority doesn't fit.
+func packPriority(version uint16, priority uint16, slot uint8) (word uint16, ok bool) {
+	if version >= 3 {
+		return priority<<13 | uint16(slot), priority <= 7
+	}
+	return priority << 14, priority <= 3
+}
+
+// The reverse of packPriority.
+func unpackPriority(version uint16, word uint16) (priority uint16, slot uint8) {
+	if version >= 3 {
+		return word >> 13, uint8(word)
+	}
+	return word >> 14, 0
+}
+
+// HeaderStats holds the cumulative size of header blocks before and after
+// compression, in bytes.
+type HeaderStats struct {
+	Uncompressed uint64
+	Compressed   uint64
+}
+
+// Ratio returns the compression ratio (uncompressed size / compressed size),
+// or 0 if no headers were compressed.
+func (s HeaderStats) Ratio() float64 {
+	if s.Compressed == 0 {
+		return 0
+	}
+	return float64(s.Uncompressed) / float64(s.Compressed)
+}
+
+func (s *HeaderStats) add(uncompressed, compressed int) {
+	atomic.AddUint64(&s.Uncompressed, uint64(uncompressed))
+	atomic.AddUint64(&s.Compressed, uint64(compressed))
+}
+
+func (s *HeaderStats) load() HeaderStats {
+	return HeaderStats{
+		Uncompressed: atomic.LoadUint64(&s.Uncompressed),
+		Compressed:   atomic.LoadUint64(&s.Compressed),
+	}
+}
+
+// HeaderStats returns the header compression statistics for frames read
+// and written by f. It is safe to call while frames are being read and written.
+func (f *Framer) HeaderStats() (in HeaderStats, out HeaderStats) {
+	return f.headerStatsIn.load(), f.headerStatsOut.load()
 }
 
 // NewFramer allocates a new Framer for a given SPDY connection, repesented by
@@ -413,15 +555,9 @@ type Framer struct {
 // from/to the Reader and Writer, so the caller should pass in an appropriately
 // buffered implementation to optimize performance.
 func NewFramer(w io.Writer, r io.Reader) (*Framer, error) {
-	compressBuf := new(bytes.Buffer)
-	compressor, err := zlib.NewWriterLevelDict(compressBuf, zlib.BestCompression, []byte(HeaderDictionary))
-	if err != nil {
-		return nil, err
-	}
 	framer := &Framer{
 		w:                w,
-		headerBuf:        compressBuf,
-		headerCompressor: compressor,
+		headerBuf:        new(bytes.Buffer),
 		r:                r,
 	}
 	return framer, nil
@@ -10,10 +10,12 @@
 package spdy
 
 import (
+	"fmt"
 	"os"
 	"log"
 	"io"
 	"net/http"
+	"sync"
 )
 
 func (frame *DataFrame)		GetStreamId() (uint32, bool)	{ return frame.StreamId, true }
@@ -25,6 +27,8 @@ func (frame *NoopFrame)		GetStreamId() (uint32, bool)	{ return 0, false }
 func (frame *SettingsFrame)	GetStreamId() (uint32, bool)	{ return 0, false }
 func (frame *PingFrame)		GetStreamId() (uint32, bool)	{ return 0, false }
 func (frame *GoAwayFrame)	GetStreamId() (uint32, bool)	{ return 0, false }
+func (frame *WindowUpdateFrame)	GetStreamId() (uint32, bool)	{ return frame.StreamId, true }
+func (frame *CredentialFrame)	GetStreamId() (uint32, bool)	{ return 0, false }
 
 func (frame *DataFrame)		GetHeaders() *http.Header	{ return nil }
 func (frame *SynStreamFrame)	GetHeaders() *http.Header	{ return &frame.Headers}
@@ -35,6 +39,8 @@ func (frame *NoopFrame)		GetHeaders() *http.Header	{ return nil }
 func (frame *SettingsFrame)	GetHeaders() *http.Header	{ return nil }
 func (frame *PingFrame)		GetHeaders() *http.Header	{ return nil }
 func (frame *GoAwayFrame)	GetHeaders() *http.Header	{ return nil }
+func (frame *WindowUpdateFrame)	GetHeaders() *http.Header	{ return nil }
+func (frame *CredentialFrame)	GetHeaders() *http.Header	{ return nil }
 
 func (frame *DataFrame)		GetFinFlag() bool	{ return frame.Flags&DataFlagFin != 0 }
 func (frame *SynStreamFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
@@ -45,6 +51,121 @@ func (frame *NoopFrame)		GetFinFlag() bool	{ return frame.CFHeader.Flags&Control
 func (frame *SettingsFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
 func (frame *PingFrame)		GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
 func (frame *GoAwayFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
+func (frame *WindowUpdateFrame)	GetFinFlag() bool	{ return false } // WINDOW_UPDATE has no flags
+func (frame *CredentialFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
+
+func (frame *DataFrame)		IsSessionLevel() bool	{ return false }
+func (frame *SynStreamFrame)	IsSessionLevel() bool	{ return false }
+func (frame *HeadersFrame)	IsSessionLevel() bool	{ return false }
+func (frame *SynReplyFrame)	IsSessionLevel() bool	{ return false }
+func (frame *RstStreamFrame)	IsSessionLevel() bool	{ return false }
+func (frame *NoopFrame)		IsSessionLevel() bool	{ return true }
+func (frame *SettingsFrame)	IsSessionLevel() bool	{ return true }
+func (frame *PingFrame)		IsSessionLevel() bool	{ return true }
+func (frame *GoAwayFrame)	IsSessionLevel() bool	{ return true }
+func (frame *WindowUpdateFrame)	IsSessionLevel() bool	{ return false }
+func (frame *CredentialFrame)	IsSessionLevel() bool	{ return true }
+
+func (frame *DataFrame) String() string {
+	return fmt.Sprintf("DATA stream=%d length=%d flags=%s", frame.StreamId, len(frame.Data), frame.Flags)
+}
+
+func (frame *SynStreamFrame) String() string {
+	return fmt.Sprintf("SYN_STREAM stream=%d associated=%d priority=%d flags=%s headers=%d",
+		frame.StreamId, frame.AssociatedToStreamId, frame.Priority, frame.CFHeader.Flags, len(frame.Headers))
+}
+
+func (frame *SynReplyFrame) String() string {
+	return fmt.Sprintf("SYN_REPLY stream=%d flags=%s headers=%d", frame.StreamId, frame.CFHeader.Flags, len(frame.Headers))
+}
+
+func (frame *HeadersFrame) String() string {
+	return fmt.Sprintf("HEADERS stream=%d flags=%s headers=%d", frame.StreamId, frame.CFHeader.Flags, len(frame.Headers))
+}
+
+func (frame *RstStreamFrame) String() string {
+	return fmt.Sprintf("RST_STREAM stream=%d status=%s", frame.StreamId, frame.Status)
+}
+
+func (frame *NoopFrame) String() string {
+	return "NOOP"
+}
+
+func (frame *SettingsFrame) String() string {
+	return fmt.Sprintf("SETTINGS flags=%s settings=%d", frame.CFHeader.Flags, len(frame.FlagIdValues))
+}
+
+func (frame *PingFrame) String() string {
+	return fmt.Sprintf("PING id=%d", frame.Id)
+}
+
+func (frame *CredentialFrame) String() string {
+	return fmt.Sprintf("CREDENTIAL slot=%d certificates=%d", frame.Slot, len(frame.Certificates))
+}
+
+// The status of a GOAWAY isn't a StatusCode of RST_STREAM: it is printed as is
+func (frame *GoAwayFrame) String() string {
+	return fmt.Sprintf("GOAWAY last-good-stream=%d status=%d", frame.LastGoodStreamId, frame.Status)
+}
+
+func (frame *WindowUpdateFrame) String() string {
+	return fmt.Sprintf("WINDOW_UPDATE stream=%d delta=%d", frame.StreamId, frame.DeltaWindowSize)
+}
+
+var statusCodeNames = map[StatusCode]string{
+	ProtocolError:		"PROTOCOL_ERROR",
+	InvalidStream:		"INVALID_STREAM",
+	RefusedStream:		"REFUSED_STREAM",
+	UnsupportedVersion:	"UNSUPPORTED_VERSION",
+	Cancel:			"CANCEL",
+	InternalError:		"INTERNAL_ERROR",
+	FlowControlError:	"FLOW_CONTROL_ERROR",
+	StreamInUse:		"STREAM_IN_USE",
+	StreamAlreadyClosed:	"STREAM_ALREADY_CLOSED",
+	InvalidCredentials:	"INVALID_CREDENTIALS",
+	FrameTooLarge:		"FRAME_TOO_LARGE",
+}
+
+// String returns the name of the status in the spec, eg. REFUSED_STREAM.
+func (status StatusCode) String() string {
+	if name, known := statusCodeNames[status]; known {
+		return name
+	}
+	return fmt.Sprintf("STATUS_%d", uint32(status))
+}
+
+/*
+** Join the names of the bits set in `flags`, with unknown bits in hex
+*/
+
+func flagNames(flags uint8, names map[uint8]string) string {
+	if flags == 0 {
+		return "0"
+	}
+	s := ""
+	for bit := uint8(1); bit != 0; bit <<= 1 {
+		if flags&bit == 0 {
+			continue
+		}
+		if s != "" {
+			s += "|"
+		}
+		if name, known := names[bit]; known {
+			s += name
+		} else {
+			s += fmt.Sprintf("0x%02x", bit)
+		}
+	}
+	return s
+}
+
+func (flags ControlFlags) String() string {
+	return flagNames(uint8(flags), map[uint8]string{uint8(ControlFlagFin): "FIN", uint8(ControlFlagUnidirectional): "UNIDIRECTIONAL"})
+}
+
+func (flags DataFlags) String() string {
+	return flagNames(uint8(flags), map[uint8]string{uint8(DataFlagFin): "FIN", DataFlagCompressed: "COMPRESSED", DataFlagPadded: "PADDED"})
+}
 
 
 
@@ -54,7 +175,8 @@ func (frame *GoAwayFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&Contro
  */
 
 func Promise(f func() error) chan error {
-	ch := make(chan error)
+	// Buffered, so that the goroutine exits even if nobody receives
+	ch := make(chan error, 1)
 	go func() {
 		ch <- f()
 	}()
@@ -62,17 +184,61 @@ func Promise(f func() error) chan error {
 }
 
 /*
-** Output a message only if the DEBUG env variable is set
+** Pass a message to the package logger. Without one, output it only if
+** DEBUG or the DEBUG env variable is set
  */
 
 var DEBUG bool = false
 
+var (
+	packageLogger	Logger	// See SetLogger
+	packageLoggerLock	sync.RWMutex
+)
+
 func debug(msg string, args ...interface{}) {
-	if DEBUG || (os.Getenv("DEBUG") != "") {
+	packageLoggerLock.RLock()
+	logger := packageLogger
+	packageLoggerLock.RUnlock()
+	if logger != nil {
+		logger.Printf(msg, args...)
+	} else if DEBUG || (os.Getenv("DEBUG") != "") {
 		log.Printf(msg, args...)
 	}
 }
 
+// SetLogger sets the destination of the debug output of the package, and of
+// the sessions without a Logger of their own. If nil (the default), messages
+// are logged with the log package when DEBUG or the DEBUG env variable is
+// set, and discarded otherwise.
+func SetLogger(logger Logger) {
+	packageLoggerLock.Lock()
+	packageLogger = logger
+	packageLoggerLock.Unlock()
+}
+
+// Logger is where sessions and streams send their debug output.
+// *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// The default Logger: calls debug()
+type debugLogger struct{}
+
+func (debugLogger) Printf(format string, args ...interface{}) {
+	debug(format, args...)
+}
+
+// A Logger which prefixes all messages before passing them to another Logger
+type prefixLogger struct {
+	logger	Logger
+	prefix	string
+}
+
+func (l *prefixLogger) Printf(format string, args ...interface{}) {
+	l.logger.Printf("%s%s", l.prefix, fmt.Sprintf(format, args...))
+}
+
 
 // DummyHandler is an http.Handler which does nothing.
 type DummyHandler struct {}
@@ -86,27 +252,52 @@ func (f *DummyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 //
 // A successful Copy returns err == nil, not err == EOF. Because Copy is
 // defined to read from src until EOF, it does not treat an EOF from Read
-// as an error to be reported.
+// as an error to be reported. Likewise, once a RST_STREAM was copied, the
+// *StreamResetError which follows it is not reported.
 //
 // As a special case, if w is nil, all frames will be discarded.
 func Copy(w Writer, r Reader) error {
+	_, _, err := CopyN(w, r)
+	return err
+}
+
+// CopyN is like Copy, and also returns the number of frames copied, and the
+// number of bytes of data they carried (the payload of the DATA frames).
+// Discarded frames are counted too.
+func CopyN(w Writer, r Reader) (frames int64, bytes int64, err error) {
+	reset := false
 	for {
 		frame, err := r.ReadFrame()
 		if err == io.EOF {
-			return nil
+			return frames, bytes, nil
+		} else if _, isReset := err.(*StreamResetError); isReset && reset {
+			// The RST_STREAM itself was copied: the reset is passed on
+			return frames, bytes, nil
 		} else if err != nil {
-			return err
+			return frames, bytes, err
 		}
 		// If the destination is nil, discard all frames
-		if w == nil {
-			continue
+		if w != nil {
+			if err := w.WriteFrame(frame); err != nil {
+				return frames, bytes, err
+			}
 		}
-		err = w.WriteFrame(frame)
-		if err != nil {
-			return err
+		frames += 1
+		if data, isData := frame.(*DataFrame); isData {
+			bytes += int64(len(data.Data))
+		}
+		if _, isRst := frame.(*RstStreamFrame); isRst {
+			reset = true
 		}
 	}
-	return nil
+}
+
+// Drain reads and discards frames from r until EOF, and returns how many
+// frames were discarded, and how many bytes of DATA they carried. It is
+// CopyN with a nil Writer: EOF, and the reset which follows a RST_STREAM,
+// aren't treated as errors.
+func Drain(r Reader) (frames int64, bytes int64, err error) {
+	return CopyN(nil, r)
 }
 
 // CopyBytes reads frames from src, extracts payload data
@@ -137,31 +328,71 @@ func CopyBytes(dst io.Writer, src Reader) error {
 // Splice runs Copy(a, b) and Copy(b, a) in 2 distinct goroutines then waits for
 // either one or both copies to complete, depending on the value of wait.
 //
-// - If wait=true, Splice waits for both copies to complete and returns the first error
-// encountered, if any. If both copies end with an error, it is undetermined which error
-// is returned.
+// - If wait=true, Splice waits for both copies to complete and returns the error of
+// the copy which failed, if any. If both copies failed, it returns a *SpliceError with
+// both errors.
 //
 // - If wait=false, Splice waits for one copy to complete and returns the first error
-// encountered during that copy, if any. The other copy continues in the background.
+// encountered during that copy, if any. It then closes a and b to stop the other
+// copy, and waits for it to return. If a or b has no Close method, the other copy
+// is left to continue in the background.
 func Splice(a ReadWriter, b ReadWriter, wait bool) error {
 	Ab, Ba := func() error {return Copy(a, b)}, func() error {return Copy(b, a)}
 	promiseAb, promiseBa := Promise(Ab), Promise(Ba)
 	if wait {
 		debug("[SPLICE] Waiting for both copies to complete...\n")
-		errAb, errBa := <-promiseAb, <-promiseBa
-		if errAb != nil {
-			return errAb
+		// Copy(a, b) copies the frames of b to a
+		errBtoA, errAtoB := <-promiseAb, <-promiseBa
+		if errBtoA == io.EOF {
+			errBtoA = nil
 		}
-		return errBa
-	} else {
-		for i:=0; i<2; i+= 1 {
-			select {
-				case err := <-promiseAb: if err == io.EOF { return nil } else { return err }
-				case err := <-promiseBa: if err == io.EOF { return nil } else { return err }
-			}
+		if errAtoB == io.EOF {
+			errAtoB = nil
+		}
+		if errAtoB != nil && errBtoA != nil {
+			return &SpliceError{AtoB: errAtoB, BtoA: errBtoA}
+		} else if errAtoB != nil {
+			return errAtoB
 		}
+		return errBtoA
 	}
-	return nil
+	var err error
+	var other chan error
+	select {
+		case err = <-promiseAb: other = promiseBa
+		case err = <-promiseBa: other = promiseAb
+	}
+	if closeFrames(a) && closeFrames(b) {
+		debug("[SPLICE] Waiting for the other copy to stop...\n")
+		<-other
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// SpliceError is returned by Splice when the copies failed in both directions.
+type SpliceError struct {
+	AtoB	error	// The error of the copy of the frames of a to b
+	BtoA	error	// The error of the copy of the frames of b to a
+}
+
+func (e *SpliceError) Error() string {
+	return fmt.Sprintf("Splice failed in both directions (a to b: %s, b to a: %s)", e.AtoB, e.BtoA)
+}
+
+/*
+** Close `rw` if it has a Close method, and return false otherwise
+*/
+
+func closeFrames(rw ReadWriter) bool {
+	switch c := rw.(type) {
+		case io.Closer:			c.Close()
+		case interface{ Close() }:	c.Close()
+		default:			return false
+	}
+	return true
 }
 
 
@@ -5,9 +5,11 @@
 package spdy
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -21,9 +23,9 @@ func (frame *SynReplyFrame) write(f *Framer) error {
 
 func (frame *RstStreamFrame) write(f *Framer) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypeRstStream
 	frame.CFHeader.length = 8
 
@@ -34,14 +36,18 @@ func (frame *RstStreamFrame) write(f *Framer) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
 		return
 	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Status); err != nil {
+	status := frame.Status
+	if frame.CFHeader.version < 3 && status > lastStatusCodeV2 {
+		status = ProtocolError
+	}
+	if err = binary.Write(f.w, binary.BigEndian, status); err != nil {
 		return
 	}
 	return
 }
 
 func (frame *SettingsFrame) write(f *Framer) (err error) {
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypeSettings
 	frame.CFHeader.length = uint32(len(frame.FlagIdValues)*8 + 4)
 
@@ -65,7 +71,7 @@ func (frame *SettingsFrame) write(f *Framer) (err error) {
 }
 
 func (frame *NoopFrame) write(f *Framer) error {
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypeNoop
 
 	// Serialize frame to Writer
@@ -74,9 +80,9 @@ func (frame *NoopFrame) write(f *Framer) error {
 
 func (frame *PingFrame) write(f *Framer) (err error) {
 	if frame.Id == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypePing
 	frame.CFHeader.length = 4
 
@@ -91,9 +97,12 @@ func (frame *PingFrame) write(f *Framer) (err error) {
 }
 
 func (frame *GoAwayFrame) write(f *Framer) (err error) {
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypeGoAway
 	frame.CFHeader.length = 4
+	if frame.CFHeader.version >= 3 {
+		frame.CFHeader.length = 8
+	}
 
 	// Serialize frame to Writer
 	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
@@ -102,19 +111,76 @@ func (frame *GoAwayFrame) write(f *Framer) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.LastGoodStreamId); err != nil {
 		return
 	}
+	if frame.CFHeader.version >= 3 {
+		return binary.Write(f.w, binary.BigEndian, frame.Status)
+	}
 	return nil
 }
 
 func (frame *HeadersFrame) write(f *Framer) error {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return f.writeHeadersFrame(frame)
 }
 
+func (frame *WindowUpdateFrame) write(f *Framer) (err error) {
+	if frame.StreamId == 0 {
+		return &Error{Err: ZeroStreamId, StreamId: 0}
+	}
+	frame.CFHeader.version = f.frameVersion()
+	frame.CFHeader.frameType = TypeWindowUpdate
+	frame.CFHeader.length = 8
+
+	// Serialize frame to Writer
+	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
+		return
+	}
+	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
+		return
+	}
+	if err = binary.Write(f.w, binary.BigEndian, frame.DeltaWindowSize); err != nil {
+		return
+	}
+	return
+}
+
+func (frame *CredentialFrame) write(f *Framer) (err error) {
+	frame.CFHeader.version = f.frameVersion()
+	if frame.CFHeader.version < 3 {
+		return &Error{Err: InvalidControlFrame, StreamId: 0}
+	}
+	frame.CFHeader.frameType = TypeCredential
+	length := 2 + 4 + len(frame.Proof)
+	for _, certificate := range frame.Certificates {
+		length += 4 + len(certificate)
+	}
+	if length > 0xffffff {
+		return &Error{Err: InvalidControlFrame, StreamId: 0}
+	}
+	frame.CFHeader.length = uint32(length)
+
+	// Serialize frame to Writer
+	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
+		return
+	}
+	if err = binary.Write(f.w, binary.BigEndian, frame.Slot); err != nil {
+		return
+	}
+	for _, block := range append([][]byte{frame.Proof}, frame.Certificates...) {
+		if err = binary.Write(f.w, binary.BigEndian, uint32(len(block))); err != nil {
+			return
+		}
+		if _, err = f.w.Write(block); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (frame *DataFrame) write(f *Framer) error {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return f.writeDataFrame(frame)
 }
@@ -124,8 +190,25 @@ func (f *Framer) WriteFrame(frame Frame) error {
 	return frame.write(f)
 }
 
+// SerializeFrame encodes a single frame as `version` (0 means Version), with
+// a new header compression context. It is meant for tests and tools: frames
+// sent on a connection share a compression context, and must be written
+// with the connection's Framer. See ParseFrame.
+func SerializeFrame(frame Frame, version uint16) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, nil)
+	if err != nil {
+		return nil, err
+	}
+	framer.version = version
+	if err := framer.WriteFrame(frame); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
 func writeControlFrameHeader(w io.Writer, h ControlFrameHeader) error {
-	if err := binary.Write(w, binary.BigEndian, 0x8000|h.version); err != nil {
+	if err := binary.Write(w, binary.BigEndian, controlBit16|h.version); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.BigEndian, h.frameType); err != nil {
@@ -138,27 +221,68 @@ func writeControlFrameHeader(w io.Writer, h ControlFrameHeader) error {
 	return nil
 }
 
-func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
+/*
+** Write the count or length `n` of a header block of `version`, and return
+** its size: 16 bits in SPDY/2, 32 bits since SPDY/3
+*/
+
+func writeHeaderLength(w io.Writer, version uint16, n int) (int, error) {
+	if version >= 3 {
+		return 4, binary.Write(w, binary.BigEndian, uint32(n))
+	}
+	return 2, binary.Write(w, binary.BigEndian, uint16(n))
+}
+
+/*
+** Return the largest count or length of a header block of `version`
+*/
+
+func maxHeaderLength(version uint16) uint64 {
+	if version >= 3 {
+		return 0xffffffff
+	}
+	return 0xffff
+}
+
+func writeHeaderValueBlock(w io.Writer, h http.Header, version uint16) (n int, err error) {
 	n = 0
-	if err = binary.Write(w, binary.BigEndian, uint16(len(h))); err != nil {
-		return
+	// Anything longer than a length field can't be encoded
+	max := maxHeaderLength(version)
+	if uint64(len(h)) > max {
+		return n, &Error{Err: InvalidHeaderPresent, StreamId: 0}
 	}
-	n += 2
 	for name, values := range h {
-		if err = binary.Write(w, binary.BigEndian, uint16(len(name))); err != nil {
+		if uint64(len(name)) > max || uint64(len(strings.Join(values, "\x00"))) > max {
+			return n, &Error{Err: InvalidHeaderPresent, StreamId: 0}
+		}
+	}
+	var size int
+	if size, err = writeHeaderLength(w, version, len(h)); err != nil {
+		return
+	}
+	n += size
+	// Sort the names, so that the same headers are always encoded the same way
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := h[name]
+		if size, err = writeHeaderLength(w, version, len(name)); err != nil {
 			return
 		}
-		n += 2
+		n += size
 		name = strings.ToLower(name)
 		if _, err = io.WriteString(w, name); err != nil {
 			return
 		}
 		n += len(name)
 		v := strings.Join(values, "\x00")
-		if err = binary.Write(w, binary.BigEndian, uint16(len(v))); err != nil {
+		if size, err = writeHeaderLength(w, version, len(v)); err != nil {
 			return
 		}
-		n += 2
+		n += size
 		if _, err = io.WriteString(w, v); err != nil {
 			return
 		}
@@ -169,22 +293,33 @@ func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
 
 func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
+	}
+	priority, ok := packPriority(f.frameVersion(), frame.Priority, frame.Slot)
+	if !ok {
+		return &Error{Err: InvalidControlFrame, StreamId: frame.StreamId}
 	}
 	// Marshal the headers.
 	var writer io.Writer = f.headerBuf
 	if !f.headerCompressionDisabled {
+		if f.headerCompressor == nil {
+			if f.headerCompressor, err = NewHeaderCompressor(f.headerBuf, f.frameVersion()); err != nil {
+				return err
+			}
+		}
 		writer = f.headerCompressor
 	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	var n int
+	if n, err = writeHeaderValueBlock(writer, frame.Headers, f.frameVersion()); err != nil {
 		return
 	}
 	if !f.headerCompressionDisabled {
 		f.headerCompressor.Flush()
 	}
+	f.headerStatsOut.add(n, f.headerBuf.Len())
 
 	// Set ControlFrameHeader
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypeSynStream
 	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 10)
 
@@ -198,7 +333,7 @@ func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.AssociatedToStreamId); err != nil {
 		return err
 	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Priority<<14); err != nil {
+	if err = binary.Write(f.w, binary.BigEndian, priority); err != nil {
 		return err
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
@@ -208,26 +343,58 @@ func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 	return nil
 }
 
+/*
+** Return the length of the fields of a SYN_REPLY or HEADERS frame of
+** `version` before its header block: the stream id, and in SPDY/2 an unused
+** 16 bit field
+*/
+
+func headersFieldsLength(version uint16) uint32 {
+	if version >= 3 {
+		return 4
+	}
+	return 6
+}
+
+/*
+** Write the unused 16 bit field of SPDY/2 SYN_REPLY and HEADERS frames,
+** which SPDY/3 dropped
+*/
+
+func writeUnusedField(w io.Writer, version uint16) error {
+	if version >= 3 {
+		return nil
+	}
+	return binary.Write(w, binary.BigEndian, uint16(0))
+}
+
 func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	// Marshal the headers.
 	var writer io.Writer = f.headerBuf
 	if !f.headerCompressionDisabled {
+		if f.headerCompressor == nil {
+			if f.headerCompressor, err = NewHeaderCompressor(f.headerBuf, f.frameVersion()); err != nil {
+				return err
+			}
+		}
 		writer = f.headerCompressor
 	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	var n int
+	if n, err = writeHeaderValueBlock(writer, frame.Headers, f.frameVersion()); err != nil {
 		return
 	}
 	if !f.headerCompressionDisabled {
 		f.headerCompressor.Flush()
 	}
+	f.headerStatsOut.add(n, f.headerBuf.Len())
 
 	// Set ControlFrameHeader
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypeSynReply
-	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 6)
+	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes())) + headersFieldsLength(frame.CFHeader.version)
 
 	// Serialize frame to Writer
 	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
@@ -236,7 +403,7 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
 		return
 	}
-	if err = binary.Write(f.w, binary.BigEndian, uint16(0)); err != nil {
+	if err = writeUnusedField(f.w, frame.CFHeader.version); err != nil {
 		return
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
@@ -250,19 +417,26 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 	// Marshal the headers.
 	var writer io.Writer = f.headerBuf
 	if !f.headerCompressionDisabled {
+		if f.headerCompressor == nil {
+			if f.headerCompressor, err = NewHeaderCompressor(f.headerBuf, f.frameVersion()); err != nil {
+				return err
+			}
+		}
 		writer = f.headerCompressor
 	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	var n int
+	if n, err = writeHeaderValueBlock(writer, frame.Headers, f.frameVersion()); err != nil {
 		return
 	}
 	if !f.headerCompressionDisabled {
 		f.headerCompressor.Flush()
 	}
+	f.headerStatsOut.add(n, f.headerBuf.Len())
 
 	// Set ControlFrameHeader
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.frameVersion()
 	frame.CFHeader.frameType = TypeHeaders
-	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 6)
+	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes())) + headersFieldsLength(frame.CFHeader.version)
 
 	// Serialize frame to Writer
 	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
@@ -271,7 +445,7 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
 		return
 	}
-	if err = binary.Write(f.w, binary.BigEndian, uint16(0)); err != nil {
+	if err = writeUnusedField(f.w, frame.CFHeader.version); err != nil {
 		return
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
@@ -282,16 +456,17 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 }
 
 func (f *Framer) writeDataFrame(frame *DataFrame) (err error) {
-	// Validate DataFrame
-	if frame.StreamId&0x80000000 != 0 || len(frame.Data) >= 0x0f000000 {
-		return &Error{InvalidDataFrame, frame.StreamId}
+	// Validate DataFrame. The high bit of the stream id is the control bit,
+	// which must be clear on a DATA frame.
+	if frame.StreamId&controlBit != 0 || len(frame.Data) > MaxDataLength {
+		return &Error{Err: InvalidDataFrame, StreamId: frame.StreamId}
 	}
 
 	// Serialize frame to Writer
 	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
 		return
 	}
-	flagsAndLength := (uint32(frame.Flags) << 24) | uint32(len(frame.Data))
+	flagsAndLength := (uint32(frame.Flags&knownDataFlags) << 24) | uint32(len(frame.Data))
 	if err = binary.Write(f.w, binary.BigEndian, flagsAndLength); err != nil {
 		return
 	}